@@ -0,0 +1,140 @@
+package fscache
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ops of AccessRecord.
+const (
+	AccessGet = "get"
+	AccessSet = "set"
+)
+
+// WithAccessLog logs Gets and Sets of the keys sampled at sampleRate, between 0 and 1, to the file
+// at path in JSON lines of AccessRecord, as the raw data of Replay() and capacity analysis.
+// Keys are sampled by their hashes, so that every access of a key sampled is logged, and logged as
+// their hashes, so that the log holds no key. Once the file takes more than maxBytes, it is rotated
+// to path.1, replacing the one rotated before, 0 meaning never. If rotating fails, the error is
+// logged and accesses are logged on to the old file until it is rotated.
+func WithAccessLog(path string, sampleRate float64, maxBytes int64) Option {
+	return func(fc *Cache) {
+		fc.accessLog = &accessLog{path: path, sampleRate: sampleRate, maxBytes: maxBytes}
+	}
+}
+
+type accessLog struct {
+	path       string
+	sampleRate float64
+	maxBytes   int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// open opens the file of the log for appending.
+func (l *accessLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, fi.Size()
+	return nil
+}
+
+func (l *accessLog) close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// keyHash returns the hash of key in the log.
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// log logs an access of key with a value of size bytes since start, if key is sampled.
+func (l *accessLog) log(op, key string, size int64, hit bool, start time.Time) error {
+	h := keyHash(key)
+	if float64(h%1000000) >= l.sampleRate*1000000 {
+		return nil
+	}
+	now := time.Now()
+	line, err := json.Marshal(AccessRecord{
+		Key:     strconv.FormatUint(h, 16),
+		Size:    size,
+		Time:    now,
+		Op:      op,
+		Hit:     hit,
+		Latency: now.Sub(start),
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	var rerr error
+	if l.maxBytes > 0 && l.size+int64(len(line)) > l.maxBytes && l.size > 0 {
+		// logging on to the old file if failed, to be rotated at the next access
+		rerr = l.rotate()
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if rerr != nil {
+		return fmt.Errorf("rotate: %w", rerr)
+	}
+	return err
+}
+
+// rotate moves the file of the log to path.1 and opens a new one, with l.mu held.
+// If the new one can not be opened, the old one is moved back and kept.
+func (l *accessLog) rotate() error {
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	old := l.file
+	if err := l.open(); err != nil {
+		if rerr := os.Rename(l.path+".1", l.path); rerr != nil {
+			return fmt.Errorf("%s, and move back: %w", err, rerr)
+		}
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// logAccess logs an access to the access log if any.
+func (f *Cache) logAccess(op, key string, size int64, hit bool, start time.Time) {
+	if f.accessLog == nil {
+		return
+	}
+	if err := f.accessLog.log(op, key, size, hit, start); err != nil {
+		f.logger.Errorf("log access to %s : %s", f.accessLog.path, err)
+	}
+}
@@ -0,0 +1,55 @@
+package fscache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// WithAdaptiveGC lets GC run sooner than the GC interval once writtenBytes have been set since the last GC,
+// and back off up to maxInterval while nothing is set. Writes are checked every minInterval.
+func WithAdaptiveGC(writtenBytes int64, minInterval, maxInterval time.Duration) Option {
+	return func(fc *Cache) {
+		fc.adaptiveGC = &adaptiveGC{writtenBytes: writtenBytes, minInterval: minInterval, maxInterval: maxInterval}
+	}
+}
+
+type adaptiveGC struct {
+	writtenBytes int64
+	minInterval  time.Duration
+	maxInterval  time.Duration
+}
+
+func (f *Cache) adaptiveGcRunner() {
+	ticker := time.NewTicker(f.adaptiveGC.minInterval)
+	defer ticker.Stop()
+
+	var (
+		_, interval = f.gcSettings()
+		lastGc      = time.Now()
+		lastWritten = atomic.LoadInt64(&f.stats.bytesWritten)
+	)
+	for {
+		select {
+		case <-f.stopCh:
+			return
+		case now := <-ticker.C:
+			written := atomic.LoadInt64(&f.stats.bytesWritten)
+			if written-lastWritten < f.adaptiveGC.writtenBytes && now.Sub(lastGc) < interval {
+				continue
+			}
+			if written == lastWritten {
+				interval *= 2
+				if interval > f.adaptiveGC.maxInterval {
+					interval = f.adaptiveGC.maxInterval
+				}
+			} else {
+				_, interval = f.gcSettings()
+			}
+			f.gc()
+			if !f.retryGc() {
+				return
+			}
+			lastGc, lastWritten = time.Now(), written
+		}
+	}
+}
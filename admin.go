@@ -0,0 +1,59 @@
+package fscache
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// NewAdminHandler returns a http.Handler serving the Stats() of f in JSON at /stats and in the text format
+// of Prometheus at /metrics, the reports of the last GC passes in JSON at /gc, and the Report() of f in JSON
+// at /report, and pages of ListEntries() in JSON at /entries, filtered by the query parameters prefix, namespace,
+// minSize, maxSize, minAge and maxAge, e.g. "1h", and paged by cursor and limit, and the ExportIndex() of f
+// at /index, for peers to ImportIndex().
+func NewAdminHandler(f *Cache) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, f.Stats())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		f.writeMetrics(w)
+	})
+	mux.HandleFunc("/gc", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, f.gcHistory.reports())
+	})
+	mux.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, f.Report())
+	})
+	mux.HandleFunc("/entries", func(w http.ResponseWriter, r *http.Request) {
+		opts, err := listOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entries, next, err := f.ListEntries(opts)
+		if err == ErrInvalidCursor {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, entriesPage{Entries: entries, Next: next})
+	})
+	mux.HandleFunc("/index", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if _, err := f.ExportIndex(w); err != nil {
+			f.logger.Errorf("export index : %s", err)
+		}
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
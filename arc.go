@@ -0,0 +1,154 @@
+package fscache
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// WithARC makes GC evict entries by ARC (Adaptive Replacement Cache) instead of LRU,
+// which adapts between recency and frequency dominated workloads, so that a scan over
+// many keys does not flush the entries got repeatedly. Its lists are saved in the cache dir
+// at Close() and after every GC pass, and loaded at startup.
+func WithARC() Option { return func(fc *Cache) { fc.policy = newARC() } }
+
+// arc keeps the entries got once in t1 and the ones got more than once in t2, and the keys
+// recently evicted from them in the ghost lists b1 and b2. A set of a key in b1 grows the target p
+// of bytes in t1, and one in b2 shrinks it.
+type arc struct {
+	mu             sync.Mutex
+	t1, t2, b1, b2 *keyList
+	p              float64
+	// c is the bytes GC keeps the entries under, learned in victims()
+	c int64
+}
+
+func newARC() *arc {
+	return &arc{t1: newKeyList(), t2: newKeyList(), b1: newKeyList(), b2: newKeyList()}
+}
+
+func ratio(a, b int64) float64 {
+	if b <= 0 || a <= b {
+		return 1
+	}
+	return float64(a) / float64(b)
+}
+
+func (a *arc) add(key string, size int64, cost float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case a.t1.has(key) || a.t2.has(key):
+		a.t1.remove(key)
+	case a.b1.has(key):
+		a.p += ratio(a.b2.bytes, a.b1.bytes) * float64(size)
+		if a.c > 0 && a.p > float64(a.c) {
+			a.p = float64(a.c)
+		}
+		a.b1.remove(key)
+	case a.b2.has(key):
+		a.p -= ratio(a.b1.bytes, a.b2.bytes) * float64(size)
+		if a.p < 0 {
+			a.p = 0
+		}
+		a.b2.remove(key)
+	default:
+		a.t1.pushBack(key, size)
+		return
+	}
+	a.t2.pushBack(key, size)
+}
+
+func (a *arc) touch(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if it, ok := a.t1.remove(key); ok {
+		a.t2.pushBack(key, it.Size)
+		return
+	}
+	a.t2.moveToBack(key)
+}
+
+func (a *arc) remove(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.t1.remove(key)
+	a.t2.remove(key)
+}
+
+func (a *arc) victims(entries []os.FileInfo, needBytes int64) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var (
+		sizes    = make(map[string]int64, len(entries))
+		curBytes int64
+	)
+	for _, fi := range entries {
+		sizes[fi.Name()] = fi.Size()
+		curBytes += fi.Size()
+	}
+	a.t1.retain(sizes)
+	a.t2.retain(sizes)
+	for _, fi := range unknownEntries(entries, a.t1, a.t2) {
+		a.t1.pushFront(fi.Name(), fi.Size())
+	}
+	a.c = curBytes - needBytes
+
+	var (
+		keys       []string
+		bytesSoFar int64
+	)
+	for bytesSoFar < needBytes && a.t1.len()+a.t2.len() > 0 {
+		from, ghost := a.t2, a.b2
+		if a.t1.len() > 0 && (float64(a.t1.bytes) > a.p || a.t2.len() == 0) {
+			from, ghost = a.t1, a.b1
+		}
+		it, _ := from.popFront()
+		ghost.pushBack(it.Key, it.Size)
+		keys = append(keys, it.Key)
+		bytesSoFar += it.Size
+	}
+	for a.b1.bytes > a.c && a.b1.len() > 0 {
+		a.b1.popFront()
+	}
+	for a.b2.bytes > a.c && a.b2.len() > 0 {
+		a.b2.popFront()
+	}
+	return keys
+}
+
+type arcState struct {
+	P  float64   `json:"p"`
+	C  int64     `json:"c"`
+	T1 []keyItem `json:"t1"`
+	T2 []keyItem `json:"t2"`
+	B1 []keyItem `json:"b1"`
+	B2 []keyItem `json:"b2"`
+}
+
+func (a *arc) save(w io.Writer) error {
+	a.mu.Lock()
+	st := arcState{P: a.p, C: a.c, T1: a.t1.items(), T2: a.t2.items(), B1: a.b1.items(), B2: a.b2.items()}
+	a.mu.Unlock()
+	return json.NewEncoder(w).Encode(st)
+}
+
+func (a *arc) load(r io.Reader) error {
+	var st arcState
+	if err := json.NewDecoder(r).Decode(&st); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.p, a.c = st.P, st.C
+	for _, l := range []struct {
+		from []keyItem
+		to   *keyList
+	}{{st.T1, a.t1}, {st.T2, a.t2}, {st.B1, a.b1}, {st.B2, a.b2}} {
+		for _, it := range l.from {
+			l.to.pushBack(it.Key, it.Size)
+		}
+	}
+	return nil
+}
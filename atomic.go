@@ -1,30 +1,46 @@
 package fscache
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
 // atomicWriteFile atomically writes data to a file named by filename.
-func atomicWriteFile(filename, tmpfile string, src []byte, perm os.FileMode) error {
-	dst, err := newAtomicFileWriter(filename, tmpfile, perm)
+func atomicWriteFile(filename, tmpfile string, fo fileOpts, src []byte, perm os.FileMode) error {
+	dst, err := newAtomicFileWriter(filename, tmpfile, fo, perm)
 	if err != nil {
 		return err
 	}
 	if written, err := dst.Write(src); err != nil || written != len(src) {
 		dst.(*atomicFileWriter).writeErr = fmt.Errorf("atomic write file %s with tmpfile %s, "+
-			"err %s, srcBytes %d, writtenBytes %d", filename, tmpfile, err, len(src), written)
+			"err %w, srcBytes %d, writtenBytes %d", filename, tmpfile, err, len(src), written)
 	}
 	return dst.Close()
 }
 
+// fileOpts is how files are written into the cache.
+type fileOpts struct {
+	// xdevDir is the dir files are renamed through, see renameFile().
+	xdevDir string
+	// nolock skips flocking tmp files, see WithNFSMode().
+	nolock bool
+}
+
+func (f *Cache) fileOpts() fileOpts { return fileOpts{xdevDir: f.xdevdir(), nolock: f.nfs} }
+
 type atomicFileWriter struct {
 	f        *os.File
 	fn       string
+	fo       fileOpts
 	writeErr error
 	perm     os.FileMode
 }
@@ -32,15 +48,17 @@ type atomicFileWriter struct {
 // newAtomicFileWriter returns WriteCloser so that writing to it writes to a
 // temporary file and closing it atomically changes the temporary file to
 // destination path. Writing and closing concurrently is not allowed.
-// tmpdir and filename must be within the same filesystem.
-func newAtomicFileWriter(filename, tmpfile string, perm os.FileMode) (io.WriteCloser, error) {
+// tmpdir and filename must be within the same filesystem, unless the xdev dir is, see renameFile().
+func newAtomicFileWriter(filename, tmpfile string, fo fileOpts, perm os.FileMode) (io.WriteCloser, error) {
 	f, err := os.OpenFile(tmpfile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0664)
 	if err != nil {
 		return nil, err
 	}
-	if err = unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
-		f.Close()
-		return nil, err
+	if !fo.nolock {
+		if err = unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+			f.Close()
+			return nil, err
+		}
 	}
 	abspath, err := filepath.Abs(filename)
 	if err != nil {
@@ -49,6 +67,7 @@ func newAtomicFileWriter(filename, tmpfile string, perm os.FileMode) (io.WriteCl
 	return &atomicFileWriter{
 		f:    f,
 		fn:   abspath,
+		fo:   fo,
 		perm: perm,
 	}, nil
 }
@@ -78,7 +97,167 @@ func (w *atomicFileWriter) Close() (retErr error) {
 		return err
 	}
 	if w.writeErr == nil {
-		return os.Rename(w.f.Name(), w.fn)
+		return renameFile(w.f.Name(), w.fn, w.fo)
+	}
+	return w.writeErr
+}
+
+// rename renames files, replaced by tests to fail across devices.
+var rename = os.Rename
+
+// renameFile renames oldpath to newpath like os.Rename(). If they are on different devices, it copies
+// oldpath to a file in the xdev dir on the device of newpath and renames that instead, so that newpath
+// is still replaced atomically, and removes oldpath. Without the xdev dir, it fails with EXDEV.
+func renameFile(oldpath, newpath string, fo fileOpts) error {
+	err := rename(oldpath, newpath)
+	if fo.xdevDir == "" || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	src, err := os.Open(oldpath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := ioutil.TempFile(fo.xdevDir, filepath.Base(newpath)+".")
+	if err != nil {
+		return err
+	}
+	// locked against cleanTmp() of other processes sharing the cache dir
+	if !fo.nolock {
+		err = unix.Flock(int(dst.Fd()), unix.LOCK_EX)
+	}
+	if err == nil {
+		if _, err = io.Copy(dst, src); err == nil {
+			err = dst.Sync()
+		}
+	}
+	if err == nil {
+		err = dst.Chmod(fi.Mode().Perm())
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), newpath)
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	return os.Remove(oldpath)
+}
+
+// xdevdir returns the dir on the device of the cache dir which files are renamed through, see renameFile(),
+// empty unless the tmp dir is on another device.
+func (f *Cache) xdevdir() string {
+	if !f.crossDevice {
+		return ""
+	}
+	return filepath.Join(f.cacheDir, "xdev")
+}
+
+// checkDevice checks if the tmp dir is on the device of the cache dir, so that files are renamed from
+// it into the cache atomically, or falls back to renaming them through the xdev dir otherwise.
+func (f *Cache) checkDevice() error {
+	err := sameDevice(f.filedir(), f.tmpdir())
+	if !errors.Is(err, ErrCrossDevice) {
+		return err
+	}
+	f.logger.Errorf("%s, copying files set into %s to rename", err, filepath.Join(f.cacheDir, "xdev"))
+	f.crossDevice = true
+	if err := os.MkdirAll(f.xdevdir(), 0775); err != nil {
+		return err
+	}
+	return sameDevice(f.filedir(), f.xdevdir())
+}
+
+// movedir returns the dir which entries are moved out of the cache into, on the device of the cache dir.
+func (f *Cache) movedir() string {
+	if f.crossDevice {
+		return f.xdevdir()
+	}
+	return f.tmpdir()
+}
+
+// sameDevice returns ErrCrossDevice if dir1 and dir2 are on different devices.
+func sameDevice(dir1, dir2 string) error {
+	var st1, st2 unix.Stat_t
+	if err := unix.Stat(dir1, &st1); err != nil {
+		return &os.PathError{Op: "stat", Path: dir1, Err: err}
+	}
+	if err := unix.Stat(dir2, &st2); err != nil {
+		return &os.PathError{Op: "stat", Path: dir2, Err: err}
+	}
+	if st1.Dev != st2.Dev {
+		return fmt.Errorf("%w: %s and %s", ErrCrossDevice, dir1, dir2)
+	}
+	return nil
+}
+
+// storageTmpMaxAge is how old tmp files are removed as left by crashes from a Storage in shared mode,
+// where they can not be locked by writers.
+const storageTmpMaxAge = time.Hour
+
+// cleanTmp removes the files left in the tmp dir by the writes of crashed processes, which are the ones
+// not locked by writers, so that they neither take space nor fail the sets of their keys creating them.
+// From a Storage, they are all removed, or only those older than storageTmpMaxAge in shared mode.
+func (f *Cache) cleanTmp() error {
+	if f.storage != nil {
+		err := f.storage.Walk(f.tmpdir(), func(fi os.FileInfo) error {
+			if f.shared && time.Since(fi.ModTime()) < storageTmpMaxAge {
+				return nil
+			}
+			if err := f.storage.Remove(filepath.Join(f.tmpdir(), fi.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		})
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, dir := range []string{f.tmpdir(), f.xdevdir()} {
+		if dir == "" {
+			continue
+		}
+		if err := f.cleanTmpDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanTmpDir removes the files in dir not locked by writers.
+func (f *Cache) cleanTmpDir(dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if f.nfs {
+		f.cleanNFSTmpDir(dir, fis)
+		return nil
+	}
+	for _, fi := range fis {
+		// taken entries are read right after renamed into the tmp dir, without being locked
+		if !fi.Mode().IsRegular() || f.shared && strings.Contains(fi.Name(), ".take-") {
+			continue
+		}
+		fp := filepath.Join(dir, fi.Name())
+		file, err := os.Open(fp)
+		if err != nil {
+			continue
+		}
+		if unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB) == nil {
+			if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+				f.logger.Errorf("remove tmp file %s : %s", fp, err)
+			}
+		}
+		file.Close()
 	}
 	return nil
 }
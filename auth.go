@@ -0,0 +1,68 @@
+package fscache
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrForbidden can be returned by an AuthFunc to reject a request.
+var ErrForbidden = errors.New("forbidden")
+
+// Action is what a request does to the cache.
+type Action string
+
+// Actions authorized by AuthFunc.
+const (
+	ActionRead   Action = "read"
+	ActionWrite  Action = "write"
+	ActionDelete Action = "delete"
+	// ActionPurge is deleting all keys with a prefix, where key is the prefix.
+	ActionPurge Action = "purge"
+)
+
+// AuthFunc authorizes the request r doing action on key, returns an error to reject it with 403 Forbidden.
+type AuthFunc func(r *http.Request, action Action, key string) error
+
+// WithAuth authorizes every request by auth.
+func WithAuth(auth AuthFunc) HandlerOption { return func(h *handler) { h.auth = auth } }
+
+// ACL grants clients actions on namespaces, mapping a key prefix to a client to actions allowed.
+// The client "*" stands for any client.
+type ACL map[string]map[string][]Action
+
+// NewACLAuth returns an AuthFunc allowing a client told by clientKey to do the actions granted by acl
+// on any namespace whose prefix the key starts with, by the host of the remote address if clientKey is nil.
+func NewACLAuth(acl ACL, clientKey func(r *http.Request) string) AuthFunc {
+	if clientKey == nil {
+		clientKey = remoteHost
+	}
+	return func(r *http.Request, action Action, key string) error {
+		client := clientKey(r)
+		for prefix, grants := range acl {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			for _, c := range []string{client, "*"} {
+				for _, a := range grants[c] {
+					if a == action {
+						return nil
+					}
+				}
+			}
+		}
+		return ErrForbidden
+	}
+}
+
+// authorized tells if r is authorized to do action on key, responding 403 if not.
+func (h *handler) authorized(w http.ResponseWriter, r *http.Request, action Action, key string) bool {
+	if h.auth == nil {
+		return true
+	}
+	if err := h.auth(r, action, key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,251 @@
+package fscache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend is where the values missing from the cache are fetched from.
+type Backend interface {
+	// Fetch fetches the value of key, returns ErrNotFound if there is none.
+	Fetch(key string) ([]byte, error)
+}
+
+// RangeBackend is a Backend which can fetch parts of values, so that large values are fetched in parallel.
+type RangeBackend interface {
+	Backend
+	// Size returns the size of the value of key, returns ErrNotFound if there is none.
+	Size(key string) (int64, error)
+	// FetchRange fetches len(dst) bytes of the value of key from offset to dst.
+	FetchRange(key string, offset int64, dst []byte) error
+}
+
+// MultiBackend is a Backend which can fetch the values of many keys at once, e.g. in one round-trip.
+type MultiBackend interface {
+	Backend
+	// FetchMulti fetches the values of keys, leaving out the keys with none.
+	FetchMulti(keys []string) (map[string][]byte, error)
+}
+
+// WithBackend makes the cache read-through: values missing from the cache are fetched from backend
+// and set to the cache by Get(), which are counted as misses and fetches.
+func WithBackend(backend Backend) Option { return func(fc *Cache) { fc.backend = backend } }
+
+// WithParallelFetch specifies that values larger than partBytes from a RangeBackend are fetched
+// in parts of partBytes with workers goroutines, written to the tmp file before renamed into the cache.
+// By default, values are fetched in parts of 8MB with 4 workers. Values stored encoded, chunked or
+// in a Storage are fetched as a whole.
+func WithParallelFetch(partBytes int64, workers int) Option {
+	return func(fc *Cache) {
+		fc.fetchPartBytes = partBytes
+		fc.fetchWorkers = workers
+	}
+}
+
+// fetch fetches the value of key from the backend to dst, and sets it to the cache at prio.
+// Concurrent fetches of key are deduplicated like the loads of GetOrSet().
+func (f *Cache) fetch(key string, dst []byte, prio Priority) ([]byte, error) {
+	val, err := f.load(key, func(key string) ([]byte, error) { return f.fetchValue(key, prio) })
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, val...), nil
+}
+
+// fetchValue fetches the value of key from the backend, and sets it to the cache at prio.
+func (f *Cache) fetchValue(key string, prio Priority) ([]byte, error) {
+	atomic.AddInt64(&f.stats.fetches, 1)
+	if rb, ok := f.backend.(RangeBackend); ok {
+		size, err := rb.Size(key)
+		if err != nil {
+			return nil, err
+		}
+		if size > f.fetchPartBytes && f.rawFile(size) && !f.shedder.shed() {
+			return f.fetchParallel(rb, key, size, nil)
+		}
+	}
+	val, err := f.backend.Fetch(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.setPrio(key, val, entryMeta{}, prio); err != nil && err != ErrShed {
+		f.logger.Errorf("set %s fetched : %s", key, err)
+	}
+	return val, nil
+}
+
+// fetchMulti fetches the values of keys missing from the cache from mb at once, and sets them to the cache.
+func (f *Cache) fetchMulti(mb MultiBackend, keys []string) (map[string][]byte, error) {
+	atomic.AddInt64(&f.stats.fetches, int64(len(keys)))
+	vals, err := mb.FetchMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if val, ok := vals[key]; ok {
+			if err := f.set(key, val, entryMeta{}); err != nil && err != ErrShed {
+				f.logger.Errorf("set %s fetched : %s", key, err)
+			}
+		}
+	}
+	return vals, nil
+}
+
+// rawFile tells if values of size bytes are stored as is in files of the local filesystem, neither encoded
+// nor chunked, so that they can be fetched in parts into their files.
+func (f *Cache) rawFile(size int64) bool {
+	return !f.encoded() && !f.entryHeader && f.storage == nil && !f.chunked(size)
+}
+
+// fetchSeq numbers the tmp files of parallel fetches.
+var fetchSeq uint64
+
+// fetchParallel fetches the value of key in parts into a tmp file of its own, not to conflict with other
+// fetches of key not deduplicated, e.g. of other processes sharing the cache dir, and renames it into the cache.
+func (f *Cache) fetchParallel(rb RangeBackend, key string, size int64, dst []byte) ([]byte, error) {
+	if !f.writable() {
+		return dst, ErrDegraded
+	}
+	tmp := fmt.Sprintf("%s.fetch-%d-%d", f.tmppath(key), time.Now().UnixNano(), atomic.AddUint64(&fetchSeq, 1))
+	w, err := newAtomicFileWriter(f.filepath(key), tmp, f.fileOpts(), 0644)
+	if err != nil {
+		return dst, err
+	}
+	aw := w.(*atomicFileWriter)
+
+	var (
+		val    = make([]byte, size)
+		parts  = int((size + f.fetchPartBytes - 1) / f.fetchPartBytes)
+		partCh = make(chan int, parts)
+		errMu  sync.Mutex
+		wg     sync.WaitGroup
+	)
+	for i := 0; i < parts; i++ {
+		partCh <- i
+	}
+	close(partCh)
+	workers := f.fetchWorkers
+	if workers > parts {
+		workers = parts
+	}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for p := range partCh {
+				start := int64(p) * f.fetchPartBytes
+				end := start + f.fetchPartBytes
+				if end > size {
+					end = size
+				}
+				err := rb.FetchRange(key, start, val[start:end])
+				if err == nil {
+					_, err = aw.f.WriteAt(val[start:end], start)
+				}
+				if err != nil {
+					errMu.Lock()
+					if aw.writeErr == nil {
+						aw.writeErr = fmt.Errorf("fetch %s range %d-%d: %w", key, start, end, err)
+					}
+					errMu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	defer f.keyLocks.lock(key)()
+	created := f.createdAt(key)
+	err = aw.Close()
+	f.health.observeWrite(err)
+	if err != nil {
+		return dst, err
+	}
+	if err := f.written(key, size, entryMeta{CreatedAt: created}); err != nil {
+		f.logger.Errorf("set %s fetched : %s", key, err)
+	}
+	return append(dst, val...), nil
+}
+
+// NewHTTPBackend returns a RangeBackend fetching the value of key from baseURL/key,
+// e.g. another cache served by NewHandler(). It is also a MultiBackend.
+func NewHTTPBackend(baseURL string, client *http.Client) RangeBackend {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpBackend{baseURL: strings.TrimSuffix(baseURL, "/"), client: client}
+}
+
+type httpBackend struct {
+	baseURL string
+	client  *http.Client
+}
+
+func (h *httpBackend) do(method, key string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, h.baseURL+"/"+url.PathEscape(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	case resp.StatusCode/100 != 2:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s responded %s: %s", method, req.URL, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+func (h *httpBackend) Fetch(key string) ([]byte, error) {
+	resp, err := h.do(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Size returns the size of the value by HEAD, or -1 if ranges are not supported,
+// so that the value is fetched as a whole.
+func (h *httpBackend) Size(key string) (int64, error) {
+	resp, err := h.do(http.MethodHead, key, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		return -1, nil
+	}
+	return strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+}
+
+func (h *httpBackend) FetchRange(key string, offset int64, dst []byte) error {
+	rng := fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(dst))-1)
+	resp, err := h.do(http.MethodGet, key, http.Header{"Range": {rng}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("range %s of %s not supported, responded %s", rng, key, resp.Status)
+	}
+	_, err = io.ReadFull(resp.Body, dst)
+	return err
+}
@@ -0,0 +1,55 @@
+package fscache
+
+import "hash/fnv"
+
+// WithBloomFilter keeps a Bloom filter of keys in the cache, sized for expectedKeys,
+// so that Get() and Has() of most keys not in the cache return without touching the disk.
+// The filter is built by scanning the cache in New(), and rebuilt by each GC.
+// Keys set by other processes are seen only after the next GC, unless WithInotify() is used.
+func WithBloomFilter(expectedKeys int) Option {
+	return func(fc *Cache) { fc.index.bloomKeys = expectedKeys }
+}
+
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7 // ~1% false positive rate with 10 bits per key
+)
+
+type bloomFilter struct {
+	bits []uint64
+}
+
+func newBloomFilter(keys int) *bloomFilter {
+	if keys < 1 {
+		keys = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (keys*bloomBitsPerKey+63)/64)}
+}
+
+func bloomHash(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+	return h1, h1>>33 | h1<<31 | 1
+}
+
+func (b *bloomFilter) add(key string) {
+	h1, h2 := bloomHash(key)
+	n := uint64(len(b.bits) * 64)
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % n
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHash(key)
+	n := uint64(len(b.bits) * 64)
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % n
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -1,13 +1,15 @@
 package fscache
 
 import (
-	"container/heap"
+	"bytes"
 	"errors"
-	"io/ioutil"
 	"log"
 	"math"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,25 +24,164 @@ type Interface interface {
 	Has(key string) bool
 }
 
+// Deleter is an Interface which can delete keys, e.g. *Cache, checked for by NewHandler() and Chain().
+type Deleter interface {
+	// Delete deletes the key, deleting a key not set is not an error.
+	Delete(key string) error
+}
+
 var (
 	// ErrNotFound will be returned when getting a key that not setting before.
 	ErrNotFound = errors.New("not found")
+	// ErrIllegalEntry will be returned when getting a key whose entry is not a regular file,
+	// e.g. a symlink planted under the cache dir.
+	ErrIllegalEntry = errors.New("illegal entry")
+	// ErrCrossDevice will be returned by New() when the cache dir has dirs on different devices, e.g. mounted
+	// under it, so that renaming files set into the cache would not be atomic. See WithTmpDir() for the tmp dir.
+	ErrCrossDevice = errors.New("tmp dir and cache dir on different devices")
+	// ErrDegraded will be returned when setting a key while the cache is degraded to read-only,
+	// because the filesystem is read-only or full, or the circuit of the disk is open, see WithCircuitBreaker().
+	ErrDegraded = errors.New("degraded to read-only")
+	// ErrLocked will be returned by New() when the cache dir is used by another cache not in shared mode.
+	ErrLocked = errors.New("cache dir locked by another cache")
+	// ErrNotModified will be returned by GetIfChanged() when the value of the key is of the version known.
+	ErrNotModified = errors.New("not modified")
 )
 
 // Cache is a LRU filesystem cache based on atime.
 type Cache struct {
-	cacheDir   string
-	maxBytes   int64
-	gcInterval time.Duration
-	logger     Logger
-	fih        fileInfoHeap
-	gcStopCh   <-chan struct{}
+	stats    *stats
+	cacheDir string
+	tmpDir   string
+	// crossDevice is true if the tmp dir is on another device than the cache dir.
+	crossDevice bool
+	nfs         bool
+	nfsDirLock  *nfsLock
+	nfsGcLock   *nfsLock
+	dirSyncs    *syncBatch
+	metaSyncs   *syncBatch
+	// overlayUpper is the cache dir in the upper layer of the overlayfs it is on, if any.
+	overlayUpper string
+	seedDir      string
+	maxBytes     int64
+	gcInterval   time.Duration
+	// tuneMu guards the settings updated by UpdateConfig(), which GC passes copy when they begin
+	tuneMu   sync.RWMutex
+	tunedCh  chan struct{}
+	logger   Logger
+	policy   policy
+	gcStopCh <-chan struct{}
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	// stopMu orders starting background goroutines before the stop channel closed, see background()
+	stopMu     sync.Mutex
+	wg         sync.WaitGroup
+	shared     bool
+	lockFile   *os.File
+	gcLockFile *os.File
+	heatmap    *heatmap
+	adaptiveGC *adaptiveGC
+	index      *index
+	inotify    bool
+	quarantine bool
+	health     *health
+	breaker    *breaker
+	evictHook  *EvictHook
+	// evictHooks holds a token for each call of evictHook running
+	evictHooks chan struct{}
+
+	metaUsed  int32
+	meta      metaStore
+	xattrMeta bool
+	watchers  watchers
+	handles   handlePool
+	readers   readerRefs
+	sched     ioScheduler
+	ghosts    ghostList
+	lists     listSnapshots
+	fds       fdBudget
+
+	directIOThreshold int64
+	fadviseThreshold  int64
+	setAdvice         Advice
+	getAdvice         Advice
+	gcHistory         gcHistory
+	sizeHist          sizeHistogram
+
+	namespaceWeights map[string]float64
+	skipAtime        bool
+	skipUnchanged    bool
+	slowOpThreshold  time.Duration
+	retryAttempts    int
+	retryBackoff     time.Duration
+
+	gcExclude         []string
+	gcExcludeMaxBytes int64
+	retention         []RetentionRule
+	scrubPeriod       time.Duration
+	gcFailures        int32
+	gcRunning         int32
+	keyLocks          keyLocks
+	flights           flights
+	tenantsMu         sync.Mutex
+	tenants           map[string]*Tenant
+	storage           Storage
+	accessLog         *accessLog
+	durable           bool
+	transforms        []Transform
+	keyHashing        bool
+	hashedKeys        *hashedKeys
+
+	minFreeBytes   int64
+	trashRetention time.Duration
+	ttlJitter      float64
+	sweepInterval  time.Duration
+	gcWorkers      int
+
+	shedder         *loadShedder
+	writeSlots      chan struct{}
+	blockWrites     bool
+	engine          Engine
+	hybridThreshold int64
+	version         string
+	entryHeader     bool
+	packs           *packStore
+	backend         Backend
+	predictor       Predictor
+	chunks          *chunkStore
+	dicts           *dictStore
+	fetchPartBytes  int64
+	fetchWorkers    int
+
+	maintenanceInterval time.Duration
+	maintenanceBatch    int
+	// maintainedKey is the key recompressed last, only used by maintain()
+	maintainedKey string
+
+	progressInterval time.Duration
+	progressFn       func(Progress)
+
+	// buffers reused by scan(), which is only called by GC
+	scanBuf   []byte
+	scanNames []string
+	scanTypes []uint8
+
+	journal         *journal
+	replicaURL      string
+	replicaInterval time.Duration
+	replicaClient   *http.Client
 }
 
 func (f *Cache) filedir() string            { return filepath.Join(f.cacheDir, "cache") }
-func (f *Cache) tmpdir() string             { return filepath.Join(f.cacheDir, "tmp") }
-func (f *Cache) filepath(key string) string { return filepath.Join(f.filedir(), key) }
-func (f *Cache) tmppath(key string) string  { return filepath.Join(f.tmpdir(), key) }
+func (f *Cache) filepath(key string) string { return filepath.Join(f.filedir(), f.filename(key)) }
+func (f *Cache) tmppath(key string) string  { return filepath.Join(f.tmpdir(), f.filename(key)) }
+
+func (f *Cache) tmpdir() string {
+	if f.tmpDir != "" {
+		return f.tmpDir
+	}
+	return filepath.Join(f.cacheDir, "tmp")
+}
 
 // Option can be passed to New() to tailor your needs.
 type Option func(fc *Cache)
@@ -48,11 +189,17 @@ type Option func(fc *Cache)
 // WithCacheDir specifies where the cache holds.
 func WithCacheDir(cacheDir string) Option { return func(fc *Cache) { fc.cacheDir = cacheDir } }
 
+// WithTmpDir specifies where the files being set are written before renamed into the cache dir,
+// which must not hold other files, as the files left in it by crashes are removed by New().
+// On another device than the cache dir, each file is copied into the xdev dir under the cache dir
+// to be renamed, which is still atomic but slower. By default, it is the tmp dir under the cache dir.
+func WithTmpDir(tmpDir string) Option { return func(fc *Cache) { fc.tmpDir = tmpDir } }
+
 // WithMaxBytes specifies how many space the cache could take up.
 func WithMaxBytes(bytes int64) Option { return func(fc *Cache) { fc.maxBytes = bytes } }
 
-// WithGcStopCh receives a channel, when the channel close, gc will stop.
-// By default, gc will not stop until the process exits.
+// WithGcStopCh receives a channel, when the channel close, gc and other background goroutines will stop.
+// By default, they will not stop until the process exits.
 func WithGcStopCh(stopCh <-chan struct{}) Option { return func(fc *Cache) { fc.gcStopCh = stopCh } }
 
 // WithGcInterval specifies how often the GC performs.
@@ -60,7 +207,9 @@ func WithGcInterval(interval time.Duration) Option {
 	return func(fc *Cache) { fc.gcInterval = interval }
 }
 
-// Logger used by this package.
+// Logger used by this package. Summaries of GC passes are logged too if it has
+//
+//	Infof(fmt string, args ...interface{})
 type Logger interface {
 	Errorf(fmt string, args ...interface{})
 }
@@ -70,117 +219,742 @@ type logger struct {
 }
 
 func (l *logger) Errorf(fmt string, args ...interface{}) { log.Printf(fmt, args...) }
+func (l *logger) Infof(fmt string, args ...interface{})  { log.Printf(fmt, args...) }
 
 // New creates a LRU filesystem cache based on atime, and starts the GC goroutine.
 func New(opts ...Option) (Interface, error) {
+	fc := configure(opts...)
+	if fc.cacheDir == "" {
+		fc.cacheDir = os.TempDir()
+	}
+	if err := fc.open(); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// configure returns a cache with opts applied over the defaults, except the cache dir.
+func configure(opts ...Option) *Cache {
 	fc := &Cache{
-		cacheDir:   os.TempDir(),
+		stats:      &stats{},
 		maxBytes:   math.MaxInt64,
 		gcInterval: 5 * time.Minute,
 		logger:     &logger{},
 		gcStopCh:   make(chan struct{}),
+		tunedCh:    make(chan struct{}, 1),
+		index:      newIndex(),
+		health:     newHealth(),
+		policy:     lru{},
+		gcHistory:  gcHistory{size: 16},
+
+		sweepInterval:  time.Minute,
+		fetchPartBytes: 8 * 1024 * 1024,
+		fetchWorkers:   4,
+
+		hybridThreshold: 64 * 1024,
+
+		replicaInterval: time.Second,
+		replicaClient:   &http.Client{Timeout: time.Minute},
 	}
+	fc.handles.fds = &fc.fds
 	for _, opt := range opts {
 		opt(fc)
 	}
-	if err := os.MkdirAll(fc.filedir(), 0775); err != nil {
-		return nil, err
+	return fc
+}
+
+// open locks and prepares the dirs of the cache, and starts background goroutines.
+func (f *Cache) open() (err error) {
+	f.stats.startAt = time.Now().UnixNano()
+	if f.nfs {
+		f.configureNFS()
 	}
-	if err := os.MkdirAll(fc.tmpdir(), 0775); err != nil {
-		return nil, err
+	if f.dicts != nil && f.chunks != nil {
+		return ErrDictChunks
 	}
-	if fc.maxBytes > 0 {
-		go fc.gcRunner()
+	if err := os.MkdirAll(f.cacheDir, 0775); err != nil {
+		return err
 	}
-	return fc, nil
+	if err := f.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.packs.close()
+			f.unlock()
+		}
+	}()
+	if err := os.MkdirAll(f.filedir(), 0775); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.tmpdir(), 0775); err != nil {
+		return err
+	}
+	if err := f.checkDevice(); err != nil {
+		return err
+	}
+	f.checkOverlay()
+	if err := f.cleanTmp(); err != nil {
+		return err
+	}
+	if err := f.checkVersion(); err != nil {
+		return err
+	}
+	if err := f.checkGcExclude(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.filedir(), 0775); err != nil {
+		return err
+	}
+	if _, err := os.Stat(f.metadir()); err == nil {
+		f.metaUsed = 1
+	}
+	if f.xattrMeta && xattrSupported(f.tmpdir()) {
+		f.meta = xattrMeta{f: f, sidecar: sidecarMeta{f: f}}
+	}
+	if f.trashEnabled() {
+		for _, dir := range []string{f.trashdir(), f.trashMetadir()} {
+			if err := os.MkdirAll(dir, 0775); err != nil {
+				return err
+			}
+		}
+	}
+	if f.quarantine {
+		if err := os.MkdirAll(f.quarantinedir(), 0775); err != nil {
+			return err
+		}
+	}
+	if f.chunks != nil {
+		if err := os.MkdirAll(f.chunkdir(), 0775); err != nil {
+			return err
+		}
+		if err := f.cleanChunkTmp(); err != nil {
+			return err
+		}
+	}
+	if f.dicts != nil {
+		if err := f.dicts.load(f.dictdir()); err != nil {
+			return err
+		}
+	}
+	f.configureEngine()
+	if err := f.loadPolicy(); err != nil {
+		f.logger.Errorf("load policy %s : %s", f.policyPath(), err)
+	}
+	if f.namespaceWeights != nil {
+		f.policy = &fairPolicy{policy: f.policy, weights: f.namespaceWeights}
+	}
+	if f.packs != nil {
+		f.packs.durable = f.durable
+		if err := f.packs.open(f.packdir()); err != nil {
+			return err
+		}
+	}
+	if f.index.bloomKeys > 0 {
+		if _, _, err := f.rebuildIndex(); err != nil {
+			return err
+		}
+	}
+	if f.accessLog != nil {
+		if err := f.accessLog.open(); err != nil {
+			return err
+		}
+	}
+	if f.heatmap != nil {
+		if err := f.heatmap.load(f.heatmapPath()); err != nil {
+			f.logger.Errorf("load heatmap %s : %s", f.heatmapPath(), err)
+		}
+	}
+	var replicaOffset int64
+	if f.replicaURL != "" {
+		j, err := openJournal(f.journalPath())
+		if err != nil {
+			return err
+		}
+		j.sync = f.durable
+		off, err := f.loadReplicationOffset()
+		if err != nil {
+			j.close()
+			return err
+		}
+		if off > j.size {
+			// the journal was truncated before the offset got saved
+			off = 0
+		}
+		f.journal, replicaOffset = j, off
+	}
+	inotifyFd := -1
+	if f.inotify {
+		if inotifyFd, err = f.watchInotify(); err != nil {
+			if f.journal != nil {
+				f.journal.close()
+			}
+			return err
+		}
+	}
+
+	f.stopCh = make(chan struct{})
+	go func() {
+		select {
+		case <-f.gcStopCh:
+			f.stop()
+		case <-f.stopCh:
+		}
+	}()
+	if inotifyFd >= 0 {
+		f.background(func() { f.inotifyRunner(inotifyFd) })
+	}
+	if f.journal != nil {
+		f.background(func() { f.replicateRunner(replicaOffset) })
+	}
+	if f.heatmap != nil {
+		f.background(f.heatmapRunner)
+	}
+	if f.nfsDirLock != nil {
+		f.background(f.nfsLockRunner)
+	}
+	if f.breaker != nil {
+		f.background(f.breakerRunner)
+	}
+	if f.maxBytes > 0 || f.packs != nil {
+		f.background(f.gcRunner)
+	}
+	if f.sweepInterval > 0 {
+		f.background(f.sweepRunner)
+	}
+	if f.scrubPeriod > 0 {
+		f.background(f.scrubRunner)
+	}
+	if f.maintenanceInterval > 0 {
+		f.background(f.maintenanceRunner)
+	}
+	return nil
+}
+
+// background runs fn in a goroutine, which should return after the stop channel closed.
+// Once the stop channel closed, fn is not run, so that Close() waits for all the goroutines started.
+func (f *Cache) background(fn func()) {
+	f.stopMu.Lock()
+	defer f.stopMu.Unlock()
+	select {
+	case <-f.stopCh:
+		return
+	default:
+	}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		fn()
+	}()
+}
+
+func (f *Cache) stop() {
+	f.stopMu.Lock()
+	defer f.stopMu.Unlock()
+	f.stopOnce.Do(func() { close(f.stopCh) })
+}
+
+// Close implements io.Closer, stopping background goroutines and releasing the cache dir.
+func (f *Cache) Close() error {
+	f.stop()
+	f.wg.Wait()
+	unregister(f)
+	f.savePolicy()
+	f.watchers.closeAll()
+	f.handles.closeAll()
+	var err error
+	if f.journal != nil {
+		err = f.journal.close()
+	}
+	if cerr := f.packs.close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.accessLog.close(); err == nil {
+		err = cerr
+	}
+	f.unlock()
+	return err
 }
 
 func (f *Cache) gcRunner() {
-	ticker := time.NewTicker(f.gcInterval)
+	if f.adaptiveGC != nil {
+		f.adaptiveGcRunner()
+		return
+	}
+	_, interval := f.gcSettings()
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
 		select {
-		case <-f.gcStopCh:
+		case <-f.stopCh:
 			return
+		case <-f.tunedCh:
+			_, interval = f.gcSettings()
+			ticker.Reset(interval)
 		case <-ticker.C:
 			f.gc()
+			if !f.retryGc() {
+				return
+			}
 		}
 	}
 }
 
 func (f *Cache) gc() {
-	curBytes := int64(0)
-	f.fih = nil
+	if !f.lockGc() {
+		return
+	}
+	defer f.unlockGc()
+	tuning := f.gcTuning()
+	f.gcHistory.begin()
+	defer f.stats.gcLatency.since(time.Now())
+	defer func() { f.logGcReport(f.gcHistory.end()) }()
+	defer f.recoverGc()
+	if f.trashEnabled() {
+		f.emptyTrash()
+	}
+	if f.packs != nil {
+		f.gcPacks()
+	}
+	if f.chunks != nil {
+		f.gcChunks()
+	}
+	if tuning.maxBytes > 0 {
+		f.gcFiles(tuning)
+	}
+	f.savePolicy()
+	atomic.StoreInt32(&f.gcFailures, 0)
+}
 
-	err := filepath.Walk(f.filedir(), func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
+// gcFiles evicts the entries in their own files.
+func (f *Cache) gcFiles(tuning gcTuning) {
+	var packedBytes int64
+	if f.engine == EngineHybrid {
+		_, packedBytes = f.packs.usage()
+	}
+	if f.inotify && tuning.excludeMaxBytes <= 0 && len(f.retention) == 0 {
+		if usage, ok := f.index.usage(); ok && usage+packedBytes <= tuning.maxBytes {
+			atomic.StoreInt64(&f.stats.lastGc, time.Now().UnixNano())
+			return
 		}
-		curBytes += info.Size()
-		heap.Push(&f.fih, info)
-		return nil
-	})
+	}
+
+	entries, curBytes, err := f.rebuildIndex()
 	if err != nil {
-		f.logger.Errorf("gc walk dir %s : %s", f.filedir(), err)
+		f.gcErrorf("gc walk dir %s : %s", f.filedir(), err)
 		return
 	}
+	atomic.StoreInt64(&f.stats.lastGc, time.Now().UnixNano())
+	if f.overlayUpper != "" {
+		entries, curBytes = f.upperEntries(entries)
+	}
+	f.gcHistory.update(func(rep *GCReport) {
+		rep.ScannedFiles, rep.ScannedBytes = int64(len(entries)), curBytes
+	})
+	if f.engine == EngineHybrid {
+		for _, fi := range f.packs.infos() {
+			entries = append(entries, fi)
+			curBytes += fi.Size()
+		}
+	}
+	f.sizeHist.update(entries)
 
-	if curBytes <= f.maxBytes {
+	entries, excluded, excludedBytes := f.splitGcExcluded(entries)
+	entries, keysToGc, freedBytes := f.retentionVictims(entries)
+	excludedKeys, excludedFreed := excludedVictims(excluded, excludedBytes, tuning.excludeMaxBytes)
+	keysToGc, freedBytes = append(keysToGc, excludedKeys...), freedBytes+excludedFreed
+	if curBytes-freedBytes <= tuning.maxBytes && len(keysToGc) == 0 {
 		return
 	}
+	if curBytes-freedBytes > tuning.maxBytes {
+		keysToGc = append(keysToGc, tuning.victims(entries, curBytes-freedBytes-tuning.maxBytes)...)
+	}
+	if f.engine == EngineHybrid {
+		keysToGc = f.gcPacked(keysToGc)
+	}
+	sizes := make(map[string]int64, len(keysToGc))
+	for _, k := range keysToGc {
+		sizes[k] = 0
+	}
+	for _, fi := range entries {
+		if _, ok := sizes[fi.Name()]; ok {
+			sizes[fi.Name()] = fi.Size()
+		}
+	}
+	var removed, removedBytes int64
+	for _, k := range f.remove(keysToGc) {
+		removed, removedBytes = removed+1, removedBytes+sizes[k]
+		f.policy.remove(k)
+		f.changed(EventEvict, k)
+		if err := f.dropMeta(k); err != nil && !vanished(err) {
+			f.gcErrorf("gc meta of %s : %s", k, err)
+		}
+	}
+	f.gcEvicted(removed, removedBytes)
+}
 
+// rebuildIndex rebuilds the index by scanning the cache dir,
+// and returns the entries found and bytes taken up by them.
+func (f *Cache) rebuildIndex() ([]os.FileInfo, int64, error) {
+	f.index.beginRebuild()
+	var entries []os.FileInfo
+	err := f.retry(func() (err error) {
+		entries, err = f.scan()
+		return err
+	})
 	var (
-		needGcBytes = curBytes - f.maxBytes
-		bytesSoFar  int64
-		keysToGc    []string
+		curBytes int64
+		sizes    = make(map[string]int64, len(entries))
 	)
+	for _, fi := range entries {
+		curBytes += fi.Size()
+		sizes[fi.Name()] = fi.Size()
+	}
+	f.index.endRebuild(sizes)
+	if err != nil {
+		f.index.markStale()
+	}
+	return entries, curBytes, err
+}
+
+// Set implements Interface.Set().
+func (f *Cache) Set(key string, src []byte) error {
+	return f.set(key, src, entryMeta{})
+}
+
+// SetWithCost sets the value of key as src like Set(), with the cost to recompute it, e.g. in seconds,
+// which is taken into account by WithGreedyDualSize().
+func (f *Cache) SetWithCost(key string, src []byte, cost float64) error {
+	return f.set(key, src, entryMeta{Cost: cost})
+}
+
+func (f *Cache) set(key string, src []byte, meta entryMeta) error {
+	return f.setPrio(key, src, meta, PriorityForeground)
+}
 
-	for bytesSoFar < needGcBytes {
-		fi := heap.Pop(&f.fih).(os.FileInfo)
-		bytesSoFar += fi.Size()
-		keysToGc = append(keysToGc, fi.Name())
+func (f *Cache) setPrio(key string, src []byte, meta entryMeta, prio Priority) (err error) {
+	defer f.sched.begin(prio)()
+	defer func(start time.Time, size int64) {
+		f.opDone(&f.stats.setLatency, AccessSet, key, size, start, err)
+	}(time.Now(), int64(len(src)))
+	if f.accessLog != nil {
+		defer f.logAccess(AccessSet, key, int64(len(src)), false, time.Now())
+	}
+	if err := f.checkKey(key); err != nil {
+		return err
+	}
+	if !f.writable() {
+		return ErrDegraded
+	}
+	if f.shedder.shed() {
+		atomic.AddInt64(&f.stats.shed, 1)
+		return ErrShed
+	}
+	if src, err = f.encodeValue(key, src); err != nil {
+		return err
+	}
+	if f.entryHeader {
+		src, meta.ExpireAt = f.encodeEntry(src, meta.ExpireAt), 0
+	}
+	if !f.packs.fits(len(src)) {
+		// the write slot is taken before the key lock, like SetReader() and SetDir(), so that they do not deadlock
+		release, err := f.acquireWrite()
+		if err != nil {
+			return err
+		}
+		defer release()
 	}
+	defer f.keyLocks.lock(key)()
+	return f.setLocked(key, src, meta)
+}
 
-	for _, k := range keysToGc {
-		fp := f.filepath(k)
-		if err := os.Remove(fp); err != nil {
-			f.logger.Errorf("gc %s : %s", fp, err)
-			return
+// setLocked sets the encoded entry src of key with the key locked, and a write slot taken unless it is packed.
+func (f *Cache) setLocked(key string, src []byte, meta entryMeta) error {
+	meta.CreatedAt = f.createdAt(key)
+	if f.packs.fits(len(src)) {
+		return f.setPacked(key, src, meta)
+	}
+	if f.skipUnchanged && f.unchanged(key, src, meta) {
+		atomic.AddInt64(&f.stats.unchangedSets, 1)
+		return nil
+	}
+	if f.chunked(int64(len(src))) {
+		return f.setChunked(key, bytes.NewReader(src), int64(len(src)), meta)
+	}
+	start := time.Now()
+	err := f.writeStored(key, src)
+	f.observeDisk(start, err)
+	f.health.observeWrite(err)
+	if err != nil {
+		return err
+	}
+	f.adviseSet(key, int64(len(src)))
+	return f.written(key, int64(len(src)), meta)
+}
+
+// written updates the bookkeeping of key whose value of size bytes was just written into the cache.
+func (f *Cache) written(key string, size int64, meta entryMeta) error {
+	if f.durable && f.storage == nil {
+		if err := f.syncFiledir(); err != nil {
+			return err
 		}
 	}
+	// drop the packed value of key if the old value was small, or the chunks if it was large
+	if _, err := f.packs.remove(key); err != nil {
+		return err
+	}
+	if _, err := f.dropChunked(key); err != nil {
+		return err
+	}
+	f.index.set(key, size)
+	f.policy.add(key, size, meta.Cost)
+	return f.recorded(key, size, meta)
 }
 
-// Set implements Interface.Set().
-func (f *Cache) Set(key string, src []byte) error {
-	return atomicWriteFile(f.filepath(key), f.tmppath(key), src, 0644)
+// recorded records the write of key to the stats, the meta and the journal.
+func (f *Cache) recorded(key string, size int64, meta entryMeta) error {
+	atomic.AddInt64(&f.stats.bytesWritten, size)
+	return f.recordSet(key, meta)
+}
+
+// recordSet records key set with meta to the meta and the journal, emitting an event.
+func (f *Cache) recordSet(key string, meta entryMeta) error {
+	f.changed(EventSet, key)
+	if f.keyHashing {
+		meta.Key = key
+		f.hashedKeys.set(f.filename(key), key)
+	}
+	if err := f.replaceMeta(key, meta); err != nil {
+		return err
+	}
+	if f.journal != nil {
+		return f.journal.append(journalOpSet, key)
+	}
+	return nil
+}
+
+// changed drops what is kept open of key, and emits an event of op to the watchers.
+func (f *Cache) changed(op EventOp, key string) {
+	f.handles.invalidate(key)
+	if op == EventEvict {
+		f.ghosts.add(key)
+	}
+	if op != EventSet {
+		if f.keyHashing {
+			f.hashedKeys.remove(f.filename(key))
+		}
+		f.tenantRemoved(key)
+	}
+	f.watchers.emit(op, key)
 }
 
 // Get implements Interface.Get().
 func (f *Cache) Get(key string, dst []byte) ([]byte, error) {
-	fp := f.filepath(key)
-	src, err := ioutil.ReadFile(fp)
-	if err != nil {
-		if os.IsNotExist(err) {
+	return f.getPrio(key, dst, PriorityForeground)
+}
+
+func (f *Cache) getPrio(key string, dst []byte, prio Priority) ([]byte, error) {
+	dst, err := f.getCached(key, dst, prio)
+	if err == ErrNotFound && f.backend != nil {
+		return f.fetch(key, dst, prio)
+	}
+	return dst, err
+}
+
+// getCached gets key at prio like Get(), without fetching it from the backend if missing.
+func (f *Cache) getCached(key string, dst []byte, prio Priority) ([]byte, error) {
+	if err := f.checkKey(key); err != nil {
+		return dst, err
+	}
+	done := f.sched.begin(prio)
+	start, n := time.Now(), len(dst)
+	err := ErrNotFound
+	if f.breaker.allow() {
+		dst, err = f.get(key, dst)
+		if err == ErrNotFound {
+			dst, err = f.getSeed(key, dst)
+		}
+		f.observeDisk(start, err)
+	}
+	done()
+	f.logAccess(AccessGet, key, int64(len(dst)-n), err == nil, start)
+	f.opDone(&f.stats.getLatency, AccessGet, key, int64(len(dst)-n), start, err)
+	f.readahead(key)
+	switch err {
+	case nil:
+		atomic.AddInt64(&f.stats.hits, 1)
+		f.policy.touch(key)
+		if f.heatmap != nil {
+			f.heatmap.hit(key)
+		}
+	case ErrNotFound:
+		atomic.AddInt64(&f.stats.misses, 1)
+		f.missed(key)
+	}
+	return dst, err
+}
+
+func (f *Cache) get(key string, dst []byte) ([]byte, error) {
+	if src, ok, err := f.packs.get(key, nil); ok {
+		if err != nil {
+			return dst, err
+		}
+		if f.expired(key) {
 			return dst, ErrNotFound
 		}
-		return dst, err
+		if src, err = f.decodeEntry(key, src); err != nil {
+			return dst, err
+		}
+		return append(dst, src...), nil
 	}
-	fi, err := os.Stat(fp)
+	if m, _, ok := f.statChunked(key); ok {
+		if f.expired(key) {
+			return dst, ErrNotFound
+		}
+		return f.getChunked(key, m, dst)
+	}
+	if !f.index.mayContain(key) {
+		return dst, ErrNotFound
+	}
+	fp := f.filepath(key)
+	var (
+		file StorageFile
+		fi   os.FileInfo
+		src  []byte
+	)
+	err := f.retry(func() (err error) {
+		if file, fi, err = f.openStored(fp); err != nil {
+			return err
+		}
+		if f.expired(key) {
+			file.Close()
+			return ErrNotFound
+		}
+		if src, err = f.readEntryFile(file, fi.Size()); err != nil {
+			file.Close()
+		}
+		return err
+	})
 	if err != nil {
 		return dst, err
 	}
-	if err := os.Chtimes(fp, time.Now(), fi.ModTime()); err != nil {
+	defer file.Close()
+	if osFile, ok := file.(*os.File); ok {
+		f.advise(osFile, fi.Size(), f.getAdvice)
+	}
+	if src, err = f.decodeEntry(key, src); err != nil {
+		if f.quarantine && errors.Is(err, ErrCorrupted) {
+			f.corrupted(key, err)
+		}
 		return dst, err
 	}
+	if !f.skipAtime {
+		// the value read stands even if deleted since
+		if err := f.chtimesStored(fp, time.Now(), fi.ModTime()); err != nil && !vanished(err) {
+			return dst, err
+		}
+	}
 	dst = append(dst, src...)
 	return dst, nil
 }
 
+// Delete implements Deleter.Delete().
+func (f *Cache) Delete(key string) error {
+	return f.deletePrio(key, PriorityForeground)
+}
+
+func (f *Cache) deletePrio(key string, prio Priority) (err error) {
+	defer f.sched.begin(prio)()
+	defer func(start time.Time) { f.opDone(&f.stats.deleteLatency, "delete", key, 0, start, err) }(time.Now())
+	if err := f.checkKey(key); err != nil {
+		return err
+	}
+	if !f.breaker.allow() {
+		return ErrDegraded
+	}
+	defer f.keyLocks.lock(key)()
+	start := time.Now()
+	err = f.delete(key, EventDelete)
+	f.observeDisk(start, err)
+	return err
+}
+
+// delete deletes key, emitting an event of op.
+func (f *Cache) delete(key string, op EventOp) error {
+	packed, err := f.packs.remove(key)
+	if err != nil {
+		return err
+	}
+	chunked, err := f.dropChunked(key)
+	if err != nil {
+		return err
+	}
+	err = f.retry(func() error {
+		if f.trashEnabled() {
+			return f.trash(key)
+		}
+		return f.removeStored(f.filepath(key))
+	})
+	if err != nil && !((packed || chunked) && os.IsNotExist(err)) {
+		if os.IsNotExist(err) {
+			// drop the meta left by an entry removed by others
+			return f.dropMeta(key)
+		}
+		return err
+	}
+	return f.deleted(key, op)
+}
+
+// deleted drops everything about key whose entry has been removed, emitting an event of op.
+func (f *Cache) deleted(key string, op EventOp) error {
+	f.index.remove(key)
+	f.policy.remove(key)
+	f.changed(op, key)
+	if err := f.dropMeta(key); err != nil {
+		return err
+	}
+	if f.journal != nil {
+		return f.journal.append(journalOpDelete, key)
+	}
+	return nil
+}
+
 // Has implements Interface.Has().
 func (f *Cache) Has(key string) bool {
-	_, err := os.Stat(f.filepath(key))
-	return err == nil
+	_, ok := f.setAt(key)
+	return ok
+}
+
+// HasFresh tells if key is in the cache like Has(), and was set within maxAge, so that stale values
+// can be fetched again without reading them first. Entries imported by Import() are as old as their
+// modification times there.
+func (f *Cache) HasFresh(key string, maxAge time.Duration) bool {
+	mtime, ok := f.setAt(key)
+	return ok && time.Since(mtime) <= maxAge
+}
+
+// setAt returns when key was set, false if it is not in the cache.
+func (f *Cache) setAt(key string) (time.Time, bool) {
+	if f.checkKey(key) != nil {
+		return time.Time{}, false
+	}
+	if loc, ok := f.packs.stat(key); ok {
+		mtime := time.Unix(0, loc.mtime)
+		if f.entryHeader {
+			_, err := f.get(key, nil)
+			return mtime, err == nil
+		}
+		return mtime, !f.expired(key)
+	}
+	if m, fi, ok := f.statChunked(key); ok {
+		return fi.ModTime(), !f.expired(key) && m.complete(f.chunkpath(key))
+	}
+	if !f.index.mayContain(key) {
+		return time.Time{}, false
+	}
+	fi, err := f.statStored(f.filepath(key))
+	if err != nil || !fi.Mode().IsRegular() || f.expired(key) || f.headerExpired(key) {
+		return time.Time{}, false
+	}
+	return fi.ModTime(), true
 }
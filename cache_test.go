@@ -2,11 +2,30 @@ package fscache
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
+	"net"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+	"unsafe"
 )
 
 func randBytes(n int) []byte {
@@ -23,25 +42,28 @@ func TestMain(m *testing.M) {
 	m.Run()
 }
 
-func newCache() (cache *Cache, cancel func()) {
+func newCache(opts ...Option) (cache *Cache, cancel func()) {
 	cacheDir, err := ioutil.TempDir("", "fscache")
 	if err != nil {
 		panic(err)
 	}
 	gcStopCh := make(chan struct{})
 
-	cacheI, err := New(
+	cacheI, err := New(append([]Option{
 		WithCacheDir(cacheDir),
-		WithMaxBytes(3*1024),
-		WithGcInterval(2*time.Second),
+		WithMaxBytes(3 * 1024),
+		WithGcInterval(2 * time.Second),
 		WithGcStopCh(gcStopCh),
-	)
+	}, opts...)...)
 	if err != nil {
 		panic(err)
 	}
 	cache = cacheI.(*Cache)
 	cancel = func() {
 		close(gcStopCh)
+		if err := cache.Close(); err != nil {
+			panic(err)
+		}
 		if err := os.RemoveAll(cacheDir); err != nil {
 			panic(err)
 		}
@@ -131,3 +153,4735 @@ func TestGc(t *testing.T) {
 		t.Errorf("expected Has() returning false for key3")
 	}
 }
+
+func TestSnapshot(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+
+	val := randBytes(1024)
+	if err := cache.Set("key", val); err != nil {
+		panic(err)
+	}
+	if err := cache.SetWithTTL("ttl", val, 50*time.Millisecond); err != nil {
+		panic(err)
+	}
+
+	snapDir, err := ioutil.TempDir("", "fscache-snapshot")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(snapDir)
+
+	if err := cache.Snapshot(snapDir); err != nil {
+		t.Fatalf("snapshot: %s", err)
+	}
+
+	if err := cache.Set("key", randBytes(1024)); err != nil {
+		panic(err)
+	}
+
+	snap, err := New(WithCacheDir(snapDir), WithMaxBytes(0))
+	if err != nil {
+		panic(err)
+	}
+	valFromSnap, err := snap.Get("key", nil)
+	if err != nil {
+		t.Fatalf("get from snapshot: %s", err)
+	}
+	if !bytes.Equal(val, valFromSnap) {
+		t.Errorf("valFromSnap not equals to val set before snapshot")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := snap.Get("ttl", nil); err != ErrNotFound {
+		t.Errorf("expected the expired entry not restored, got %v", err)
+	}
+
+	if err := cache.Snapshot(snapDir); err != ErrSnapshotDirNotEmpty {
+		t.Errorf("expected snapshot dir not empty error, got %v", err)
+	}
+	if err := cache.Snapshot(filepath.Join(snapDir, "missing")); err != nil {
+		t.Errorf("expected snapshot into a missing dir, got %v", err)
+	}
+
+	// restored with TTLs, hashed keys and chunked values
+	opts := []Option{WithKeyHashing(), WithChunkedStorage(2000, 1000, 0)}
+	rich, cancel2 := newCache(opts...)
+	defer cancel2()
+	big := randBytes(3500)
+	if err := rich.SetWithTTL("ttl", val, 50*time.Millisecond); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if err := rich.Set("a/hashed", val); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if err := rich.Set("big", big); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	richDir := filepath.Join(snapDir, "rich")
+	if err := rich.Snapshot(richDir); err != nil {
+		t.Fatalf("snapshot: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	ri, err := New(append([]Option{WithCacheDir(richDir)}, opts...)...)
+	if err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	restored := ri.(*Cache)
+	defer restored.Close()
+	if _, err := restored.Get("ttl", nil); err != ErrNotFound {
+		t.Errorf("expected the expired entry not restored, got %v", err)
+	}
+	if got, err := restored.Get("big", nil); err != nil || !bytes.Equal(got, big) {
+		t.Errorf("expected the chunked value restored, err %v", err)
+	}
+	old := time.Now().Add(-2 * orphanAge)
+	if err := os.Chtimes(restored.filepath("a/hashed"), old, old); err != nil {
+		t.Fatalf("chtimes: %s", err)
+	}
+	restored.gc()
+	if got, err := restored.Get("a/hashed", nil); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected the hashed key restored, err %v", err)
+	}
+}
+
+func TestSeedDir(t *testing.T) {
+	seedDir, err := ioutil.TempDir("", "fscache-seed")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(seedDir)
+	val := randBytes(1024)
+	if err := ioutil.WriteFile(filepath.Join(seedDir, "key"), val, 0644); err != nil {
+		panic(err)
+	}
+
+	cache, cancel := newCache()
+	defer cancel()
+	WithSeedDir(seedDir)(cache)
+
+	valFromCache, err := cache.Get("key", nil)
+	if err != nil {
+		t.Fatalf("get from seed: %s", err)
+	}
+	if !bytes.Equal(val, valFromCache) {
+		t.Errorf("valFromCache not equals to val")
+	}
+	if !cache.Has("key") {
+		t.Errorf("expected seed hit copied into the cache")
+	}
+	if _, err := cache.Get("notFound", nil); err != ErrNotFound {
+		t.Errorf("expected not found error")
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.SeedHits != 1 || stats.Misses != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestDumpHeatmap(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	WithHeatmap(time.Minute)(cache)
+
+	for _, key := range []string{"cold", "hot"} {
+		if err := cache.Set(key, randBytes(16)); err != nil {
+			panic(err)
+		}
+	}
+	for _, key := range []string{"hot", "hot", "cold"} {
+		if _, err := cache.Get(key, nil); err != nil {
+			panic(err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := cache.DumpHeatmap(buf, HeatmapCSV); err != nil {
+		t.Fatalf("dump heatmap: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "hot,2,") || !strings.HasPrefix(lines[2], "cold,1,") {
+		t.Errorf("unexpected heatmap:\n%s", buf)
+	}
+
+	if err := cache.heatmap.save(cache.heatmapPath()); err != nil {
+		panic(err)
+	}
+	loaded := newHeatmap(time.Minute, maxHeatmapKeys)
+	if err := loaded.load(cache.heatmapPath()); err != nil {
+		t.Fatalf("load heatmap: %s", err)
+	}
+	if len(loaded.m) != 2 || loaded.m["hot"].Value.(*heat).hits != 2 {
+		t.Errorf("unexpected loaded heatmap %v", loaded.entries())
+	}
+
+	// the least recently hit keys are dropped over the max, also when loaded
+	capped := newHeatmap(time.Minute, 2)
+	for _, key := range []string{"a", "b", "a", "c"} {
+		capped.hit(key)
+	}
+	if len(capped.m) != 2 || capped.m["b"] != nil {
+		t.Errorf("expected b dropped, got %v", capped.entries())
+	}
+	if err := capped.save(cache.heatmapPath()); err != nil {
+		panic(err)
+	}
+	reloaded := newHeatmap(time.Minute, 1)
+	if err := reloaded.load(cache.heatmapPath()); err != nil {
+		t.Fatalf("load heatmap: %s", err)
+	}
+	if len(reloaded.m) != 1 || reloaded.m["c"] == nil {
+		t.Errorf("expected c kept, got %v", reloaded.entries())
+	}
+}
+
+func TestAdaptiveGc(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "fscache")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	gcStopCh := make(chan struct{})
+	defer close(gcStopCh)
+
+	cacheI, err := New(
+		WithCacheDir(cacheDir),
+		WithMaxBytes(1024),
+		WithGcInterval(time.Hour),
+		WithGcStopCh(gcStopCh),
+		WithAdaptiveGC(2*1024, 100*time.Millisecond, time.Hour),
+	)
+	if err != nil {
+		panic(err)
+	}
+	cache := cacheI.(*Cache)
+
+	if err := cache.Set("key1", randBytes(1024)); err != nil {
+		panic(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if !cache.Has("key1") {
+		t.Errorf("expected no gc before writing the threshold")
+	}
+
+	if err := cache.Set("key2", randBytes(1024)); err != nil {
+		panic(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if cache.Has("key1") && cache.Has("key2") {
+		t.Errorf("expected gc after writing the threshold")
+	}
+}
+
+func TestInotify(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "fscache")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	gcStopCh := make(chan struct{})
+	defer close(gcStopCh)
+
+	cacheI, err := New(
+		WithCacheDir(cacheDir),
+		WithMaxBytes(3*1024),
+		WithGcInterval(time.Hour),
+		WithGcStopCh(gcStopCh),
+		WithInotify(),
+	)
+	if err != nil {
+		panic(err)
+	}
+	cache := cacheI.(*Cache)
+	cache.gc()
+
+	if err := cache.Set("key1", randBytes(1024)); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(cache.filepath("external"), randBytes(1024), 0644); err != nil {
+		panic(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	if usage, ok := cache.index.usage(); !ok || usage != 2*1024 {
+		t.Errorf("expected usage 2048 accounted, got %d, %v", usage, ok)
+	}
+
+	if err := os.Remove(cache.filepath("external")); err != nil {
+		panic(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	if usage, ok := cache.index.usage(); !ok || usage != 1024 {
+		t.Errorf("expected usage 1024 accounted, got %d, %v", usage, ok)
+	}
+}
+
+func TestIllegalEntry(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	WithQuarantine()(cache)
+	if err := os.MkdirAll(cache.quarantinedir(), 0775); err != nil {
+		panic(err)
+	}
+
+	target := filepath.Join(cache.cacheDir, "secret")
+	if err := ioutil.WriteFile(target, randBytes(16), 0644); err != nil {
+		panic(err)
+	}
+	if err := os.Symlink(target, cache.filepath("symlink")); err != nil {
+		panic(err)
+	}
+	if err := os.Mkdir(cache.filepath("dir"), 0775); err != nil {
+		panic(err)
+	}
+
+	if cache.Has("symlink") {
+		t.Errorf("expected Has() returning false for symlink")
+	}
+	if _, err := cache.Get("symlink", nil); err != ErrIllegalEntry {
+		t.Errorf("expected illegal entry error for symlink, got %v", err)
+	}
+
+	cache.gc()
+
+	if _, err := os.Lstat(cache.filepath("dir")); !os.IsNotExist(err) {
+		t.Errorf("expected dir quarantined")
+	}
+	fis, err := ioutil.ReadDir(cache.quarantinedir())
+	if err != nil {
+		panic(err)
+	}
+	if len(fis) != 2 {
+		t.Errorf("expected 2 quarantined entries, got %d", len(fis))
+	}
+	if _, err := os.Stat(target); err != nil {
+		t.Errorf("expected symlink target untouched")
+	}
+}
+
+func TestTmpDirCrossDevice(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "fscache")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := New(WithCacheDir(cacheDir), WithTmpDir(filepath.Join(cacheDir, "mytmp")), WithMaxBytes(0))
+	if err != nil {
+		t.Fatalf("expected tmp dir on the same device accepted, got %s", err)
+	}
+	cache.(*Cache).Close()
+
+	tmpDir, err := ioutil.TempDir("/dev/shm", "fscache")
+	if err != nil {
+		t.Skipf("no /dev/shm: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := sameDevice(cacheDir, tmpDir); err == nil {
+		t.Skipf("%s and %s on the same device", cacheDir, tmpDir)
+	}
+	// files set are renamed through the xdev dir
+	ci, err := New(WithCacheDir(cacheDir), WithTmpDir(tmpDir), WithMaxBytes(0))
+	if err != nil {
+		t.Fatalf("expected tmp dir on another device accepted, got %s", err)
+	}
+	xc := ci.(*Cache)
+	defer xc.Close()
+	val := randBytes(1024)
+	if err := xc.Set("key", val); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if err := xc.SetReader("key2", bytes.NewReader(val), int64(len(val))); err != nil {
+		t.Fatalf("set reader: %s", err)
+	}
+	if got, err := xc.Get("key", nil); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected value got, got %v", err)
+	}
+	if got, err := xc.Take("key2"); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected value taken, got %v", err)
+	}
+	for _, dir := range []string{tmpDir, xc.xdevdir()} {
+		if fis, err := ioutil.ReadDir(dir); err != nil || len(fis) > 0 {
+			t.Errorf("expected nothing left in %s, got %d, %v", dir, len(fis), err)
+		}
+	}
+}
+
+func TestRenameCrossDevice(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	// renames out of the tmp dir fail as if it were on another device
+	defer func(orig func(string, string) error) { rename = orig }(rename)
+	rename = func(oldpath, newpath string) error {
+		if filepath.Dir(oldpath) == cache.tmpdir() {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+
+	val := randBytes(1024)
+	if err := cache.Set("key", val); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("expected EXDEV without the xdev dir, got %v", err)
+	}
+	cache.crossDevice = true
+	if err := os.MkdirAll(cache.xdevdir(), 0775); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := cache.Set("key", val); err != nil {
+		t.Fatalf("expected set through the xdev dir, got %s", err)
+	}
+	if got, err := cache.Get("key", nil); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected value got, got %v", err)
+	}
+	if fi, err := os.Stat(cache.filepath("key")); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("expected the mode of the file kept, got %v", err)
+	}
+	for _, dir := range []string{cache.tmpdir(), cache.xdevdir()} {
+		if fis, err := ioutil.ReadDir(dir); err != nil || len(fis) > 0 {
+			t.Errorf("expected nothing left in %s, got %d, %v", dir, len(fis), err)
+		}
+	}
+}
+
+func TestDegradedMode(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	hookCh := make(chan error, 2)
+	WithDegradedMode(2, 100*time.Millisecond)(cache)
+	WithHealthHook(func(err error) { hookCh <- err })(cache)
+
+	enospc := &os.PathError{Op: "write", Path: "key", Err: syscall.ENOSPC}
+	cache.health.observeWrite(enospc)
+	if cache.Stats().Degraded {
+		t.Errorf("expected not degraded after 1 failure")
+	}
+	cache.health.observeWrite(enospc)
+	if !cache.Stats().Degraded {
+		t.Fatalf("expected degraded after 2 failures")
+	}
+	if err := <-hookCh; err != enospc {
+		t.Errorf("expected hook called with %v, got %v", enospc, err)
+	}
+
+	if err := cache.Set("key", randBytes(16)); err != ErrDegraded {
+		t.Errorf("expected degraded error, got %v", err)
+	}
+	if _, err := cache.Get("key", nil); err != ErrNotFound {
+		t.Errorf("expected Get() served while degraded, got %v", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if err := cache.Set("key", randBytes(16)); err != nil {
+		t.Errorf("expected probing Set() succeeding, got %v", err)
+	}
+	if cache.Stats().Degraded {
+		t.Errorf("expected recovered after a successful write")
+	}
+	if err := <-hookCh; err != nil {
+		t.Errorf("expected hook called with nil, got %v", err)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+
+	if err := cache.Healthy(context.Background()); err != nil {
+		t.Errorf("expected healthy, got %s", err)
+	}
+	if fis, _ := ioutil.ReadDir(cache.filedir()); len(fis) != 0 {
+		t.Errorf("expected probe removed")
+	}
+
+	WithMinFreeBytes(math.MaxInt64)(cache)
+	if err := cache.Healthy(context.Background()); err == nil {
+		t.Errorf("expected unhealthy for lacking free space")
+	}
+}
+
+func TestDeleteUndelete(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	WithTrash(200 * time.Millisecond)(cache)
+	if err := os.MkdirAll(cache.trashdir(), 0775); err != nil {
+		panic(err)
+	}
+
+	val := randBytes(1024)
+	if err := cache.Set("key", val); err != nil {
+		panic(err)
+	}
+	if err := cache.Delete("key"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if cache.Has("key") {
+		t.Errorf("expected Has() returning false after Delete()")
+	}
+	if err := cache.Delete("notFound"); err != nil {
+		t.Errorf("expected deleting a key not set succeeding, got %s", err)
+	}
+
+	if err := cache.Undelete("key"); err != nil {
+		t.Fatalf("undelete: %s", err)
+	}
+	valFromCache, err := cache.Get("key", nil)
+	if err != nil {
+		t.Fatalf("get after undelete: %s", err)
+	}
+	if !bytes.Equal(val, valFromCache) {
+		t.Errorf("valFromCache not equals to val")
+	}
+
+	if err := cache.Delete("key"); err != nil {
+		panic(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	cache.emptyTrash()
+	if err := cache.Undelete("key"); err != ErrNotFound {
+		t.Errorf("expected not found error after the retention, got %v", err)
+	}
+
+	// hashed keys are restored with their metadata, so that GC does not take them as orphans
+	hashed, cancel2 := newCache(WithKeyHashing(), WithTrash(time.Hour))
+	defer cancel2()
+	if err := hashed.SetWithTTL("a/key", val, time.Hour); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if err := hashed.Delete("a/key"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if err := hashed.Undelete("a/key"); err != nil {
+		t.Fatalf("undelete: %s", err)
+	}
+	if m, err := hashed.readMeta("a/key"); err != nil || m.Key != "a/key" || m.ExpireAt == 0 {
+		t.Errorf("expected the meta restored, got %+v, err %v", m, err)
+	}
+	old := time.Now().Add(-2 * orphanAge)
+	if err := os.Chtimes(hashed.filepath("a/key"), old, old); err != nil {
+		t.Fatalf("chtimes: %s", err)
+	}
+	hashed.hashedKeys = &hashedKeys{m: map[string]string{}}
+	hashed.gc()
+	if keys, err := hashed.Keys(); err != nil || len(keys) != 1 || keys[0] != "a/key" || !hashed.Has("a/key") {
+		t.Errorf("expected the undeleted key kept, got %q, err %v", keys, err)
+	}
+}
+
+func TestGreedyDualSize(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	WithGreedyDualSize()(cache)
+
+	if err := cache.SetWithCost("expensive", randBytes(2*1024), 1000); err != nil {
+		panic(err)
+	}
+	if err := cache.SetWithCost("cheap", randBytes(1024), 1); err != nil {
+		panic(err)
+	}
+	if err := cache.Set("default", randBytes(1024)); err != nil {
+		panic(err)
+	}
+	// LRU would evict expensive
+	if _, err := cache.Get("cheap", nil); err != nil {
+		panic(err)
+	}
+
+	cache.gc()
+
+	if !cache.Has("expensive") {
+		t.Errorf("expected Has() returning true for expensive")
+	}
+	if cache.Has("cheap") && cache.Has("default") {
+		t.Errorf("expected one of the cheap entries evicted")
+	}
+
+	// costs survive restarts
+	restarted := &Cache{cacheDir: cache.cacheDir, metaUsed: 1, logger: cache.logger}
+	if cost := restarted.entryCost("expensive"); cost != 1000 {
+		t.Errorf("expected cost 1000 read from meta, got %f", cost)
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+
+	for _, key := range []string{"img1-thumb1", "img1-thumb2", "img2-thumb1"} {
+		if err := cache.Set(key, randBytes(16)); err != nil {
+			panic(err)
+		}
+	}
+	n, err := cache.DeletePrefix("img1-")
+	if err != nil {
+		t.Fatalf("delete prefix: %s", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 keys deleted, got %d", n)
+	}
+	if cache.Has("img1-thumb1") || cache.Has("img1-thumb2") || !cache.Has("img2-thumb1") {
+		t.Errorf("expected only keys with prefix img1- deleted")
+	}
+}
+
+func TestInvalidateTag(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+
+	if err := cache.SetWithTags("user1-avatar", randBytes(16), "user1", "avatar"); err != nil {
+		panic(err)
+	}
+	if err := cache.SetWithTags("user1-profile", randBytes(16), "user1"); err != nil {
+		panic(err)
+	}
+	if err := cache.SetWithTags("user2-avatar", randBytes(16), "user2", "avatar"); err != nil {
+		panic(err)
+	}
+	// retagging drops the key from its previous tags
+	if err := cache.SetWithTags("user1-profile", randBytes(16), "profile"); err != nil {
+		panic(err)
+	}
+
+	n, err := cache.InvalidateTag("user1")
+	if err != nil {
+		t.Fatalf("invalidate tag: %s", err)
+	}
+	if n != 1 || cache.Has("user1-avatar") || !cache.Has("user1-profile") {
+		t.Errorf("expected only user1-avatar invalidated, got %d invalidated", n)
+	}
+
+	n, err = cache.InvalidateTag("avatar")
+	if err != nil {
+		t.Fatalf("invalidate tag: %s", err)
+	}
+	if n != 1 || cache.Has("user2-avatar") {
+		t.Errorf("expected user2-avatar invalidated, got %d invalidated", n)
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	WithTTLJitter(0.5)(cache)
+
+	expireAts := map[int64]bool{}
+	for i := 0; i < 10; i++ {
+		if err := cache.SetWithTTL("key", randBytes(16), time.Hour); err != nil {
+			panic(err)
+		}
+		m, err := cache.readMeta("key")
+		if err != nil {
+			panic(err)
+		}
+		ttl := time.Until(time.Unix(0, m.ExpireAt))
+		if ttl < 29*time.Minute || ttl > 91*time.Minute {
+			t.Errorf("expected ttl within 1h±30m, got %s", ttl)
+		}
+		expireAts[m.ExpireAt] = true
+	}
+	if len(expireAts) < 2 {
+		t.Errorf("expected jittered ttls")
+	}
+
+	if err := cache.SetWithTTL("key", randBytes(16), 100*time.Millisecond); err != nil {
+		panic(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if cache.Has("key") {
+		t.Errorf("expected Has() returning false after expired")
+	}
+	if _, err := cache.Get("key", nil); err != ErrNotFound {
+		t.Errorf("expected not found error after expired, got %v", err)
+	}
+
+	// a value set over an expired one is not deleted before its meta is written
+	if err := cache.SetWithTTL("key", randBytes(16), time.Millisecond); err != nil {
+		panic(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	unlock, err := cache.LockKey("key")
+	if err != nil {
+		t.Fatalf("lock key: %s", err)
+	}
+	if err := ioutil.WriteFile(cache.filepath("key"), randBytes(16), 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if _, err := cache.Get("key", nil); err != ErrNotFound {
+		t.Errorf("expected not found error while set, got %v", err)
+	}
+	if err := cache.replaceMeta("key", entryMeta{}); err != nil {
+		t.Fatalf("replace meta: %s", err)
+	}
+	unlock()
+	if _, err := cache.Get("key", nil); err != nil {
+		t.Errorf("expected the value set kept, got %v", err)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+
+	if err := cache.SetWithTTL("expiring", randBytes(16), 100*time.Millisecond); err != nil {
+		panic(err)
+	}
+	if err := cache.SetWithTTL("lasting", randBytes(16), time.Hour); err != nil {
+		panic(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	cache.sweep()
+
+	if _, err := os.Lstat(cache.filepath("expiring")); !os.IsNotExist(err) {
+		t.Errorf("expected expiring swept")
+	}
+	if _, err := os.Lstat(cache.metapath("expiring")); !os.IsNotExist(err) {
+		t.Errorf("expected meta of expiring swept")
+	}
+	if !cache.Has("lasting") {
+		t.Errorf("expected Has() returning true for lasting")
+	}
+
+	// sweeps disabled
+	_, cancelUnswept := newCache(WithSweepInterval(0))
+	cancelUnswept()
+}
+
+func TestParallelGc(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	WithGcWorkers(4)(cache)
+
+	for i := 0; i < 100; i++ {
+		if err := cache.Set(strconv.Itoa(i), randBytes(128)); err != nil {
+			panic(err)
+		}
+	}
+	cache.gc()
+
+	entries, err := cache.scan()
+	if err != nil {
+		panic(err)
+	}
+	var usage int64
+	for _, fi := range entries {
+		usage += fi.Size()
+	}
+	if usage > cache.maxBytes || usage < cache.maxBytes-128 {
+		t.Errorf("expected usage just under %d bytes after gc, got %d", cache.maxBytes, usage)
+	}
+}
+
+func TestStatEntry(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	if err := cache.Set("key", randBytes(1024)); err != nil {
+		panic(err)
+	}
+	expected, err := os.Lstat(cache.filepath("key"))
+	if err != nil {
+		panic(err)
+	}
+	dir, err := os.Open(cache.filedir())
+	if err != nil {
+		panic(err)
+	}
+	defer dir.Close()
+
+	defer atomic.StoreInt32(&noStatx, 0)
+	for _, statx := range []int32{0, 1} {
+		atomic.StoreInt32(&noStatx, statx)
+		fi, err := statEntry(int(dir.Fd()), "key")
+		if err != nil {
+			t.Fatalf("stat entry: %s", err)
+		}
+		if fi.Size() != expected.Size() || fi.Mode() != expected.Mode() || !fi.ModTime().Equal(expected.ModTime()) {
+			t.Errorf("expected %s %d %s, got %s %d %s", expected.Mode(), expected.Size(), expected.ModTime(),
+				fi.Mode(), fi.Size(), fi.ModTime())
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	var reports []Progress
+	WithProgress(0, func(p Progress) { reports = append(reports, p) })(cache)
+
+	for i := 0; i < 3; i++ {
+		if err := cache.Set(strconv.Itoa(i), randBytes(16)); err != nil {
+			panic(err)
+		}
+	}
+	if _, err := cache.scan(); err != nil {
+		panic(err)
+	}
+
+	if len(reports) == 0 {
+		t.Fatalf("expected progress reported")
+	}
+	last := reports[len(reports)-1]
+	if !last.Done || last.Op != "scan" || last.Files != 3 || last.TotalFiles != 3 || last.Bytes != 3*16 {
+		t.Errorf("unexpected last progress %+v", last)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "fscache")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	if err := os.MkdirAll(filepath.Join(cacheDir, "cache"), 0775); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cacheDir, "cache", "existing"), randBytes(16), 0644); err != nil {
+		panic(err)
+	}
+
+	cacheI, err := New(WithCacheDir(cacheDir), WithMaxBytes(0), WithBloomFilter(1000))
+	if err != nil {
+		panic(err)
+	}
+	cache := cacheI.(*Cache)
+	if err := cache.Set("key", randBytes(16)); err != nil {
+		panic(err)
+	}
+
+	if !cache.Has("existing") || !cache.Has("key") {
+		t.Errorf("expected Has() returning true for keys in the bloom filter")
+	}
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if cache.index.mayContain("notFound" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("expected about 1%% false positives, got %d in 1000", falsePositives)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "fscache")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	gcStopCh := make(chan struct{})
+	defer close(gcStopCh)
+
+	a, err := Open("TestOpen-a", WithCacheDir(cacheDir), WithGcStopCh(gcStopCh))
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	if again, _ := Open("TestOpen-a"); again != a {
+		t.Errorf("expected the same cache opening the same name")
+	}
+	if b, _ := Open("TestOpen-b", WithCacheDir(cacheDir+"/")); b != a {
+		t.Errorf("expected the same cache opening the same cache dir")
+	}
+}
+
+func TestLock(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+
+	if _, err := New(WithCacheDir(cache.cacheDir)); err != ErrLocked {
+		t.Errorf("expected locked error, got %v", err)
+	}
+	if _, err := New(WithCacheDir(cache.cacheDir), WithSharedMode()); err != ErrLocked {
+		t.Errorf("expected locked error in shared mode, got %v", err)
+	}
+
+	cacheDir, err := ioutil.TempDir("", "fscache")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	shared1, err := New(WithCacheDir(cacheDir), WithSharedMode(), WithMaxBytes(0))
+	if err != nil {
+		t.Fatalf("new in shared mode: %s", err)
+	}
+	shared2, err := New(WithCacheDir(cacheDir), WithSharedMode(), WithMaxBytes(0))
+	if err != nil {
+		t.Fatalf("new another in shared mode: %s", err)
+	}
+	if !shared1.(*Cache).lockGc() {
+		t.Errorf("expected the first cache running gc")
+	}
+	if shared2.(*Cache).lockGc() {
+		t.Errorf("expected only one cache running gc")
+	}
+	shared1.(*Cache).unlockGc()
+	shared1.(*Cache).Close()
+	shared2.(*Cache).Close()
+
+	exclusive, err := New(WithCacheDir(cacheDir), WithMaxBytes(0))
+	if err != nil {
+		t.Fatalf("expected cache dir released by Close(), got %s", err)
+	}
+	exclusive.(*Cache).Close()
+}
+
+func TestResumableUpload(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	val := randBytes(2048)
+
+	upload, err := cache.BeginSet("key")
+	if err != nil {
+		t.Fatalf("begin set: %s", err)
+	}
+	if err := upload.WriteChunk(0, val[:1024]); err != nil {
+		t.Fatalf("write chunk: %s", err)
+	}
+	// interrupted
+	upload.file.Close()
+
+	upload, err = cache.BeginSet("key")
+	if err != nil {
+		t.Fatalf("resume set: %s", err)
+	}
+	if upload.Offset() != 1024 {
+		t.Fatalf("expected resuming at 1024, got %d", upload.Offset())
+	}
+	if err := upload.WriteChunk(0, val[:1024]); !errors.Is(err, ErrUploadOffset) {
+		t.Errorf("expected upload offset error, got %v", err)
+	}
+	if err := upload.WriteChunk(1024, val[1024:]); err != nil {
+		t.Fatalf("write chunk: %s", err)
+	}
+	if cache.Has("key") {
+		t.Errorf("expected Has() returning false before commit")
+	}
+	if err := upload.Commit(); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+
+	valFromCache, err := cache.Get("key", nil)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if !bytes.Equal(val, valFromCache) {
+		t.Errorf("valFromCache not equals to val")
+	}
+}
+
+func TestParallelFetch(t *testing.T) {
+	origin, cancelOrigin := newCache()
+	defer cancelOrigin()
+	srv := httptest.NewServer(NewHandler(origin))
+	defer srv.Close()
+
+	val := randBytes(2500)
+	if err := origin.Set("big", val); err != nil {
+		t.Fatalf("set origin: %s", err)
+	}
+
+	cache, cancel := newCache()
+	defer cancel()
+	WithBackend(NewHTTPBackend(srv.URL, nil))(cache)
+	WithParallelFetch(1000, 2)(cache)
+
+	valFromCache, err := cache.Get("big", nil)
+	if err != nil {
+		t.Fatalf("get through backend: %s", err)
+	}
+	if !bytes.Equal(val, valFromCache) {
+		t.Errorf("valFromCache not equals to val")
+	}
+	if valFromCache, err = ioutil.ReadFile(cache.filepath("big")); err != nil || !bytes.Equal(val, valFromCache) {
+		t.Errorf("expected fetched value set to the cache, err %v", err)
+	}
+	if _, err := cache.Get("notFound", nil); err != ErrNotFound {
+		t.Errorf("expected not found error, got %v", err)
+	}
+	if _, err := cache.Get("big", nil); err != nil {
+		t.Errorf("get fetched: %s", err)
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Fetches != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// fetches of a key not deduplicated write tmp files of their own
+	errs := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := cache.fetchParallel(NewHTTPBackend(srv.URL, nil), "big", int64(len(val)), nil)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("fetch in parallel: %s", err)
+		}
+	}
+
+	// values stored encoded are fetched as a whole and set encoded
+	invert := func(key string, val []byte) ([]byte, error) {
+		out := make([]byte, len(val))
+		for i, b := range val {
+			out[i] = ^b
+		}
+		return out, nil
+	}
+	encoded, cancelEncoded := newCache(WithEntryHeader(), WithTransforms(NewTransform(invert, invert)))
+	defer cancelEncoded()
+	WithBackend(NewHTTPBackend(srv.URL, nil))(encoded)
+	WithParallelFetch(1000, 2)(encoded)
+	for i := 0; i < 2; i++ {
+		if got, err := encoded.Get("big", nil); err != nil || !bytes.Equal(got, val) {
+			t.Errorf("expected the value fetched with an entry header, got %v", err)
+		}
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	WithLoadShedding(10)(cache)
+	pressureFile := filepath.Join(cache.cacheDir, "io.pressure")
+	cache.shedder.files = []string{pressureFile}
+
+	setPressure := func(avg10 string) {
+		psi := "some avg10=" + avg10 + " avg60=0.00 avg300=0.00 total=0\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=0\n"
+		if err := ioutil.WriteFile(pressureFile, []byte(psi), 0644); err != nil {
+			panic(err)
+		}
+		atomic.StoreInt64(&cache.shedder.checkedAt, 0)
+	}
+
+	setPressure("42.00")
+	if err := cache.Set("shed", randBytes(10)); err != ErrShed {
+		t.Fatalf("expected set under pressure shed, got %v", err)
+	}
+	if cache.Has("shed") {
+		t.Errorf("expected set skipped under pressure")
+	}
+	// fills are returned without being set
+	val, err := cache.GetOrSet("loaded", nil, func(string) ([]byte, error) { return []byte("val"), nil })
+	if err != nil || string(val) != "val" || cache.Has("loaded") {
+		t.Errorf("expected the value loaded and not set under pressure, got %q, %v", val, err)
+	}
+	setPressure("1.00")
+	if err := cache.Set("filled", randBytes(10)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if !cache.Has("filled") {
+		t.Errorf("expected set filled without pressure")
+	}
+	if stats := cache.Stats(); stats.Shed != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSetGetDir(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+
+	srcDir := filepath.Join(cache.cacheDir, "src")
+	files := map[string][]byte{
+		"a":          randBytes(100),
+		"sub/b":      randBytes(200),
+		"sub/deep/c": randBytes(0),
+	}
+	for name, val := range files {
+		fp := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(fp), 0775); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(fp, val, 0644); err != nil {
+			panic(err)
+		}
+	}
+	if err := os.Symlink("sub/b", filepath.Join(srcDir, "link")); err != nil {
+		panic(err)
+	}
+
+	if err := cache.SetDir("tree", srcDir); err != nil {
+		t.Fatalf("set dir: %s", err)
+	}
+	dstDir := filepath.Join(cache.cacheDir, "dst", "tree")
+	if err := cache.GetDir("tree", dstDir); err != nil {
+		t.Fatalf("get dir: %s", err)
+	}
+	for name, val := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dstDir, name))
+		if err != nil || !bytes.Equal(got, val) {
+			t.Errorf("%s not unpacked, err %v", name, err)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(dstDir, "link")); err != nil || link != "sub/b" {
+		t.Errorf("symlink not unpacked, link %q err %v", link, err)
+	}
+	if err := cache.GetDir("tree", dstDir); err == nil {
+		t.Errorf("expected error getting dir to an existing dir")
+	}
+	if err := cache.GetDir("notFound", filepath.Join(cache.cacheDir, "dst", "notFound")); err != ErrNotFound {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestPackfiles(t *testing.T) {
+	cache, cancel := newCache(WithPackfiles(100, 300))
+	defer cancel()
+	cache.packs.sealBytes = 200
+
+	small, big := randBytes(50), randBytes(500)
+	for key, val := range map[string][]byte{"small": small, "big": big} {
+		if err := cache.Set(key, val); err != nil {
+			t.Fatalf("set %s: %s", key, err)
+		}
+	}
+	if !cache.packs.has("small") || cache.packs.has("big") {
+		t.Errorf("expected only small values packed")
+	}
+	if _, err := os.Stat(cache.filepath("small")); !os.IsNotExist(err) {
+		t.Errorf("expected no file for packed value, err %v", err)
+	}
+	for key, val := range map[string][]byte{"small": small, "big": big} {
+		if got, err := cache.Get(key, nil); err != nil || !bytes.Equal(got, val) {
+			t.Errorf("get %s, err %v", key, err)
+		}
+	}
+
+	// replacing a packed value with a big one and the other way around
+	if err := cache.Set("small", big); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if cache.packs.has("small") || !cache.Has("small") {
+		t.Errorf("expected big value moved out of packs")
+	}
+	if err := cache.Set("small", small); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if _, err := os.Stat(cache.filepath("small")); !os.IsNotExist(err) || !cache.packs.has("small") {
+		t.Errorf("expected small value moved into packs, err %v", err)
+	}
+
+	if err := cache.Delete("small"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if cache.Has("small") {
+		t.Errorf("expected packed value deleted")
+	}
+
+	// evicting beyond maxBytes and compacting sealed packs
+	for i := 0; i < 10; i++ {
+		if err := cache.Set("k"+strconv.Itoa(i), randBytes(50)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	cache.gc()
+	if cache.packs.bytes > 300 {
+		t.Errorf("expected packed values no more than 300 bytes, got %d", cache.packs.bytes)
+	}
+	if cache.Has("k0") || !cache.Has("k9") {
+		t.Errorf("expected least recently set packed values evicted")
+	}
+	names, _ := readDirNames(cache.packdir())
+	if len(names) > 4 {
+		t.Errorf("expected packs compacted, got %v", names)
+	}
+
+	// reloading packs
+	time.Sleep(10 * time.Millisecond)
+	if _, err := cache.Get("k9", nil); err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	accessed, _ := cache.packs.stat("k9")
+	if err := cache.packs.close(); err != nil {
+		t.Fatalf("close packs: %s", err)
+	}
+	if err := cache.packs.open(cache.packdir()); err != nil {
+		t.Fatalf("reopen packs: %s", err)
+	}
+	if cache.Has("small") || cache.Has("k0") || !cache.Has("k9") {
+		t.Errorf("expected packs reloaded with deletes and evictions")
+	}
+	if loc, _ := cache.packs.stat("k9"); loc.atime != accessed.atime {
+		t.Errorf("expected atime %d of packed value restored, got %d", accessed.atime, loc.atime)
+	}
+}
+
+func TestLogEngine(t *testing.T) {
+	cache, cancel := newCache(WithEngine(EngineLog))
+	defer cancel()
+	cache.packs.sealBytes = 1024
+
+	vals := map[string][]byte{}
+	for i := 0; i < 8; i++ {
+		key := "k" + strconv.Itoa(i)
+		vals[key] = randBytes(300)
+		if err := cache.Set(key, vals[key]); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	if err := cache.Delete("k0"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	delete(vals, "k0")
+	if names, _ := readDirNames(cache.filedir()); len(names) != 0 {
+		t.Errorf("expected no files of values, got %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(cache.packdir(), hintName(0))); err != nil {
+		t.Errorf("expected hints of the sealed log: %s", err)
+	}
+
+	if err := cache.packs.close(); err != nil {
+		t.Fatalf("close logs: %s", err)
+	}
+	if err := cache.packs.open(cache.packdir()); err != nil {
+		t.Fatalf("reopen logs: %s", err)
+	}
+	if cache.Has("k0") {
+		t.Errorf("expected deleted value not loaded")
+	}
+	for key, val := range vals {
+		if got, err := cache.Get(key, nil); err != nil || !bytes.Equal(got, val) {
+			t.Errorf("get %s after reopen, err %v", key, err)
+		}
+	}
+
+	cache.gc()
+	if cache.packs.bytes > 3*1024 {
+		t.Errorf("expected values no more than max bytes, got %d", cache.packs.bytes)
+	}
+}
+
+func TestHybridEngine(t *testing.T) {
+	cache, cancel := newCache(WithEngine(EngineHybrid), WithHybridThreshold(512))
+	defer cancel()
+
+	if err := cache.Set("big", randBytes(1500)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 6; i++ {
+		if err := cache.Set("small"+strconv.Itoa(i), randBytes(300)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	if cache.packs.has("big") || !cache.packs.has("small0") {
+		t.Errorf("expected values routed by size")
+	}
+	if _, err := os.Stat(cache.filepath("big")); err != nil {
+		t.Errorf("expected big value in its own file: %s", err)
+	}
+	if stats := cache.Stats(); stats.PackedEntries != 6 || stats.PackedBytes != 1800 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// 3300 bytes in total over 3KB, the big value accessed the least recently
+	atime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(cache.filepath("big"), atime, atime); err != nil {
+		panic(err)
+	}
+	cache.gc()
+	if cache.Has("big") {
+		t.Errorf("expected the least recently accessed value evicted across engines")
+	}
+	for i := 0; i < 6; i++ {
+		if !cache.Has("small" + strconv.Itoa(i)) {
+			t.Errorf("expected small%d kept", i)
+		}
+	}
+}
+
+func TestCacheVersion(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "fscache")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	open := func(version string, opts ...Option) *Cache {
+		c, err := New(append([]Option{WithCacheDir(cacheDir), WithCacheVersion(version)}, opts...)...)
+		if err != nil {
+			t.Fatalf("new with version %s: %s", version, err)
+		}
+		return c.(*Cache)
+	}
+	cache := open("v1")
+	if err := cache.Set("key", randBytes(10)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	cache.Close()
+
+	cache = open("v1")
+	if !cache.Has("key") {
+		t.Errorf("expected entries kept with the same version")
+	}
+	stale := []string{cache.heatmapPath(), cache.journalPath(), filepath.Join(cache.trashdir(), "key"),
+		filepath.Join(cache.uploaddir(), "key"), filepath.Join(cache.chunkdir(), "key")}
+	for _, fp := range stale {
+		if err := os.MkdirAll(filepath.Dir(fp), 0775); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(fp, randBytes(10), 0644); err != nil {
+			panic(err)
+		}
+	}
+	cache.Close()
+
+	cache = open("v2", WithQuarantine())
+	if cache.Has("key") {
+		t.Errorf("expected entries invalidated with another version")
+	}
+	if names, _ := readDirNames(cache.quarantinedir()); len(names) != 1 || !strings.HasPrefix(names[0], "version-v1-") {
+		t.Errorf("expected entries of v1 quarantined, got %v", names)
+	}
+	for _, fp := range stale {
+		if _, err := os.Stat(fp); !os.IsNotExist(err) {
+			t.Errorf("expected %s of v1 invalidated, got %v", fp, err)
+		}
+	}
+	cache.Close()
+}
+
+func TestEntryHeader(t *testing.T) {
+	cache, cancel := newCache(WithEntryHeader())
+	defer cancel()
+
+	val := randBytes(100)
+	if err := cache.Set("key", val); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if got, err := cache.Get("key", nil); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("get, err %v", err)
+	}
+	entry, err := ioutil.ReadFile(cache.filepath("key"))
+	if err != nil || !bytes.HasPrefix(entry, []byte(entryMagic)) {
+		t.Errorf("expected entry prefixed with header, err %v", err)
+	}
+
+	entry[len(entry)-1] ^= 0xff
+	if err := ioutil.WriteFile(cache.filepath("key"), entry, 0644); err != nil {
+		panic(err)
+	}
+	if _, err := cache.Get("key", nil); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("expected corrupted error, got %v", err)
+	}
+
+	// entries without header read as raw values
+	if err := ioutil.WriteFile(cache.filepath("raw"), val, 0644); err != nil {
+		panic(err)
+	}
+	if got, err := cache.Get("raw", nil); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("get raw, err %v", err)
+	}
+
+	if err := cache.SetWithTTL("ttl", val, 50*time.Millisecond); err != nil {
+		t.Fatalf("set with ttl: %s", err)
+	}
+	if _, err := os.Stat(cache.metapath("ttl")); !os.IsNotExist(err) {
+		t.Errorf("expected no sidecar for ttl in header, err %v", err)
+	}
+	if !cache.Has("ttl") {
+		t.Errorf("expected ttl entry before expiry")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if cache.Has("ttl") {
+		t.Errorf("expected ttl entry expired")
+	}
+	if _, err := cache.Get("ttl", nil); err != ErrNotFound {
+		t.Errorf("expected not found error, got %v", err)
+	}
+
+	// expired entries got while their keys are held, e.g. being set again, are left to their holders
+	for _, key := range []string{"held", "swept"} {
+		if err := cache.SetWithTTL(key, val, 20*time.Millisecond); err != nil {
+			t.Fatalf("set with ttl: %s", err)
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+	unlock, err := cache.LockKey("held")
+	if err != nil {
+		t.Fatalf("lock key: %s", err)
+	}
+	if _, err := cache.Get("held", nil); err != ErrNotFound {
+		t.Errorf("expected not found error, got %v", err)
+	}
+	if _, err := os.Lstat(cache.filepath("held")); err != nil {
+		t.Errorf("expected the entry of the key held not deleted, got %v", err)
+	}
+	unlock()
+
+	// expired entries are swept by their headers
+	cache.sweep()
+	for _, key := range []string{"held", "swept"} {
+		if _, err := os.Lstat(cache.filepath(key)); !os.IsNotExist(err) {
+			t.Errorf("expected %s swept, got %v", key, err)
+		}
+	}
+}
+
+func TestXattrMeta(t *testing.T) {
+	cache, cancel := newCache(WithXattrMeta())
+	defer cancel()
+	if _, ok := cache.meta.(xattrMeta); !ok {
+		t.Skip("user extended attributes not supported")
+	}
+
+	if err := cache.SetWithTags("key", randBytes(10), "tag"); err != nil {
+		t.Fatalf("set with tags: %s", err)
+	}
+	if _, err := os.Stat(cache.metapath("key")); !os.IsNotExist(err) {
+		t.Errorf("expected no sidecar file, err %v", err)
+	}
+	if m, err := cache.readMeta("key"); err != nil || !hasTag(m.Tags, "tag") {
+		t.Errorf("expected tags in xattr, got %+v err %v", m, err)
+	}
+
+	// tags dropped with the file replaced
+	if err := cache.Set("key", randBytes(10)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if n, err := cache.InvalidateTag("tag"); err != nil || n != 0 || !cache.Has("key") {
+		t.Errorf("expected key without the tag kept, deleted %d err %v", n, err)
+	}
+
+	if err := cache.SetWithTTL("ttl", randBytes(10), time.Millisecond); err != nil {
+		t.Fatalf("set with ttl: %s", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	cache.sweep()
+	if _, err := os.Stat(cache.filepath("ttl")); !os.IsNotExist(err) {
+		t.Errorf("expected expired entry swept, err %v", err)
+	}
+}
+
+func TestTake(t *testing.T) {
+	cache, cancel := newCache(WithPackfiles(100, 1024))
+	defer cancel()
+
+	for _, key := range []string{"packed", "file"} {
+		size := 10
+		if key == "file" {
+			size = 1000
+		}
+		val := randBytes(size)
+		if err := cache.Set(key, val); err != nil {
+			t.Fatalf("set %s: %s", key, err)
+		}
+
+		var (
+			taken int32
+			wg    sync.WaitGroup
+		)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				got, err := cache.Take(key)
+				if err == ErrNotFound {
+					return
+				}
+				if err != nil || !bytes.Equal(got, val) {
+					t.Errorf("take %s, err %v", key, err)
+				}
+				atomic.AddInt32(&taken, 1)
+			}()
+		}
+		wg.Wait()
+		if taken != 1 {
+			t.Errorf("expected %s taken once, got %d", key, taken)
+		}
+		if cache.Has(key) {
+			t.Errorf("expected %s deleted by take", key)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	events, cancelWatch := cache.Watch("a-")
+
+	if err := cache.Set("a-set", randBytes(10)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if err := cache.Set("b-ignored", randBytes(10)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if err := cache.Delete("a-set"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if err := cache.SetWithTTL("a-ttl", randBytes(10), time.Millisecond); err != nil {
+		t.Fatalf("set with ttl: %s", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	cache.sweep()
+	if err := cache.Set("a-evicted", randBytes(4*1024)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	cache.gc()
+	cancelWatch()
+
+	var got []string
+	for e := range events {
+		got = append(got, string(e.Op)+" "+e.Key)
+	}
+	want := []string{"set a-set", "delete a-set", "set a-ttl", "expire a-ttl", "set a-evicted", "evict a-evicted"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected events %v, got %v", want, got)
+	}
+}
+
+func TestGcHistory(t *testing.T) {
+	cache, cancel := newCache(WithGcHistory(2))
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		if err := cache.Set("key"+strconv.Itoa(i), randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		cache.gc()
+	}
+	reports := cache.Stats().GCHistory
+	if len(reports) != 2 {
+		t.Fatalf("expected the last 2 reports kept, got %+v", reports)
+	}
+	if reports[0].Start.After(reports[1].Start) {
+		t.Errorf("expected reports the oldest first")
+	}
+	// the first pass evicted, which is dropped from the ring
+	for _, rep := range reports {
+		if rep.ScannedFiles != 3 || rep.ScannedBytes != 3*1024 || rep.EvictedFiles != 0 {
+			t.Errorf("unexpected report %+v", rep)
+		}
+	}
+
+	// a pass is skipped while another one of the cache is running
+	if !cache.lockGc() {
+		t.Fatalf("expected the gc lock taken")
+	}
+	cache.gc()
+	cache.unlockGc()
+	if got := cache.Stats().GCHistory; got[1].Start != reports[1].Start {
+		t.Errorf("expected no pass while another one running")
+	}
+}
+
+func TestNamespaceWeights(t *testing.T) {
+	cache, cancel := newCache(WithNamespaceWeights(map[string]float64{"hot-": 1, "cold-": 1}))
+	defer cancel()
+
+	old := time.Now().Add(-time.Hour)
+	for i := 0; i < 2; i++ {
+		key := "cold-" + strconv.Itoa(i)
+		if err := cache.Set(key, randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+		if err := os.Chtimes(cache.filepath(key), old, old); err != nil {
+			panic(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if err := cache.Set("hot-"+strconv.Itoa(i), randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+
+	// LRU would evict all cold entries, while each namespace gets half of 3KB
+	cache.gc()
+	count := func(prefix string) int {
+		keys, _ := cache.keys()
+		n := 0
+		for _, k := range keys {
+			if strings.HasPrefix(k, prefix) {
+				n++
+			}
+		}
+		return n
+	}
+	if n := count("cold-"); n != 1 {
+		t.Errorf("expected 1 cold entry kept, got %d", n)
+	}
+	if n := count("hot-"); n != 1 {
+		t.Errorf("expected 1 hot entry kept, got %d", n)
+	}
+}
+
+func TestClock(t *testing.T) {
+	cache, cancel := newCache(WithClock())
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		if err := cache.Set("key"+strconv.Itoa(i), randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	// the first sweep clears the reference bits set by Set(), evicting key0
+	cache.gc()
+	if cache.Has("key0") {
+		t.Errorf("expected key0 evicted")
+	}
+
+	if _, err := cache.Get("key1", nil); err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if err := cache.Set("key4", randBytes(1024)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+
+	// key1 referenced gets a second chance, key2 not referenced since the last sweep is evicted
+	cache.gc()
+	for key, kept := range map[string]bool{"key1": true, "key2": false, "key3": true, "key4": true} {
+		if cache.Has(key) != kept {
+			t.Errorf("expected %s kept %v", key, kept)
+		}
+	}
+}
+
+func TestARC(t *testing.T) {
+	cache, cancel := newCache(WithARC())
+	defer cancel()
+
+	for _, key := range []string{"key0", "key1"} {
+		if err := cache.Set(key, randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+		if _, err := cache.Get(key, nil); err != nil {
+			t.Fatalf("get: %s", err)
+		}
+	}
+	// a scan over keys got once does not flush the keys got twice
+	for _, key := range []string{"key2", "key3", "key4"} {
+		if err := cache.Set(key, randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	cache.gc()
+	for key, kept := range map[string]bool{"key0": true, "key1": true, "key2": false, "key3": false, "key4": true} {
+		if cache.Has(key) != kept {
+			t.Errorf("expected %s kept %v", key, kept)
+		}
+	}
+
+	// the lists are loaded as saved after GC
+	file, err := os.Open(cache.policyPath())
+	if err != nil {
+		t.Fatalf("open policy: %s", err)
+	}
+	defer file.Close()
+	a := newARC()
+	if err := a.load(file); err != nil {
+		t.Fatalf("load policy: %s", err)
+	}
+	if !a.t2.has("key0") || !a.t2.has("key1") || !a.t1.has("key4") || !a.b1.has("key2") {
+		t.Errorf("expected lists loaded, got t1 %v t2 %v b1 %v", a.t1.items(), a.t2.items(), a.b1.items())
+	}
+
+	// setting a key evicted from t1 grows the target of t1
+	if err := cache.Set("key2", randBytes(1024)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if p := cache.policy.(*arc).p; p <= 0 {
+		t.Errorf("expected p grown, got %v", p)
+	}
+}
+
+func TestTinyLFU(t *testing.T) {
+	cache, cancel := newCache(WithTinyLFU())
+	defer cancel()
+
+	for _, key := range []string{"key0", "key1"} {
+		if err := cache.Set(key, randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := cache.Get(key, nil); err != nil {
+				t.Fatalf("get: %s", err)
+			}
+		}
+	}
+	// a scan over keys set once is not admitted to the main area over the hot keys
+	for i := 0; i < 4; i++ {
+		if err := cache.Set("scan"+strconv.Itoa(i), randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	cache.gc()
+	for key, kept := range map[string]bool{"key0": true, "key1": true, "scan0": false, "scan1": false, "scan2": false, "scan3": true} {
+		if cache.Has(key) != kept {
+			t.Errorf("expected %s kept %v", key, kept)
+		}
+	}
+}
+
+func TestAdaptiveTinyLFU(t *testing.T) {
+	cache, cancel := newCache(WithAdaptiveTinyLFU())
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		if err := cache.Set("scan"+strconv.Itoa(i), randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	cache.gc()
+	// the keys set once the admission rejected set again grow the window
+	var evicted int
+	for i := 0; i < 4; i++ {
+		if key := "scan" + strconv.Itoa(i); !cache.Has(key) {
+			evicted++
+			if err := cache.Set(key, randBytes(1024)); err != nil {
+				t.Fatalf("set: %s", err)
+			}
+		}
+	}
+	if evicted == 0 {
+		t.Fatalf("expected keys evicted")
+	}
+	if share := cache.policy.(*tinyLFU).share; share <= tinyLFUWindow {
+		t.Errorf("expected the window grown, got %v", share)
+	}
+}
+
+func TestSLRU(t *testing.T) {
+	cache, cancel := newCache(WithSLRU())
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		if err := cache.Set("key"+strconv.Itoa(i), randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	// key0 got again is protected, key1 and key2 only set once are evicted before it
+	if _, err := cache.Get("key0", nil); err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if err := cache.Set("key4", randBytes(1024)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	cache.gc()
+	for key, kept := range map[string]bool{"key0": true, "key1": false, "key2": false, "key3": true, "key4": true} {
+		if cache.Has(key) != kept {
+			t.Errorf("expected %s kept %v", key, kept)
+		}
+	}
+}
+
+func TestGcExclude(t *testing.T) {
+	cache, cancel := newCache(WithGcExclude("manifest-*"), WithGcExcludeMaxBytes(2*1024))
+	defer cancel()
+
+	// the excluded entries are not evicted even if the least recently used
+	for _, key := range []string{"manifest-0", "manifest-1", "blob-0", "blob-1"} {
+		if err := cache.Set(key, randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cache.gc()
+	for key, kept := range map[string]bool{"manifest-0": true, "manifest-1": true, "blob-0": false, "blob-1": true} {
+		if cache.Has(key) != kept {
+			t.Errorf("expected %s kept %v", key, kept)
+		}
+	}
+
+	// the excluded entries over the hard cap are evicted
+	if err := cache.Set("manifest-2", randBytes(1024)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	cache.gc()
+	for key, kept := range map[string]bool{"manifest-0": false, "manifest-1": true, "manifest-2": true, "blob-1": true} {
+		if cache.Has(key) != kept {
+			t.Errorf("expected %s kept %v", key, kept)
+		}
+	}
+
+	if _, err := New(WithCacheDir(t.TempDir()), WithGcExclude("[")); err == nil {
+		t.Errorf("expected malformed glob rejected")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	cache, cancel := newCache(WithRetention(
+		RetentionRule{Prefix: "", MaxAge: time.Hour},
+		RetentionRule{Prefix: "logs-", MaxAge: time.Minute},
+		RetentionRule{Prefix: "logs-audit-", MaxAge: 2 * time.Hour},
+	))
+	defer cancel()
+
+	old := time.Now().Add(-30 * time.Minute)
+	for _, key := range []string{"logs-0", "logs-audit-0", "blob-0"} {
+		if err := cache.Set(key, randBytes(16)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+		if err := os.Chtimes(cache.filepath(key), old, old); err != nil {
+			t.Fatalf("chtimes: %s", err)
+		}
+	}
+	if err := cache.Set("logs-1", randBytes(16)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	cache.gc()
+	for key, kept := range map[string]bool{"logs-0": false, "logs-1": true, "logs-audit-0": true, "blob-0": true} {
+		if cache.Has(key) != kept {
+			t.Errorf("expected %s kept %v", key, kept)
+		}
+	}
+}
+
+func TestScrub(t *testing.T) {
+	cache, cancel := newCache(WithEntryHeader(), WithQuarantine(), WithScrub(100*time.Millisecond))
+	defer cancel()
+
+	for _, key := range []string{"key0", "key1"} {
+		if err := cache.Set(key, randBytes(64)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	buf, err := ioutil.ReadFile(cache.filepath("key1"))
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	buf[len(buf)-1] ^= 0xff
+	if err := ioutil.WriteFile(cache.filepath("key1"), buf, 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); cache.Stats().CorruptEntries == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := cache.Stats(); s.CorruptEntries != 1 || s.ScrubbedEntries == 0 {
+		t.Errorf("expected 1 corrupt entry scrubbed, got %d of %d", s.CorruptEntries, s.ScrubbedEntries)
+	}
+	if !cache.Has("key0") || cache.Has("key1") {
+		t.Errorf("expected only the corrupt entry removed")
+	}
+	if names, _ := readDirNames(cache.quarantinedir()); len(names) != 2 || !strings.HasPrefix(names[0], "key1.") {
+		t.Errorf("expected key1 quarantined with a report, got %v", names)
+	}
+}
+
+func TestQuarantineCorrupt(t *testing.T) {
+	cache, cancel := newCache(WithEntryHeader(), WithQuarantine())
+	defer cancel()
+
+	if err := cache.Set("key0", randBytes(64)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	buf, err := ioutil.ReadFile(cache.filepath("key0"))
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	size := int64(len(buf) - 1)
+	if err := ioutil.WriteFile(cache.filepath("key0"), buf[:size], 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if _, err := cache.Get("key0", nil); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted, got %v", err)
+	}
+	if cache.Has("key0") {
+		t.Errorf("expected key0 moved out of the cache")
+	}
+
+	names, _ := readDirNames(cache.quarantinedir())
+	var report string
+	for _, name := range names {
+		if strings.HasSuffix(name, quarantineReportSuffix) {
+			report = name
+		}
+	}
+	if len(names) != 2 || report == "" {
+		t.Fatalf("expected key0 quarantined with a report, got %v", names)
+	}
+	buf, err = ioutil.ReadFile(filepath.Join(cache.quarantinedir(), report))
+	if err != nil {
+		t.Fatalf("read report: %s", err)
+	}
+	var rep QuarantineReport
+	if err := json.Unmarshal(buf, &rep); err != nil {
+		t.Fatalf("unmarshal report: %s", err)
+	}
+	if rep.Key != "key0" || rep.Size != size || !strings.Contains(rep.Reason, "checksum") {
+		t.Errorf("unexpected report %+v", rep)
+	}
+}
+
+type panicPolicy struct{ lru }
+
+func (panicPolicy) victims(entries []os.FileInfo, needBytes int64) []string { panic("bad entry") }
+
+func TestGcRecover(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		if err := cache.Set("key"+strconv.Itoa(i), randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	cache.policy = panicPolicy{}
+	for i := 0; i < gcMaxFailures; i++ {
+		cache.gc()
+	}
+	s := cache.Stats()
+	if s.GCPanics != gcMaxFailures {
+		t.Errorf("expected %d gc panics, got %d", gcMaxFailures, s.GCPanics)
+	}
+	if errs := s.GCHistory[len(s.GCHistory)-1].Errors; len(errs) != 1 || errs[0] != "panic: bad entry" {
+		t.Errorf("expected the panic reported, got %v", errs)
+	}
+	if err := cache.Healthy(context.Background()); err == nil {
+		t.Errorf("expected unhealthy after gc panics")
+	}
+
+	cache.policy = lru{}
+	cache.gc()
+	if s := cache.Stats(); s.GCHistory[len(s.GCHistory)-1].EvictedFiles != 1 {
+		t.Errorf("expected 1 entry evicted after recovered")
+	}
+	if err := cache.Healthy(context.Background()); err != nil {
+		t.Errorf("expected healthy, got %s", err)
+	}
+
+	// panics of GC workers are recovered too
+	workers, cancel2 := newCache(WithGcWorkers(4), WithMaxBytes(1024),
+		WithStorage(panicStorage{&memStorage{files: map[string]*memFile{}}}))
+	defer cancel2()
+	for i := 0; i < 8; i++ {
+		if err := workers.Set("key"+strconv.Itoa(i), randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	workers.gc()
+	s = workers.Stats()
+	if errs := s.GCHistory[len(s.GCHistory)-1].Errors; s.GCPanics != 1 || len(errs) != 1 || errs[0] != "panic: bad storage" {
+		t.Errorf("expected the panic of a worker reported, got %d, %v", s.GCPanics, errs)
+	}
+}
+
+// panicStorage is a Storage panicking on removes.
+type panicStorage struct{ *memStorage }
+
+func (panicStorage) Remove(path string) error { panic("bad storage") }
+
+type recordLogger struct {
+	mu   sync.Mutex
+	errs []string
+}
+
+func (l *recordLogger) Errorf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errs = append(l.errs, fmt.Sprintf(format, args...))
+}
+
+func TestGcVanished(t *testing.T) {
+	cache, cancel := newCache(WithQuarantine())
+	defer cancel()
+	l := &recordLogger{}
+	cache.logger = l
+
+	for i := 0; i < 4; i++ {
+		if err := cache.Set("key"+strconv.Itoa(i), randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	fi, err := os.Lstat(cache.filepath("key0"))
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+	// entries removed by others between listing and handling them are skipped
+	for _, k := range []string{"key0", "key1"} {
+		if err := os.Remove(cache.filepath(k)); err != nil {
+			t.Fatalf("remove: %s", err)
+		}
+	}
+	if removed := cache.remove([]string{"key0"}); len(removed) != 1 {
+		t.Errorf("expected key0 removed, got %v", removed)
+	}
+	cache.illegalEntry(cache.filepath("key1"), fi)
+	cache.gc()
+
+	if len(l.errs) > 0 {
+		t.Errorf("expected no errors, got %v", l.errs)
+	}
+	if s := cache.Stats(); s.LastGC.IsZero() || len(s.GCHistory[len(s.GCHistory)-1].Errors) > 0 {
+		t.Errorf("expected gc completed without errors, got %+v", s.GCHistory)
+	}
+}
+
+func TestGetAt(t *testing.T) {
+	cache, cancel := newCache(WithEntryHeader(), WithHandlePool(2))
+	defer cancel()
+
+	val := randBytes(1024)
+	if err := cache.Set("key0", val); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	r, c, err := cache.GetAt("key0")
+	if err != nil {
+		t.Fatalf("get at: %s", err)
+	}
+	buf := make([]byte, 100)
+	if _, err := r.ReadAt(buf, 500); err != nil || !bytes.Equal(buf, val[500:600]) {
+		t.Errorf("expected value read at 500, got %v", err)
+	}
+	if size := r.(*io.SectionReader).Size(); size != int64(len(val)) {
+		t.Errorf("expected size %d, got %d", len(val), size)
+	}
+	file := cache.handles.open["key0"].file
+	c.Close()
+
+	// the idle file is reused
+	r, c, err = cache.GetAt("key0")
+	if err != nil {
+		t.Fatalf("get at: %s", err)
+	}
+	if cache.handles.open["key0"].file != file {
+		t.Errorf("expected the file reused")
+	}
+	// the reader keeps reading the value got after set again
+	newVal := randBytes(1024)
+	if err := cache.Set("key0", newVal); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if _, err := r.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, val[:100]) {
+		t.Errorf("expected the old value read, got %v", err)
+	}
+	c.Close()
+	r, c, err = cache.GetAt("key0")
+	if err != nil {
+		t.Fatalf("get at: %s", err)
+	}
+	if _, err := r.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, newVal[:100]) {
+		t.Errorf("expected the new value read, got %v", err)
+	}
+	c.Close()
+
+	for i := 1; i < 4; i++ {
+		key := "key" + strconv.Itoa(i)
+		if err := cache.Set(key, randBytes(16)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+		_, c, err := cache.GetAt(key)
+		if err != nil {
+			t.Fatalf("get at: %s", err)
+		}
+		c.Close()
+	}
+	if n := len(cache.handles.open); n != 2 {
+		t.Errorf("expected 2 files kept open, got %d", n)
+	}
+	if _, _, err := cache.GetAt("missing"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	cache, cancel := newCache(WithHandlePool(4), WithMaxOpenFiles(2))
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		if err := cache.Set("key"+strconv.Itoa(i), randBytes(16)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	_, c0, err := cache.GetAt("key0")
+	if err != nil {
+		t.Fatalf("get at: %s", err)
+	}
+	_, c1, err := cache.GetAt("key1")
+	if err != nil {
+		t.Fatalf("get at: %s", err)
+	}
+	if _, _, err := cache.GetAt("key2"); err != ErrTooManyOpenFiles {
+		t.Errorf("expected ErrTooManyOpenFiles, got %v", err)
+	}
+	if s := cache.Stats(); s.OpenFiles != 2 || s.RejectedOpens != 1 {
+		t.Errorf("expected 2 open files and 1 rejected, got %d and %d", s.OpenFiles, s.RejectedOpens)
+	}
+
+	// the idle file of key0 is closed to make room
+	c0.Close()
+	_, c2, err := cache.GetAt("key2")
+	if err != nil {
+		t.Fatalf("get at: %s", err)
+	}
+	if _, err := cache.BeginSet("key3"); err != ErrTooManyOpenFiles {
+		t.Errorf("expected ErrTooManyOpenFiles, got %v", err)
+	}
+	c1.Close()
+	c2.Close()
+	u, err := cache.BeginSet("key3")
+	if err != nil {
+		t.Fatalf("begin set: %s", err)
+	}
+	if err := u.Abort(); err != nil {
+		t.Fatalf("abort: %s", err)
+	}
+	if s := cache.Stats(); s.OpenFiles != 1 {
+		t.Errorf("expected 1 idle file left open, got %d", s.OpenFiles)
+	}
+}
+
+func TestDirectIO(t *testing.T) {
+	cache, cancel := newCache(WithMaxBytes(1024*1024), WithDirectIO(4096))
+	defer cancel()
+
+	for _, size := range []int{100, 4096, 3*4096 + 123, 2*directIOBufBytes + 1} {
+		key := "key" + strconv.Itoa(size)
+		val := randBytes(size)
+		if err := cache.Set(key, val); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+		got, err := cache.Get(key, nil)
+		if err != nil {
+			t.Fatalf("get: %s", err)
+		}
+		if !bytes.Equal(got, val) {
+			t.Errorf("expected value of %d bytes got back, got %d bytes", size, len(got))
+		}
+	}
+}
+
+// residentPages returns the number of pages of the file at fp in the page cache.
+func residentPages(t *testing.T, fp string) int {
+	file, err := os.Open(fp)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+	mem, err := syscall.Mmap(int(file.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatalf("mmap: %s", err)
+	}
+	defer syscall.Munmap(mem)
+	vec := make([]byte, (len(mem)+os.Getpagesize()-1)/os.Getpagesize())
+	_, _, errno := syscall.Syscall(syscall.SYS_MINCORE, uintptr(unsafe.Pointer(&mem[0])), uintptr(len(mem)), uintptr(unsafe.Pointer(&vec[0])))
+	if errno != 0 {
+		t.Fatalf("mincore: %s", errno)
+	}
+	n := 0
+	for _, v := range vec {
+		n += int(v & 1)
+	}
+	return n
+}
+
+func TestFadvise(t *testing.T) {
+	cache, cancel := newCache(WithMaxBytes(1024*1024), WithFadvise(64*1024, AdviceDontNeed, AdviceDontNeed))
+	defer cancel()
+
+	if err := cache.Set("key0", randBytes(256*1024)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if n := residentPages(t, cache.filepath("key0")); n != 0 {
+		t.Errorf("expected no pages cached after set, got %d", n)
+	}
+	if _, err := cache.Get("key0", nil); err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if n := residentPages(t, cache.filepath("key0")); n != 0 {
+		t.Errorf("expected no pages cached after get, got %d", n)
+	}
+}
+
+func TestSetReader(t *testing.T) {
+	cache, cancel := newCache(WithEntryHeader())
+	defer cancel()
+
+	val := randBytes(2048)
+	if err := cache.SetReader("key0", bytes.NewReader(val), int64(len(val))); err != nil {
+		t.Fatalf("set reader: %s", err)
+	}
+	if got, err := cache.Get("key0", nil); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected value got back, got %v", err)
+	}
+
+	fp := filepath.Join(t.TempDir(), "val")
+	if err := ioutil.WriteFile(fp, val[:1024], 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := cache.SetFromFile("key1", fp); err != nil {
+		t.Fatalf("set from file: %s", err)
+	}
+	if got, err := cache.Get("key1", nil); err != nil || !bytes.Equal(got, val[:1024]) {
+		t.Errorf("expected value got back, got %v", err)
+	}
+
+	if err := cache.SetReader("key2", bytes.NewReader(val), 4096); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if err := cache.SetReader("key3", bytes.NewReader(val), 1<<50); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("expected ErrDiskFull, got %v", err)
+	}
+	if cache.Has("key2") || cache.Has("key3") {
+		t.Errorf("expected failed sets not set")
+	}
+	if names, _ := readDirNames(cache.tmpdir()); len(names) != 0 {
+		t.Errorf("expected no tmp files left, got %v", names)
+	}
+}
+
+func TestGetTo(t *testing.T) {
+	cache, cancel := newCache(WithEntryHeader())
+	defer cancel()
+
+	val := randBytes(2048)
+	if err := cache.Set("key0", val); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if n, err := cache.GetTo("key0", &buf); err != nil || n != int64(len(val)) || !bytes.Equal(buf.Bytes(), val) {
+		t.Errorf("expected value written to buffer, got %d bytes, %v", n, err)
+	}
+
+	file, err := ioutil.TempFile(t.TempDir(), "val")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	defer file.Close()
+	if _, err := cache.GetTo("key0", file); err != nil {
+		t.Fatalf("get to file: %s", err)
+	}
+	if got, err := ioutil.ReadFile(file.Name()); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected value written to file, got %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		cache.GetTo("key0", conn)
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept: %s", err)
+	}
+	defer conn.Close()
+	if got, err := ioutil.ReadAll(conn); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected value written to conn, got %v", err)
+	}
+
+	if _, err := cache.GetTo("missing", &buf); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestInvalidKey(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+
+	for _, key := range []string{"", ".", "..", "../escaped", "a/b", "nul\x00"} {
+		if err := cache.Set(key, randBytes(16)); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("expected set of %q rejected, got %v", key, err)
+		}
+		if _, err := cache.Get(key, nil); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("expected get of %q rejected, got %v", key, err)
+		}
+		if err := cache.Delete(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("expected delete of %q rejected, got %v", key, err)
+		}
+		if cache.Has(key) {
+			t.Errorf("expected %q not found", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cache.cacheDir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing written out of the dir of files, got %v", err)
+	}
+
+	// any key is valid with key hashing
+	hashed, cancel2 := newCache(WithKeyHashing())
+	defer cancel2()
+	if err := hashed.Set("../escaped", randBytes(16)); err != nil || !hashed.Has("../escaped") {
+		t.Errorf("expected key with slashes set with key hashing, got %v", err)
+	}
+}
+
+func TestKeyHashing(t *testing.T) {
+	cache, cancel := newCache(WithKeyHashing())
+	defer cancel()
+
+	keys := []string{"https://example.com/a/b?c=d", strings.Repeat("k", 1000), "plain"}
+	for _, key := range keys {
+		if err := cache.SetWithTags(key, randBytes(16), "tag"); err != nil {
+			t.Fatalf("set %.32s: %s", key, err)
+		}
+		if _, err := cache.Get(key, nil); err != nil {
+			t.Fatalf("get %.32s: %s", key, err)
+		}
+	}
+	// as if restarted, the keys are looked up in the meta
+	cache.hashedKeys = &hashedKeys{m: map[string]string{}}
+	got, err := cache.Keys()
+	if err != nil {
+		t.Fatalf("keys: %s", err)
+	}
+	sort.Strings(got)
+	want := append([]string(nil), keys...)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected original keys %.64q, got %.64q", want, got)
+	}
+
+	n, err := cache.InvalidateTag("tag")
+	if err != nil || n != len(keys) {
+		t.Errorf("expected %d keys invalidated, got %d, %v", len(keys), n, err)
+	}
+	for _, key := range keys {
+		if cache.Has(key) {
+			t.Errorf("expected %.32s invalidated", key)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := cache.Set("https://example.com/"+strconv.Itoa(i), randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	cache.gc()
+	if got, _ := cache.Keys(); len(got) != 3 {
+		t.Errorf("expected 3 keys left by GC, got %q", got)
+	}
+
+	// files left without their meta are removed by GC once old enough
+	orphan, young := cache.filepath("orphan"), cache.filepath("young")
+	for _, fp := range []string{orphan, young} {
+		if err := ioutil.WriteFile(fp, randBytes(16), 0644); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+	}
+	old := time.Now().Add(-2 * orphanAge)
+	if err := os.Chtimes(orphan, old, old); err != nil {
+		t.Fatalf("chtimes: %s", err)
+	}
+	cache.gc()
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("expected the old orphan removed, got %v", err)
+	}
+	if _, err := os.Stat(young); err != nil {
+		t.Errorf("expected the young orphan kept, got %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	vals := map[string][]byte{"a": randBytes(16), "b": randBytes(2048), "c": randBytes(16)}
+	open := func(opts ...Option) *Cache {
+		cache, err := New(append([]Option{WithCacheDir(dir), WithMaxBytes(0)}, opts...)...)
+		if err != nil {
+			t.Fatalf("new: %s", err)
+		}
+		return cache.(*Cache)
+	}
+	cache := open(WithKeyHashing())
+	for key, val := range vals {
+		if err := cache.SetWithTags(key, val, "tag"); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	cache.Close()
+
+	for _, step := range []struct {
+		from, to Layout
+		opt      Option
+	}{
+		{LayoutHashed, LayoutPacked, WithEngine(EngineLog)},
+		{LayoutPacked, LayoutFlat, WithEngine(EngineFile)},
+		{LayoutFlat, LayoutHashed, WithKeyHashing()},
+	} {
+		// migrating twice resumes the first one, which has nothing left to migrate
+		for i := 0; i < 2; i++ {
+			if err := Migrate(dir, step.from, step.to); err != nil {
+				t.Fatalf("migrate from %s to %s: %s", step.from, step.to, err)
+			}
+		}
+		cache := open(step.opt)
+		keys, err := cache.Keys()
+		if err != nil || len(keys) != len(vals) {
+			t.Errorf("expected %d keys in %s layout, got %q, %v", len(vals), step.to, keys, err)
+		}
+		for key, val := range vals {
+			if got, err := cache.Get(key, nil); err != nil || !bytes.Equal(got, val) {
+				t.Errorf("expected value of %s kept in %s layout, got %v", key, step.to, err)
+			}
+		}
+		cache.Close()
+	}
+
+	cache = open(WithKeyHashing())
+	defer cache.Close()
+	if n, err := cache.InvalidateTag("tag"); err != nil || n != len(vals) {
+		t.Errorf("expected tags kept, got %d invalidated, %v", n, err)
+	}
+	if err := Migrate(dir, LayoutHashed, LayoutFanOut); !errors.Is(err, ErrUnsupportedLayout) {
+		t.Errorf("expected the fan-out layout unsupported, got %v", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	cache, cancel := newCache(WithKeyHashing())
+	defer cancel()
+
+	write := func(path string, data []byte, modTime time.Time) {
+		if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("chtimes: %s", err)
+		}
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	dir := t.TempDir()
+	write(filepath.Join(dir, "djherbis", base64.URLEncoding.EncodeToString([]byte("dj-key"))), []byte("dj-val"), old)
+	write(filepath.Join(dir, "diskv", "ab", "diskv-key"), []byte("diskv-val"), old)
+	nginx := append([]byte{5, 0, 0, 0, 0, 0, 0, 0, 0xff, 0x10}, "\nKEY: http://example.com/a?b\nHTTP/1.1 200 OK\r\nContent-Length: 9\r\n\r\nnginx-val"...)
+	write(filepath.Join(dir, "nginx", "c", "29", "b7f54b2df7773722d382f4809d65029c"), nginx, old)
+	write(filepath.Join(dir, "nginx", "temp"), []byte("partial"), old)
+
+	for _, im := range []Importer{
+		NewDjherbisImporter(filepath.Join(dir, "djherbis")),
+		NewDiskvImporter(filepath.Join(dir, "diskv")),
+		NewNginxImporter(filepath.Join(dir, "nginx")),
+	} {
+		if n, err := cache.Import(im); err != nil || n != 1 {
+			t.Errorf("expected 1 entry imported by %T, got %d, %v", im, n, err)
+		}
+	}
+	for key, val := range map[string]string{"dj-key": "dj-val", "diskv-key": "diskv-val", "http://example.com/a?b": "nginx-val"} {
+		fi, err := os.Stat(cache.filepath(key))
+		if err != nil || !fi.ModTime().Equal(old) {
+			t.Errorf("expected %s imported with its modification time, got %v", key, err)
+		}
+		if got, err := cache.Get(key, nil); err != nil || string(got) != val {
+			t.Errorf("expected %s imported as %q, got %q, %v", key, val, got, err)
+		}
+	}
+}
+
+// memStorage is a Storage emulating files in memory, as an object store would.
+type memStorage struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+func (m *memFile) Name() string       { return filepath.Base(m.name) }
+func (m *memFile) Size() int64        { return int64(len(m.data)) }
+func (m *memFile) Mode() os.FileMode  { return 0644 }
+func (m *memFile) ModTime() time.Time { return m.modTime }
+func (m *memFile) IsDir() bool        { return false }
+func (m *memFile) Sys() interface{}   { return nil }
+
+type memReader struct {
+	*bytes.Reader
+	fi *memFile
+}
+
+func (r memReader) Close() error               { return nil }
+func (r memReader) Stat() (os.FileInfo, error) { return r.fi, nil }
+
+type memWriter struct {
+	s    *memStorage
+	path string
+	buf  bytes.Buffer
+}
+
+func (w *memWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *memWriter) Close() error {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	w.s.files[w.path] = &memFile{name: w.path, data: w.buf.Bytes(), modTime: time.Now()}
+	return nil
+}
+
+func (s *memStorage) Open(path string) (StorageFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fi, ok := s.files[path]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return memReader{Reader: bytes.NewReader(fi.data), fi: fi}, nil
+}
+
+func (s *memStorage) CreateTemp(path string) (io.WriteCloser, error) {
+	return &memWriter{s: s, path: path}, nil
+}
+
+func (s *memStorage) Rename(oldpath, newpath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fi, ok := s.files[oldpath]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: os.ErrNotExist}
+	}
+	delete(s.files, oldpath)
+	fi.name = newpath
+	s.files[newpath] = fi
+	return nil
+}
+
+func (s *memStorage) Walk(dir string, fn func(fi os.FileInfo) error) error {
+	s.mu.Lock()
+	var fis []os.FileInfo
+	for path, fi := range s.files {
+		if filepath.Dir(path) == dir {
+			fis = append(fis, fi)
+		}
+	}
+	s.mu.Unlock()
+	for _, fi := range fis {
+		if err := fn(fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) Remove(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[path]; !ok {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	delete(s.files, path)
+	return nil
+}
+
+func (s *memStorage) Stat(path string) (os.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fi, ok := s.files[path]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return fi, nil
+}
+
+func (s *memStorage) Chtimes(path string, atime, mtime time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if fi, ok := s.files[path]; ok {
+		fi.modTime = atime
+	}
+	return nil
+}
+
+func TestStorage(t *testing.T) {
+	storage := &memStorage{files: map[string]*memFile{}}
+	cache, cancel := newCache(WithStorage(storage))
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		if err := cache.Set("key"+strconv.Itoa(i), randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(storage.files) != 4 {
+		t.Errorf("expected 4 files in the storage, got %d", len(storage.files))
+	}
+	if names, _ := readDirNames(cache.filedir()); len(names) != 0 {
+		t.Errorf("expected no local files, got %q", names)
+	}
+	if _, err := cache.Get("key0", nil); err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	cache.gc()
+	// key0 got is kept, key1 least recently used is evicted
+	if !cache.Has("key0") || cache.Has("key1") || !cache.Has("key3") {
+		t.Errorf("expected key1 evicted by GC of the storage, got %d files", len(storage.files))
+	}
+	if err := cache.Delete("key0"); err != nil || cache.Has("key0") {
+		t.Errorf("expected key0 deleted, got %v", err)
+	}
+	if keys, err := cache.Keys(); err != nil || len(keys) != 2 {
+		t.Errorf("expected the keys listed from the storage, got %q, err %v", keys, err)
+	}
+	if val, err := cache.Take("key2"); err != nil || len(val) != 1024 || cache.Has("key2") {
+		t.Errorf("expected key2 taken from the storage, err %v", err)
+	}
+
+	// the self-test, imports and replication go through the storage too
+	if err := cache.Healthy(context.Background()); err != nil {
+		t.Errorf("expected the storage healthy, got %v", err)
+	}
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := ioutil.WriteFile(filepath.Join(dir, "imported"), randBytes(16), 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "imported"), old, old); err != nil {
+		t.Fatalf("chtimes: %s", err)
+	}
+	if n, err := cache.Import(NewDiskvImporter(dir)); err != nil || n != 1 {
+		t.Errorf("expected 1 entry imported, got %d, %v", n, err)
+	}
+	if fi, err := storage.Stat(cache.filepath("imported")); err != nil || !fi.ModTime().Equal(old) {
+		t.Errorf("expected the entry imported into the storage with its modification time, got %v", err)
+	}
+	peer, cancelPeer := newCache()
+	defer cancelPeer()
+	server := httptest.NewServer(NewHandler(peer))
+	defer server.Close()
+	cache.replicaURL, cache.replicaClient = server.URL, server.Client()
+	if err := cache.ship(journalRecord{op: journalOpSet, key: "key3"}); err != nil || !peer.Has("key3") {
+		t.Errorf("expected key3 replicated from the storage, got %v", err)
+	}
+	if names, _ := readDirNames(cache.filedir()); len(names) != 0 {
+		t.Errorf("expected no local files, got %q", names)
+	}
+	if err := cache.Snapshot(filepath.Join(dir, "snapshot")); !errors.Is(err, ErrLocalOnly) {
+		t.Errorf("expected snapshots of the storage failing, got %v", err)
+	}
+	if _, err := cache.BeginSet("key3"); !errors.Is(err, ErrLocalOnly) {
+		t.Errorf("expected uploads into the storage failing, got %v", err)
+	}
+
+	// the trash is in the storage too
+	storage = &memStorage{files: map[string]*memFile{}}
+	trashed, cancel2 := newCache(WithStorage(storage), WithTrash(time.Hour))
+	defer cancel2()
+	if err := trashed.Set("key0", randBytes(16)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if err := trashed.Delete("key0"); err != nil || trashed.Has("key0") {
+		t.Fatalf("expected key0 trashed, got %v", err)
+	}
+	if _, ok := storage.files[trashed.trashpath("key0")]; !ok {
+		t.Errorf("expected key0 in the trash of the storage")
+	}
+	if err := trashed.Undelete("key0"); err != nil || !trashed.Has("key0") {
+		t.Errorf("expected key0 restored from the storage, got %v", err)
+	}
+	if err := trashed.Undelete("key0"); err != ErrNotFound {
+		t.Errorf("expected not found error, got %v", err)
+	}
+
+	// tmp files left in the storage by crashes of caches sharing it are removed once old
+	cacheDir, err := ioutil.TempDir("", "fscache")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	storage = &memStorage{files: map[string]*memFile{}}
+	tmpdir := filepath.Join(cacheDir, "tmp")
+	for name, modTime := range map[string]time.Time{"old": time.Now().Add(-2 * time.Hour), "new": time.Now()} {
+		fp := filepath.Join(tmpdir, name)
+		storage.files[fp] = &memFile{name: fp, data: randBytes(16), modTime: modTime}
+	}
+	shared, err := New(WithCacheDir(cacheDir), WithStorage(storage), WithSharedMode())
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+	defer shared.(*Cache).Close()
+	if _, ok := storage.files[filepath.Join(tmpdir, "old")]; ok {
+		t.Errorf("expected old tmp file removed from the shared storage")
+	}
+	if _, ok := storage.files[filepath.Join(tmpdir, "new")]; !ok {
+		t.Errorf("expected tmp file possibly being written kept in the shared storage")
+	}
+}
+
+func TestLockKey(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+
+	unlock, err := cache.LockKey("key0")
+	if err != nil {
+		t.Fatalf("lock key: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cache.Set("key0", randBytes(16)) }()
+	select {
+	case <-done:
+		t.Fatalf("expected set blocked by the lock of key0")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := cache.Set("key1", randBytes(16)); err != nil {
+		t.Errorf("expected other keys not blocked, got %v", err)
+	}
+	unlock()
+	if err := <-done; err != nil || !cache.Has("key0") {
+		t.Errorf("expected set after unlocked, got %v", err)
+	}
+	if len(cache.keyLocks.m) != 0 {
+		t.Errorf("expected locks dropped once unlocked, got %d", len(cache.keyLocks.m))
+	}
+}
+
+func TestTenant(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+
+	if _, err := cache.Tenant("a:b", TenantConfig{}); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey for tenant a:b, got %v", err)
+	}
+	a, err := cache.Tenant("a", TenantConfig{MaxBytes: 100})
+	if err != nil {
+		t.Fatalf("tenant: %s", err)
+	}
+	b, err := cache.Tenant("b", TenantConfig{})
+	if err != nil {
+		t.Fatalf("tenant: %s", err)
+	}
+	for _, key := range []string{"", "../key", "a/b", strings.Repeat("k", 201)} {
+		if err := a.Set(key, randBytes(1)); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("expected ErrInvalidKey for %.16q, got %v", key, err)
+		}
+	}
+	if err := a.Set("key1", randBytes(60)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if err := a.Set("key2", randBytes(60)); err != ErrQuotaExceeded {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if err := a.Set("key1", randBytes(30)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if err := a.Set("key2", randBytes(60)); err != nil {
+		t.Errorf("expected key2 within quota after key1 shrunk, got %v", err)
+	}
+	if b.Has("key1") || !cache.Has("a:key1") {
+		t.Errorf("expected keys of a kept in its namespace")
+	}
+	if err := cache.Delete("a:key2"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	st := cache.Stats().Tenants["a"]
+	if st.Keys != 1 || st.Bytes != 30 || st.Sets != 3 || st.Rejected != 1 {
+		t.Errorf("expected stats of a updated by the delete, got %+v", st)
+	}
+
+	// a view got again counts the entries of the tenant in the cache
+	a.Close()
+	if a, err = cache.Tenant("a", TenantConfig{MaxBytes: 100}); err != nil {
+		t.Fatalf("tenant: %s", err)
+	}
+	if st := a.Stats(); st.Keys != 1 || st.Bytes != 30 {
+		t.Errorf("expected entries of a counted, got %+v", st)
+	}
+
+	// the stored sizes are charged, the same as counted again
+	headed, cancel2 := newCache(WithEntryHeader())
+	defer cancel2()
+	h, err := headed.Tenant("h", TenantConfig{})
+	if err != nil {
+		t.Fatalf("tenant: %s", err)
+	}
+	if err := h.Set("key", randBytes(30)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if st := h.Stats(); st.Bytes != 30+entryHeaderLen {
+		t.Errorf("expected the stored size charged, got %+v", st)
+	}
+	h.Close()
+	if h, err = headed.Tenant("h", TenantConfig{}); err != nil {
+		t.Fatalf("tenant: %s", err)
+	}
+	if st := h.Stats(); st.Bytes != 30+entryHeaderLen {
+		t.Errorf("expected the stored size counted, got %+v", st)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fscache-config")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fscache.json")
+	content := fmt.Sprintf(`{"cacheDir": %q, "maxBytes": 3072, "policy": "arc", "gcInterval": "1m",
+		"retention": [{"prefix": "logs-", "maxAge": "1h"}]}`, filepath.Join(dir, "cache"))
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	os.Setenv("FSCACHE_MAX_BYTES", "4096")
+	os.Setenv("FSCACHE_GC_EXCLUDE", "a-,b-")
+	defer os.Unsetenv("FSCACHE_MAX_BYTES")
+	defer os.Unsetenv("FSCACHE_GC_EXCLUDE")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if cfg.MaxBytes != 4096 || time.Duration(cfg.GcInterval) != time.Minute || len(cfg.GcExclude) != 2 ||
+		len(cfg.Retention) != 1 || cfg.Retention[0].MaxAge != time.Hour {
+		t.Errorf("expected env merged over the file, got %+v", cfg)
+	}
+	cache, err := NewFromConfig(path)
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+	defer cache.(*Cache).Close()
+	if c := cache.(*Cache); c.maxBytes != 4096 || c.gcInterval != time.Minute {
+		t.Errorf("expected cache configured, got maxBytes %d gcInterval %s", c.maxBytes, c.gcInterval)
+	}
+
+	os.Setenv("FSCACHE_POLICY", "mru")
+	defer os.Unsetenv("FSCACHE_POLICY")
+	if _, err := NewFromConfig(path); err == nil {
+		t.Errorf("expected unknown policy to fail")
+	}
+	if _, err := LoadConfig(filepath.Join(dir, "fscache.yaml")); err == nil {
+		t.Errorf("expected yaml unsupported")
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	cache, cancel := newCache(WithGcInterval(time.Hour))
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		if err := cache.Set("key"+strconv.Itoa(i), randBytes(512)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	if err := cache.UpdateConfig(&Config{MaxBytes: 1024, GcInterval: Duration(50 * time.Millisecond)}); err != nil {
+		t.Fatalf("update: %s", err)
+	}
+	// GC runs within the new interval instead of the hour configured, and keeps the new max bytes
+	time.Sleep(500 * time.Millisecond)
+	if keys, err := cache.Keys(); err != nil || len(keys) != 2 {
+		t.Errorf("expected 2 keys left under the new max bytes, got %v, %v", keys, err)
+	}
+	if err := cache.UpdateConfig(&Config{NamespaceWeights: map[string]float64{"a": 1}}); err == nil {
+		t.Errorf("expected namespace weights not updatable without WithNamespaceWeights()")
+	}
+	if err := cache.UpdateConfig(&Config{MaxBytes: -1}); err == nil {
+		t.Errorf("expected negative max bytes to fail")
+	}
+	if maxBytes, interval := cache.gcSettings(); maxBytes != 1024 || interval != 50*time.Millisecond {
+		t.Errorf("expected failed updates to keep the settings, got %d, %s", maxBytes, interval)
+	}
+}
+
+func TestUpdateConfigDuringGc(t *testing.T) {
+	evicting, release := make(chan struct{}, 4), make(chan struct{})
+	cache, cancel := newCache(WithMaxBytes(1024), WithGcInterval(time.Hour), WithEvictHook(EvictHook{Timeout: time.Minute, Func: func(key string, value io.Reader) {
+		evicting <- struct{}{}
+		<-release
+	}}))
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		if err := cache.Set("key"+strconv.Itoa(i), randBytes(512)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	gcDone := make(chan struct{})
+	go func() {
+		defer close(gcDone)
+		cache.gc()
+	}()
+	<-evicting
+
+	// neither the update nor the health checks behind it wait for the GC pass in progress
+	updated := make(chan error, 1)
+	go func() { updated <- cache.UpdateConfig(&Config{MaxBytes: 4096}) }()
+	select {
+	case err := <-updated:
+		if err != nil {
+			t.Errorf("update: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected UpdateConfig() not waiting for the GC pass")
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), time.Second)
+	defer cancelCtx()
+	if err := cache.Healthy(ctx); err != nil {
+		t.Errorf("expected healthy during the GC pass, got %s", err)
+	}
+	close(release)
+	<-gcDone
+
+	disabled, cancelDisabled := newCache(WithMaxBytes(0))
+	defer cancelDisabled()
+	if err := disabled.UpdateConfig(&Config{MaxBytes: 1024}); err == nil {
+		t.Errorf("expected GC not enabled on caches created without it")
+	}
+}
+
+func TestChain(t *testing.T) {
+	upper, cancelUpper := newCache(WithStorage(&memStorage{files: map[string]*memFile{}}))
+	defer cancelUpper()
+	lower, cancelLower := newCache()
+	defer cancelLower()
+	chained := Chain(upper, lower)
+
+	val := randBytes(100)
+	if err := lower.Set("key", val); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	got, err := chained.Get("key", []byte("prefix"))
+	if err != nil || !bytes.Equal(got, append([]byte("prefix"), val...)) {
+		t.Fatalf("expected value got from the lower level, got %v", err)
+	}
+	if got, err := upper.Get("key", nil); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected upper level back-filled, got %v", err)
+	}
+	if err := chained.Set("key2", val); err != nil || !upper.Has("key2") || !lower.Has("key2") {
+		t.Errorf("expected key2 set into every level, got %v", err)
+	}
+	if err := chained.(Deleter).Delete("key"); err != nil || chained.Has("key") {
+		t.Errorf("expected key deleted from every level, got %v", err)
+	}
+	if _, err := chained.Get("key", nil); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	suffix := func(s string) Transform {
+		return NewTransform(func(key string, val []byte) ([]byte, error) {
+			return append(append([]byte{}, val...), s...), nil
+		}, func(key string, val []byte) ([]byte, error) {
+			if !bytes.HasSuffix(val, []byte(s)) {
+				return nil, fmt.Errorf("no suffix %s", s)
+			}
+			return val[:len(val)-len(s)], nil
+		})
+	}
+	cache, cancel := newCache(WithTransforms(suffix("1"), suffix("2")), WithEntryHeader())
+	defer cancel()
+
+	val := randBytes(100)
+	if err := cache.Set("key1", val); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if stored, err := ioutil.ReadFile(cache.filepath("key1")); err != nil || !bytes.HasSuffix(stored, []byte("12")) {
+		t.Errorf("expected value stored encoded in order, got %v", err)
+	}
+	if got, err := cache.Get("key1", nil); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected value decoded, got %v", err)
+	}
+	if err := cache.SetReader("key2", bytes.NewReader(val), int64(len(val))); err != nil {
+		t.Fatalf("set reader: %s", err)
+	}
+	var buf bytes.Buffer
+	if _, err := cache.GetTo("key2", &buf); err != nil || !bytes.Equal(buf.Bytes(), val) {
+		t.Errorf("expected streamed value decoded, got %v", err)
+	}
+	upload, err := cache.BeginSet("key4")
+	if err != nil {
+		t.Fatalf("begin set: %s", err)
+	}
+	if err := upload.WriteChunk(0, val); err != nil {
+		t.Fatalf("write chunk: %s", err)
+	}
+	if err := upload.Commit(); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	if got, err := cache.Get("key4", nil); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected uploaded value decoded, got %v", err)
+	}
+	if _, err := os.Stat(cache.uploadpath("key4")); !os.IsNotExist(err) {
+		t.Errorf("expected upload removed after commit, got %v", err)
+	}
+	if err := ioutil.WriteFile(cache.filepath("key3"), val, 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if _, err := cache.Get("key3", nil); err == nil {
+		t.Errorf("expected value set without the transforms not decodable")
+	}
+}
+
+func TestReport(t *testing.T) {
+	cache, cancel := newCache(WithHeatmap(time.Hour))
+	defer cancel()
+
+	for key, size := range map[string]int{"key1": 512, "key2": 512, "key3": 1024} {
+		if err := cache.Set(key, randBytes(size)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	for key, hits := range map[string]int{"key1": 8, "key2": 2, "key3": 2, "missing": 1} {
+		for i := 0; i < hits; i++ {
+			cache.Get(key, nil)
+		}
+	}
+	cache.gc()
+
+	rep := cache.Report()
+	if len(rep.SizeHistogram) == 0 || rep.SizeHistogram[0].Entries != 3 || rep.SizeHistogram[0].Bytes != 2048 {
+		t.Errorf("expected 3 entries up to 1KB, got %+v", rep.SizeHistogram)
+	}
+	expected := []float64{0, 8. / 13, 10. / 13, 10. / 13, 12. / 13}
+	if len(rep.HitRates) != len(expected) {
+		t.Fatalf("expected %d hit rates, got %+v", len(expected), rep.HitRates)
+	}
+	for i, hr := range rep.HitRates {
+		if math.Abs(hr.HitRate-expected[i]) > 1e-9 {
+			t.Errorf("expected hit rate %.3f at %d bytes, got %.3f", expected[i], hr.MaxBytes, hr.HitRate)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var log bytes.Buffer
+	for _, key := range []string{"a", "b", "c", "a", "a"} {
+		fmt.Fprintf(&log, "{\"key\": %q, \"size\": 1}\n", key)
+	}
+	results, err := Replay(bytes.NewReader(log.Bytes()), ReplayConfig{
+		Policies:   []string{"lru"},
+		MaxBytes:   []int64{2, 3},
+		GcInterval: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("replay: %s", err)
+	}
+	expected := []ReplayResult{
+		{Policy: "lru", MaxBytes: 2, Gets: 5, Hits: 1, HitRatio: 0.2, ByteHitRatio: 0.2, Evictions: 2},
+		{Policy: "lru", MaxBytes: 3, Gets: 5, Hits: 2, HitRatio: 0.4, ByteHitRatio: 0.4},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected %+v, got %+v", expected, results)
+	}
+	if results, err := Replay(bytes.NewReader(log.Bytes()), ReplayConfig{MaxBytes: []int64{2}}); err != nil || len(results) != 6 {
+		t.Errorf("expected every policy simulated by default, got %d, %v", len(results), err)
+	}
+	if _, err := Replay(bytes.NewReader(log.Bytes()), ReplayConfig{Policies: []string{"mru"}, MaxBytes: []int64{2}}); err == nil {
+		t.Errorf("expected unknown policy to fail")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fscache-accesslog")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.jsonl")
+	cache, cancel := newCache(WithAccessLog(path, 1, 300))
+	defer cancel()
+
+	if err := cache.Set("key", randBytes(100)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	for _, key := range []string{"key", "missing", "key"} {
+		cache.Get(key, nil)
+	}
+	rotated, err := ioutil.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatalf("expected log rotated: %s", err)
+	}
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	log := append(rotated, current...)
+	var ops []string
+	for _, line := range bytes.Split(bytes.TrimSpace(log), []byte("\n")) {
+		var rec AccessRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			t.Fatalf("unmarshal %s: %s", line, err)
+		}
+		if rec.Key == "key" || rec.Key == "" {
+			t.Errorf("expected key hashed, got %q", rec.Key)
+		}
+		ops = append(ops, fmt.Sprintf("%s %v %d", rec.Op, rec.Hit, rec.Size))
+	}
+	expected := []string{"set false 100", "get true 100", "get false 0", "get true 100"}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected %v logged, got %v", expected, ops)
+	}
+
+	results, err := Replay(bytes.NewReader(log), ReplayConfig{Policies: []string{"lru"}, MaxBytes: []int64{1024}})
+	if err != nil || len(results) != 1 || results[0].Gets != 3 || results[0].Hits != 2 {
+		t.Errorf("expected log replayed with 2 hits of 3 gets, got %+v, %v", results, err)
+	}
+
+	// failing to rotate, logging on to the old file and reporting it
+	l := &recordLogger{}
+	cache.logger = l
+	if err := os.Remove(path + ".1"); err != nil {
+		t.Fatalf("remove: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0775); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	for i := 0; i < 4; i++ {
+		cache.Get("key", nil)
+	}
+	if after, _ := ioutil.ReadFile(path); bytes.Count(after, []byte("\n")) != bytes.Count(current, []byte("\n"))+4 {
+		t.Errorf("expected accesses logged to the old file, got %s", after)
+	}
+	if len(l.errs) == 0 || !strings.Contains(l.errs[0], "rotate") {
+		t.Errorf("expected failed rotation reported, got %v", l.errs)
+	}
+}
+
+func TestGetOrSet(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+
+	val := randBytes(100)
+	release := make(chan struct{})
+	load := func(key string) ([]byte, error) {
+		<-release
+		return val, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := cache.GetOrSet("key", nil, load); err != nil || !bytes.Equal(got, val) {
+				t.Errorf("expected value loaded, got %v", err)
+			}
+		}()
+	}
+	for atomic.LoadInt64(&cache.stats.loads)+atomic.LoadInt64(&cache.stats.dedupedLoads) < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if st := cache.Stats(); st.Loads != 1 || st.DedupedLoads != 4 || !cache.Has("key") {
+		t.Errorf("expected 1 load shared by 4 misses and set, got %d, %d", st.Loads, st.DedupedLoads)
+	}
+
+	panicky := func(key string) ([]byte, error) { panic("boom") }
+	if _, err := cache.GetOrSet("key2", nil, panicky); !errors.Is(err, ErrLoaderPanic) {
+		t.Errorf("expected ErrLoaderPanic, got %v", err)
+	}
+	if got, err := cache.GetOrSet("key2", nil, func(string) ([]byte, error) { return val, nil }); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected key2 loaded after the panic, got %v", err)
+	}
+	if st := cache.Stats(); st.LoaderPanics != 1 || len(cache.flights.m) != 0 {
+		t.Errorf("expected 1 panic and no load left in progress, got %d, %d", st.LoaderPanics, len(cache.flights.m))
+	}
+}
+
+func TestDurable(t *testing.T) {
+	cache, cancel := newCache(WithDurable(), WithPackfiles(64, 1<<20))
+	defer cancel()
+
+	if !cache.packs.durable {
+		t.Errorf("expected packs durable")
+	}
+	small, large := randBytes(10), randBytes(1024)
+	if err := cache.SetWithTags("small", small, "tag"); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if err := cache.SetWithTTL("large", large, time.Hour); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	for key, val := range map[string][]byte{"small": small, "large": large} {
+		if got, err := cache.Get(key, nil); err != nil || !bytes.Equal(got, val) {
+			t.Errorf("expected %s got, got %v", key, err)
+		}
+	}
+}
+
+// errCrash is returned by a faultStorage once crashed.
+var errCrash = errors.New("crashed")
+
+// faultStorage is a Storage over the local filesystem crashing at the crashAt-th operation, 0 meaning never,
+// after which every operation fails as if the process died, leaving the files as they were.
+// A write crashing writes half of its bytes.
+type faultStorage struct {
+	Storage
+	mu      sync.Mutex
+	crashAt int
+	ops     int
+}
+
+// step counts an operation, and tells if the storage has crashed at or before it.
+func (s *faultStorage) step() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.crashAt == 0 {
+		return false
+	}
+	s.ops++
+	return s.ops >= s.crashAt
+}
+
+func (s *faultStorage) crashed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.crashAt > 0 && s.ops >= s.crashAt
+}
+
+type faultWriter struct {
+	s *faultStorage
+	w io.WriteCloser
+}
+
+func (w *faultWriter) Write(p []byte) (int, error) {
+	if w.s.step() {
+		n, _ := w.w.Write(p[:len(p)/2])
+		return n, errCrash
+	}
+	return w.w.Write(p)
+}
+
+func (w *faultWriter) Close() error {
+	if w.s.step() {
+		// closed without syncing, as by the death of the process
+		if sc, ok := w.w.(syncCloser); ok {
+			sc.File.Close()
+		}
+		return errCrash
+	}
+	return w.w.Close()
+}
+
+func (s *faultStorage) Open(path string) (StorageFile, error) {
+	if s.step() {
+		return nil, errCrash
+	}
+	return s.Storage.Open(path)
+}
+
+func (s *faultStorage) CreateTemp(path string) (io.WriteCloser, error) {
+	if s.step() {
+		return nil, errCrash
+	}
+	w, err := s.Storage.CreateTemp(path)
+	if err != nil {
+		return nil, err
+	}
+	return &faultWriter{s: s, w: w}, nil
+}
+
+func (s *faultStorage) Rename(oldpath, newpath string) error {
+	if s.step() {
+		return errCrash
+	}
+	return s.Storage.Rename(oldpath, newpath)
+}
+
+func (s *faultStorage) Remove(path string) error {
+	if s.step() {
+		return errCrash
+	}
+	return s.Storage.Remove(path)
+}
+
+func (s *faultStorage) Chtimes(path string, atime, mtime time.Time) error {
+	if s.step() {
+		return errCrash
+	}
+	return s.Storage.Chtimes(path, atime, mtime)
+}
+
+// TestCrashConsistency crashes a set of a key at each of its steps, and checks the cache recovered from
+// the crash serves either the old or the new value of the key, and sets it again.
+func TestCrashConsistency(t *testing.T) {
+	oldVal, newVal := randBytes(1000), randBytes(1000)
+	for crashAt := 1; ; crashAt++ {
+		cacheDir, err := ioutil.TempDir("", "fscache-crash")
+		if err != nil {
+			t.Fatalf("tempdir: %s", err)
+		}
+		open := func(storage Storage) *Cache {
+			c, err := New(WithCacheDir(cacheDir), WithStorage(storage), WithEntryHeader(), WithTTLJitter(0))
+			if err != nil {
+				t.Fatalf("new: %s", err)
+			}
+			return c.(*Cache)
+		}
+
+		cache := open(LocalStorage())
+		if err := cache.SetWithTTL("key", oldVal, time.Hour); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+		cache.Close()
+
+		storage := &faultStorage{Storage: LocalStorage()}
+		cache = open(storage)
+		storage.mu.Lock()
+		storage.crashAt = crashAt
+		storage.mu.Unlock()
+		err = cache.Set("key", newVal)
+		crashed := storage.crashed()
+		if !crashed && err != nil {
+			t.Fatalf("set without crash: %s", err)
+		}
+		cache.Close()
+
+		cache = open(LocalStorage())
+		got, err := cache.Get("key", nil)
+		if err != nil || !bytes.Equal(got, newVal) && (!crashed || !bytes.Equal(got, oldVal)) {
+			t.Errorf("crash at step %d: expected the old or the new value, got %d bytes, %v", crashAt, len(got), err)
+		}
+		if err := cache.Set("key", newVal); err != nil {
+			t.Errorf("crash at step %d: expected key set after recovery, got %v", crashAt, err)
+		}
+		if fis, err := ioutil.ReadDir(cache.tmpdir()); err != nil || len(fis) != 0 {
+			t.Errorf("crash at step %d: expected no tmp file left, got %d, %v", crashAt, len(fis), err)
+		}
+		cache.Close()
+		os.RemoveAll(cacheDir)
+		if !crashed {
+			return
+		}
+	}
+}
+
+func TestGcProperties(t *testing.T) {
+	seed := time.Now().UnixNano()
+	for _, name := range replayPolicies {
+		opt, err := policyOption(name)
+		if err != nil {
+			t.Fatalf("policy %s : %s", name, err)
+		}
+		opts := []Option{WithGcExclude("pinned-*")}
+		if opt != nil {
+			opts = append(opts, opt)
+		}
+		cache, cancel := newCache(opts...)
+		r := rand.New(rand.NewSource(seed))
+		pinned := map[string]bool{}
+		for round := 0; round < 10; round++ {
+			for i := r.Intn(10); i >= 0; i-- {
+				key := fmt.Sprintf("key-%d", r.Intn(20))
+				if r.Intn(10) == 0 && len(pinned) < 4 {
+					key = fmt.Sprintf("pinned-%d", r.Intn(4))
+					pinned[key] = true
+				}
+				if err := cache.Set(key, randBytes(1+r.Intn(1024))); err != nil {
+					t.Fatalf("set: %s", err)
+				}
+				if r.Intn(2) == 0 {
+					cache.Get(fmt.Sprintf("key-%d", r.Intn(20)), nil)
+				}
+			}
+			cache.gc()
+
+			keys, err := cache.Keys()
+			if err != nil {
+				t.Fatalf("keys: %s", err)
+			}
+			var bytes int64
+			onlyPinned := true
+			for _, key := range keys {
+				fi, err := os.Stat(cache.filepath(key))
+				if err != nil {
+					t.Fatalf("stat %s : %s", key, err)
+				}
+				bytes += fi.Size()
+				onlyPinned = onlyPinned && pinned[key]
+			}
+			// never over quota after GC, unless only the pinned are left
+			if bytes > cache.maxBytes && !onlyPinned {
+				t.Fatalf("policy %s seed %d round %d: %d bytes after gc over %d", name, seed, round, bytes, cache.maxBytes)
+			}
+			// never evicting the pinned
+			for key := range pinned {
+				if !cache.Has(key) {
+					t.Fatalf("policy %s seed %d round %d: pinned %s evicted", name, seed, round, key)
+				}
+			}
+		}
+		cancel()
+	}
+}
+
+var soakDuration = flag.Duration("soak", 2*time.Second, "how long TestSoak loads the cache, e.g. 1h nightly")
+
+func TestSoak(t *testing.T) {
+	res, err := Soak(context.Background(), SoakConfig{
+		Duration:      *soakDuration,
+		Keys:          100,
+		MaxValueBytes: 4096,
+		CheckInterval: *soakDuration / 4,
+	}, WithCacheDir(t.TempDir()), WithMaxBytes(64*1024), WithGcInterval(time.Second))
+	if err != nil {
+		t.Fatalf("soak: %s", err)
+	}
+	if res.Sets == 0 || res.Gets == 0 || res.Hits == 0 || res.Deletes == 0 || res.Checks < 4 {
+		t.Errorf("expected load and checks, got %+v", res)
+	}
+	for _, v := range res.Violations {
+		t.Errorf("violation: %s", v)
+	}
+
+	if _, err := Soak(context.Background(), SoakConfig{}, WithCacheDir(t.TempDir()), WithStorage(&memStorage{files: map[string]*memFile{}})); err == nil {
+		t.Errorf("expected soak over a storage to fail")
+	}
+}
+
+func TestNFSMode(t *testing.T) {
+	cacheDir := t.TempDir()
+	ci, err := New(WithCacheDir(cacheDir), WithNFSMode(), WithDurable(), WithMaxBytes(3*1024))
+	if err != nil {
+		t.Fatalf("new in nfs mode: %s", err)
+	}
+	cache := ci.(*Cache)
+	defer cache.Close()
+	if _, ok := cache.policy.(*clock); !ok || !cache.skipAtime {
+		t.Errorf("expected clock instead of atime, got %T", cache.policy)
+	}
+	if _, err := New(WithCacheDir(cacheDir), WithNFSMode()); err != ErrLocked {
+		t.Errorf("expected cache dir locked, got %v", err)
+	}
+
+	// the dir syncs of concurrent sets are batched, with those of their metadata
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := cache.SetWithCost(strconv.Itoa(i), randBytes(512), 2); err != nil {
+				t.Errorf("set: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, b := range []*syncBatch{cache.dirSyncs, cache.metaSyncs} {
+		if b.rounds == 0 || b.rounds > 8 {
+			t.Errorf("expected at most 8 syncs of %s, got %d", b.dir, b.rounds)
+		}
+	}
+
+	// a lock not refreshed for a lease is broken, and its holder does not evict after
+	old := time.Now().Add(-2 * nfsLockLease)
+	if err := os.Chtimes(cache.nfsLockPath(), old, old); err != nil {
+		t.Fatalf("chtimes: %s", err)
+	}
+	other, err := New(WithCacheDir(cacheDir), WithNFSMode(), WithMaxBytes(0))
+	if err != nil {
+		t.Fatalf("expected stale lock broken, got %s", err)
+	}
+	if token := other.(*Cache).nfsDirLock.token; token != 2 {
+		t.Errorf("expected fencing token 2, got %d", token)
+	}
+	if cache.lockGc() {
+		t.Errorf("expected gc fenced off")
+	}
+	if removed := cache.remove([]string{"0"}); len(removed) > 0 || !cache.Has("0") {
+		t.Errorf("expected nothing evicted without the lock, got %v", removed)
+	}
+	other.(*Cache).Close()
+
+	// caches in shared mode lock gc by a lockfile
+	sharedDir := t.TempDir()
+	shared1, err := New(WithCacheDir(sharedDir), WithNFSMode(), WithSharedMode(), WithMaxBytes(0))
+	if err != nil {
+		t.Fatalf("new in shared mode: %s", err)
+	}
+	defer shared1.(*Cache).Close()
+	shared2, err := New(WithCacheDir(sharedDir), WithNFSMode(), WithSharedMode(), WithMaxBytes(0))
+	if err != nil {
+		t.Fatalf("new another in shared mode: %s", err)
+	}
+	defer shared2.(*Cache).Close()
+	if !shared1.(*Cache).lockGc() || shared2.(*Cache).lockGc() {
+		t.Errorf("expected only one cache running gc")
+	}
+	shared1.(*Cache).unlockGc()
+	if !shared2.(*Cache).lockGc() {
+		t.Errorf("expected gc lock released")
+	}
+	shared2.(*Cache).unlockGc()
+
+	// ESTALE is retried
+	calls := 0
+	err = cache.retry(func() error {
+		if calls++; calls < 3 {
+			return &os.PathError{Op: "open", Path: "key", Err: syscall.ESTALE}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("expected ESTALE retried, got %d calls, %v", calls, err)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	mountinfo := strings.Join([]string{
+		`22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw`,
+		`45 22 0:39 / /var/lib/my\040app rw,relatime - overlay overlay rw,lowerdir=/l,upperdir=/data/u\040p,workdir=/w`,
+		`46 45 0:40 / /var/lib/my\040app/vol rw,relatime - ext4 /dev/sdb1 rw`,
+	}, "\n")
+	for dir, expected := range map[string]string{
+		"/var/lib/my app/cache/cache": "/data/u p/cache/cache",
+		"/var/lib/my app":             "/data/u p",
+		"/var/lib/my app/vol/cache":   "",
+		"/var/lib/my apps/cache":      "",
+	} {
+		if upper, err := parseOverlayUpperDir(strings.NewReader(mountinfo), dir); err != nil || upper != expected {
+			t.Errorf("expected upper dir of %s %q, got %q, %v", dir, expected, upper, err)
+		}
+	}
+
+	// over a real overlayfs only as root
+	dir := t.TempDir()
+	for _, d := range []string{"lower/cache", "upper", "work", "merged"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "lower/cache/baked"), randBytes(4096), 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	merged := filepath.Join(dir, "merged")
+	opts := fmt.Sprintf("lowerdir=%s/lower,upperdir=%s/upper,workdir=%s/work", dir, dir, dir)
+	if err := syscall.Mount("overlay", merged, "overlay", 0, opts); err != nil {
+		t.Skipf("mount overlayfs: %s", err)
+	}
+	defer syscall.Unmount(merged, 0)
+	ci, err := New(WithCacheDir(merged), WithMaxBytes(3*1024), WithGcInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+	cache := ci.(*Cache)
+	defer cache.Close()
+	if cache.overlayUpper != filepath.Join(dir, "upper/cache") || !cache.skipAtime {
+		t.Errorf("expected overlayfs detected, got upper dir %q", cache.overlayUpper)
+	}
+	// the baked entry takes none of the quota, and is not copied up by Gets
+	if _, err := cache.Get("baked", nil); err != nil {
+		t.Errorf("get baked: %s", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := cache.Set(key, randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	cache.gc()
+	for _, key := range []string{"baked", "a", "b"} {
+		if !cache.Has(key) {
+			t.Errorf("expected %s kept", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "upper/cache/baked")); !os.IsNotExist(err) {
+		t.Errorf("expected baked entry not copied up, got %v", err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	for _, ns := range []int64{0, 1, 7, 8, 15, 16, 17, 1000, 123456789, math.MaxInt64} {
+		b := latencyBucket(ns)
+		if max := latencyBucketMax(b); max < ns || float64(max-ns) > float64(ns)/8 {
+			t.Errorf("expected %d in bucket %d up to %d within 1/8", ns, b, max)
+		}
+		if b > 0 && latencyBucketMax(b-1) >= ns {
+			t.Errorf("expected %d above bucket %d", ns, b-1)
+		}
+	}
+
+	var h latencyHistogram
+	for i := 1; i <= 100; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	l := h.get()
+	for expected, got := range map[time.Duration]time.Duration{50 * time.Millisecond: l.P50, 95 * time.Millisecond: l.P95, 99 * time.Millisecond: l.P99} {
+		if got < expected || got > expected+expected/8 {
+			t.Errorf("expected percentile %s within 1/8, got %s", expected, got)
+		}
+	}
+	if l.Count != 100 || l.Max != 100*time.Millisecond {
+		t.Errorf("expected 100 latencies up to 100ms, got %+v", l)
+	}
+
+	cache, cancel := newCache()
+	defer cancel()
+	cache.Set("key", randBytes(10))
+	cache.Get("key", nil)
+	cache.Get("missing", nil)
+	cache.Delete("key")
+	cache.gc()
+	s := cache.Stats()
+	if s.GetLatency.Count != 2 || s.SetLatency.Count != 1 || s.DeleteLatency.Count != 1 || s.GCLatency.Count < 1 {
+		t.Errorf("expected latencies recorded, got %+v %+v %+v %+v", s.GetLatency, s.SetLatency, s.DeleteLatency, s.GCLatency)
+	}
+	rec := httptest.NewRecorder()
+	NewAdminHandler(cache).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		"fscache_hits_total 1\n",
+		"# TYPE fscache_operation_duration_seconds summary\n",
+		`fscache_operation_duration_seconds_count{op="get"} 2` + "\n",
+		`fscache_operation_duration_seconds{op="set",quantile="0.99"} `,
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("expected %q in metrics, got %s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestSlowOp(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	l := &recordLogger{}
+	cache.logger = l
+	cache.Set("key", randBytes(10))
+	cache.Get("key", nil)
+	if len(l.errs) > 0 {
+		t.Errorf("expected no slow ops logged by default, got %v", l.errs)
+	}
+
+	WithSlowOpThreshold(time.Nanosecond)(cache)
+	cache.Set("key", randBytes(10))
+	cache.Get("key", nil)
+	cache.Delete("key")
+	cache.opDone(&cache.stats.getLatency, AccessGet, "key", 0, time.Now().Add(-time.Second), &os.PathError{Op: "read", Path: "key", Err: syscall.EIO})
+	hash := fmt.Sprintf("key=%x", keyHash("key"))
+	for i, prefix := range []string{"slow op=set " + hash + " size=10 ", "slow op=get " + hash + " size=10 ", "slow op=delete " + hash + " size=0 ", "slow op=get " + hash + " size=0 duration=1"} {
+		if i >= len(l.errs) || !strings.HasPrefix(l.errs[i], prefix) {
+			t.Fatalf("expected %q logged, got %v", prefix, l.errs)
+		}
+	}
+	if !strings.HasSuffix(l.errs[2], " errno=-") || !strings.HasSuffix(l.errs[3], " errno=EIO") {
+		t.Errorf("expected errnos logged, got %v", l.errs)
+	}
+}
+
+// flakyStorage fails the next fails opens, creates and removes with err.
+type flakyStorage struct {
+	Storage
+	mu    sync.Mutex
+	fails int
+	err   error
+}
+
+func (s *flakyStorage) fail() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fails == 0 {
+		return nil
+	}
+	s.fails--
+	return s.err
+}
+
+func (s *flakyStorage) failNext(fails int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fails, s.err = fails, err
+}
+
+func (s *flakyStorage) Open(path string) (StorageFile, error) {
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+	return s.Storage.Open(path)
+}
+
+func (s *flakyStorage) CreateTemp(path string) (io.WriteCloser, error) {
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+	return s.Storage.CreateTemp(path)
+}
+
+func (s *flakyStorage) Remove(path string) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.Storage.Remove(path)
+}
+
+func TestRetry(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "fscache-retry")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(cacheDir)
+	eintr := &os.PathError{Op: "open", Path: "key", Err: syscall.EINTR}
+	storage := &flakyStorage{Storage: LocalStorage()}
+	ci, err := New(WithCacheDir(cacheDir), WithStorage(storage), WithRetry(2, time.Millisecond))
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+	defer ci.(*Cache).Close()
+	cache := ci.(*Cache)
+
+	val := randBytes(100)
+	storage.failNext(2, eintr)
+	if err := cache.Set("key", val); err != nil {
+		t.Fatalf("expected set retried, got %s", err)
+	}
+	storage.failNext(2, eintr)
+	if got, err := cache.Get("key", nil); err != nil || !bytes.Equal(got, val) {
+		t.Fatalf("expected get retried, got %v", err)
+	}
+	storage.failNext(2, eintr)
+	if err := cache.Delete("key"); err != nil {
+		t.Fatalf("expected delete retried, got %s", err)
+	}
+	if retries := cache.Stats().Retries; retries != 6 {
+		t.Errorf("expected 6 retries, got %d", retries)
+	}
+
+	// out of retries, and errors not transient are not retried
+	storage.failNext(3, eintr)
+	if err := cache.Set("key", val); !errors.Is(err, syscall.EINTR) {
+		t.Errorf("expected EINTR, got %v", err)
+	}
+	storage.failNext(1, &os.PathError{Op: "open", Path: "key", Err: syscall.EIO})
+	if err := cache.Set("key", val); !errors.Is(err, syscall.EIO) {
+		t.Errorf("expected EIO, got %v", err)
+	}
+	if retries := cache.Stats().Retries; retries != 8 {
+		t.Errorf("expected 8 retries, got %d", retries)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "fscache-circuit")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(cacheDir)
+	storage := &flakyStorage{Storage: LocalStorage()}
+	ci, err := New(WithCacheDir(cacheDir), WithStorage(storage), WithCircuitBreaker(2, 0, 20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+	defer ci.(*Cache).Close()
+	cache := ci.(*Cache)
+	l := &recordLogger{}
+	cache.logger = l
+
+	val := randBytes(100)
+	if err := cache.Set("key", val); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	// misses and other errors not of the disk keep the circuit closed
+	for i := 0; i < 3; i++ {
+		if _, err := cache.Get("missing", nil); err != ErrNotFound {
+			t.Fatalf("expected not found, got %v", err)
+		}
+	}
+	eio := &os.PathError{Op: "open", Path: "key", Err: syscall.EIO}
+	storage.failNext(2, eio)
+	for i := 0; i < 2; i++ {
+		if err := cache.Set("other", val); !errors.Is(err, syscall.EIO) {
+			t.Fatalf("expected EIO, got %v", err)
+		}
+	}
+	if !cache.Stats().CircuitOpen {
+		t.Fatalf("expected circuit open")
+	}
+	if _, err := cache.Get("key", nil); err != ErrNotFound {
+		t.Errorf("expected a miss with the circuit open, got %v", err)
+	}
+	if err := cache.Set("key", val); err != ErrDegraded {
+		t.Errorf("expected set failing with the circuit open, got %v", err)
+	}
+	if err := cache.Delete("key"); err != ErrDegraded {
+		t.Errorf("expected delete failing with the circuit open, got %v", err)
+	}
+
+	// probes close the circuit once the disk recovers
+	for start := time.Now(); cache.Stats().CircuitOpen; time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("expected circuit closed by probes, logged %v", l.errs)
+		}
+	}
+	if got, err := cache.Get("key", nil); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected key hit with the circuit closed, got %v", err)
+	}
+
+	defaulted, cancelDefaulted := newCache(WithCircuitBreaker(3, 0, 0))
+	defer cancelDefaulted()
+	if defaulted.breaker.probeInterval != defaultProbeInterval {
+		t.Errorf("expected the probe interval defaulted, got %s", defaulted.breaker.probeInterval)
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	vals := map[string][]byte{}
+	keys := []string{"missing"}
+	for i := 0; i < 40; i++ {
+		key := "key" + strconv.Itoa(i)
+		vals[key] = randBytes(10)
+		keys = append(keys, key)
+		if err := cache.Set(key, vals[key]); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	got, err := cache.GetMulti(keys)
+	if err != nil {
+		t.Fatalf("get multi: %s", err)
+	}
+	if !reflect.DeepEqual(got, vals) {
+		t.Errorf("expected the values of the keys found, got %d values", len(got))
+	}
+
+	// a failed key fails alone
+	if err := os.Remove(cache.filepath("key0")); err != nil {
+		t.Fatalf("remove: %s", err)
+	}
+	if err := os.Mkdir(cache.filepath("key0"), 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	got, err = cache.GetMulti(keys)
+	var errs KeyErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs["key0"] != ErrIllegalEntry {
+		t.Fatalf("expected key0 failed, got %v", err)
+	}
+	if len(got) != len(vals)-1 {
+		t.Errorf("expected the values of the other keys, got %d values", len(got))
+	}
+
+}
+
+func TestHasFresh(t *testing.T) {
+	for _, packed := range []bool{false, true} {
+		var opts []Option
+		if packed {
+			opts = append(opts, WithPackfiles(100, 1024))
+		}
+		cache, cancel := newCache(opts...)
+		if err := cache.Set("key", randBytes(10)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+		if !cache.HasFresh("key", time.Minute) || cache.HasFresh("missing", time.Minute) {
+			t.Errorf("expected only key fresh, packed %v", packed)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if cache.HasFresh("key", 10*time.Millisecond) {
+			t.Errorf("expected key stale, packed %v", packed)
+		}
+		// reads do not refresh
+		cache.Get("key", nil)
+		if cache.HasFresh("key", 10*time.Millisecond) || !cache.Has("key") {
+			t.Errorf("expected key stale after get, packed %v", packed)
+		}
+		cancel()
+	}
+}
+
+func TestStat(t *testing.T) {
+	for _, packed := range []bool{false, true} {
+		var opts []Option
+		if packed {
+			opts = append(opts, WithPackfiles(100, 1024))
+		}
+		cache, cancel := newCache(opts...)
+		if _, err := cache.Stat("key"); err != ErrNotFound {
+			t.Errorf("expected not found, got %v", err)
+		}
+		cache.Set("key", randBytes(10))
+		first, err := cache.Stat("key")
+		if err != nil {
+			t.Fatalf("stat: %s", err)
+		}
+		if first.Size != 10 || !first.Created.Equal(first.Updated) || time.Since(first.Created) > time.Minute {
+			t.Errorf("expected a new entry of 10 bytes, got %+v, packed %v", first, packed)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		cache.Get("key", nil)
+		cache.Set("key", randBytes(20))
+		info, err := cache.Stat("key")
+		if err != nil {
+			t.Fatalf("stat: %s", err)
+		}
+		if info.Size != 20 || !info.Created.Equal(first.Created) || !info.Updated.After(first.Updated) {
+			t.Errorf("expected the creation kept over the update, got %+v after %+v, packed %v", info, first, packed)
+		}
+
+		// a new key once deleted
+		cache.Delete("key")
+		cache.Set("key", randBytes(10))
+		if info, err := cache.Stat("key"); err != nil || !info.Created.Equal(info.Updated) {
+			t.Errorf("expected the key created again, got %+v, %v, packed %v", info, err, packed)
+		}
+		cancel()
+	}
+}
+
+func TestEvictHook(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		evicted = map[string][]byte{}
+	)
+	hook := EvictHook{WantValue: true, Func: func(key string, value io.Reader) {
+		val, err := ioutil.ReadAll(value)
+		if err != nil {
+			t.Errorf("read %s evicted: %s", key, err)
+		}
+		mu.Lock()
+		evicted[key] = val
+		mu.Unlock()
+	}}
+	for _, opts := range [][]Option{
+		{WithEvictHook(hook), WithEntryHeader()},
+		{WithEvictHook(hook), WithPackfiles(100, 300)},
+	} {
+		evicted = map[string][]byte{}
+		cache, cancel := newCache(opts...)
+		size := 1024
+		if cache.packs != nil {
+			size = 80
+		}
+		vals := map[string][]byte{}
+		for i := 0; i < 5; i++ {
+			key := "key" + strconv.Itoa(i)
+			vals[key] = randBytes(size)
+			if err := cache.Set(key, vals[key]); err != nil {
+				t.Fatalf("set: %s", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cache.gc()
+		if len(evicted) == 0 {
+			t.Errorf("expected keys evicted")
+		}
+		for key, val := range evicted {
+			if !bytes.Equal(val, vals[key]) || cache.Has(key) {
+				t.Errorf("expected the value of %s passed before evicted", key)
+			}
+		}
+		cancel()
+	}
+
+	// a hook timing out does not stall GC
+	block := make(chan struct{})
+	defer close(block)
+	cache, cancel := newCache(WithEvictHook(EvictHook{Timeout: 10 * time.Millisecond, Func: func(key string, value io.Reader) {
+		if value != nil {
+			t.Errorf("expected no value unless wanted")
+		}
+		<-block
+	}}))
+	defer cancel()
+	for i := 0; i < 4; i++ {
+		cache.Set("key"+strconv.Itoa(i), randBytes(1024))
+	}
+	start := time.Now()
+	cache.gc()
+	keys, _ := cache.Keys()
+	if d := time.Since(start); d > time.Second || len(keys) == 4 {
+		t.Errorf("expected a key evicted without waiting for the hook, took %s", d)
+	}
+
+	// the timeout is for a GC pass rather than each key
+	slow, cancel2 := newCache(WithMaxBytes(1024), WithEvictHook(EvictHook{Timeout: 100 * time.Millisecond, Func: func(key string, value io.Reader) {
+		<-block
+	}}))
+	defer cancel2()
+	for i := 0; i < 10; i++ {
+		slow.Set("key"+strconv.Itoa(i), randBytes(1024))
+	}
+	start = time.Now()
+	slow.gc()
+	keys, _ = slow.Keys()
+	if d := time.Since(start); d > 500*time.Millisecond || len(keys) > 1 {
+		t.Errorf("expected 9 keys evicted within the timeout of the pass, took %s, %d keys left", d, len(keys))
+	}
+
+	// the calls left running are bounded, skipping the keys beyond
+	var calls int32
+	many, cancel3 := newCache(WithMaxBytes(1024), WithEvictHook(EvictHook{Timeout: 10 * time.Millisecond, Func: func(key string, value io.Reader) {
+		atomic.AddInt32(&calls, 1)
+		<-block
+	}}))
+	defer cancel3()
+	for i := 0; i < 2*evictHookMaxRunning; i++ {
+		many.Set("key"+strconv.Itoa(i), randBytes(1024))
+	}
+	many.gc()
+	reps := many.Stats().GCHistory
+	if len(reps) == 0 {
+		t.Fatalf("expected a GC report")
+	}
+	rep := reps[len(reps)-1]
+	for i := 0; i < 100 && int64(atomic.LoadInt32(&calls)) < rep.EvictedFiles-rep.SkippedHooks; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&calls); n > evictHookMaxRunning || rep.SkippedHooks != rep.EvictedFiles-int64(n) || rep.SkippedHooks == 0 {
+		t.Errorf("expected at most %d calls running and the others skipped, got %d calls, %+v", evictHookMaxRunning, n, rep)
+	}
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	for _, header := range []bool{false, true} {
+		opts := []Option{WithSkipUnchanged()}
+		if header {
+			opts = append(opts, WithEntryHeader())
+		}
+		cache, cancel := newCache(opts...)
+		val := randBytes(1000)
+		if err := cache.Set("key", val); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+		first, _ := cache.Stat("key")
+		time.Sleep(10 * time.Millisecond)
+		if err := cache.Set("key", val); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+		if info, _ := cache.Stat("key"); cache.Stats().UnchangedSets != 1 || !info.Updated.Equal(first.Updated) {
+			t.Errorf("expected the unchanged value not written, header %v", header)
+		}
+
+		// changed values, and unchanged values with changed metadata are written
+		other := append([]byte(nil), val...)
+		other[len(other)-1]++
+		cache.Set("key", other)
+		cache.SetWithTTL("key", other, time.Hour)
+		if got, err := cache.Get("key", nil); err != nil || !bytes.Equal(got, other) {
+			t.Errorf("expected the changed value, got %v, header %v", err, header)
+		}
+		if n := cache.Stats().UnchangedSets; n != 1 {
+			t.Errorf("expected changed values written, got %d skipped, header %v", n, header)
+		}
+		cancel()
+	}
+}
+
+func TestGetIfChanged(t *testing.T) {
+	for _, packed := range []bool{false, true} {
+		var opts []Option
+		if packed {
+			opts = append(opts, WithPackfiles(100, 1024))
+		}
+		cache, cancel := newCache(opts...)
+		val := randBytes(50)
+		cache.Set("key", val)
+		got, version, err := cache.GetIfChanged("key", "")
+		if err != nil || !bytes.Equal(got, val) || version == "" {
+			t.Fatalf("expected the value with its version, got %q, %v, packed %v", version, err, packed)
+		}
+		if info, _ := cache.Stat("key"); info.Version != version {
+			t.Errorf("expected version %q in stat, got %q", version, info.Version)
+		}
+		if got, again, err := cache.GetIfChanged("key", version); err != ErrNotModified || got != nil || again != version {
+			t.Errorf("expected not modified, got %v, packed %v", err, packed)
+		}
+
+		cache.Set("key", val)
+		got, changed, err := cache.GetIfChanged("key", version)
+		if err != nil || !bytes.Equal(got, val) || changed == version {
+			t.Errorf("expected a new version once set again, got %q, %v, packed %v", changed, err, packed)
+		}
+		cache.Delete("key")
+		if _, _, err := cache.GetIfChanged("key", changed); err != ErrNotFound {
+			t.Errorf("expected not found, got %v, packed %v", err, packed)
+		}
+		cancel()
+	}
+}
+
+func TestDeferBusyEviction(t *testing.T) {
+	cache, cancel := newCache(WithDeferBusyEviction())
+	defer cancel()
+	var closers []io.Closer
+	for i := 0; i < 4; i++ {
+		key := "key" + strconv.Itoa(i)
+		cache.Set(key, randBytes(1024))
+		_, c, err := cache.GetAt(key)
+		if err != nil {
+			t.Fatalf("get at: %s", err)
+		}
+		closers = append(closers, c)
+	}
+	cache.gc()
+	if keys, _ := cache.Keys(); len(keys) != 4 || cache.Stats().DeferredEvictions == 0 {
+		t.Errorf("expected the evictions of the entries being read deferred, got %d keys", len(keys))
+	}
+
+	for _, c := range closers {
+		c.Close()
+	}
+	cache.gc()
+	if keys, _ := cache.Keys(); len(keys) == 4 {
+		t.Errorf("expected entries evicted once their readers closed")
+	}
+}
+
+func TestMaxConcurrentWrites(t *testing.T) {
+	cache, cancel := newCache(WithMaxConcurrentWrites(1, false))
+	defer cancel()
+	release, err := cache.acquireWrite()
+	if err != nil {
+		t.Fatalf("acquire: %s", err)
+	}
+	if err := cache.Set("key", randBytes(10)); err != ErrTooManyWrites {
+		t.Errorf("expected set over the limit failed, got %v", err)
+	}
+	if err := cache.SetReader("key", bytes.NewReader(randBytes(10)), 10); err != ErrTooManyWrites {
+		t.Errorf("expected set reader over the limit failed, got %v", err)
+	}
+	release()
+	if err := cache.Set("key", randBytes(10)); err != nil || cache.Stats().RejectedWrites != 2 {
+		t.Errorf("expected set within the limit, got %v", err)
+	}
+
+	blocking, cancelBlocking := newCache(WithMaxConcurrentWrites(1, true))
+	defer cancelBlocking()
+	release, _ = blocking.acquireWrite()
+	done := make(chan error)
+	go func() { done <- blocking.Set("key", randBytes(10)) }()
+	select {
+	case err := <-done:
+		t.Fatalf("expected set over the limit blocked, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	if err := <-done; err != nil {
+		t.Errorf("expected set once a slot freed, got %s", err)
+	}
+
+	// Set and SetReader of a key take the write slot and the key lock in the same order
+	unlock := blocking.keyLocks.lock("key")
+	go func() { done <- blocking.Set("key", randBytes(10)) }()
+	time.Sleep(20 * time.Millisecond)
+	go func() { done <- blocking.SetReader("key", bytes.NewReader(randBytes(1024)), 1024) }()
+	time.Sleep(20 * time.Millisecond)
+	unlock()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("expected set, got %s", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected Set and SetReader not deadlocked")
+		}
+	}
+}
+
+func TestPriority(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	if cache.WithPriority(PriorityForeground) != Interface(cache) {
+		t.Errorf("expected the cache itself in the foreground")
+	}
+	bg := cache.WithPriority(PriorityBackground)
+	if err := bg.Set("key", randBytes(10)); err != nil {
+		t.Fatalf("set in the background: %s", err)
+	}
+
+	// background operations wait for the foreground ones in progress
+	done := cache.sched.begin(PriorityForeground)
+	got := make(chan error)
+	go func() {
+		_, err := bg.Get("key", nil)
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		t.Fatalf("expected the background get waiting, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if _, err := cache.Get("key", nil); err != nil {
+		t.Errorf("expected foreground get not waiting, got %s", err)
+	}
+	done()
+	if err := <-got; err != nil {
+		t.Errorf("expected the background get once idle, got %s", err)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	origin, cancelOrigin := newCache()
+	defer cancelOrigin()
+	srv := httptest.NewServer(NewHandler(origin))
+	defer srv.Close()
+
+	val := randBytes(100)
+	if err := origin.Set("key", val); err != nil {
+		t.Fatalf("set origin: %s", err)
+	}
+
+	cache, cancel := newCache()
+	defer cancel()
+	cache.Prefetch([]string{"key"})
+	if cache.Has("key") {
+		t.Fatalf("expected nothing prefetched without a backend")
+	}
+	WithBackend(NewHTTPBackend(srv.URL, nil))(cache)
+	cache.Prefetch([]string{"key", "notFound"})
+	for deadline := time.Now().Add(5 * time.Second); !cache.Has("key") && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if got, err := cache.Get("key", nil); err != nil || !bytes.Equal(got, val) {
+		t.Fatalf("expected the value prefetched, err %v", err)
+	}
+	cache.Prefetch([]string{"key"})
+
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.Misses != 0 {
+		t.Errorf("expected the prefetched value hit, got %+v", stats)
+	}
+
+	// a Get of a key whose prefetch waits for the foreground does not wait too
+	busy, cancelBusy := newCache(WithBackend(NewHTTPBackend(srv.URL, nil)))
+	defer cancelBusy()
+	done := busy.sched.begin(PriorityForeground)
+	busy.Prefetch([]string{"key"})
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	if got, err := busy.Get("key", nil); err != nil || !bytes.Equal(got, val) {
+		t.Fatalf("expected the value fetched, err %v", err)
+	}
+	done()
+	if d := time.Since(start); d > backgroundMaxWait/2 {
+		t.Errorf("expected the get not waiting for the foreground, took %s", d)
+	}
+
+	// prefetches after closed are not started
+	busy.Close()
+	busy.Prefetch([]string{"key"})
+}
+
+func TestReadahead(t *testing.T) {
+	next := NextChunks(2)
+	for key, expected := range map[string][]string{
+		"file.2":   {"file.3", "file.4"},
+		"file.009": {"file.010", "file.011"},
+		"file.99":  {"file.100", "file.101"},
+		"file":     nil,
+	} {
+		if got := next(key); !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %v after %s, got %v", expected, key, got)
+		}
+	}
+
+	origin, cancelOrigin := newCache()
+	defer cancelOrigin()
+	srv := httptest.NewServer(NewHandler(origin))
+	defer srv.Close()
+	for _, key := range []string{"chunk.1", "chunk.2", "chunk.3"} {
+		if err := origin.Set(key, randBytes(100)); err != nil {
+			t.Fatalf("set origin: %s", err)
+		}
+	}
+
+	cache, cancel := newCache()
+	defer cancel()
+	WithBackend(NewHTTPBackend(srv.URL, nil))(cache)
+	WithPredictor(next)(cache)
+	if _, err := cache.Get("chunk.1", nil); err != nil {
+		t.Fatalf("get through backend: %s", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !(cache.Has("chunk.2") && cache.Has("chunk.3")) && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if !cache.Has("chunk.2") || !cache.Has("chunk.3") {
+		t.Errorf("expected the next chunks read ahead")
+	}
+}
+
+func TestChunkedStorage(t *testing.T) {
+	cache, cancel := newCache(WithChunkedStorage(1000, 1000, 1500))
+	defer cancel()
+
+	val := randBytes(3500)
+	if err := cache.Set("big", val); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if _, err := os.Stat(cache.filepath("big")); !os.IsNotExist(err) {
+		t.Errorf("expected no file of the chunked value, got %v", err)
+	}
+	m, _, ok := cache.statChunked("big")
+	if !ok || m.Size != 3500 || len(m.Chunks) != 4 {
+		t.Fatalf("expected 4 chunks of the value, got %+v", m)
+	}
+	if got, err := cache.Get("big", nil); err != nil || !bytes.Equal(got, val) {
+		t.Fatalf("expected the chunked value, err %v", err)
+	}
+	r, c, err := cache.GetAt("big")
+	if err != nil {
+		t.Fatalf("get at: %s", err)
+	}
+	buf := make([]byte, 1000)
+	if _, err := r.ReadAt(buf, 1500); err != nil || !bytes.Equal(buf, val[1500:2500]) {
+		t.Errorf("expected the range across chunks, err %v", err)
+	}
+	c.Close()
+	var out bytes.Buffer
+	if n, err := cache.GetTo("big", &out); err != nil || n != 3500 || !bytes.Equal(out.Bytes(), val) {
+		t.Errorf("expected the chunked value written, got %d bytes, err %v", n, err)
+	}
+	if info, err := cache.Stat("big"); err != nil || info.Size != 3500 {
+		t.Errorf("expected the size of the chunked value, got %+v, err %v", info, err)
+	}
+
+	// chunks already written are not written again
+	first := filepath.Join(cache.chunkpath("big"), m.Chunks[0].Sum)
+	fi, err := os.Stat(first)
+	if err != nil {
+		t.Fatalf("stat chunk: %s", err)
+	}
+	val2 := append(append([]byte(nil), val[:1000]...), randBytes(1500)...)
+	if err := cache.SetReader("big", bytes.NewReader(val2), int64(len(val2))); err != nil {
+		t.Fatalf("set again: %s", err)
+	}
+	if fi2, err := os.Stat(first); err != nil || !os.SameFile(fi, fi2) {
+		t.Errorf("expected the unchanged chunk kept, err %v", err)
+	}
+	if names, _ := readDirNames(cache.chunkpath("big")); len(names) != 4 {
+		t.Errorf("expected the old chunks dropped, got %v", names)
+	}
+	if got, err := cache.Get("big", nil); err != nil || !bytes.Equal(got, val2) {
+		t.Fatalf("expected the value set again, err %v", err)
+	}
+
+	// GC evicts the cold chunks, keeping the hot ones read by GetAt()
+	m, _, _ = cache.statChunked("big")
+	if err := cache.Set("other", val); err != nil {
+		t.Fatalf("set other: %s", err)
+	}
+	for i, name := range []string{"other", "big"} {
+		old := time.Now().Add(time.Duration(i-2) * time.Hour)
+		dir := cache.chunkpath(name)
+		names, _ := readDirNames(dir)
+		for _, n := range names {
+			os.Chtimes(filepath.Join(dir, n), old, old)
+		}
+	}
+	cache.touchChunk(filepath.Join(cache.chunkpath("big"), m.Chunks[1].Sum))
+	cache.gc()
+	if cache.Has("big") || cache.Has("other") {
+		t.Errorf("expected the values evicted in part missing")
+	}
+	if _, err := os.Stat(cache.chunkpath("other")); !os.IsNotExist(err) {
+		t.Errorf("expected the value evicted entirely dropped, got %v", err)
+	}
+	if r, c, err = cache.GetAt("big"); err != nil {
+		t.Fatalf("get at evicted in part: %s", err)
+	}
+	defer c.Close()
+	if _, err := r.ReadAt(buf, 1000); err != nil || !bytes.Equal(buf, val2[1000:2000]) {
+		t.Errorf("expected the hot chunk kept, err %v", err)
+	}
+	if _, err := r.ReadAt(buf, 0); err != ErrNotFound {
+		t.Errorf("expected the cold chunk evicted, got %v", err)
+	}
+
+	if err := cache.Delete("big"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err := os.Stat(cache.chunkpath("big")); !os.IsNotExist(err) {
+		t.Errorf("expected the chunks deleted, got %v", err)
+	}
+
+	// chunked values are taken
+	if err := cache.Set("taken", val); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if got, err := cache.Take("taken"); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected the chunked value taken, err %v", err)
+	}
+	if _, err := os.Stat(cache.chunkpath("taken")); !os.IsNotExist(err) || cache.Has("taken") {
+		t.Errorf("expected the taken chunks dropped, got %v", err)
+	}
+	if _, err := cache.Take("taken"); err != ErrNotFound {
+		t.Errorf("expected taken once, got %v", err)
+	}
+
+	// chunks left being written are removed on open
+	dir := t.TempDir()
+	open := func() *Cache {
+		ci, err := New(WithCacheDir(dir), WithChunkedStorage(1000, 1000, 0))
+		if err != nil {
+			t.Fatalf("new: %s", err)
+		}
+		return ci.(*Cache)
+	}
+	reopened := open()
+	if err := reopened.Set("big", val); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	tmp := filepath.Join(reopened.chunkpath("big"), chunkTmpPrefix+"123")
+	if err := ioutil.WriteFile(tmp, randBytes(10), 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	reopened.Close()
+	reopened = open()
+	defer reopened.Close()
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("expected the tmp chunk removed, got %v", err)
+	}
+	if got, err := reopened.Get("big", nil); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected the chunked value kept, err %v", err)
+	}
+}
+
+func TestSetPatch(t *testing.T) {
+	cache, cancel := newCache(WithChunkedStorage(1000, 1000, 0))
+	defer cancel()
+
+	inodes := func(key string) map[string]uint64 {
+		m, _, ok := cache.statChunked(key)
+		if !ok {
+			t.Fatalf("expected %s chunked", key)
+		}
+		rst := map[string]uint64{}
+		for _, c := range m.Chunks {
+			fi, err := os.Stat(filepath.Join(cache.chunkpath(key), c.Sum))
+			if err != nil {
+				t.Fatalf("stat chunk: %s", err)
+			}
+			rst[c.Sum] = fi.Sys().(*syscall.Stat_t).Ino
+		}
+		return rst
+	}
+	written := func(before, after map[string]uint64) int {
+		n := 0
+		for sum, ino := range after {
+			if before[sum] != ino {
+				n++
+			}
+		}
+		return n
+	}
+
+	val := randBytes(4000)
+	if err := cache.Set("big", val); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	before := inodes("big")
+
+	// bytes inserted do not shift the chunks after them
+	val = append(append(append([]byte(nil), val[:1500]...), randBytes(10)...), val[1500:]...)
+	if err := cache.Set("big", val); err != nil {
+		t.Fatalf("set again: %s", err)
+	}
+	after := inodes("big")
+	if n := written(before, after); n != 2 {
+		t.Errorf("expected 2 chunks written around the bytes inserted, got %d", n)
+	}
+	if got, err := cache.Get("big", nil); err != nil || !bytes.Equal(got, val) {
+		t.Fatalf("expected the new version, err %v", err)
+	}
+
+	// zero-filled chunks are found too
+	zeros := append(append(randBytes(1000), make([]byte, 1000)...), randBytes(2000)...)
+	if err := cache.Set("zeros", zeros); err != nil {
+		t.Fatalf("set zeros: %s", err)
+	}
+	zeroSum := chunkSum(make([]byte, 1000))
+	zeroIno := inodes("zeros")[zeroSum]
+	zeros = append(append(append([]byte(nil), zeros[:500]...), randBytes(10)...), zeros[500:]...)
+	if err := cache.Set("zeros", zeros); err != nil {
+		t.Fatalf("set zeros again: %s", err)
+	}
+	if ino := inodes("zeros")[zeroSum]; ino != zeroIno {
+		t.Errorf("expected the zero-filled chunk kept")
+	}
+
+	// chunks kept by a new version since scanned are not evicted
+	zeroName := filepath.Join(cache.filename("zeros"), zeroSum)
+	fi, err := os.Lstat(filepath.Join(cache.chunkdir(), zeroName))
+	if err != nil {
+		t.Fatalf("stat chunk: %s", err)
+	}
+	scanned := map[string]os.FileInfo{zeroName: fi}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(cache.chunkdir(), zeroName), later, fi.ModTime()); err != nil {
+		t.Fatalf("chtimes: %s", err)
+	}
+	if n, _ := cache.evictChunks(cache.filename("zeros"), []string{zeroName}, scanned); n != 0 {
+		t.Errorf("expected the chunk touched since scanned not evicted")
+	}
+
+	before = after
+	patch := randBytes(5)
+	if err := cache.SetPatch("big", 100, patch); err != nil {
+		t.Fatalf("patch: %s", err)
+	}
+	copy(val[100:], patch)
+	if n := written(before, inodes("big")); n != 1 {
+		t.Errorf("expected 1 chunk written by the patch, got %d", n)
+	}
+	if err := cache.SetPatch("big", int64(len(val)), patch); err != nil {
+		t.Fatalf("patch at the end: %s", err)
+	}
+	val = append(val, patch...)
+	if got, err := cache.Get("big", nil); err != nil || !bytes.Equal(got, val) {
+		t.Fatalf("expected the value patched, err %v", err)
+	}
+	if err := cache.SetPatch("big", int64(len(val))+1, patch); err != ErrPatchOffset {
+		t.Errorf("expected patch offset error, got %v", err)
+	}
+
+	if err := cache.Set("small", []byte("hello world")); err != nil {
+		t.Fatalf("set small: %s", err)
+	}
+	if err := cache.SetPatch("small", 6, []byte("there!")); err != nil {
+		t.Fatalf("patch small: %s", err)
+	}
+	if got, err := cache.Get("small", nil); err != nil || string(got) != "hello there!" {
+		t.Errorf("expected the small value patched, got %q, err %v", got, err)
+	}
+	if err := cache.SetPatch("notFound", 0, patch); err != ErrNotFound {
+		t.Errorf("expected not found error, got %v", err)
+	}
+
+	headed, cancel2 := newCache(WithEntryHeader())
+	defer cancel2()
+	if err := headed.SetWithTTL("ttl", []byte("hello world"), time.Hour); err != nil {
+		t.Fatalf("set with ttl: %s", err)
+	}
+	h, ok := headed.storedHeader("ttl")
+	if !ok || h.expireAt == 0 {
+		t.Fatalf("expected the ttl in the header")
+	}
+	if err := headed.SetPatch("ttl", 6, []byte("there")); err != nil {
+		t.Fatalf("patch with ttl: %s", err)
+	}
+	if got, ok := headed.storedHeader("ttl"); !ok || got.expireAt != h.expireAt {
+		t.Errorf("expected the ttl kept by the patch, got %d, want %d", got.expireAt, h.expireAt)
+	}
+
+	// concurrent patches of different bytes are not lost
+	if err := headed.Set("concurrent", make([]byte, 64)); err != nil {
+		t.Fatalf("set concurrent: %s", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := headed.SetPatch("concurrent", int64(i), []byte{1}); err != nil {
+				t.Errorf("patch concurrent: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got, err := headed.Get("concurrent", nil); err != nil || !bytes.Equal(got, bytes.Repeat([]byte{1}, 64)) {
+		t.Errorf("expected all the patches, got %v, err %v", got, err)
+	}
+}
+
+func TestDictCompression(t *testing.T) {
+	cache, cancel := newCache(WithDictCompression(1024), WithMaxBytes(1024*1024))
+	defer cancel()
+
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"name":"user-%d","email":"user-%d@example.com","country":"NL",`+
+			`"preferences":{"theme":"dark","language":"en-US","notifications":true,"newsletter":false},"token":"%x"}`,
+			i, i, i, randBytes(8)))
+	}
+	if _, err := cache.TrainDict(10, 0); err != errNoSamples {
+		t.Errorf("expected no samples error, got %v", err)
+	}
+	if err := cache.Set("raw", value(0)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	for i := 1; i <= 50; i++ {
+		if err := cache.Set(fmt.Sprintf("key%d", i), value(i)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(cache.filepath("key1"), old, old); err != nil {
+		t.Fatalf("chtimes: %s", err)
+	}
+	version, err := cache.TrainDict(50, 4096)
+	if err != nil || version != 1 {
+		t.Fatalf("expected dictionary 1, got %d, err %v", version, err)
+	}
+	if fi, err := os.Stat(cache.filepath("key1")); err != nil || !atime(fi).Equal(old) {
+		t.Errorf("expected the access time of the samples kept, err %v", err)
+	}
+
+	val := value(100)
+	if err := cache.Set("compressed", val); err != nil {
+		t.Fatalf("set compressed: %s", err)
+	}
+	buf, err := ioutil.ReadFile(cache.filepath("compressed"))
+	if err != nil {
+		t.Fatalf("read entry: %s", err)
+	}
+	if h, ok := parseEntryHeader(buf); !ok || h.codec != codecDeflateDict || h.dict != 1 {
+		t.Errorf("expected the entry compressed by dictionary 1, got %+v", h)
+	}
+	if len(buf) > entryHeaderLen+len(val)/2 {
+		t.Errorf("expected the value compressed to less than half, got %d of %d bytes", len(buf)-entryHeaderLen, len(val))
+	}
+
+	if version, err = cache.TrainDict(50, 4096); err != nil || version != 2 {
+		t.Fatalf("expected dictionary 2, got %d, err %v", version, err)
+	}
+	for key, expected := range map[string][]byte{"compressed": val, "raw": nil} {
+		got, err := cache.Get(key, nil)
+		if err != nil || (expected != nil && !bytes.Equal(got, expected)) {
+			t.Errorf("expected %s read, err %v", key, err)
+		}
+	}
+	var w bytes.Buffer
+	if _, err := cache.GetTo("compressed", &w); err != nil || !bytes.Equal(w.Bytes(), val) {
+		t.Errorf("expected the value decompressed by GetTo(), err %v", err)
+	}
+
+	// dictionaries are kept for the entries compressed by them
+	dicts := &dictStore{maxValueBytes: 1024}
+	if err := dicts.load(cache.dictdir()); err != nil || dicts.current != 2 || len(dicts.dicts) != 2 {
+		t.Errorf("expected 2 dictionaries saved, got %d, err %v", len(dicts.dicts), err)
+	}
+
+	if _, err := New(WithCacheDir(cache.cacheDir+"-chunked"), WithDictCompression(1024),
+		WithChunkedStorage(1024, 0, 0)); err != ErrDictChunks {
+		t.Errorf("expected chunked storage rejected, got %v", err)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"name":"user-%d","email":"user-%d@example.com","country":"NL",`+
+			`"preferences":{"theme":"dark","language":"en-US","notifications":true,"newsletter":false}}`, i, i, i))
+	}
+	for _, engine := range []Engine{EngineFile, EngineHybrid} {
+		cache, cancel := newCache(WithDictCompression(1024), WithMaxBytes(1024*1024), WithEngine(engine),
+			WithMaintenance(time.Hour, 20))
+		for i := 0; i < 30; i++ {
+			if err := cache.Set(fmt.Sprintf("key%02d", i), value(i)); err != nil {
+				t.Fatalf("set: %s", err)
+			}
+		}
+		before, _ := cache.Stat("key00")
+		if _, err := cache.TrainDict(30, 0); err != nil {
+			t.Fatalf("train: %s", err)
+		}
+
+		// a batch a pass, continuing from the last
+		cache.maintain()
+		if stats := cache.Stats(); stats.Recompressed != 20 || stats.RecompressedBytes <= 0 {
+			t.Errorf("expected a batch of %v entries recompressed, got %+v", engine, stats)
+		}
+		cache.maintain()
+		if stats := cache.Stats(); stats.Recompressed != 30 {
+			t.Errorf("expected all %v entries recompressed, got %d", engine, stats.Recompressed)
+		}
+		for i := 0; i < 30; i++ {
+			if got, err := cache.Get(fmt.Sprintf("key%02d", i), nil); err != nil || !bytes.Equal(got, value(i)) {
+				t.Errorf("expected the %v value recompressed, err %v", engine, err)
+			}
+		}
+		if after, err := cache.Stat("key00"); err != nil || !after.Updated.Equal(before.Updated) {
+			t.Errorf("expected the modification time of the %v entry kept, got %v and %v", engine, before.Updated, after.Updated)
+		}
+		cancel()
+	}
+}
+
+func TestEvictionGhosts(t *testing.T) {
+	cache, cancel := newCache(WithEvictionGhosts(10))
+	defer cancel()
+	for i := 0; i < 4; i++ {
+		if err := cache.Set(fmt.Sprintf("key%d", i), randBytes(1024)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	cache.gc()
+
+	var evicted int64
+	for i := 0; i < 4; i++ {
+		if _, err := cache.Get(fmt.Sprintf("key%d", i), nil); err == ErrNotFound {
+			evicted++
+		}
+	}
+	if evicted == 0 {
+		t.Fatalf("expected keys evicted")
+	}
+	if got := cache.Stats().PrematureEvictions; got != evicted {
+		t.Errorf("expected %d premature evictions, got %d", evicted, got)
+	}
+
+	// once an eviction, and not for keys never cached
+	for i := 0; i < 4; i++ {
+		cache.Get(fmt.Sprintf("key%d", i), nil)
+	}
+	cache.Get("never", nil)
+	if got := cache.Stats().PrematureEvictions; got != evicted {
+		t.Errorf("expected %d premature evictions still, got %d", evicted, got)
+	}
+
+	// a key evicted twice is counted twice
+	var g ghostList
+	g.max = 10
+	g.add("twice")
+	g.add("twice")
+	if !g.take("twice") || !g.take("twice") || g.take("twice") {
+		t.Errorf("expected 2 evictions of the key taken")
+	}
+}
+
+func TestListEntries(t *testing.T) {
+	cache, cancel := newCache(WithMaxBytes(1024 * 1024))
+	defer cancel()
+	for i := 0; i < 5; i++ {
+		if err := cache.Set(fmt.Sprintf("a%d", i), randBytes(10*(i+1))); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	if err := cache.Set("b", randBytes(10)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	tenant, err := cache.Tenant("team", TenantConfig{})
+	if err != nil {
+		t.Fatalf("tenant: %s", err)
+	}
+	if err := tenant.Set("a0", randBytes(10)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+
+	// pages of 2 entries by the cursors
+	var keys []string
+	opts := ListOptions{Prefix: "a", Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("expected 3 pages")
+		}
+		entries, next, err := cache.ListEntries(opts)
+		if err != nil {
+			t.Fatalf("list: %s", err)
+		}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		if next == "" {
+			break
+		}
+		opts.Cursor = next
+	}
+	if want := []string{"a0", "a1", "a2", "a3", "a4"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("expected keys %v, got %v", want, keys)
+	}
+	if n := len(cache.lists.snaps); n != 0 {
+		t.Errorf("expected the key snapshot dropped after the last page, got %d", n)
+	}
+	// a cursor whose snapshot expired lists the keys again
+	entries, next, err := cache.ListEntries(ListOptions{Prefix: "a", Limit: 2, Cursor: "ffff:a2"})
+	if err != nil || len(entries) != 2 || entries[0].Key != "a3" || next != "" {
+		t.Errorf("expected a3 and a4 listed again, got %+v, %q, %v", entries, next, err)
+	}
+	if _, _, err := cache.ListEntries(ListOptions{Cursor: "a2"}); err != ErrInvalidCursor {
+		t.Errorf("expected invalid cursor, got %v", err)
+	}
+
+	entries, _, err = cache.ListEntries(ListOptions{Prefix: "a", MinSize: 20, MaxSize: 40})
+	if err != nil || len(entries) != 3 || entries[0].Key != "a1" || entries[2].Key != "a3" {
+		t.Errorf("expected the entries of sizes 20 to 40, got %+v, %v", entries, err)
+	}
+	entries, _, err = cache.ListEntries(ListOptions{Namespace: "team"})
+	if err != nil || len(entries) != 1 || entries[0].Key != "team:a0" {
+		t.Errorf("expected the entry of the tenant, got %+v, %v", entries, err)
+	}
+	entries, _, err = cache.ListEntries(ListOptions{MinAge: time.Hour})
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected no entry an hour old, got %+v, %v", entries, err)
+	}
+}
@@ -0,0 +1,85 @@
+package fscache
+
+import "io"
+
+// Chain returns a cache composed of caches as levels, from the fastest to the slowest,
+// e.g. a cache in memory, a cache on a local disk, and a cache on NFS shared by hosts.
+// Get falls through the levels until one has the key, and back-fills the levels above it,
+// so that keys hit in slow levels are hit in fast ones afterwards. Set, Delete and Close apply
+// to every level, Delete to the levels which are Deleters and Close to the ones which are io.Closers,
+// and return the first error of the levels.
+func Chain(caches ...Interface) Interface { return chain(caches) }
+
+type chain []Interface
+
+// Set implements Interface.Set(), setting every level, so that evicted from a level a key is still hit below.
+func (c chain) Set(key string, src []byte) error {
+	var err error
+	for _, level := range c {
+		if serr := level.Set(key, src); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// Get implements Interface.Get(). Errors of a level other than ErrNotFound, e.g. of an unavailable
+// NFS cache, are taken as misses of the level, and returned only if no level has the key.
+func (c chain) Get(key string, dst []byte) ([]byte, error) {
+	err := ErrNotFound
+	for i, level := range c {
+		val, gerr := level.Get(key, dst)
+		if gerr != nil {
+			if gerr != ErrNotFound && err == ErrNotFound {
+				err = gerr
+			}
+			continue
+		}
+		// back-filling is best effort, as the value is got anyway
+		for _, upper := range c[:i] {
+			upper.Set(key, val[len(dst):])
+		}
+		return val, nil
+	}
+	return dst, err
+}
+
+// Has implements Interface.Has().
+func (c chain) Has(key string) bool {
+	for _, level := range c {
+		if level.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete implements Deleter.Delete(), deleting from the levels which are Deleters.
+func (c chain) Delete(key string) error {
+	var err error
+	for _, level := range c {
+		d, ok := level.(Deleter)
+		if !ok {
+			continue
+		}
+		if derr := d.Delete(key); err == nil {
+			err = derr
+		}
+	}
+	return err
+}
+
+// Close implements io.Closer, closing the levels which are io.Closers.
+func (c chain) Close() error {
+	var err error
+	for _, level := range c {
+		closer, ok := level.(io.Closer)
+		if !ok {
+			continue
+		}
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
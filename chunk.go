@@ -0,0 +1,551 @@
+package fscache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// WithChunkedStorage stores the values over thresholdBytes set by Set() or SetReader() as chunks of
+// chunkBytes, 4MB if not positive, in files of their own listed by a manifest under the chunks dir,
+// for very large artifacts. GetAt() reads only the chunks of the ranges read, Get() reads the chunks
+// in parallel, and a value set again, e.g. after a failed SetReader(), skips writing the chunks already there.
+// GC evicts the least recently read chunks over maxBytes, keeping the hot chunks of values read in part,
+// whose ranges kept are still read by GetAt(), while Get() and Has() miss them. Chunked values are not
+// counted by WithMaxBytes(), and are never evicted if maxBytes is not positive.
+// Values are not chunked with WithTransforms(), WithEntryHeader() or WithStorage().
+func WithChunkedStorage(thresholdBytes, chunkBytes, maxBytes int64) Option {
+	return func(fc *Cache) {
+		if chunkBytes <= 0 {
+			chunkBytes = defaultChunkBytes
+		}
+		fc.chunks = &chunkStore{threshold: thresholdBytes, chunkBytes: chunkBytes, maxBytes: maxBytes}
+	}
+}
+
+const (
+	defaultChunkBytes = 4 << 20
+	// chunkWorkers is how many chunks of a value are read or written at once.
+	chunkWorkers = 4
+	// chunkManifestName is the name of the manifest in the dir of a chunked value.
+	chunkManifestName = "manifest"
+	// chunkTmpPrefix prefixes the names of chunks and manifests being written.
+	chunkTmpPrefix = ".tmp-"
+	// chunkTmpMaxAge is how old chunks and manifests being written by other caches sharing the cache dir
+	// are when left by a crash, see cleanChunkTmp().
+	chunkTmpMaxAge = time.Hour
+)
+
+// chunkStore is the config of chunked values.
+type chunkStore struct {
+	threshold, chunkBytes, maxBytes int64
+}
+
+// chunkManifest lists the chunks of a value.
+type chunkManifest struct {
+	Size   int64      `json:"size"`
+	Chunks []chunkRef `json:"chunks"`
+}
+
+// chunkRef is a chunk of a value, stored in the file named by its sum, so that identical chunks
+// of a value are stored once.
+type chunkRef struct {
+	Size int64  `json:"size"`
+	Sum  string `json:"sum"`
+	// Weak is the rolling sum of a chunk of the chunk size, by which the next version of the value
+	// finds it at any offset, see writeDelta(). It is nil for shorter chunks.
+	Weak *uint32 `json:"weak,omitempty"`
+}
+
+func (f *Cache) chunkdir() string            { return filepath.Join(f.cacheDir, "chunks") }
+func (f *Cache) chunkpath(key string) string { return filepath.Join(f.chunkdir(), f.filename(key)) }
+
+// chunked tells if a value of size bytes is chunked.
+func (f *Cache) chunked(size int64) bool {
+	return f.chunks != nil && size > f.chunks.threshold &&
+		f.storage == nil && len(f.transforms) == 0 && !f.entryHeader
+}
+
+// chunkSum returns the sum naming the chunk buf.
+func chunkSum(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:16])
+}
+
+// statChunked returns the manifest of the value of key and the info of its file, false if it is not chunked.
+func (f *Cache) statChunked(key string) (*chunkManifest, os.FileInfo, bool) {
+	if f.chunks == nil {
+		return nil, nil, false
+	}
+	// most keys are not chunked, whose dirs are missing, which is told without reading a manifest
+	if _, err := os.Lstat(f.chunkpath(key)); err != nil {
+		return nil, nil, false
+	}
+	file, err := os.Open(filepath.Join(f.chunkpath(key), chunkManifestName))
+	if err != nil {
+		return nil, nil, false
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, nil, false
+	}
+	m := &chunkManifest{}
+	if err := json.NewDecoder(file).Decode(m); err != nil {
+		f.logger.Errorf("read chunk manifest of %s : %s", key, err)
+		return nil, nil, false
+	}
+	return m, fi, true
+}
+
+// cleanChunkTmp removes the chunks and manifests left being written by a crash in the dirs of chunked values.
+// Those of other caches sharing the cache dir are removed only if older than chunkTmpMaxAge.
+func (f *Cache) cleanChunkTmp() error {
+	names, err := readDirNames(f.chunkdir())
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		dir := filepath.Join(f.chunkdir(), name)
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !vanished(err) {
+				f.logger.Errorf("read chunk dir %s : %s", dir, err)
+			}
+			continue
+		}
+		for _, fi := range fis {
+			if !strings.HasPrefix(fi.Name(), chunkTmpPrefix) || f.shared && time.Since(fi.ModTime()) < chunkTmpMaxAge {
+				continue
+			}
+			fp := filepath.Join(dir, fi.Name())
+			if err := os.Remove(fp); err != nil && !vanished(err) {
+				f.logger.Errorf("remove tmp chunk %s : %s", fp, err)
+			}
+		}
+	}
+	return nil
+}
+
+// complete tells if no chunk of m in dir has been evicted.
+func (m *chunkManifest) complete(dir string) bool {
+	for _, c := range m.Chunks {
+		if _, err := os.Lstat(filepath.Join(dir, c.Sum)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// chunkGroup runs fns with chunkWorkers goroutines, and keeps the first error.
+type chunkGroup struct {
+	wg  sync.WaitGroup
+	sem chan struct{}
+	mu  sync.Mutex
+	err error
+}
+
+func newChunkGroup() *chunkGroup { return &chunkGroup{sem: make(chan struct{}, chunkWorkers)} }
+
+func (g *chunkGroup) run(fn func() error) {
+	g.sem <- struct{}{}
+	g.wg.Add(1)
+	go func() {
+		defer func() { <-g.sem; g.wg.Done() }()
+		if err := fn(); err != nil {
+			g.fail(err)
+		}
+	}()
+}
+
+func (g *chunkGroup) fail(err error) {
+	g.mu.Lock()
+	if g.err == nil {
+		g.err = err
+	}
+	g.mu.Unlock()
+}
+
+func (g *chunkGroup) failed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err != nil
+}
+
+func (g *chunkGroup) wait() error {
+	g.wg.Wait()
+	return g.err
+}
+
+// setChunked sets the value of key as size bytes read from r in chunks, with the key locked.
+// A new version of a chunked value only writes the chunks changed, see writeDelta().
+func (f *Cache) setChunked(key string, r io.Reader, size int64, meta entryMeta) error {
+	dir := f.chunkpath(key)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	var (
+		m   *chunkManifest
+		err error
+	)
+	if old, _, ok := f.statChunked(key); ok {
+		m, err = f.writeDelta(dir, old, r, size)
+	} else {
+		m, err = f.writeChunks(dir, r, size)
+	}
+	f.health.observeWrite(err)
+	if err != nil {
+		return err
+	}
+	return f.commitChunked(key, m, meta)
+}
+
+// writeChunks writes size bytes read from r into dir in chunks of the chunk size.
+func (f *Cache) writeChunks(dir string, r io.Reader, size int64) (*chunkManifest, error) {
+	m := &chunkManifest{Size: size}
+	g := newChunkGroup()
+	for off := int64(0); off < size && !g.failed(); off += f.chunks.chunkBytes {
+		buf := make([]byte, f.chunks.chunkBytes)
+		if size-off < int64(len(buf)) {
+			buf = buf[:size-off]
+		}
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			g.fail(err)
+			break
+		}
+		f.addChunk(g, m, dir, buf)
+	}
+	return m, g.wait()
+}
+
+// addChunk appends the chunk buf, which must not be modified after, to m, writing it into dir with g.
+func (f *Cache) addChunk(g *chunkGroup, m *chunkManifest, dir string, buf []byte) {
+	c := chunkRef{Size: int64(len(buf)), Sum: chunkSum(buf)}
+	if c.Size == f.chunks.chunkBytes {
+		var s rollingSum
+		s.init(buf)
+		weak := s.sum()
+		c.Weak = &weak
+	}
+	m.Chunks = append(m.Chunks, c)
+	g.run(func() error { return f.writeChunk(dir, c.Sum, buf) })
+}
+
+// commitChunked writes the manifest m of the chunks of key written, with the key locked,
+// and drops the chunks of the old value and the old value of key stored otherwise.
+func (f *Cache) commitChunked(key string, m *chunkManifest, meta entryMeta) error {
+	dir := f.chunkpath(key)
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := f.writeChunkFile(dir, chunkManifestName, buf); err != nil {
+		return err
+	}
+	names, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool, len(m.Chunks)+1)
+	live[chunkManifestName] = true
+	for _, c := range m.Chunks {
+		live[c.Sum] = true
+	}
+	for _, name := range names {
+		if !live[name] {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	if _, err := f.packs.remove(key); err != nil {
+		return err
+	}
+	if err := f.removeStored(f.filepath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f.index.remove(key)
+	f.policy.remove(key)
+	return f.recorded(key, m.Size, meta)
+}
+
+// writeChunk writes the chunk buf of sum into dir, unless it is there already.
+func (f *Cache) writeChunk(dir, sum string, buf []byte) error {
+	if fi, err := os.Lstat(filepath.Join(dir, sum)); err == nil && fi.Size() == int64(len(buf)) {
+		return nil
+	}
+	return f.writeChunkFile(dir, sum, buf)
+}
+
+// writeChunkFile writes buf into the file of name in dir atomically.
+func (f *Cache) writeChunkFile(dir, name string, buf []byte) error {
+	tmp, err := ioutil.TempFile(dir, chunkTmpPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil && f.durable {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// dropChunked drops the chunked value of key, locked, telling if there was one.
+func (f *Cache) dropChunked(key string) (bool, error) {
+	if f.chunks == nil {
+		return false, nil
+	}
+	dir := f.chunkpath(key)
+	if _, err := os.Lstat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, os.RemoveAll(dir)
+}
+
+// getChunked appends the value of key listed by m to dst, reading its chunks in parallel.
+func (f *Cache) getChunked(key string, m *chunkManifest, dst []byte) ([]byte, error) {
+	n := len(dst)
+	if int64(cap(dst)-n) < m.Size {
+		dst = append(make([]byte, 0, int64(n)+m.Size), dst...)
+	}
+	dst = dst[:int64(n)+m.Size]
+	var (
+		dir = f.chunkpath(key)
+		g   = newChunkGroup()
+		off = int64(n)
+	)
+	for _, c := range m.Chunks {
+		c, buf := c, dst[off:off+c.Size]
+		off += c.Size
+		g.run(func() error { return f.readChunk(dir, c, buf) })
+	}
+	if err := g.wait(); err != nil {
+		return dst[:n], err
+	}
+	return dst, nil
+}
+
+// readChunk reads the chunk c in dir into dst, verifying its sum.
+func (f *Cache) readChunk(dir string, c chunkRef, dst []byte) error {
+	fp := filepath.Join(dir, c.Sum)
+	file, err := os.Open(fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	defer file.Close()
+	if _, err := io.ReadFull(file, dst); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("chunk %s : %w", fp, ErrCorrupted)
+		}
+		return err
+	}
+	if chunkSum(dst) != c.Sum {
+		return fmt.Errorf("chunk %s : %w", fp, ErrCorrupted)
+	}
+	f.touchChunk(fp)
+	return nil
+}
+
+// touchChunk updates the access time of the chunk at fp read, by which GC evicts chunks.
+func (f *Cache) touchChunk(fp string) {
+	if !f.skipAtime {
+		now := time.Now()
+		os.Chtimes(fp, now, now)
+	}
+}
+
+// chunkReader reads a chunked value at random offsets, opening only the chunks read.
+type chunkReader struct {
+	f    *Cache
+	dir  string
+	m    *chunkManifest
+	offs []int64
+}
+
+func newChunkReader(f *Cache, key string, m *chunkManifest) *chunkReader {
+	r := &chunkReader{f: f, dir: f.chunkpath(key), m: m, offs: make([]int64, len(m.Chunks))}
+	var off int64
+	for i, c := range m.Chunks {
+		r.offs[i] = off
+		off += c.Size
+	}
+	return r
+}
+
+func (r *chunkReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.m.Size {
+		return 0, io.EOF
+	}
+	n := 0
+	i := sort.Search(len(r.offs), func(i int) bool { return r.offs[i] > off }) - 1
+	for ; n < len(p) && i < len(r.m.Chunks); i++ {
+		fp := filepath.Join(r.dir, r.m.Chunks[i].Sum)
+		file, err := os.Open(fp)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return n, ErrNotFound
+			}
+			return n, err
+		}
+		m, err := file.ReadAt(p[n:], off+int64(n)-r.offs[i])
+		file.Close()
+		n += m
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		r.f.touchChunk(fp)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// chunkedKeys returns the keys of the chunked values.
+func (f *Cache) chunkedKeys() ([]string, error) {
+	if f.chunks == nil {
+		return nil, nil
+	}
+	names, err := readDirNames(f.chunkdir())
+	return f.keysOf(names), err
+}
+
+// gcChunks evicts the least recently read chunks over the max bytes of chunked values,
+// and removes the values left without chunks.
+func (f *Cache) gcChunks() {
+	if f.chunks.maxBytes <= 0 {
+		return
+	}
+	names, err := readDirNames(f.chunkdir())
+	if err != nil {
+		f.gcErrorf("gc walk dir %s : %s", f.chunkdir(), err)
+		return
+	}
+	var (
+		infos    []os.FileInfo
+		curBytes int64
+	)
+	for _, name := range names {
+		fis, err := ioutil.ReadDir(filepath.Join(f.chunkdir(), name))
+		if err != nil {
+			if !vanished(err) {
+				f.gcErrorf("gc walk dir %s : %s", filepath.Join(f.chunkdir(), name), err)
+			}
+			continue
+		}
+		for _, fi := range fis {
+			st, ok := fi.Sys().(*syscall.Stat_t)
+			if !ok || fi.Name() == chunkManifestName {
+				continue
+			}
+			infos = append(infos, &entryInfo{name: filepath.Join(name, fi.Name()), st: *st})
+			curBytes += fi.Size()
+		}
+	}
+	if curBytes <= f.chunks.maxBytes {
+		return
+	}
+	scanned := make(map[string]os.FileInfo, len(infos))
+	for _, fi := range infos {
+		scanned[fi.Name()] = fi
+	}
+	var (
+		removed, removedBytes int64
+		victims               = map[string][]string{}
+		emptied               = map[string]bool{}
+	)
+	for _, name := range (lru{}).victims(infos, curBytes-f.chunks.maxBytes) {
+		victims[filepath.Dir(name)] = append(victims[filepath.Dir(name)], name)
+	}
+	for dir, names := range victims {
+		n, nBytes := f.evictChunks(dir, names, scanned)
+		removedBytes += nBytes
+		if n > 0 {
+			emptied[dir] = true
+		}
+	}
+	for name := range emptied {
+		key, ok := f.keyOf(name)
+		if ok && f.dropEmptyChunked(key) {
+			removed++
+		}
+	}
+	f.gcEvicted(removed, removedBytes)
+}
+
+// evictChunks removes the chunks names of the chunked value in dir with its key locked,
+// so that the chunks kept by a new version being written, see writeDelta(), are not removed.
+// The chunks read or kept since scanned are skipped. It returns the count and the bytes of the chunks removed.
+func (f *Cache) evictChunks(dir string, names []string, scanned map[string]os.FileInfo) (n int, nBytes int64) {
+	if key, ok := f.keyOf(dir); ok {
+		defer f.keyLocks.lock(key)()
+	}
+	for _, name := range names {
+		fp := filepath.Join(f.chunkdir(), name)
+		if fi, err := os.Lstat(fp); err == nil && atime(fi).After(atime(scanned[name])) {
+			continue
+		}
+		if err := os.Remove(fp); err != nil {
+			if !vanished(err) {
+				f.gcErrorf("gc %s : %s", fp, err)
+			}
+			continue
+		}
+		n++
+		nBytes += scanned[name].Size()
+	}
+	return n, nBytes
+}
+
+// dropEmptyChunked drops the chunked value of key if all its chunks have been evicted,
+// telling if it was dropped.
+func (f *Cache) dropEmptyChunked(key string) bool {
+	defer f.keyLocks.lock(key)()
+	dir := f.chunkpath(key)
+	names, err := readDirNames(dir)
+	if err != nil {
+		return false
+	}
+	for _, name := range names {
+		if name != chunkManifestName {
+			return false
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		f.gcErrorf("gc %s : %s", dir, err)
+		return false
+	}
+	f.changed(EventEvict, key)
+	if err := f.dropMeta(key); err != nil && !vanished(err) {
+		f.gcErrorf("gc meta of %s : %s", key, err)
+	}
+	return true
+}
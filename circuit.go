@@ -0,0 +1,145 @@
+package fscache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// WithCircuitBreaker opens a circuit once failures consecutive Gets, Sets and Deletes fail with errors of
+// the filesystem, or take longer than slow if it is not zero, protecting the latency of requests from a
+// dying disk. While the circuit is open, the disk is left alone: Gets miss, so that a Chain() serves only
+// the hits of the levels above, e.g. in memory, and Sets and Deletes fail with ErrDegraded at once.
+// Every probeInterval, 10 seconds if it is not positive, a probe entry is set, got and removed, and the circuit
+// is closed once a probe succeeds in time. By default, there is no circuit breaker.
+func WithCircuitBreaker(failures int, slow, probeInterval time.Duration) Option {
+	if probeInterval <= 0 {
+		probeInterval = defaultProbeInterval
+	}
+	return func(fc *Cache) {
+		fc.breaker = &breaker{maxFailures: failures, slow: slow, probeInterval: probeInterval}
+	}
+}
+
+// defaultProbeInterval is how often the disk is probed while the circuit is open by default.
+const defaultProbeInterval = 10 * time.Second
+
+// breaker is a circuit breaker of the disk, all of whose methods may be called on a nil one, which never opens.
+type breaker struct {
+	maxFailures   int
+	slow          time.Duration
+	probeInterval time.Duration
+
+	open     int32
+	mu       sync.Mutex
+	failures int
+}
+
+// allow tells if the disk may be used, which is false while the circuit is open.
+func (b *breaker) allow() bool { return b == nil || atomic.LoadInt32(&b.open) == 0 }
+
+// failed tells if an operation taking d and failing with err counts against the disk,
+// unlike misses and the like.
+func (b *breaker) failed(d time.Duration, err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) || b.slow > 0 && d > b.slow
+}
+
+// observe counts an operation taking d and failing with err, and tells if it opened the circuit.
+func (b *breaker) observe(d time.Duration, err error) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.failed(d, err) {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures < b.maxFailures || !atomic.CompareAndSwapInt32(&b.open, 0, 1) {
+		return false
+	}
+	b.failures = 0
+	return true
+}
+
+func (b *breaker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	atomic.StoreInt32(&b.open, 0)
+}
+
+// writable tells if a write should be tried, neither degraded nor with the circuit open.
+func (f *Cache) writable() bool {
+	return f.breaker.allow() && f.health.allowWrite()
+}
+
+// observeDisk counts an operation on the disk started at start and failing with err to the circuit breaker.
+func (f *Cache) observeDisk(start time.Time, err error) {
+	d := time.Since(start)
+	if f.breaker.observe(d, err) {
+		f.logger.Errorf("circuit of the disk opened after %d failed or slow operations, the last taking %s : %v",
+			f.breaker.maxFailures, d, err)
+	}
+}
+
+// breakerRunner probes the disk while the circuit is open, and closes it once a probe succeeds in time.
+func (f *Cache) breakerRunner() {
+	ticker := time.NewTicker(f.breaker.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if f.breaker.allow() {
+				continue
+			}
+			start := time.Now()
+			err := f.probeDisk()
+			if d := time.Since(start); err != nil || f.breaker.failed(d, err) {
+				f.logger.Errorf("circuit of the disk kept open, probe taking %s : %v", d, err)
+				continue
+			}
+			f.breaker.close()
+			f.logger.Errorf("circuit of the disk closed")
+		case <-f.stopCh:
+			return
+		}
+	}
+}
+
+// probeDisk sets, gets and removes a probe entry in the storage.
+func (f *Cache) probeDisk() error {
+	key := ".probe-" + strconv.Itoa(os.Getpid()) + "-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	fp := f.filepath(key)
+	val := []byte(key)
+	if err := f.writeStoredOnce(key, val); err != nil {
+		return fmt.Errorf("set probe: %w", err)
+	}
+	file, _, err := f.openStored(fp)
+	if err != nil {
+		f.removeStored(fp)
+		return fmt.Errorf("get probe: %w", err)
+	}
+	got, err := ioutil.ReadAll(file)
+	file.Close()
+	if err == nil && !bytes.Equal(got, val) {
+		err = errors.New("value mismatched")
+	}
+	if err != nil {
+		f.removeStored(fp)
+		return fmt.Errorf("get probe: %w", err)
+	}
+	if err := f.removeStored(fp); err != nil {
+		return fmt.Errorf("remove probe: %w", err)
+	}
+	return nil
+}
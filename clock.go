@@ -0,0 +1,110 @@
+package fscache
+
+import (
+	"os"
+	"sync"
+)
+
+// WithClock makes GC evict entries by CLOCK instead of LRU, which approximates LRU with a reference bit
+// per entry in memory instead of atime, so Get() does not update atime, which is costly on some filesystems
+// or disabled by mount options. Entries found by GC but not set since the start are considered unreferenced.
+func WithClock() Option {
+	return func(fc *Cache) {
+		fc.policy = &clock{ref: map[string]bool{}}
+		fc.skipAtime = true
+	}
+}
+
+// clock keeps keys in a ring swept by a hand, evicting the keys unreferenced since the last sweep,
+// and clearing the reference bits of the others.
+type clock struct {
+	mu    sync.Mutex
+	ring  []string
+	ref   map[string]bool
+	hand  int
+	stale int
+}
+
+func (c *clock) add(key string, size int64, cost float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.ref[key]; !ok {
+		c.ring = append(c.ring, key)
+	}
+	c.ref[key] = true
+}
+
+func (c *clock) touch(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.ref[key]; ok {
+		c.ref[key] = true
+	}
+}
+
+func (c *clock) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.ref[key]; ok {
+		delete(c.ref, key)
+		c.stale++
+	}
+}
+
+// compact drops the keys removed from the ring, keeping the hand at the same key, with c.mu held.
+func (c *clock) compact() {
+	ring := make([]string, 0, len(c.ref))
+	hand := 0
+	for i, k := range c.ring {
+		if i == c.hand {
+			hand = len(ring)
+		}
+		if _, ok := c.ref[k]; ok {
+			ring = append(ring, k)
+		}
+	}
+	c.ring, c.hand, c.stale = ring, hand, 0
+	if c.hand >= len(c.ring) {
+		c.hand = 0
+	}
+}
+
+func (c *clock) victims(entries []os.FileInfo, needBytes int64) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sizes := make(map[string]int64, len(entries))
+	for _, fi := range entries {
+		sizes[fi.Name()] = fi.Size()
+		if _, ok := c.ref[fi.Name()]; !ok {
+			// set before the start or by others
+			c.ring = append(c.ring, fi.Name())
+			c.ref[fi.Name()] = false
+		}
+	}
+	if c.stale > 0 {
+		c.compact()
+	}
+
+	var (
+		keys       []string
+		bytesSoFar int64
+		chosen     = map[string]bool{}
+	)
+	// two rounds clear all reference bits, evicting every entry found if needed
+	for steps := 0; bytesSoFar < needBytes && steps < 2*len(c.ring); steps++ {
+		k := c.ring[c.hand]
+		c.hand = (c.hand + 1) % len(c.ring)
+		size, found := sizes[k]
+		if !found || chosen[k] {
+			continue
+		}
+		if c.ref[k] {
+			c.ref[k] = false
+			continue
+		}
+		chosen[k] = true
+		keys = append(keys, k)
+		bytesSoFar += size
+	}
+	return keys
+}
@@ -0,0 +1,289 @@
+// Command fscached serves a cache dir over HTTP as a daemon, with its metrics on an admin listener.
+//
+//	fscached -config /etc/fscached.json
+//	fscached migrate -dir /var/cache/fscached -from flat -to hashed
+//	fscached replay -log access.jsonl -max-bytes 1073741824,4294967296 -policies lru,arc
+//	fscached soak -dir /mnt/scratch/fscache -duration 1h
+//
+// Under systemd socket activation, the first socket passed is served instead of listening on the
+// listen address, and the second one if any instead of the admin address. SIGINT and SIGTERM shut the
+// daemon down gracefully, waiting for requests in flight up to the shutdown timeout.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sequix/fscache"
+)
+
+// config is the config file of the daemon in JSON, with the fields of fscache.Config configuring the cache,
+// which are overridden by the FSCACHE_ environment variables.
+type config struct {
+	fscache.Config
+	// Listen is the address serving the cache, ":8080" by default.
+	Listen string `json:"listen"`
+	// AdminListen is the address serving the metrics at /stats, /metrics and /gc, none if empty.
+	AdminListen string `json:"adminListen"`
+	// ShutdownTimeout is how long requests in flight are waited for at shutdown, "30s" by default.
+	ShutdownTimeout fscache.Duration `json:"shutdownTimeout"`
+}
+
+// commands is the subcommands by their names.
+var commands = map[string]func(args []string) error{
+	"migrate": migrate,
+	"replay":  replay,
+	"soak":    soak,
+}
+
+func loadConfig(path string) (*config, error) {
+	cfg := &config{Listen: ":8080", ShutdownTimeout: fscache.Duration(30 * time.Second)}
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		dec := json.NewDecoder(file)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("parse config %s : %w", path, err)
+		}
+	}
+	return cfg, cfg.ApplyEnv()
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+	configPath := flag.String("config", "", "path of the config file in JSON")
+	flag.Parse()
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := serve(*configPath, cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve serves the cache configured by cfg loaded from configPath until SIGINT or SIGTERM,
+// and reloads the settings tunable at runtime from configPath on SIGHUP.
+func serve(configPath string, cfg *config) error {
+	opts, err := cfg.Options()
+	if err != nil {
+		return err
+	}
+	c, err := fscache.New(opts...)
+	if err != nil {
+		return err
+	}
+	defer c.(io.Closer).Close()
+
+	activated, err := activationListeners()
+	if err != nil {
+		return err
+	}
+	servers := []*http.Server{{Handler: fscache.NewHandler(c)}}
+	addrs := []string{cfg.Listen}
+	if f, ok := c.(*fscache.Cache); ok && (cfg.AdminListen != "" || len(activated) > 1) {
+		servers = append(servers, &http.Server{Handler: fscache.NewAdminHandler(f)})
+		addrs = append(addrs, cfg.AdminListen)
+	}
+	errCh := make(chan error, len(servers))
+	for i, srv := range servers {
+		var l net.Listener
+		if i < len(activated) {
+			l = activated[i]
+		} else if l, err = net.Listen("tcp", addrs[i]); err != nil {
+			return err
+		}
+		log.Printf("serving on %s", l.Addr())
+		go func(srv *http.Server, l net.Listener) { errCh <- srv.Serve(l) }(srv, l)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := syscall.SIGHUP; sig == syscall.SIGHUP; {
+		select {
+		case s := <-sigCh:
+			sig = s.(syscall.Signal)
+		case err := <-errCh:
+			return err
+		}
+		if sig != syscall.SIGHUP {
+			log.Printf("shutting down on %s", sig)
+		} else if err := reload(c, configPath); err != nil {
+			log.Printf("reload %s : %s", configPath, err)
+		} else {
+			log.Printf("reloaded %s", configPath)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reload updates the settings of c tunable at runtime from the config file at configPath.
+func reload(c fscache.Interface, configPath string) error {
+	f, ok := c.(*fscache.Cache)
+	if !ok {
+		return fmt.Errorf("cache %T not reloadable", c)
+	}
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	return f.UpdateConfig(&cfg.Config)
+}
+
+// listenFdsStart is the first fd passed by systemd socket activation, after stdin, stdout and stderr.
+var listenFdsStart = 3
+
+// activationListeners returns the sockets passed by systemd socket activation, nil if none.
+func activationListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("parse LISTEN_FDS : %w", err)
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listen on fd %d : %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+var layouts = map[string]fscache.Layout{
+	"flat":   fscache.LayoutFlat,
+	"hashed": fscache.LayoutHashed,
+	"packed": fscache.LayoutPacked,
+	// not supported yet, failing to migrate
+	"fan-out": fscache.LayoutFanOut,
+}
+
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dir := fs.String("dir", "", "cache dir to migrate, which must not be in use")
+	from := fs.String("from", "flat", "layout of the cache dir: flat, hashed or packed")
+	to := fs.String("to", "", "layout to migrate to: flat, hashed or packed")
+	fs.Parse(args)
+	fromLayout, ok := layouts[*from]
+	toLayout, ok2 := layouts[*to]
+	if *dir == "" || !ok || !ok2 {
+		fs.Usage()
+		return errors.New("migrate needs -dir, and -from and -to among flat, hashed and packed")
+	}
+	return fscache.Migrate(*dir, fromLayout, toLayout, fscache.WithProgress(5*time.Second, func(p fscache.Progress) {
+		log.Printf("migrated %d/%d entries, %d bytes", p.Files, p.TotalFiles, p.Bytes)
+	}))
+}
+
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	logPath := fs.String("log", "", "access log in JSON lines of key, size and time")
+	maxBytes := fs.String("max-bytes", "", "comma separated quotas to simulate")
+	policies := fs.String("policies", "", "comma separated eviction policies to simulate, all by default")
+	gcInterval := fs.Duration("gc-interval", 5*time.Minute, "how often GC runs in the time of the log")
+	fs.Parse(args)
+	if *logPath == "" || *maxBytes == "" {
+		fs.Usage()
+		return errors.New("replay needs -log and -max-bytes")
+	}
+	cfg := fscache.ReplayConfig{GcInterval: *gcInterval}
+	for _, s := range strings.Split(*maxBytes, ",") {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("max bytes %q: %w", s, err)
+		}
+		cfg.MaxBytes = append(cfg.MaxBytes, n)
+	}
+	if *policies != "" {
+		cfg.Policies = strings.Split(*policies, ",")
+	}
+	file, err := os.Open(*logPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	results, err := fscache.Replay(file, cfg)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "POLICY\tMAX BYTES\tGETS\tHIT RATIO\tBYTE HIT RATIO\tEVICTIONS")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.4f\t%.4f\t%d\n", r.Policy, r.MaxBytes, r.Gets, r.HitRatio, r.ByteHitRatio, r.Evictions)
+	}
+	return w.Flush()
+}
+
+func soak(args []string) error {
+	fs := flag.NewFlagSet("soak", flag.ExitOnError)
+	dir := fs.String("dir", "", "cache dir to stress on the filesystem to validate, which must not be in use")
+	maxBytes := fs.Int64("max-bytes", 1<<30, "max bytes of the cache")
+	var cfg fscache.SoakConfig
+	fs.DurationVar(&cfg.Duration, "duration", time.Minute, "how long to stress the cache")
+	fs.IntVar(&cfg.Writers, "writers", 4, "goroutines setting keys")
+	fs.IntVar(&cfg.Readers, "readers", 4, "goroutines getting keys")
+	fs.IntVar(&cfg.Deleters, "deleters", 1, "goroutines deleting keys")
+	fs.IntVar(&cfg.Keys, "keys", 1000, "number of keys")
+	fs.IntVar(&cfg.MaxValueBytes, "max-value-bytes", 64*1024, "most bytes of a value")
+	fs.DurationVar(&cfg.CheckInterval, "check-interval", 10*time.Second, "how often to check the invariants")
+	fs.Parse(args)
+	if *dir == "" {
+		fs.Usage()
+		return errors.New("soak needs -dir")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	res, err := fscache.Soak(ctx, cfg, fscache.WithCacheDir(*dir), fscache.WithMaxBytes(*maxBytes))
+	if err != nil {
+		return err
+	}
+	log.Printf("%d sets, %d gets, %d hits, %d deletes, %d checks", res.Sets, res.Gets, res.Hits, res.Deletes, res.Checks)
+	for _, v := range res.Violations {
+		log.Printf("violation: %s", v)
+	}
+	if len(res.Violations) > 0 {
+		return fmt.Errorf("%d invariants broken", len(res.Violations))
+	}
+	return nil
+}
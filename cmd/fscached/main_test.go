@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a buffer written by the logger and read by tests concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// eventually tells if cond holds within 5 seconds.
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+// activate passes a socket listening on a random local port as if by systemd socket activation,
+// and returns its address.
+func activate(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	file, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("file of listener: %s", err)
+	}
+	defer file.Close()
+	// activationListeners takes the fd over
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		t.Fatalf("dup: %s", err)
+	}
+	listenFdsStart = fd
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	return l.Addr().String()
+}
+
+func writeConfig(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("write config: %s", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadConfig("")
+	if err != nil || cfg.Listen != ":8080" || time.Duration(cfg.ShutdownTimeout) != 30*time.Second {
+		t.Errorf("expected the defaults without a config file, got %+v, %v", cfg, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "fscached.json")
+	writeConfig(t, path, `{"listen": ":9090", "adminListen": ":9091", "cacheDir": "/var/cache/fscached", "maxBytes": 1024, "gcInterval": "1m"}`)
+	os.Setenv("FSCACHE_MAX_BYTES", "2048")
+	defer os.Unsetenv("FSCACHE_MAX_BYTES")
+	cfg, err = loadConfig(path)
+	if err != nil {
+		t.Fatalf("load config: %s", err)
+	}
+	if cfg.Listen != ":9090" || cfg.AdminListen != ":9091" || cfg.CacheDir != "/var/cache/fscached" || time.Duration(cfg.GcInterval) != time.Minute {
+		t.Errorf("expected the fields of the config file, got %+v", cfg)
+	}
+	if cfg.MaxBytes != 2048 {
+		t.Errorf("expected the environment overriding the config file, got max bytes %d", cfg.MaxBytes)
+	}
+	if time.Duration(cfg.ShutdownTimeout) != 30*time.Second {
+		t.Errorf("expected the default of fields missing, got %s", time.Duration(cfg.ShutdownTimeout))
+	}
+
+	writeConfig(t, path, `{"maxBytes": 1024, "unknown": true}`)
+	if _, err := loadConfig(path); err == nil {
+		t.Errorf("expected unknown fields to fail")
+	}
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("expected a missing config file to fail, got %v", err)
+	}
+}
+
+func TestActivationListeners(t *testing.T) {
+	defer func(start int) { listenFdsStart = start }(listenFdsStart)
+	if ls, err := activationListeners(); err != nil || ls != nil {
+		t.Errorf("expected no listeners without socket activation, got %v, %v", ls, err)
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	if ls, err := activationListeners(); err != nil || ls != nil {
+		t.Errorf("expected the sockets passed to another process ignored, got %v, %v", ls, err)
+	}
+
+	addr := activate(t)
+	ls, err := activationListeners()
+	if err != nil || len(ls) != 1 || ls[0].Addr().String() != addr {
+		t.Fatalf("expected the socket passed on %s, got %v, %v", addr, ls, err)
+	}
+	ls[0].Close()
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Errorf("expected the activation environment unset, not passed to children")
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "one")
+	if _, err := activationListeners(); err == nil {
+		t.Errorf("expected an invalid LISTEN_FDS to fail")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+}
+
+func TestServe(t *testing.T) {
+	defer func(start int) { listenFdsStart = start }(listenFdsStart)
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	// keep the signals sent below from killing the test if serve is not notified yet
+	sigCh := make(chan os.Signal, 4)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "a", "b", "cache")
+	path := filepath.Join(dir, "fscached.json")
+	writeConfig(t, path, `{"cacheDir": "`+cacheDir+`", "maxBytes": 1048576, "gcInterval": "10ms"}`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("load config: %s", err)
+	}
+	base := "http://" + activate(t)
+	done := make(chan error, 1)
+	go func() { done <- serve(path, cfg) }()
+
+	do := func(method, target, body string) (int, string) {
+		req, err := http.NewRequest(method, base+target, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("new request: %s", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %s", method, target, err)
+		}
+		defer resp.Body.Close()
+		got, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(got)
+	}
+	val := strings.Repeat("v", 1024)
+	for _, key := range []string{"key1", "key2"} {
+		if code, _ := do(http.MethodPut, "/"+key, val); code != http.StatusNoContent {
+			t.Fatalf("expected %s set, got %d", key, code)
+		}
+	}
+	if code, got := do(http.MethodGet, "/key1", ""); code != http.StatusOK || got != val {
+		t.Errorf("expected key1 got, got %d", code)
+	}
+	for _, target := range []string{"/../../escaped", "/..%2F..%2Fescaped"} {
+		if code, _ := do(http.MethodPut, target, val); code != http.StatusBadRequest {
+			t.Errorf("expected PUT %s rejected, got %d", target, code)
+		}
+	}
+	for _, fp := range []string{filepath.Join(cacheDir, "escaped"), filepath.Join(dir, "a", "escaped")} {
+		if _, err := os.Stat(fp); !os.IsNotExist(err) {
+			t.Errorf("expected nothing written to %s, got %v", fp, err)
+		}
+	}
+
+	// SIGHUP reloads the quota, under which GC evicts a key
+	writeConfig(t, path, `{"cacheDir": "`+cacheDir+`", "maxBytes": 1024, "gcInterval": "10ms"}`)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	if !eventually(func() bool { return strings.Contains(logs.String(), "reloaded "+path) }) {
+		t.Errorf("expected the config reloaded on SIGHUP, got logs %q", logs.String())
+	}
+	if !eventually(func() bool {
+		code1, _ := do(http.MethodGet, "/key1", "")
+		code2, _ := do(http.MethodGet, "/key2", "")
+		return code1 == http.StatusNotFound || code2 == http.StatusNotFound
+	}) {
+		t.Errorf("expected a key evicted under the quota reloaded")
+	}
+	writeConfig(t, path, `{"maxBytes": -1}`)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	if !eventually(func() bool { return strings.Contains(logs.String(), "reload "+path+" : ") }) {
+		t.Errorf("expected an invalid config failing to reload, got logs %q", logs.String())
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected a graceful shutdown on SIGTERM, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected serve returning on SIGTERM")
+	}
+}
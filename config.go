@@ -0,0 +1,353 @@
+package fscache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Config is the configuration of a cache loaded from a JSON file and environment variables,
+// so that the cache is configured without recompiling. Zero fields keep the defaults of the options.
+type Config struct {
+	CacheDir     string `json:"cacheDir"`
+	TmpDir       string `json:"tmpDir"`
+	SeedDir      string `json:"seedDir"`
+	CacheVersion string `json:"cacheVersion"`
+	// MaxBytes is the quota of the cache, see WithMaxBytes().
+	MaxBytes     int64 `json:"maxBytes"`
+	MinFreeBytes int64 `json:"minFreeBytes"`
+
+	GcInterval        Duration        `json:"gcInterval"`
+	GcWorkers         int             `json:"gcWorkers"`
+	GcHistory         int             `json:"gcHistory"`
+	GcExclude         []string        `json:"gcExclude"`
+	GcExcludeMaxBytes int64           `json:"gcExcludeMaxBytes"`
+	Retention         []RetentionRule `json:"retention"`
+	// Policy is the eviction policy among "lru", the default, "gds", "clock", "arc", "tinylfu",
+	// "adaptive-tinylfu" and "slru".
+	Policy           string             `json:"policy"`
+	NamespaceWeights map[string]float64 `json:"namespaceWeights"`
+
+	// Engine is the storage engine among "file", the default, "log" and "hybrid".
+	Engine            string `json:"engine"`
+	HybridThreshold   int64  `json:"hybridThreshold"`
+	PackfileThreshold int64  `json:"packfileThreshold"`
+	PackfileMaxBytes  int64  `json:"packfileMaxBytes"`
+
+	KeyHashing  bool `json:"keyHashing"`
+	XattrMeta   bool `json:"xattrMeta"`
+	EntryHeader bool `json:"entryHeader"`
+	Inotify     bool `json:"inotify"`
+	SharedMode  bool `json:"sharedMode"`
+	Quarantine  bool `json:"quarantine"`
+	Durable     bool `json:"durable"`
+	NFSMode     bool `json:"nfsMode"`
+	// SkipUnchanged skips the Sets of unchanged values, see WithSkipUnchanged().
+	SkipUnchanged bool `json:"skipUnchanged"`
+	// DeferBusyEviction defers evicting the entries being read, see WithDeferBusyEviction().
+	DeferBusyEviction bool `json:"deferBusyEviction"`
+
+	Trash         Duration `json:"trash"`
+	Scrub         Duration `json:"scrub"`
+	SweepInterval Duration `json:"sweepInterval"`
+	TTLJitter     float64  `json:"ttlJitter"`
+	BloomFilter   int      `json:"bloomFilter"`
+	MaxOpenFiles  int      `json:"maxOpenFiles"`
+	HandlePool    int      `json:"handlePool"`
+	DirectIO      int64    `json:"directIO"`
+	LoadShedding  float64  `json:"loadShedding"`
+	Heatmap       Duration `json:"heatmap"`
+	SlowOp        Duration `json:"slowOp"`
+	// MaxConcurrentWrites and BlockWrites are the writes and the blocking of WithMaxConcurrentWrites().
+	MaxConcurrentWrites int  `json:"maxConcurrentWrites"`
+	BlockWrites         bool `json:"blockWrites"`
+	// ReadaheadChunks is the number of chunks after the keys got to prefetch, see NextChunks().
+	ReadaheadChunks int `json:"readaheadChunks"`
+	// ChunkThreshold, ChunkBytes and ChunkMaxBytes are the threshold, the chunk size and the max bytes
+	// of WithChunkedStorage().
+	ChunkThreshold int64 `json:"chunkThreshold"`
+	ChunkBytes     int64 `json:"chunkBytes"`
+	ChunkMaxBytes  int64 `json:"chunkMaxBytes"`
+	// DictCompression is the max bytes of the values compressed by WithDictCompression().
+	DictCompression int `json:"dictCompression"`
+	// Maintenance and MaintenanceBatch are the interval and the batch of WithMaintenance(), 1000 if unset.
+	Maintenance      Duration `json:"maintenance"`
+	MaintenanceBatch int      `json:"maintenanceBatch"`
+	// EvictionGhosts is the number of keys evicted kept by WithEvictionGhosts().
+	EvictionGhosts int `json:"evictionGhosts"`
+	// Retries and RetryBackoff are the attempts and the first backoff of WithRetry(), 10ms if unset.
+	Retries      int      `json:"retries"`
+	RetryBackoff Duration `json:"retryBackoff"`
+	// AccessLog is the path of the access log, see WithAccessLog(), whose sample rate is 1 by default.
+	AccessLog           string  `json:"accessLog"`
+	AccessLogSampleRate float64 `json:"accessLogSampleRate"`
+	AccessLogMaxBytes   int64   `json:"accessLogMaxBytes"`
+	// DegradedAfter and DegradedProbe are the failures and the probe interval of WithDegradedMode(),
+	// 3 and 30s if either is set.
+	DegradedAfter int      `json:"degradedAfter"`
+	DegradedProbe Duration `json:"degradedProbe"`
+	// CircuitFailures, CircuitSlow and CircuitProbe are the failures, the slow latency and the probe interval
+	// of WithCircuitBreaker(), 5, none and 10s if either is set.
+	CircuitFailures     int      `json:"circuitFailures"`
+	CircuitSlow         Duration `json:"circuitSlow"`
+	CircuitProbe        Duration `json:"circuitProbe"`
+	Replication         string   `json:"replication"`
+	ReplicationInterval Duration `json:"replicationInterval"`
+}
+
+// Duration is a time.Duration in the syntax of time.ParseDuration() in configs, e.g. "5m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var ns int64
+		if json.Unmarshal(b, &ns) != nil {
+			return fmt.Errorf("duration %s : %w", b, err)
+		}
+		*d = Duration(ns)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) { return json.Marshal(time.Duration(d).String()) }
+
+// UnmarshalJSON lets the MaxAge of rules in configs be a Duration, e.g. {"prefix": "logs-", "maxAge": "168h"}.
+func (r *RetentionRule) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Prefix string
+		MaxAge Duration
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	r.Prefix, r.MaxAge = v.Prefix, time.Duration(v.MaxAge)
+	return nil
+}
+
+// configEnvPrefix prefixes the environment variables of Config fields, e.g. FSCACHE_MAX_BYTES.
+const configEnvPrefix = "FSCACHE_"
+
+// LoadConfig loads the config from the JSON file at path if not empty, and then from environment
+// variables overriding the file, see Config.ApplyEnv().
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path != "" {
+		if ext := filepath.Ext(path); ext != ".json" && ext != "" {
+			return nil, fmt.Errorf("config %s : unsupported format %s, only JSON is supported", path, ext)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		dec := json.NewDecoder(file)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("config %s : %w", path, err)
+		}
+	}
+	if err := cfg.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ApplyEnv sets the fields of c from the environment variables named FSCACHE_ and the JSON names
+// of the fields in upper snake case, e.g. FSCACHE_GC_INTERVAL=5m. Lists are separated by commas,
+// and maps and rules are in JSON.
+func (c *Config) ApplyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := configEnvPrefix + upperSnake(strings.Split(field.Tag.Get("json"), ",")[0])
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		var err error
+		switch p := v.Field(i).Addr().Interface().(type) {
+		case *string:
+			*p = val
+		case *[]string:
+			*p = strings.Split(val, ",")
+		case *Duration:
+			var d time.Duration
+			d, err = time.ParseDuration(val)
+			*p = Duration(d)
+		default:
+			err = json.Unmarshal([]byte(val), p)
+		}
+		if err != nil {
+			return fmt.Errorf("config env %s : %w", name, err)
+		}
+	}
+	return nil
+}
+
+// upperSnake converts camelCase into UPPER_SNAKE_CASE.
+func upperSnake(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// Options returns the options configured by c.
+func (c *Config) Options() ([]Option, error) {
+	var opts []Option
+	add := func(ok bool, opt Option) {
+		if ok {
+			opts = append(opts, opt)
+		}
+	}
+	add(c.CacheDir != "", WithCacheDir(c.CacheDir))
+	add(c.TmpDir != "", WithTmpDir(c.TmpDir))
+	add(c.SeedDir != "", WithSeedDir(c.SeedDir))
+	add(c.CacheVersion != "", WithCacheVersion(c.CacheVersion))
+	add(c.MaxBytes != 0, WithMaxBytes(c.MaxBytes))
+	add(c.MinFreeBytes != 0, WithMinFreeBytes(c.MinFreeBytes))
+	add(c.GcInterval != 0, WithGcInterval(time.Duration(c.GcInterval)))
+	add(c.GcWorkers != 0, WithGcWorkers(c.GcWorkers))
+	add(c.GcHistory != 0, WithGcHistory(c.GcHistory))
+	add(len(c.GcExclude) > 0, WithGcExclude(c.GcExclude...))
+	add(c.GcExcludeMaxBytes != 0, WithGcExcludeMaxBytes(c.GcExcludeMaxBytes))
+	add(len(c.Retention) > 0, WithRetention(c.Retention...))
+	add(c.NamespaceWeights != nil, WithNamespaceWeights(c.NamespaceWeights))
+
+	policy, err := policyOption(c.Policy)
+	if err != nil {
+		return nil, fmt.Errorf("config %w", err)
+	}
+	add(policy != nil, policy)
+	switch c.Engine {
+	case "", "file":
+	case "log":
+		opts = append(opts, WithEngine(EngineLog))
+	case "hybrid":
+		opts = append(opts, WithEngine(EngineHybrid))
+	default:
+		return nil, fmt.Errorf("config engine %q: unknown", c.Engine)
+	}
+	add(c.HybridThreshold != 0, WithHybridThreshold(c.HybridThreshold))
+	add(c.PackfileThreshold != 0, WithPackfiles(c.PackfileThreshold, c.PackfileMaxBytes))
+
+	add(c.KeyHashing, WithKeyHashing())
+	add(c.XattrMeta, WithXattrMeta())
+	add(c.EntryHeader, WithEntryHeader())
+	add(c.Inotify, WithInotify())
+	add(c.SharedMode, WithSharedMode())
+	add(c.Quarantine, WithQuarantine())
+	add(c.Durable, WithDurable())
+	add(c.NFSMode, WithNFSMode())
+	add(c.SkipUnchanged, WithSkipUnchanged())
+	add(c.DeferBusyEviction, WithDeferBusyEviction())
+
+	add(c.Trash != 0, WithTrash(time.Duration(c.Trash)))
+	add(c.Scrub != 0, WithScrub(time.Duration(c.Scrub)))
+	add(c.SweepInterval != 0, WithSweepInterval(time.Duration(c.SweepInterval)))
+	add(c.TTLJitter != 0, WithTTLJitter(c.TTLJitter))
+	add(c.BloomFilter != 0, WithBloomFilter(c.BloomFilter))
+	add(c.MaxOpenFiles != 0, WithMaxOpenFiles(c.MaxOpenFiles))
+	add(c.HandlePool != 0, WithHandlePool(c.HandlePool))
+	add(c.DirectIO != 0, WithDirectIO(c.DirectIO))
+	add(c.LoadShedding != 0, WithLoadShedding(c.LoadShedding))
+	add(c.Heatmap != 0, WithHeatmap(time.Duration(c.Heatmap)))
+	add(c.SlowOp != 0, WithSlowOpThreshold(time.Duration(c.SlowOp)))
+	add(c.MaxConcurrentWrites != 0, WithMaxConcurrentWrites(c.MaxConcurrentWrites, c.BlockWrites))
+	add(c.ReadaheadChunks != 0, WithPredictor(NextChunks(c.ReadaheadChunks)))
+	add(c.ChunkThreshold != 0, WithChunkedStorage(c.ChunkThreshold, c.ChunkBytes, c.ChunkMaxBytes))
+	add(c.DictCompression != 0, WithDictCompression(c.DictCompression))
+	if c.Maintenance != 0 {
+		batch := c.MaintenanceBatch
+		if batch == 0 {
+			batch = 1000
+		}
+		opts = append(opts, WithMaintenance(time.Duration(c.Maintenance), batch))
+	}
+	add(c.EvictionGhosts != 0, WithEvictionGhosts(c.EvictionGhosts))
+	if c.Retries != 0 {
+		backoff := time.Duration(c.RetryBackoff)
+		if backoff == 0 {
+			backoff = 10 * time.Millisecond
+		}
+		opts = append(opts, WithRetry(c.Retries, backoff))
+	}
+	if c.AccessLog != "" {
+		rate := c.AccessLogSampleRate
+		if rate == 0 {
+			rate = 1
+		}
+		opts = append(opts, WithAccessLog(c.AccessLog, rate, c.AccessLogMaxBytes))
+	}
+	if c.DegradedAfter != 0 || c.DegradedProbe != 0 {
+		failures, probe := c.DegradedAfter, time.Duration(c.DegradedProbe)
+		if failures == 0 {
+			failures = 3
+		}
+		if probe == 0 {
+			probe = 30 * time.Second
+		}
+		opts = append(opts, WithDegradedMode(failures, probe))
+	}
+	if c.CircuitFailures != 0 || c.CircuitSlow != 0 || c.CircuitProbe != 0 {
+		failures, probe := c.CircuitFailures, time.Duration(c.CircuitProbe)
+		if failures == 0 {
+			failures = 5
+		}
+		if probe == 0 {
+			probe = 10 * time.Second
+		}
+		opts = append(opts, WithCircuitBreaker(failures, time.Duration(c.CircuitSlow), probe))
+	}
+	add(c.Replication != "", WithReplication(c.Replication))
+	add(c.ReplicationInterval != 0, WithReplicationInterval(time.Duration(c.ReplicationInterval)))
+	return opts, nil
+}
+
+// policyOption returns the option of the eviction policy name, nil for LRU.
+func policyOption(name string) (Option, error) {
+	switch name {
+	case "", "lru":
+		return nil, nil
+	case "gds":
+		return WithGreedyDualSize(), nil
+	case "clock":
+		return WithClock(), nil
+	case "arc":
+		return WithARC(), nil
+	case "tinylfu":
+		return WithTinyLFU(), nil
+	case "adaptive-tinylfu":
+		return WithAdaptiveTinyLFU(), nil
+	case "slru":
+		return WithSLRU(), nil
+	}
+	return nil, fmt.Errorf("policy %q: unknown", name)
+}
+
+// NewFromConfig creates a cache configured by the JSON file at path and environment variables,
+// see LoadConfig(), with opts applied after, e.g. for a Backend or a Storage.
+func NewFromConfig(path string, opts ...Option) (Interface, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	cfgOpts, err := cfg.Options()
+	if err != nil {
+		return nil, err
+	}
+	return New(append(cfgOpts, opts...)...)
+}
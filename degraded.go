@@ -0,0 +1,88 @@
+package fscache
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// WithDegradedMode specifies after how many consecutive Sets failing with EROFS or ENOSPC the cache
+// degrades to read-only, and how often a Set is let through to probe whether writes work again.
+// In degraded mode, Gets are still served and Sets fail with ErrDegraded.
+// By default, the cache degrades after 3 failures and probes every 30 seconds.
+func WithDegradedMode(failures int, probeInterval time.Duration) Option {
+	return func(fc *Cache) {
+		fc.health.maxFailures = failures
+		fc.health.probeInterval = probeInterval
+	}
+}
+
+// WithHealthHook specifies a function called when the cache degrades to read-only with the error causing it,
+// and when it recovers with a nil error.
+func WithHealthHook(hook func(err error)) Option { return func(fc *Cache) { fc.health.hook = hook } }
+
+type health struct {
+	mu            sync.Mutex
+	maxFailures   int
+	probeInterval time.Duration
+	hook          func(err error)
+
+	failures  int
+	degraded  bool
+	lastProbe time.Time
+}
+
+func newHealth() *health {
+	return &health{maxFailures: 3, probeInterval: 30 * time.Second}
+}
+
+// allowWrite tells if a write should be tried, which is false in degraded mode unless it is time to probe.
+func (h *health) allowWrite() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.degraded {
+		return true
+	}
+	if now := time.Now(); now.Sub(h.lastProbe) >= h.probeInterval {
+		h.lastProbe = now
+		return true
+	}
+	return false
+}
+
+// observeWrite updates the health by the result of a write.
+func (h *health) observeWrite(err error) {
+	if err != nil && !errors.Is(err, syscall.EROFS) && !errors.Is(err, syscall.ENOSPC) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err == nil {
+		h.failures = 0
+		if h.degraded {
+			h.degraded = false
+			h.notify(nil)
+		}
+		return
+	}
+	h.failures++
+	if !h.degraded && h.maxFailures > 0 && h.failures >= h.maxFailures {
+		h.degraded = true
+		h.lastProbe = time.Now()
+		h.notify(err)
+	}
+}
+
+func (h *health) notify(err error) {
+	if h.hook != nil {
+		go h.hook(err)
+	}
+}
+
+func (h *health) isDegraded() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.degraded
+}
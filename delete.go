@@ -0,0 +1,52 @@
+package fscache
+
+import "strings"
+
+// DeletePrefix deletes all keys starting with prefix, and returns how many keys deleted.
+func (f *Cache) DeletePrefix(prefix string) (int, error) {
+	return f.DeleteFunc(func(key string) bool { return strings.HasPrefix(key, prefix) })
+}
+
+// DeleteFunc deletes all keys matching match, and returns how many keys deleted.
+func (f *Cache) DeleteFunc(match func(key string) bool) (int, error) {
+	keys, err := f.keys()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, k := range keys {
+		if !match(k) {
+			continue
+		}
+		if err := f.Delete(k); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// keys returns the keys in the cache, the packed ones and the ones from the index if it is kept current by inotify,
+// or by reading the cache dir otherwise.
+func (f *Cache) keys() ([]string, error) {
+	keys := f.packs.keys()
+	chunked, err := f.chunkedKeys()
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, chunked...)
+	if f.inotify {
+		if _, ok := f.index.usage(); ok {
+			return append(keys, f.index.keys()...), nil
+		}
+	}
+	if f.storage != nil {
+		infos, err := f.scanStored()
+		for _, fi := range infos {
+			keys = append(keys, fi.Name())
+		}
+		return keys, err
+	}
+	names, err := readDirNames(f.filedir())
+	return append(keys, f.keysOf(names)...), err
+}
@@ -0,0 +1,255 @@
+package fscache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrPatchOffset will be returned when patching a value at an offset beyond its end.
+var ErrPatchOffset = errors.New("patch offset beyond the end of value")
+
+// SetPatch writes data over the value of key at offset, extending the value if data runs past its end,
+// and keeps the metadata of key. A chunked value, see WithChunkedStorage(), is patched by writing only
+// the chunks data falls into, while other values are got, patched and set again in memory.
+// The key is locked while patching, so that concurrent patches and sets of key are not lost.
+// It returns ErrNotFound if key is not in the cache.
+func (f *Cache) SetPatch(key string, offset int64, data []byte) error {
+	if err := f.checkKey(key); err != nil {
+		return err
+	}
+	if !f.writable() {
+		return ErrDegraded
+	}
+	release, err := f.acquireWrite()
+	if err != nil {
+		return err
+	}
+	defer release()
+	defer f.keyLocks.lock(key)()
+	if f.chunks != nil {
+		if m, _, ok := f.statChunked(key); ok {
+			return f.patchChunked(key, m, offset, data)
+		}
+	}
+	val, err := f.get(key, nil)
+	if err != nil {
+		return err
+	}
+	if offset > int64(len(val)) {
+		return ErrPatchOffset
+	}
+	if end := offset + int64(len(data)); end > int64(len(val)) {
+		val = append(val, make([]byte, end-int64(len(val)))...)
+	}
+	copy(val[offset:], data)
+	meta, err := f.readMeta(key)
+	if err != nil {
+		return err
+	}
+	meta.Key, meta.CreatedAt = "", 0
+	src, err := f.encodeValue(key, val)
+	if err != nil {
+		return err
+	}
+	if f.entryHeader {
+		// the expiry of an entry with a header is kept in the header rather than in its meta
+		if h, ok := f.storedHeader(key); ok && h.flags&entryFlagTTL != 0 {
+			meta.ExpireAt = h.expireAt
+		}
+		src, meta.ExpireAt = f.encodeEntry(src, meta.ExpireAt), 0
+	}
+	return f.setLocked(key, src, meta)
+}
+
+// patchChunked writes data over the chunked value of key listed by m at offset, with the key locked.
+func (f *Cache) patchChunked(key string, m *chunkManifest, offset int64, data []byte) error {
+	if offset > m.Size {
+		return ErrPatchOffset
+	}
+	var (
+		dir = f.chunkpath(key)
+		end = offset + int64(len(data))
+		pm  = &chunkManifest{Size: m.Size}
+		off int64
+		i   int
+	)
+	if end > pm.Size {
+		pm.Size = end
+	}
+	// keep the chunks before data, and read the ones data falls into
+	for ; i < len(m.Chunks) && off+m.Chunks[i].Size <= offset; i++ {
+		pm.Chunks = append(pm.Chunks, m.Chunks[i])
+		off += m.Chunks[i].Size
+	}
+	var (
+		spanAt = off
+		span   []byte
+	)
+	for ; i < len(m.Chunks) && off < end; i++ {
+		buf := make([]byte, m.Chunks[i].Size)
+		if err := f.readChunk(dir, m.Chunks[i], buf); err != nil {
+			return err
+		}
+		span = append(span, buf...)
+		off += m.Chunks[i].Size
+	}
+	if n := end - spanAt; n > int64(len(span)) {
+		span = append(span, make([]byte, n-int64(len(span)))...)
+	}
+	copy(span[offset-spanAt:], data)
+
+	g := newChunkGroup()
+	for len(span) > 0 {
+		n := len(span)
+		if int64(n) > f.chunks.chunkBytes {
+			n = int(f.chunks.chunkBytes)
+		}
+		f.addChunk(g, pm, dir, span[:n])
+		span = span[n:]
+	}
+	pm.Chunks = append(pm.Chunks, m.Chunks[i:]...)
+	err := g.wait()
+	f.health.observeWrite(err)
+	if err != nil {
+		return err
+	}
+	meta, err := f.readMeta(key)
+	if err != nil {
+		return err
+	}
+	meta.Key = ""
+	return f.commitChunked(key, pm, meta)
+}
+
+// writeDelta writes size bytes read from r into dir as the next version of the chunked value listed by old.
+// Like rsync, the chunks of old of the chunk size are found at any offset of the new value by their
+// rolling sums, confirmed by their sums, and kept instead of written, so that bytes inserted or removed
+// do not shift the chunks after them. The bytes between them are written in new chunks.
+func (f *Cache) writeDelta(dir string, old *chunkManifest, r io.Reader, size int64) (*chunkManifest, error) {
+	bs := int(f.chunks.chunkBytes)
+	blocks := map[uint32][]chunkRef{}
+	for _, c := range old.Chunks {
+		if c.Weak != nil && c.Size == int64(bs) {
+			blocks[*c.Weak] = append(blocks[*c.Weak], c)
+		}
+	}
+	var (
+		m  = &chunkManifest{Size: size}
+		g  = newChunkGroup()
+		lr = io.LimitReader(r, size)
+		// buf holds the literal bytes before p, and the window of the chunk size from p
+		buf  []byte
+		p    int
+		eof  bool
+		read int64
+		roll rollingSum
+	)
+	fill := func(n int) error {
+		for len(buf) < n && !eof {
+			more := make([]byte, bs)
+			k, err := io.ReadFull(lr, more)
+			buf, read = append(buf, more[:k]...), read+int64(k)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	literal := func(lit []byte) {
+		for len(lit) > 0 {
+			n := len(lit)
+			if n > bs {
+				n = bs
+			}
+			f.addChunk(g, m, dir, append([]byte(nil), lit[:n]...))
+			lit = lit[n:]
+		}
+	}
+
+	if err := fill(bs); err != nil {
+		return nil, err
+	}
+	if len(buf) >= bs {
+		roll.init(buf[:bs])
+	}
+	for len(buf)-p >= bs && !g.failed() {
+		if c, ok := matchChunk(dir, blocks, roll.sum(), buf[p:p+bs]); ok {
+			literal(buf[:p])
+			m.Chunks = append(m.Chunks, c)
+			buf, p = append([]byte(nil), buf[p+bs:]...), 0
+			if err := fill(bs); err != nil {
+				return nil, err
+			}
+			if len(buf) >= bs {
+				roll.init(buf[:bs])
+			}
+			continue
+		}
+		if p == bs {
+			literal(buf[:p])
+			buf, p = append([]byte(nil), buf[p:]...), 0
+		}
+		if err := fill(p + bs + 1); err != nil {
+			return nil, err
+		}
+		if len(buf) < p+bs+1 {
+			break
+		}
+		roll.roll(buf[p], buf[p+bs])
+		p++
+	}
+	literal(buf)
+	if err := g.wait(); err != nil {
+		return nil, err
+	}
+	if read < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return m, nil
+}
+
+// matchChunk returns the chunk among blocks of the rolling sum weak which is window, and still in dir.
+// The chunk matched is touched, so that gcChunks() does not evict it while the new version is written.
+func matchChunk(dir string, blocks map[uint32][]chunkRef, weak uint32, window []byte) (chunkRef, bool) {
+	cs := blocks[weak]
+	if len(cs) == 0 {
+		return chunkRef{}, false
+	}
+	sum := chunkSum(window)
+	for _, c := range cs {
+		if c.Sum != sum {
+			continue
+		}
+		fp := filepath.Join(dir, c.Sum)
+		if fi, err := os.Lstat(fp); err == nil && os.Chtimes(fp, time.Now(), fi.ModTime()) == nil {
+			return c, true
+		}
+	}
+	return chunkRef{}, false
+}
+
+// rollingSum is the rolling checksum of rsync over a window of bytes, which slides a byte at a time.
+type rollingSum struct {
+	a, b, n uint32
+}
+
+func (s *rollingSum) init(buf []byte) {
+	s.a, s.b, s.n = 0, 0, uint32(len(buf))
+	for i, x := range buf {
+		s.a += uint32(x)
+		s.b += uint32(len(buf)-i) * uint32(x)
+	}
+}
+
+// roll slides the window by a byte, out leaving it and in entering it.
+func (s *rollingSum) roll(out, in byte) {
+	s.a += uint32(in) - uint32(out)
+	s.b += s.a - s.n*uint32(out)
+}
+
+func (s *rollingSum) sum() uint32 { return s.a&0xffff | s.b<<16 }
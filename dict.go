@@ -0,0 +1,327 @@
+package fscache
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// WithDictCompression compresses the values of at most maxValueBytes set with DEFLATE and a preset
+// dictionary trained from a sample of the entries by TrainDict(), for workloads of many similar small
+// values, which compress poorly one by one. It enables WithEntryHeader(), whose codec and dictionary version
+// tell how each entry is stored, so that the entries compressed with older dictionaries, which are kept,
+// and the entries stored as is are still read. Values are stored as is until a dictionary is trained,
+// or if they do not compress. Values got by GetTo() and GetAt() are decompressed in memory.
+// As chunked values have no entry header, it can not be combined with WithChunkedStorage(), failing New()
+// with ErrDictChunks.
+func WithDictCompression(maxValueBytes int) Option {
+	return func(fc *Cache) {
+		fc.entryHeader = true
+		fc.dicts = &dictStore{maxValueBytes: maxValueBytes}
+	}
+}
+
+// maxDictBytes is the max size of dictionaries, the window of DEFLATE.
+const maxDictBytes = 32 * 1024
+
+const (
+	// dictKmer is the length of the substrings counted by the training of dictionaries.
+	dictKmer = 8
+	// dictSegment is the length of the segments of samples picked into dictionaries.
+	dictSegment = 64
+)
+
+var errNoSamples = errors.New("no values to train a dictionary from")
+
+// ErrDictChunks will be returned by New() if both WithDictCompression() and WithChunkedStorage() are given.
+var ErrDictChunks = errors.New("dictionary compression and chunked storage are exclusive")
+
+func (f *Cache) dictdir() string { return filepath.Join(f.cacheDir, "dicts") }
+
+// dictStore holds the dictionaries of the cache by their versions, the latest one compressing the values set.
+type dictStore struct {
+	maxValueBytes int
+
+	mu      sync.RWMutex
+	current uint16
+	dicts   map[uint16][]byte
+	// writers are the writers of the current dictionary.
+	writers *sync.Pool
+}
+
+// load loads the dictionaries saved in dir.
+func (d *dictStore) load(dir string) error {
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	names, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dicts = map[uint16][]byte{}
+	for _, name := range names {
+		version, err := strconv.ParseUint(name, 10, 16)
+		if err != nil {
+			continue
+		}
+		dict, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		d.dicts[uint16(version)] = dict
+		if uint16(version) > d.current {
+			d.current = uint16(version)
+		}
+	}
+	if d.current > 0 {
+		d.writers = newDictWriters(d.dicts[d.current])
+	}
+	return nil
+}
+
+func newDictWriters(dict []byte) *sync.Pool {
+	return &sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriterDict(nil, flate.DefaultCompression, dict)
+		return w
+	}}
+}
+
+// add saves dict in dir as the next version, which compresses the values set after.
+func (d *dictStore) add(dir string, dict []byte) (uint16, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.current == 1<<16-1 {
+		return 0, errors.New("dictionary versions exhausted")
+	}
+	version := d.current + 1
+	fp := filepath.Join(dir, strconv.Itoa(int(version)))
+	if err := ioutil.WriteFile(fp+".tmp", dict, 0644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(fp+".tmp", fp); err != nil {
+		return 0, err
+	}
+	d.dicts[version], d.current, d.writers = dict, version, newDictWriters(dict)
+	return version, nil
+}
+
+// version returns the version of the current dictionary, 0 if none.
+func (d *dictStore) version() uint16 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.current
+}
+
+// stale tells if the entry of header h was stored as is or compressed with an older dictionary,
+// and can be compressed with the current one.
+func (d *dictStore) stale(h entryHeader) bool {
+	current := d.version()
+	switch h.codec {
+	case codecRaw:
+		return current > 0
+	case codecDeflateDict:
+		return h.dict < current
+	}
+	return false
+}
+
+// fits tells if values of size bytes are compressed.
+func (d *dictStore) fits(size int64) bool { return d != nil && size <= int64(d.maxValueBytes) }
+
+// compress compresses val with the current dictionary, returning its version, false if val is not compressed.
+func (d *dictStore) compress(val []byte) ([]byte, uint16, bool) {
+	if !d.fits(int64(len(val))) {
+		return nil, 0, false
+	}
+	d.mu.RLock()
+	version, writers := d.current, d.writers
+	d.mu.RUnlock()
+	if version == 0 {
+		return nil, 0, false
+	}
+	var buf bytes.Buffer
+	w := writers.Get().(*flate.Writer)
+	defer writers.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(val); err != nil {
+		return nil, 0, false
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(val) {
+		return nil, 0, false
+	}
+	return buf.Bytes(), version, true
+}
+
+// decompress decompresses val compressed with the dictionary of version.
+func (d *dictStore) decompress(version uint16, val []byte) ([]byte, error) {
+	var (
+		dict []byte
+		ok   bool
+	)
+	if d != nil {
+		d.mu.RLock()
+		dict, ok = d.dicts[version]
+		d.mu.RUnlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: dictionary %d", ErrUnknownFormat, version)
+	}
+	r := flate.NewReaderDict(bytes.NewReader(val), dict)
+	defer r.Close()
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompress : %w", ErrCorrupted)
+	}
+	return buf, nil
+}
+
+// encodeEntry encodes the value val with its entry header, compressing it if it compresses.
+func (f *Cache) encodeEntry(val []byte, expireAt int64) []byte {
+	if packed, version, ok := f.dicts.compress(val); ok {
+		return encodeEntryCodec(packed, expireAt, codecDeflateDict, version)
+	}
+	return encodeEntry(val, expireAt)
+}
+
+// encoded tells if the values are stored encoded, so that they can not be read from their files as is.
+func (f *Cache) encoded() bool { return len(f.transforms) > 0 || f.dicts != nil }
+
+// TrainDict trains a dictionary of at most maxBytes, up to 32KB, from the values of up to samples entries
+// picked at random, and compresses the values set after with it, see WithDictCompression().
+// It returns the version of the dictionary.
+func (f *Cache) TrainDict(samples, maxBytes int) (int, error) {
+	if f.dicts == nil {
+		return 0, errors.New("dictionary compression not enabled")
+	}
+	if maxBytes <= 0 || maxBytes > maxDictBytes {
+		maxBytes = maxDictBytes
+	}
+	keys, err := f.keys()
+	if err != nil {
+		return 0, err
+	}
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	var vals [][]byte
+	for _, k := range keys {
+		if len(vals) >= samples {
+			break
+		}
+		if val, ok := f.sample(k); ok {
+			vals = append(vals, val)
+		}
+	}
+	dict := trainDict(vals, maxBytes)
+	if len(dict) == 0 {
+		return 0, errNoSamples
+	}
+	version, err := f.dicts.add(f.dictdir(), dict)
+	return int(version), err
+}
+
+// sample returns the value of key as compressed, i.e. transformed, if it fits the dictionaries, false if not.
+// Larger entries are not read, and the access time of key is not updated, so that a training neither reads
+// the whole cache nor reorders GC.
+func (f *Cache) sample(key string) ([]byte, bool) {
+	limit := int64(f.dicts.maxValueBytes + entryHeaderLen)
+	var buf []byte
+	if loc, ok := f.packs.stat(key); ok {
+		if loc.size > limit {
+			return nil, false
+		}
+		var err error
+		if buf, _, err = f.packs.peek(key); err != nil || buf == nil {
+			return nil, false
+		}
+	} else {
+		fp := f.filepath(key)
+		file, fi, err := f.openStored(fp)
+		if err != nil {
+			return nil, false
+		}
+		defer file.Close()
+		if fi.Size() > limit {
+			return nil, false
+		}
+		if buf, err = f.readEntryFile(file, fi.Size()); err != nil {
+			return nil, false
+		}
+		// the read may update the access time by relatime, which is put back like by recompress()
+		f.chtimesStored(fp, atime(fi), fi.ModTime())
+	}
+	h, ok := parseEntryHeader(buf)
+	if !ok {
+		return buf, f.dicts.fits(int64(len(buf)))
+	}
+	if verifyEntry(key, buf) != nil {
+		return nil, false
+	}
+	val := buf[entryHeaderLen:]
+	if h.codec == codecDeflateDict {
+		var err error
+		if val, err = f.dicts.decompress(h.dict, val); err != nil {
+			return nil, false
+		}
+	}
+	return val, f.dicts.fits(int64(len(val)))
+}
+
+// trainDict returns a dictionary of at most maxBytes of the segments of samples which share the most
+// substrings with the other samples, the most common last, closest to the values compressed.
+func trainDict(samples [][]byte, maxBytes int) []byte {
+	// count the samples having each substring
+	counts := map[string]int{}
+	for _, s := range samples {
+		seen := map[string]bool{}
+		for i := 0; i+dictKmer <= len(s); i++ {
+			if km := string(s[i : i+dictKmer]); !seen[km] {
+				seen[km] = true
+				counts[km]++
+			}
+		}
+	}
+	type segment struct {
+		buf   []byte
+		score int
+	}
+	var segs []segment
+	for _, s := range samples {
+		for i := 0; i < len(s); i += dictSegment {
+			end := i + dictSegment
+			if end > len(s) {
+				end = len(s)
+			}
+			seg := segment{buf: s[i:end]}
+			for j := 0; j+dictKmer <= len(seg.buf); j++ {
+				if n := counts[string(seg.buf[j:j+dictKmer])]; n > 1 {
+					seg.score += n
+				}
+			}
+			if seg.score > 0 {
+				segs = append(segs, seg)
+			}
+		}
+	}
+	sort.SliceStable(segs, func(i, j int) bool { return segs[i].score > segs[j].score })
+
+	var picked []byte
+	for _, seg := range segs {
+		if len(picked)+len(seg.buf) > maxBytes {
+			continue
+		}
+		if !bytes.Contains(picked, seg.buf) {
+			// the best segments end up at the end, reachable by the shortest distances
+			picked = append(append([]byte(nil), seg.buf...), picked...)
+		}
+	}
+	return picked
+}
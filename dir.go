@@ -0,0 +1,214 @@
+package fscache
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SetDir sets the directory tree srcDir as the value of key, packed as a tar of
+// its regular files, directories and symlinks, e.g. the output tree of a build step.
+func (f *Cache) SetDir(key, srcDir string) error {
+	if err := f.checkKey(key); err != nil {
+		return err
+	}
+	if !f.writable() {
+		return ErrDegraded
+	}
+	release, err := f.acquireWrite()
+	if err != nil {
+		return err
+	}
+	defer release()
+	defer f.keyLocks.lock(key)()
+	created := f.createdAt(key)
+	w, err := newAtomicFileWriter(f.filepath(key), f.tmppath(key), f.fileOpts(), 0644)
+	if err != nil {
+		return err
+	}
+	cw := &countingWriter{w: w}
+	err = packDir(cw, srcDir)
+	if err != nil {
+		w.(*atomicFileWriter).writeErr = err
+	}
+	err = w.Close()
+	f.health.observeWrite(err)
+	if err != nil {
+		return err
+	}
+	return f.written(key, cw.n, entryMeta{CreatedAt: created})
+}
+
+// GetDir unpacks the directory tree set by SetDir() as the value of key to dstDir, which must not exist.
+// The tree is unpacked into a staging dir next to dstDir and renamed to dstDir, so that dstDir appears
+// complete or not at all.
+func (f *Cache) GetDir(key, dstDir string) error {
+	if err := f.checkKey(key); err != nil {
+		return err
+	}
+	err := f.getDir(key, dstDir)
+	switch err {
+	case nil:
+		atomic.AddInt64(&f.stats.hits, 1)
+		f.policy.touch(key)
+		if f.heatmap != nil {
+			f.heatmap.hit(key)
+		}
+	case ErrNotFound:
+		atomic.AddInt64(&f.stats.misses, 1)
+		f.missed(key)
+	}
+	return err
+}
+
+func (f *Cache) getDir(key, dstDir string) error {
+	if !f.index.mayContain(key) {
+		return ErrNotFound
+	}
+	fp := f.filepath(key)
+	file, fi, err := f.openEntry(fp)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if f.expired(key) {
+		return ErrNotFound
+	}
+
+	dstDir = filepath.Clean(dstDir)
+	if err := os.MkdirAll(filepath.Dir(dstDir), 0775); err != nil {
+		return err
+	}
+	stageDir := fmt.Sprintf("%s.fscache-%d", dstDir, time.Now().UnixNano())
+	if err := unpackDir(file, stageDir); err != nil {
+		os.RemoveAll(stageDir)
+		return fmt.Errorf("unpack %s : %w", key, err)
+	}
+	if err := os.Rename(stageDir, dstDir); err != nil {
+		os.RemoveAll(stageDir)
+		return err
+	}
+	return os.Chtimes(fp, time.Now(), fi.ModTime())
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func packDir(w io.Writer, srcDir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(srcDir, path)
+		if err != nil || name == "." {
+			return err
+		}
+		var link string
+		switch mode := info.Mode(); {
+		case mode.IsRegular(), mode.IsDir():
+		case mode&os.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: unsupported file mode %s", path, mode)
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func unpackDir(r io.Reader, dstDir string) error {
+	if err := os.Mkdir(dstDir, 0775); err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(dstDir)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(filepath.Clean(name), ".."+string(filepath.Separator)) {
+			return fmt.Errorf("illegal path %q", hdr.Name)
+		}
+		path := filepath.Join(dstDir, name)
+		if parent, err := filepath.EvalSymlinks(filepath.Dir(path)); err != nil {
+			return err
+		} else if parent != root && !strings.HasPrefix(parent, root+string(filepath.Separator)) {
+			return fmt.Errorf("illegal path %q through symlink", hdr.Name)
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tr)
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: unsupported type %c", hdr.Name, hdr.Typeflag)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+		}
+	}
+}
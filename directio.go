@@ -0,0 +1,100 @@
+package fscache
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithDirectIO makes values of threshold bytes or more written and read with O_DIRECT, bypassing the page cache,
+// so that transferring a huge value does not evict the page cache used by the rest of the process.
+// Filesystems not supporting O_DIRECT, e.g. tmpfs, fall back to buffered IO. By default, it is disabled.
+func WithDirectIO(threshold int64) Option {
+	return func(fc *Cache) { fc.directIOThreshold = threshold }
+}
+
+// directIOAlign is the alignment of buffers, offsets and lengths of O_DIRECT,
+// which is the logical block size of most devices or a multiple of it.
+const directIOAlign = 4096
+
+// directIOBufBytes is the size of the aligned buffer values are copied through to be written with O_DIRECT.
+const directIOBufBytes = 1024 * 1024
+
+func (f *Cache) directIO(size int64) bool {
+	return f.directIOThreshold > 0 && size >= f.directIOThreshold
+}
+
+// alignedBuf returns a buffer of n bytes whose address is aligned for O_DIRECT.
+func alignedBuf(n int) []byte {
+	buf := make([]byte, n+directIOAlign)
+	off := 0
+	if r := int(uintptr(unsafe.Pointer(&buf[0])) % directIOAlign); r != 0 {
+		off = directIOAlign - r
+	}
+	return buf[off : off+n]
+}
+
+// setDirect sets or clears O_DIRECT of file.
+func setDirect(file *os.File, direct bool) error {
+	fd := int(file.Fd())
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+	if err != nil {
+		return err
+	}
+	if direct {
+		flags |= unix.O_DIRECT
+	} else {
+		flags &^= unix.O_DIRECT
+	}
+	_, err = unix.FcntlInt(uintptr(fd), unix.F_SETFL, flags)
+	return err
+}
+
+// atomicWriteFileDirect is atomicWriteFile() writing the aligned part of src with O_DIRECT,
+// and the rest with buffered IO.
+func atomicWriteFileDirect(filename, tmpfile string, fo fileOpts, src []byte, perm os.FileMode) error {
+	dst, err := newAtomicFileWriter(filename, tmpfile, fo, perm)
+	if err != nil {
+		return err
+	}
+	w := dst.(*atomicFileWriter)
+	if err := setDirect(w.f, true); err != nil {
+		// not supported by the filesystem
+		w.Write(src)
+		return w.Close()
+	}
+	aligned := len(src) / directIOAlign * directIOAlign
+	buf := alignedBuf(directIOBufBytes)
+	for off := 0; off < aligned && w.writeErr == nil; {
+		n := copy(buf, src[off:aligned])
+		w.Write(buf[:n])
+		off += n
+	}
+	if w.writeErr == nil {
+		if w.writeErr = setDirect(w.f, false); w.writeErr == nil {
+			w.Write(src[aligned:])
+		}
+	}
+	return w.Close()
+}
+
+// readEntryFile reads the entry file of size bytes, with O_DIRECT for large values if enabled.
+func (f *Cache) readEntryFile(file StorageFile, size int64) ([]byte, error) {
+	osFile, ok := file.(*os.File)
+	if !ok || !f.directIO(size) || setDirect(osFile, true) != nil {
+		return ioutil.ReadAll(file)
+	}
+	buf := alignedBuf(int((size + directIOAlign - 1) / directIOAlign * directIOAlign))
+	n, err := io.ReadFull(file, buf)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		// the file is not a multiple of the alignment
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,23 @@
+package fscache
+
+import "os"
+
+// WithDurable makes a Set survive power loss once it returns, for caches doubling as staging stores.
+// Besides syncing the files of entries before renaming them into the cache, as always, it syncs the dirs
+// of the files renamed or created, i.e. of entries, sidecar metadata and value logs, and syncs the journal
+// of WithReplication() after each record, so that the journal never holds a record lost with the set.
+// Deletes are not made durable. With WithStorage(), the storage is responsible for its renames.
+func WithDurable() Option { return func(fc *Cache) { fc.durable = true } }
+
+// syncDir syncs dir, so that the files renamed or created in it survive power loss.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
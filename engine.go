@@ -0,0 +1,37 @@
+package fscache
+
+import "math"
+
+// Engine is how the cache stores values on disk.
+type Engine int
+
+const (
+	// EngineFile stores every value in a file of its own, which suits big values. It is the default.
+	EngineFile Engine = iota
+	// EngineLog stores values in append-only value logs with an index in memory, bitcask-style,
+	// which suits workloads dominated by small values where a file per key is the bottleneck.
+	// GC evicts the values least recently accessed first once they take more than WithMaxBytes(),
+	// and compacts the logs. Values of 4GB or larger are still stored in files of their own.
+	EngineLog
+	// EngineHybrid stores values smaller than WithHybridThreshold() in value logs like EngineLog,
+	// and larger ones in files of their own like EngineFile, transparent to callers.
+	// Values in both are evicted by GC together by the eviction policy within WithMaxBytes().
+	EngineHybrid
+)
+
+// WithEngine specifies the storage engine of the cache.
+func WithEngine(engine Engine) Option { return func(fc *Cache) { fc.engine = engine } }
+
+// WithHybridThreshold specifies the size under which values are stored in value logs by EngineHybrid,
+// which is 64KB by default.
+func WithHybridThreshold(bytes int64) Option { return func(fc *Cache) { fc.hybridThreshold = bytes } }
+
+// configureEngine sets up the packs as the value logs of the engine.
+func (f *Cache) configureEngine() {
+	switch f.engine {
+	case EngineLog:
+		f.packs = &packStore{threshold: math.MaxUint32, maxBytes: f.maxBytes, sealBytes: packSealBytes}
+	case EngineHybrid:
+		f.packs = &packStore{threshold: f.hybridThreshold, sealBytes: packSealBytes}
+	}
+}
@@ -0,0 +1,98 @@
+package fscache
+
+import "time"
+
+// EntryInfo describes an entry in the cache.
+type EntryInfo struct {
+	Key string
+	// Size is the bytes taken by the entry, including its header if any.
+	Size int64
+	// Created is when the key was first set, and Updated is when it was set the last time,
+	// neither of which is changed by Gets.
+	Created time.Time
+	Updated time.Time
+	// Accessed is when the entry was got the last time, or Updated if access times are not kept,
+	// see WithClock().
+	Accessed time.Time
+	// Version is the version of the value, see GetIfChanged().
+	Version string
+}
+
+// Stat returns the info of the entry of key, or ErrNotFound if there is none.
+func (f *Cache) Stat(key string) (EntryInfo, error) {
+	if _, ok := f.setAt(key); !ok {
+		return EntryInfo{}, ErrNotFound
+	}
+	m, err := f.readMeta(key)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	info := EntryInfo{Key: key}
+	if loc, ok := f.packs.stat(key); ok {
+		info.Size, info.Updated, info.Accessed = loc.size, time.Unix(0, loc.mtime), time.Unix(0, loc.atime)
+		info.Version = packVersion(loc)
+	} else if m, fi, ok := f.statChunked(key); ok {
+		info.Size, info.Updated, info.Accessed = m.Size, fi.ModTime(), atime(fi)
+		info.Version = "c" + fileVersion(fi)
+	} else {
+		fi, err := f.statStored(f.filepath(key))
+		if err != nil {
+			if vanished(err) {
+				return EntryInfo{}, ErrNotFound
+			}
+			return EntryInfo{}, err
+		}
+		if !fi.Mode().IsRegular() {
+			return EntryInfo{}, ErrIllegalEntry
+		}
+		info.Size, info.Updated, info.Accessed = fi.Size(), fi.ModTime(), atime(fi)
+		info.Version = fileVersion(fi)
+	}
+	info.Created = info.Updated
+	if m.CreatedAt > 0 {
+		info.Created = time.Unix(0, m.CreatedAt)
+	}
+	return info, nil
+}
+
+// storedSize returns the bytes taken by the entry of key as stored, including its header if any,
+// whether packed, chunked or in its file.
+func (f *Cache) storedSize(key string) (int64, bool) {
+	if loc, ok := f.packs.stat(key); ok {
+		return loc.size, true
+	}
+	if m, _, ok := f.statChunked(key); ok {
+		return m.Size, true
+	}
+	fi, err := f.statStored(f.filepath(key))
+	if err != nil || !fi.Mode().IsRegular() {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
+// createdAt returns when key, locked to be set again, was first set in unix nanoseconds, 0 if it is not
+// in the cache, which is kept in its metadata once set again.
+func (f *Cache) createdAt(key string) int64 {
+	m, err := f.readMeta(key)
+	if err != nil || m.expired(time.Now()) {
+		return 0
+	}
+	if m.CreatedAt > 0 {
+		return m.CreatedAt
+	}
+	if loc, ok := f.packs.stat(key); ok {
+		return loc.mtime
+	}
+	if _, fi, ok := f.statChunked(key); ok {
+		return fi.ModTime().UnixNano()
+	}
+	if !f.index.mayContain(key) {
+		return 0
+	}
+	fi, err := f.statStored(f.filepath(key))
+	if err != nil || !fi.Mode().IsRegular() {
+		return 0
+	}
+	return fi.ModTime().UnixNano()
+}
@@ -0,0 +1,160 @@
+package fscache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// EvictHook is called by GC with each key it evicts, before its entry is removed.
+type EvictHook struct {
+	// Func is called with the key evicted, and a reader of its value if WantValue, nil otherwise,
+	// which is valid only until Func returns, e.g. to archive the value somewhere else.
+	Func func(key string, value io.Reader)
+	// WantValue tells if Func wants the value.
+	WantValue bool
+	// Timeout is how long a GC pass waits for Func in total before evicting the keys anyway,
+	// 10 seconds by default, so that a slow hook can not stall GC. Once it is over, Func is still
+	// called with the keys left but not waited for, unless 64 calls are still running, when the keys
+	// are evicted without calling Func, counted by SkippedHooks of the GC report. A reader of a value
+	// in its own file can still be read after the timeout until Func returns.
+	Timeout time.Duration
+}
+
+const (
+	// defaultEvictHookTimeout is how long GC waits for an evict hook by default.
+	defaultEvictHookTimeout = 10 * time.Second
+	// evictHookMaxRunning is the max number of calls of an evict hook running.
+	evictHookMaxRunning = 64
+)
+
+// WithEvictHook specifies a hook called with each key evicted by GC. Keys deleted or expired are not passed.
+func WithEvictHook(hook EvictHook) Option {
+	return func(fc *Cache) {
+		if hook.Timeout <= 0 {
+			hook.Timeout = defaultEvictHookTimeout
+		}
+		fc.evictHook = &hook
+		fc.evictHooks = make(chan struct{}, evictHookMaxRunning)
+	}
+}
+
+// wantEvicted tells if the values of the keys evicted are wanted by the evict hook.
+func (f *Cache) wantEvicted() bool { return f.evictHook != nil && f.evictHook.WantValue }
+
+// callEvictHook calls the evict hook with key and a reader of its value opened by open, if it wants it,
+// and waits for it until the timeout since the start of the GC pass running. The call is skipped
+// if the calls running do not end before the timeout.
+func (f *Cache) callEvictHook(key string, open func() (io.ReadCloser, error)) {
+	if f.evictHook == nil {
+		return
+	}
+	deadline := f.gcHistory.started().Add(f.evictHook.Timeout)
+	if !f.reserveEvictHook(deadline) {
+		f.gcHistory.update(func(rep *GCReport) { rep.SkippedHooks++ })
+		return
+	}
+	var value io.ReadCloser
+	if f.evictHook.WantValue {
+		var err error
+		if value, err = open(); err != nil {
+			<-f.evictHooks
+			f.gcErrorf("read %s evicted for the evict hook : %s", key, err)
+			return
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() { <-f.evictHooks }()
+		if value != nil {
+			defer value.Close()
+			f.evictHook.Func(key, value)
+			return
+		}
+		f.evictHook.Func(key, nil)
+	}()
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		f.gcErrorf("evict hook of %s timed out, GC pass over %s", key, f.evictHook.Timeout)
+	}
+}
+
+// reserveEvictHook reserves one of the calls of the evict hook running, waiting for the calls running
+// until deadline, and tells if reserved.
+func (f *Cache) reserveEvictHook(deadline time.Time) bool {
+	select {
+	case f.evictHooks <- struct{}{}:
+		return true
+	default:
+	}
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case f.evictHooks <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// readCloser is a reader closed by a closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// evictedValue returns a reader of the value in the file of key about to be evicted, with the key locked.
+func (f *Cache) evictedValue(key string) (io.ReadCloser, error) {
+	file, fi, err := f.openStored(f.filepath(key))
+	if err != nil {
+		return nil, err
+	}
+	if !f.encoded() {
+		// stream the value after its header if any
+		var off int64
+		hdr := make([]byte, entryHeaderLen)
+		if n, _ := file.ReadAt(hdr, 0); n == entryHeaderLen {
+			if _, ok := parseEntryHeader(hdr); ok {
+				off = entryHeaderLen
+			}
+		}
+		return readCloser{io.NewSectionReader(file, off, fi.Size()-off), file}, nil
+	}
+	buf, err := f.readEntryFile(file, fi.Size())
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	return f.packedValue(key, buf)
+}
+
+// packedValue returns a reader of the value of key stored as buf, e.g. packed.
+func (f *Cache) packedValue(key string, buf []byte) (io.ReadCloser, error) {
+	if h, ok := parseEntryHeader(buf); ok {
+		buf = buf[entryHeaderLen:]
+		if h.codec == codecDeflateDict {
+			var err error
+			if buf, err = f.dicts.decompress(h.dict, buf); err != nil {
+				return nil, err
+			}
+		}
+	}
+	val, err := f.decodeValue(key, buf)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(val)), nil
+}
@@ -0,0 +1,80 @@
+package fscache
+
+import (
+	"os"
+	"path"
+)
+
+// WithGcExclude makes GC never evict the entries whose keys match any of globs in the syntax of path.Match(),
+// e.g. manifests that are cheap to keep but expensive to miss. Excluded entries still count towards
+// WithMaxBytes(), so that the others are evicted in their place, and are capped by WithGcExcludeMaxBytes().
+func WithGcExclude(globs ...string) Option {
+	return func(fc *Cache) { fc.gcExclude = append(fc.gcExclude, globs...) }
+}
+
+// WithGcExcludeMaxBytes caps the bytes taken up by the entries excluded by WithGcExclude(), over which GC
+// evicts the least recently used of them, so that they do not grow unbounded. By default, it is unlimited.
+func WithGcExcludeMaxBytes(bytes int64) Option {
+	return func(fc *Cache) { fc.gcExcludeMaxBytes = bytes }
+}
+
+// checkGcExclude returns path.ErrBadPattern if any glob of WithGcExclude() is malformed.
+func (f *Cache) checkGcExclude() error {
+	for _, glob := range f.gcExclude {
+		if _, err := path.Match(glob, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Cache) gcExcluded(key string) bool {
+	for _, glob := range f.gcExclude {
+		if ok, _ := path.Match(glob, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// splitGcExcluded splits entries into the ones GC may evict and the excluded ones,
+// and returns the bytes taken up by the latter.
+func (f *Cache) splitGcExcluded(entries []os.FileInfo) ([]os.FileInfo, []os.FileInfo, int64) {
+	if len(f.gcExclude) == 0 {
+		return entries, nil, 0
+	}
+	var (
+		evictable = make([]os.FileInfo, 0, len(entries))
+		excluded  []os.FileInfo
+		bytes     int64
+	)
+	for _, fi := range entries {
+		if f.gcExcluded(fi.Name()) {
+			excluded = append(excluded, fi)
+			bytes += fi.Size()
+			continue
+		}
+		evictable = append(evictable, fi)
+	}
+	return evictable, excluded, bytes
+}
+
+// excludedVictims returns the least recently used excluded entries over maxBytes of WithGcExcludeMaxBytes(),
+// and the bytes taken up by them.
+func excludedVictims(excluded []os.FileInfo, excludedBytes, maxBytes int64) ([]string, int64) {
+	if maxBytes <= 0 || excludedBytes <= maxBytes {
+		return nil, 0
+	}
+	sizes := make(map[string]int64, len(excluded))
+	for _, fi := range excluded {
+		sizes[fi.Name()] = fi.Size()
+	}
+	var (
+		keys  = lru{}.victims(excluded, excludedBytes-maxBytes)
+		bytes int64
+	)
+	for _, k := range keys {
+		bytes += sizes[k]
+	}
+	return keys, bytes
+}
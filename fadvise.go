@@ -0,0 +1,60 @@
+package fscache
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Advice is a hint to the kernel on the page cache of the file of a value, see posix_fadvise(2).
+type Advice int
+
+const (
+	// AdviceNone gives no hint.
+	AdviceNone Advice = iota
+	// AdviceDontNeed drops the pages of the file from the page cache, for values rarely read again soon.
+	AdviceDontNeed
+	// AdviceWillNeed reads the file into the page cache ahead, for values read again soon.
+	AdviceWillNeed
+)
+
+// WithFadvise gives the kernel the advice afterSet on the page cache of the files of values of threshold bytes
+// or more after setting them, and afterGet after getting them, so that the cache cooperates with the page cache
+// instead of polluting it, e.g. AdviceDontNeed after both for huge artifacts transferred once.
+// By default, no advice is given.
+func WithFadvise(threshold int64, afterSet, afterGet Advice) Option {
+	return func(fc *Cache) {
+		fc.fadviseThreshold, fc.setAdvice, fc.getAdvice = threshold, afterSet, afterGet
+	}
+}
+
+func (a Advice) flag() int {
+	switch a {
+	case AdviceDontNeed:
+		return unix.FADV_DONTNEED
+	case AdviceWillNeed:
+		return unix.FADV_WILLNEED
+	}
+	return -1
+}
+
+// advise gives advice on the file of size bytes, if large enough. It is only a hint, so errors are ignored.
+func (f *Cache) advise(file *os.File, size int64, advice Advice) {
+	if advice == AdviceNone || f.fadviseThreshold <= 0 || size < f.fadviseThreshold {
+		return
+	}
+	unix.Fadvise(int(file.Fd()), 0, 0, advice.flag())
+}
+
+// adviseSet gives the advice after set on the file of key of size bytes.
+func (f *Cache) adviseSet(key string, size int64) {
+	if f.setAdvice == AdviceNone || f.fadviseThreshold <= 0 || size < f.fadviseThreshold {
+		return
+	}
+	file, err := os.Open(f.filepath(key))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	f.advise(file, size, f.setAdvice)
+}
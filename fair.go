@@ -0,0 +1,85 @@
+package fscache
+
+import (
+	"os"
+	"strings"
+)
+
+// WithNamespaceWeights makes GC evict from namespaces in proportion to their weights, instead of by
+// the eviction policy across all entries, so that a namespace of naturally colder entries is not always
+// evicted first. The namespace of a key is the longest prefix of it in weights, or "" weighted 1 if none.
+// Once over WithMaxBytes(), namespaces taking more than their share of it by weight are evicted down to
+// their shares, where the share unused by a namespace is split among the others, and the eviction policy
+// decides which entries to evict within a namespace.
+func WithNamespaceWeights(weights map[string]float64) Option {
+	return func(fc *Cache) { fc.namespaceWeights = weights }
+}
+
+// fairPolicy evicts from namespaces in proportion to their weights by the policy within namespaces.
+type fairPolicy struct {
+	policy
+	weights map[string]float64
+}
+
+func (p *fairPolicy) namespace(key string) string {
+	ns := ""
+	for prefix := range p.weights {
+		if len(prefix) > len(ns) && strings.HasPrefix(key, prefix) {
+			ns = prefix
+		}
+	}
+	return ns
+}
+
+func (p *fairPolicy) weight(ns string) float64 {
+	if w, ok := p.weights[ns]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+func (p *fairPolicy) victims(entries []os.FileInfo, needBytes int64) []string {
+	var (
+		groups = map[string][]os.FileInfo{}
+		usage  = map[string]int64{}
+		total  int64
+	)
+	for _, fi := range entries {
+		ns := p.namespace(fi.Name())
+		groups[ns] = append(groups[ns], fi)
+		usage[ns] += fi.Size()
+		total += fi.Size()
+	}
+
+	// split what remains after eviction by weight, giving the share unused by a namespace to the others
+	remaining := float64(total - needBytes)
+	over := map[string]bool{}
+	for ns := range groups {
+		over[ns] = true
+	}
+	for changed := true; changed; {
+		changed = false
+		var weights float64
+		for ns := range over {
+			weights += p.weight(ns)
+		}
+		for ns := range over {
+			if float64(usage[ns]) <= remaining*p.weight(ns)/weights {
+				remaining -= float64(usage[ns])
+				delete(over, ns)
+				changed = true
+			}
+		}
+	}
+	var weights float64
+	for ns := range over {
+		weights += p.weight(ns)
+	}
+
+	var keys []string
+	for ns := range over {
+		share := int64(remaining * p.weight(ns) / weights)
+		keys = append(keys, p.policy.victims(groups[ns], usage[ns]-share)...)
+	}
+	return keys
+}
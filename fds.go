@@ -0,0 +1,56 @@
+package fscache
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrTooManyOpenFiles will be returned when opening a file kept open by the cache over WithMaxOpenFiles().
+var ErrTooManyOpenFiles = errors.New("too many open files")
+
+// WithMaxOpenFiles caps the number of files kept open by the cache, which are the files of readers got by GetAt()
+// and of the handle pool, see WithHandlePool(), the files of uploads begun by BeginSet(), and packs, so that
+// the cache does not exhaust RLIMIT_NOFILE of the process. Idle files of the handle pool are closed to make room,
+// before ErrTooManyOpenFiles is returned. Files opened only within a call, e.g. by Get(), are not counted.
+// By default, it is unlimited.
+func WithMaxOpenFiles(n int) Option { return func(fc *Cache) { fc.fds.max = int64(n) } }
+
+// fdBudget counts the files kept open against the max.
+type fdBudget struct {
+	max      int64
+	open     int64
+	rejected int64
+}
+
+// acquire counts a file opened, and tells if it is allowed with others files kept open.
+func (b *fdBudget) acquire(others int64) bool {
+	for {
+		open := atomic.LoadInt64(&b.open)
+		if b.max > 0 && open+others+1 > b.max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.open, open, open+1) {
+			return true
+		}
+	}
+}
+
+// release counts a file closed.
+func (b *fdBudget) release() {
+	if b != nil {
+		atomic.AddInt64(&b.open, -1)
+	}
+}
+
+// reserveFd counts a file to be kept open, closing idle files of the handle pool to make room if needed.
+func (f *Cache) reserveFd() error {
+	for {
+		if f.fds.acquire(int64(f.packs.files())) {
+			return nil
+		}
+		if !f.handles.closeIdle() {
+			atomic.AddInt64(&f.fds.rejected, 1)
+			return ErrTooManyOpenFiles
+		}
+	}
+}
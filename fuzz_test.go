@@ -0,0 +1,133 @@
+//go:build go1.18
+// +build go1.18
+
+package fscache
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func FuzzKey(f *testing.F) {
+	for _, key := range []string{"a", "a/b", ".", "..", "../a", "a\x00b", "http://example.com/a?b=c"} {
+		f.Add(key)
+	}
+	cache := &Cache{cacheDir: "/cache"}
+	hashing := &Cache{cacheDir: "/cache", keyHashing: true}
+	t := &Tenant{f: cache, name: "t", prefix: "t" + tenantSep, cfg: TenantConfig{MaxKeyLen: 200}}
+	f.Fuzz(func(tt *testing.T, key string) {
+		name := hashing.filename(key)
+		if _, err := hex.DecodeString(name); err != nil || len(name) != 64 {
+			tt.Fatalf("hashed name %q of %q", name, key)
+		}
+		if name != hashing.filename(key) {
+			tt.Fatalf("hashed name of %q not stable", key)
+		}
+		if filepath.Dir(hashing.filepath(key)) != hashing.filedir() {
+			tt.Fatalf("hashed %q out of %s", key, hashing.filedir())
+		}
+
+		k, err := t.key(key)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidKey) {
+				tt.Fatalf("tenant key %q : %s", key, err)
+			}
+			return
+		}
+		if filepath.Dir(cache.filepath(k)) != cache.filedir() {
+			tt.Fatalf("tenant key %q out of %s", key, cache.filedir())
+		}
+	})
+}
+
+func FuzzEntryHeader(f *testing.F) {
+	f.Add([]byte("value"), int64(0))
+	f.Add(encodeEntry([]byte("value"), 1), int64(-1))
+	f.Add([]byte(entryMagic+"\x00\x00\x00\x00"), int64(1<<62))
+	f.Fuzz(func(t *testing.T, val []byte, expireAt int64) {
+		// arbitrary bytes are parsed or rejected as a whole
+		if h, ok := parseEntryHeader(val); ok && len(val) < entryHeaderLen {
+			t.Fatalf("parsed %+v out of %d bytes", h, len(val))
+		}
+
+		buf := encodeEntry(val, expireAt)
+		h, ok := parseEntryHeader(buf)
+		if !ok {
+			t.Fatalf("header of %x not parsed", buf)
+		}
+		if h.codec != codecRaw || (h.flags&entryFlagTTL != 0) != (expireAt > 0) || h.expireAt != expireAt {
+			t.Fatalf("expected expiry %d, got %+v", expireAt, h)
+		}
+		if !bytes.Equal(buf[entryHeaderLen:], val) {
+			t.Fatalf("expected value %x, got %x", val, buf[entryHeaderLen:])
+		}
+	})
+}
+
+func FuzzPackRecord(f *testing.F) {
+	f.Add("key", []byte("value"), byte(0), []byte{})
+	f.Add("", []byte{}, byte(packFlagTombstone), []byte{0xff, 0xff, 0xff, 0xff, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, key string, val []byte, flags byte, raw []byte) {
+		buf := appendRecord(nil, key, val, flags)
+		if int64(len(buf)) != recordLen(key, int64(len(val))) {
+			t.Fatalf("expected %d bytes, got %d", recordLen(key, int64(len(val))), len(buf))
+		}
+		k, v, fl, err := readRecord(bytes.NewReader(buf))
+		if err != nil || k != key || !bytes.Equal(v, val) || fl != flags {
+			t.Fatalf("expected %q %x %d, got %q %x %d, %v", key, val, flags, k, v, fl, err)
+		}
+
+		// a torn record is an error
+		if len(buf) > 0 {
+			if _, _, _, err := readRecord(bytes.NewReader(buf[:len(buf)-1])); err == nil {
+				t.Fatalf("expected torn record of %q rejected", key)
+			}
+		}
+		// arbitrary bytes are an error or a record of them
+		k, v, _, err = readRecord(bytes.NewReader(raw))
+		if err == nil && recordLen(k, int64(len(v))) > int64(len(raw)) {
+			t.Fatalf("read %d bytes of record out of %d", recordLen(k, int64(len(v))), len(raw))
+		}
+	})
+}
+
+func FuzzNginxHeader(f *testing.F) {
+	f.Add([]byte("\x05\x00\x00\x00\nKEY: http://example.com/a\r\nHTTP/1.1 200 OK\r\n\r\nbody"))
+	f.Add([]byte("\nKEY: \n\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		key, body, err := readNginxHeader(bytes.NewReader(buf))
+		if err != nil {
+			if err != errNoNginxKey && err != io.EOF {
+				t.Fatalf("unexpected error %s", err)
+			}
+			return
+		}
+		if key == "" || body < 0 || body > int64(len(buf)) {
+			t.Fatalf("key %q body at %d out of %d bytes", key, body, len(buf))
+		}
+	})
+}
+
+func FuzzAccessLog(f *testing.F) {
+	f.Add([]byte("{\"key\": \"a\", \"size\": 1}\n\n{\"key\": \"b\", \"size\": 2, \"op\": \"set\", \"time\": \"2021-01-02T15:04:05Z\"}\n"))
+	f.Add([]byte("{\"key\": \"a\", \"size\": -1, \"latency\": -5}"))
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		records, err := readAccessLog(bytes.NewReader(buf))
+		if err != nil {
+			return
+		}
+		for _, rec := range records {
+			if rec.Time.IsZero() {
+				t.Fatalf("record %+v without time", rec)
+			}
+		}
+		// any log read replays
+		if _, err := Replay(bytes.NewReader(buf), ReplayConfig{MaxBytes: []int64{0, 1 << 10}}); err != nil {
+			t.Fatalf("replay: %s", err)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package fscache
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// gcMinBackoff is how long GC waits before rerunning a pass which panicked, doubled after each
+	// panic in a row up to the GC interval.
+	gcMinBackoff = time.Second
+	// gcMaxFailures is the number of GC passes panicking in a row over which Healthy() reports an error.
+	gcMaxFailures = 3
+)
+
+// recoverGc recovers from a panic of the GC pass, e.g. on an unexpected entry, so that eviction is not
+// stopped forever by it, and counts the pass as failed. It must be deferred by gc().
+func (f *Cache) recoverGc() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	n := atomic.AddInt32(&f.gcFailures, 1)
+	atomic.AddInt64(&f.stats.gcPanics, 1)
+	f.gcHistory.update(func(rep *GCReport) {
+		if len(rep.Errors) < gcReportMaxErrors {
+			rep.Errors = append(rep.Errors, fmt.Sprintf("panic: %v", r))
+		}
+	})
+	stack := debug.Stack()
+	if wp, ok := r.(workerPanic); ok {
+		stack = wp.stack
+	}
+	f.logger.Errorf("gc panic, %d in a row : %v\n%s", n, r, stack)
+}
+
+// workerPanic is a panic of a GC worker raised again by the GC pass, with the stack of the worker.
+type workerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+func (p workerPanic) String() string { return fmt.Sprint(p.value) }
+
+// retryGc reruns GC passes which panicked with exponential backoff, until one succeeds,
+// and tells if the cache is still running.
+func (f *Cache) retryGc() bool {
+	backoff := gcMinBackoff
+	for atomic.LoadInt32(&f.gcFailures) > 0 {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-f.stopCh:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+		f.gc()
+		_, interval := f.gcSettings()
+		if backoff *= 2; backoff > interval {
+			backoff = interval
+		}
+		if backoff < gcMinBackoff {
+			backoff = gcMinBackoff
+		}
+	}
+	return true
+}
+
+// gcFailed returns an error if the last GC passes panicked in a row.
+func (f *Cache) gcFailed() error {
+	if n := atomic.LoadInt32(&f.gcFailures); n >= gcMaxFailures {
+		return fmt.Errorf("gc panicked %d times in a row", n)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package fscache
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// GCReport is the result of a GC pass.
+type GCReport struct {
+	Start        time.Time     `json:"start"`
+	Duration     time.Duration `json:"duration"`
+	ScannedFiles int64         `json:"scannedFiles"`
+	ScannedBytes int64         `json:"scannedBytes"`
+	EvictedFiles int64         `json:"evictedFiles"`
+	EvictedBytes int64         `json:"evictedBytes"`
+	SkippedHooks int64         `json:"skippedHooks"`
+	Errors       []string      `json:"errors,omitempty"`
+}
+
+// WithGcHistory keeps the reports of the last n GC passes, returned by Stats(), 16 by default.
+func WithGcHistory(n int) Option { return func(fc *Cache) { fc.gcHistory.size = n } }
+
+// gcReportMaxErrors is the max number of errors kept in a GC report.
+const gcReportMaxErrors = 16
+
+// gcHistory is a ring of GC reports, with the report of the GC pass running.
+type gcHistory struct {
+	mu      sync.Mutex
+	size    int
+	ring    []GCReport
+	next    int
+	running *GCReport
+}
+
+func (h *gcHistory) begin() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running = &GCReport{Start: time.Now()}
+}
+
+// end moves the report of the GC pass running into the ring, and returns it.
+func (h *gcHistory) end() GCReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rep := *h.running
+	h.running = nil
+	rep.Duration = time.Since(rep.Start)
+	if h.size <= 0 {
+		return rep
+	}
+	if len(h.ring) < h.size {
+		h.ring = append(h.ring, rep)
+	} else {
+		h.ring[h.next] = rep
+	}
+	h.next = (h.next + 1) % h.size
+	return rep
+}
+
+// started returns when the GC pass running started, or now if none is running.
+func (h *gcHistory) started() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.running == nil {
+		return time.Now()
+	}
+	return h.running.Start
+}
+
+// update updates the report of the GC pass running, if any.
+func (h *gcHistory) update(fn func(rep *GCReport)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.running != nil {
+		fn(h.running)
+	}
+}
+
+// reports returns the reports kept, the oldest first.
+func (h *gcHistory) reports() []GCReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.ring) < h.size {
+		return append([]GCReport(nil), h.ring...)
+	}
+	return append(append([]GCReport(nil), h.ring[h.next:]...), h.ring[:h.next]...)
+}
+
+// gcErrorf logs an error of GC, recording it in the report of the GC pass running.
+func (f *Cache) gcErrorf(format string, args ...interface{}) {
+	f.logger.Errorf(format, args...)
+	f.gcHistory.update(func(rep *GCReport) {
+		if len(rep.Errors) < gcReportMaxErrors {
+			rep.Errors = append(rep.Errors, fmt.Sprintf(format, args...))
+		}
+	})
+}
+
+// gcEvicted records files of bytes evicted in the report of the GC pass running.
+func (f *Cache) gcEvicted(files, bytes int64) {
+	f.gcHistory.update(func(rep *GCReport) {
+		rep.EvictedFiles += files
+		rep.EvictedBytes += bytes
+	})
+}
+
+// logGcReport logs the summary of a GC pass in key=value pairs, if the logger logs infos.
+func (f *Cache) logGcReport(rep GCReport) {
+	l, ok := f.logger.(interface {
+		Infof(fmt string, args ...interface{})
+	})
+	if !ok {
+		return
+	}
+	l.Infof("gc start=%s duration=%s scanned_files=%d scanned_bytes=%d evicted_files=%d evicted_bytes=%d skipped_hooks=%d errors=%d",
+		rep.Start.Format(time.RFC3339Nano), rep.Duration, rep.ScannedFiles, rep.ScannedBytes,
+		rep.EvictedFiles, rep.EvictedBytes, rep.SkippedHooks, len(rep.Errors))
+}
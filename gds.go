@@ -0,0 +1,114 @@
+package fscache
+
+import (
+	"os"
+	"sort"
+	"sync"
+)
+
+// WithGreedyDualSize makes GC evict entries by GreedyDual-Size instead of LRU, which balances recency,
+// size and the cost set by SetWithCost(), so that expensive-to-rebuild entries survive longer.
+// Entries set without a cost are considered costing 1.
+func WithGreedyDualSize() Option {
+	return func(fc *Cache) {
+		fc.policy = &greedyDualSize{
+			costOf: fc.entryCost,
+			ratio:  map[string]float64{},
+			h:      map[string]float64{},
+		}
+	}
+}
+
+// greedyDualSize gives each entry a priority H = L + cost/size, refreshed on each access,
+// evicts the entry with the lowest H, and inflates L to that H.
+type greedyDualSize struct {
+	mu     sync.Mutex
+	costOf func(key string) float64
+	l      float64
+	ratio  map[string]float64
+	h      map[string]float64
+}
+
+func costRatio(size int64, cost float64) float64 {
+	if cost <= 0 {
+		cost = 1
+	}
+	if size <= 0 {
+		size = 1
+	}
+	return cost / float64(size)
+}
+
+func (g *greedyDualSize) add(key string, size int64, cost float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ratio[key] = costRatio(size, cost)
+	g.h[key] = g.l + g.ratio[key]
+}
+
+func (g *greedyDualSize) touch(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if r, ok := g.ratio[key]; ok {
+		g.h[key] = g.l + r
+	}
+}
+
+func (g *greedyDualSize) remove(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.ratio, key)
+	delete(g.h, key)
+}
+
+func (g *greedyDualSize) victims(entries []os.FileInfo, needBytes int64) []string {
+	var unknown []os.FileInfo
+	g.mu.Lock()
+	for _, fi := range entries {
+		if _, ok := g.ratio[fi.Name()]; !ok {
+			unknown = append(unknown, fi)
+		}
+	}
+	g.mu.Unlock()
+
+	// entries set before a restart or by others, read their costs without holding the lock
+	costs := make([]float64, len(unknown))
+	for i, fi := range unknown {
+		costs[i] = g.costOf(fi.Name())
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, fi := range unknown {
+		g.ratio[fi.Name()] = costRatio(fi.Size(), costs[i])
+		g.h[fi.Name()] = g.l + g.ratio[fi.Name()]
+	}
+	found := make(map[string]struct{}, len(entries))
+	for _, fi := range entries {
+		found[fi.Name()] = struct{}{}
+	}
+	for k := range g.ratio {
+		if _, ok := found[k]; !ok {
+			delete(g.ratio, k)
+			delete(g.h, k)
+		}
+	}
+
+	sorted := make([]os.FileInfo, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool { return g.h[sorted[i].Name()] < g.h[sorted[j].Name()] })
+
+	var (
+		bytesSoFar int64
+		keys       []string
+	)
+	for _, fi := range sorted {
+		if bytesSoFar >= needBytes {
+			break
+		}
+		bytesSoFar += fi.Size()
+		keys = append(keys, fi.Name())
+		g.l = g.h[fi.Name()]
+	}
+	return keys
+}
@@ -0,0 +1,64 @@
+package fscache
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// GetIfChanged gets the value of key like Get() with its version, unless its version is knownVersion,
+// e.g. of a value got before, in which case it returns ErrNotModified without reading the value, as
+// If-None-Match of HTTP. Versions are opaque, and change once the key is set again, except by Sets skipped
+// by WithSkipUnchanged(). The version of a value got from the seed dir is empty.
+func (f *Cache) GetIfChanged(key, knownVersion string) ([]byte, string, error) {
+	if err := f.checkKey(key); err != nil {
+		return nil, "", err
+	}
+	version, ok := f.entryVersion(key)
+	if ok && version == knownVersion && f.Has(key) {
+		atomic.AddInt64(&f.stats.hits, 1)
+		f.policy.touch(key)
+		return nil, version, ErrNotModified
+	}
+	// the version taken before reading is older than the value if they differ, which is read again later
+	val, err := f.Get(key, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		// e.g. fetched from the backend
+		version, _ = f.entryVersion(key)
+	}
+	return val, version, nil
+}
+
+// entryVersion returns the version of the entry of key, false if there is none.
+func (f *Cache) entryVersion(key string) (string, bool) {
+	if loc, ok := f.packs.stat(key); ok {
+		return packVersion(loc), true
+	}
+	if _, fi, ok := f.statChunked(key); ok {
+		return "c" + fileVersion(fi), true
+	}
+	if !f.index.mayContain(key) {
+		return "", false
+	}
+	fi, err := f.statStored(f.filepath(key))
+	if err != nil || !fi.Mode().IsRegular() {
+		return "", false
+	}
+	return fileVersion(fi), true
+}
+
+// packVersion returns the version of a packed entry, which is appended anew once set again.
+func packVersion(loc packLoc) string { return fmt.Sprintf("p%x-%x-%x", loc.pack, loc.off, loc.size) }
+
+// fileVersion returns the version of an entry file, which is replaced by a new file once set again.
+func fileVersion(fi os.FileInfo) string {
+	var ino uint64
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		ino = st.Ino
+	}
+	return fmt.Sprintf("%x-%x-%x", ino, fi.ModTime().UnixNano(), fi.Size())
+}
@@ -0,0 +1,88 @@
+package fscache
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// getMultiWorkers is the most entries GetMulti() reads at once.
+const getMultiWorkers = 16
+
+// KeyErrors is the errors of the keys failed by a call on many keys, by the keys.
+type KeyErrors map[string]error
+
+func (e KeyErrors) Error() string {
+	keys := make([]string, 0, len(e))
+	for key := range e {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	msgs := make([]string, len(keys))
+	for i, key := range keys {
+		msgs[i] = fmt.Sprintf("%s: %s", key, e[key])
+	}
+	return fmt.Sprintf("%d keys failed: %s", len(keys), strings.Join(msgs, "; "))
+}
+
+// GetMulti gets the values of keys as Get(), reading their entries concurrently, and returns the values
+// of the keys found. Keys not found are left out, and if others fail, the values of the rest are returned
+// with a KeyErrors of the failed ones. With a MultiBackend, the keys missing are fetched at once.
+func (f *Cache) GetMulti(keys []string) (map[string][]byte, error) {
+	var (
+		mu      sync.Mutex
+		vals    = make(map[string][]byte, len(keys))
+		errs    = KeyErrors{}
+		missing []string
+		wg      sync.WaitGroup
+		ch      = make(chan string)
+		get     = f.Get
+	)
+	mb, multi := f.backend.(MultiBackend)
+	if multi {
+		get = func(key string, dst []byte) ([]byte, error) { return f.getCached(key, dst, PriorityForeground) }
+	}
+	workers := getMultiWorkers
+	if workers > len(keys) {
+		workers = len(keys)
+	}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for key := range ch {
+				val, err := get(key, nil)
+				mu.Lock()
+				switch err {
+				case nil:
+					vals[key] = val
+				case ErrNotFound:
+					missing = append(missing, key)
+				default:
+					errs[key] = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, key := range keys {
+		ch <- key
+	}
+	close(ch)
+	wg.Wait()
+	if multi && len(missing) > 0 {
+		fetched, err := f.fetchMulti(mb, missing)
+		for _, key := range missing {
+			if err != nil {
+				errs[key] = err
+			} else if val, ok := fetched[key]; ok {
+				vals[key] = val
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return vals, errs
+	}
+	return vals, nil
+}
@@ -0,0 +1,96 @@
+package fscache
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// GetTo writes the value of key to w, and returns the number of bytes written.
+// If w is a *net.TCPConn, an *os.File, or a writer reading from them, e.g. a http.ResponseWriter,
+// the value is moved kernel side by sendfile(2) or splice(2), without being copied through memory.
+// The checksum in the entry header is not verified.
+func (f *Cache) GetTo(key string, w io.Writer) (int64, error) {
+	if err := f.checkKey(key); err != nil {
+		return 0, err
+	}
+	n, err := f.getTo(key, w)
+	switch err {
+	case nil:
+		atomic.AddInt64(&f.stats.hits, 1)
+		f.policy.touch(key)
+		if f.heatmap != nil {
+			f.heatmap.hit(key)
+		}
+	case ErrNotFound:
+		atomic.AddInt64(&f.stats.misses, 1)
+		f.missed(key)
+	}
+	return n, err
+}
+
+func (f *Cache) getTo(key string, w io.Writer) (int64, error) {
+	if f.packs.has(key) || f.encoded() {
+		val, err := f.get(key, nil)
+		if err != nil {
+			return 0, err
+		}
+		n, err := w.Write(val)
+		return int64(n), err
+	}
+	if m, _, ok := f.statChunked(key); ok {
+		if f.expired(key) {
+			return 0, ErrNotFound
+		}
+		return io.Copy(w, io.NewSectionReader(newChunkReader(f, key, m), 0, m.Size))
+	}
+	if !f.index.mayContain(key) {
+		return 0, ErrNotFound
+	}
+	fp := f.filepath(key)
+	f.addReader(key)
+	defer f.doneReader(key)
+	file, fi, err := f.openEntry(fp)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if f.expired(key) || f.headerExpired(key) {
+		return 0, ErrNotFound
+	}
+	off, err := entryValueOffset(file)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	// io.Copy hands the file to ReadFrom of w, which uses sendfile or splice for files
+	n, err := io.Copy(w, &io.LimitedReader{R: file, N: fi.Size() - off})
+	if err != nil {
+		return n, err
+	}
+	if !f.skipAtime {
+		if err := os.Chtimes(fp, time.Now(), fi.ModTime()); err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// entryValueOffset returns where the value starts in the entry file, after the header if any.
+func entryValueOffset(file *os.File) (int64, error) {
+	buf := make([]byte, entryHeaderLen)
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		return 0, nil
+	}
+	h, ok := parseEntryHeader(buf)
+	if !ok {
+		return 0, nil
+	}
+	if h.codec != codecRaw {
+		return 0, ErrUnknownFormat
+	}
+	return entryHeaderLen, nil
+}
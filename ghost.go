@@ -0,0 +1,82 @@
+package fscache
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// WithEvictionGhosts keeps the hashes of the last n keys evicted by GC, and counts the misses of them
+// as premature evictions in Stats, once per eviction, which tell that the cache is too small for its
+// working set if they are a large share of the misses.
+func WithEvictionGhosts(n int) Option { return func(fc *Cache) { fc.ghosts.max = n } }
+
+// ghostList is a bounded list of the hashes of keys evicted, the oldest dropped first.
+type ghostList struct {
+	max int
+
+	mu     sync.Mutex
+	ring   []uint64
+	next   int
+	hashes map[uint64]int
+}
+
+func ghostHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// add adds key evicted, dropping the oldest key over the max.
+func (g *ghostList) add(key string) {
+	if g.max <= 0 {
+		return
+	}
+	h := ghostHash(key)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.hashes == nil {
+		g.hashes = map[uint64]int{}
+	}
+	if len(g.ring) < g.max {
+		g.ring = append(g.ring, h)
+	} else {
+		old := g.ring[g.next]
+		if n := g.hashes[old]; n > 1 {
+			g.hashes[old] = n - 1
+		} else {
+			delete(g.hashes, old)
+		}
+		g.ring[g.next] = h
+		g.next = (g.next + 1) % g.max
+	}
+	g.hashes[h]++
+}
+
+// take tells if key was evicted recently, forgetting it.
+func (g *ghostList) take(key string) bool {
+	if g.max <= 0 {
+		return false
+	}
+	h := ghostHash(key)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := g.hashes[h]
+	if n == 0 {
+		return false
+	}
+	// the hash is still in the ring, which drops its count once the oldest
+	if n > 1 {
+		g.hashes[h] = n - 1
+	} else {
+		delete(g.hashes, h)
+	}
+	return true
+}
+
+// missed counts the miss of key as a premature eviction if it was evicted recently.
+func (f *Cache) missed(key string) {
+	if f.ghosts.take(key) {
+		atomic.AddInt64(&f.stats.prematureEvictions, 1)
+	}
+}
@@ -1,5 +1,5 @@
 module github.com/sequix/fscache
 
-go 1.15
+go 1.16
 
 require golang.org/x/sys v0.0.0-20210110051926-789bb1bd4061
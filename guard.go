@@ -0,0 +1,60 @@
+package fscache
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// WithQuarantine moves illegal entries, e.g. symlinks, devices or directories planted under the cache dir,
+// into the quarantine dir under the cache dir, instead of leaving them in place. Entries found corrupt
+// by Get() or WithScrub() are moved there too with a QuarantineReport, instead of being left or deleted.
+func WithQuarantine() Option { return func(fc *Cache) { fc.quarantine = true } }
+
+func (f *Cache) quarantinedir() string { return filepath.Join(f.cacheDir, "quarantine") }
+
+// openEntry opens the regular file at fp without following symlinks.
+func (f *Cache) openEntry(fp string) (*os.File, os.FileInfo, error) {
+	file, err := os.OpenFile(fp, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, ErrNotFound
+		}
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ELOOP {
+			if fi, err := os.Lstat(fp); err == nil {
+				f.illegalEntry(fp, fi)
+			}
+			return nil, nil, ErrIllegalEntry
+		}
+		return nil, nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		file.Close()
+		f.illegalEntry(fp, fi)
+		return nil, nil, ErrIllegalEntry
+	}
+	return file, fi, nil
+}
+
+// illegalEntry reports the entry at fp which is not a regular file, and quarantines it if enabled.
+func (f *Cache) illegalEntry(fp string, fi os.FileInfo) {
+	if !f.quarantine {
+		f.logger.Errorf("illegal entry %s with mode %s, ignored", fp, fi.Mode())
+		return
+	}
+	dst := filepath.Join(f.quarantinedir(), fi.Name()+"."+strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := os.Rename(fp, dst); err != nil {
+		if !vanished(err) {
+			f.logger.Errorf("quarantine illegal entry %s : %s", fp, err)
+		}
+		return
+	}
+	f.logger.Errorf("illegal entry %s with mode %s, quarantined to %s", fp, fi.Mode(), dst)
+}
@@ -0,0 +1,251 @@
+package fscache
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// WithHandlePool keeps the files opened by GetAt() open after closed, up to maxOpen files,
+// closing the least recently used idle ones over it, so that repeated random reads of hot large entries
+// do not open and close them every time. By default, files are closed as soon as closed by callers.
+func WithHandlePool(maxOpen int) Option { return func(fc *Cache) { fc.handles.max = maxOpen } }
+
+// GetAt returns a reader of the value of key at random offsets without copying it into memory,
+// which must be closed after use. The reader is an *io.SectionReader whose Size() is the size of the value,
+// and keeps reading the value got even if key is set, deleted or evicted before closed, see
+// WithDeferBusyEviction().
+// The checksum in the entry header is not verified.
+func (f *Cache) GetAt(key string) (io.ReaderAt, io.Closer, error) {
+	if err := f.checkKey(key); err != nil {
+		return nil, nil, err
+	}
+	r, c, err := f.getAt(key)
+	switch err {
+	case nil:
+		atomic.AddInt64(&f.stats.hits, 1)
+		f.policy.touch(key)
+		if f.heatmap != nil {
+			f.heatmap.hit(key)
+		}
+	case ErrNotFound:
+		atomic.AddInt64(&f.stats.misses, 1)
+		f.missed(key)
+	}
+	return r, c, err
+}
+
+func (f *Cache) getAt(key string) (io.ReaderAt, io.Closer, error) {
+	if m, _, ok := f.statChunked(key); ok {
+		if f.expired(key) {
+			return nil, nil, ErrNotFound
+		}
+		return io.NewSectionReader(newChunkReader(f, key, m), 0, m.Size), ioutil.NopCloser(nil), nil
+	}
+	if f.packs.has(key) || f.encoded() {
+		val, err := f.get(key, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return io.NewSectionReader(bytes.NewReader(val), 0, int64(len(val))), ioutil.NopCloser(nil), nil
+	}
+	if !f.index.mayContain(key) {
+		return nil, nil, ErrNotFound
+	}
+	if f.expired(key) || f.headerExpired(key) {
+		return nil, nil, ErrNotFound
+	}
+	f.addReader(key)
+	h, err := f.handles.acquire(f, key)
+	if err != nil {
+		f.doneReader(key)
+		return nil, nil, err
+	}
+	if !f.skipAtime {
+		if err := os.Chtimes(f.filepath(key), time.Now(), h.mtime); err != nil && !os.IsNotExist(err) {
+			f.handles.release(h)
+			f.doneReader(key)
+			return nil, nil, err
+		}
+	}
+	return io.NewSectionReader(h.file, h.off, h.size-h.off), &handleCloser{f: f, h: h}, nil
+}
+
+// handle is an open file of an entry, shared by the readers got by GetAt().
+type handle struct {
+	key      string
+	file     *os.File
+	dev, ino uint64
+	mtime    time.Time
+	// off is where the value starts, after the entry header if any
+	off, size int64
+	refs      int
+	// stale handles are out of the pool, closed once released by all readers
+	stale bool
+	// elem is the element in the idle list of the pool, if idle
+	elem *list.Element
+}
+
+type handleCloser struct {
+	f    *Cache
+	h    *handle
+	once sync.Once
+}
+
+func (c *handleCloser) Close() error {
+	c.once.Do(func() {
+		c.f.handles.release(c.h)
+		c.f.doneReader(c.h.key)
+	})
+	return nil
+}
+
+// handlePool keeps the handles open, the idle ones from the least to the most recently used.
+type handlePool struct {
+	mu   sync.Mutex
+	max  int
+	open map[string]*handle
+	idle *list.List
+	fds  *fdBudget
+}
+
+// acquire returns a handle of the entry file of key, reusing the open one if it is still the file of key.
+func (p *handlePool) acquire(f *Cache, key string) (*handle, error) {
+	fp := f.filepath(key)
+	p.mu.Lock()
+	if h, ok := p.open[key]; ok {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(fp, &st); err == nil && uint64(st.Dev) == h.dev && st.Ino == h.ino {
+			p.ref(h)
+			p.mu.Unlock()
+			return h, nil
+		}
+		p.drop(h)
+	}
+	p.mu.Unlock()
+
+	h, err := openHandle(f, key)
+	if err != nil {
+		return nil, err
+	}
+	h.refs = 1
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.max <= 0 {
+		h.stale = true
+		return h, nil
+	}
+	if p.open == nil {
+		p.open, p.idle = map[string]*handle{}, list.New()
+	}
+	if old, ok := p.open[key]; ok {
+		p.drop(old)
+	}
+	p.open[key] = h
+	p.trim()
+	return h, nil
+}
+
+func openHandle(f *Cache, key string) (*handle, error) {
+	if err := f.reserveFd(); err != nil {
+		return nil, err
+	}
+	file, fi, err := f.openEntry(f.filepath(key))
+	if err != nil {
+		f.fds.release()
+		return nil, err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	h := &handle{key: key, file: file, dev: uint64(st.Dev), ino: st.Ino, mtime: fi.ModTime(), size: fi.Size()}
+	if h.off, err = entryValueOffset(file); err != nil {
+		file.Close()
+		f.fds.release()
+		return nil, err
+	}
+	return h, nil
+}
+
+// ref takes a reference of h, with p.mu held.
+func (p *handlePool) ref(h *handle) {
+	h.refs++
+	if h.elem != nil {
+		p.idle.Remove(h.elem)
+		h.elem = nil
+	}
+}
+
+func (p *handlePool) release(h *handle) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h.refs--
+	if h.refs > 0 {
+		return
+	}
+	if h.stale {
+		p.close(h)
+		return
+	}
+	h.elem = p.idle.PushBack(h)
+	p.trim()
+}
+
+// drop removes h from the pool, closing it if idle, with p.mu held.
+func (p *handlePool) drop(h *handle) {
+	delete(p.open, h.key)
+	h.stale = true
+	if h.elem != nil {
+		p.idle.Remove(h.elem)
+		h.elem = nil
+	}
+	if h.refs == 0 {
+		p.close(h)
+	}
+}
+
+func (p *handlePool) close(h *handle) {
+	h.file.Close()
+	p.fds.release()
+}
+
+// closeIdle closes the least recently used idle handle, and tells if there was one.
+func (p *handlePool) closeIdle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.idle == nil || p.idle.Len() == 0 {
+		return false
+	}
+	p.drop(p.idle.Front().Value.(*handle))
+	return true
+}
+
+// trim closes the least recently used idle handles over the max, with p.mu held.
+func (p *handlePool) trim() {
+	for len(p.open) > p.max && p.idle.Len() > 0 {
+		p.drop(p.idle.Front().Value.(*handle))
+	}
+}
+
+// invalidate closes the idle handle of key, and makes the busy one closed once released,
+// so that the file of an entry set or deleted is not kept open.
+func (p *handlePool) invalidate(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h, ok := p.open[key]; ok {
+		p.drop(h)
+	}
+}
+
+// closeAll closes the idle handles, and makes the busy ones closed once released.
+func (p *handlePool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, h := range p.open {
+		p.drop(h)
+	}
+}
@@ -0,0 +1,157 @@
+package fscache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WithKeyHashing names the files of entries by the SHA-256 of their keys instead of the keys,
+// so that keys of any length and with any bytes, e.g. URLs with slashes, can be cached.
+// The original keys are stored in the metadata of entries, so that Keys() and ForEach(),
+// and the tools built on them, still see the original keys rather than the hashes.
+func WithKeyHashing() Option {
+	return func(fc *Cache) {
+		fc.keyHashing = true
+		fc.hashedKeys = &hashedKeys{m: map[string]string{}}
+	}
+}
+
+// filename returns the name of the files of key.
+func (f *Cache) filename(key string) string {
+	if !f.keyHashing {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// validKey tells if key is a valid file name, so that it does not name a file out of its dir.
+func validKey(key string) bool {
+	return key != "" && key != "." && key != ".." && !strings.ContainsAny(key, "/\x00")
+}
+
+// checkKey fails with ErrInvalidKey if key can not be the name of the file of its entry.
+// Any key is valid with key hashing, as the names of files are their hashes.
+func (f *Cache) checkKey(key string) error {
+	if f.keyHashing || validKey(key) {
+		return nil
+	}
+	return fmt.Errorf("key %.64q: %w", key, ErrInvalidKey)
+}
+
+// hashedKeys maps the names of files to the keys hashed to them.
+type hashedKeys struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func (h *hashedKeys) get(name string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key, ok := h.m[name]
+	return key, ok
+}
+
+func (h *hashedKeys) set(name, key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.m[name] = key
+}
+
+func (h *hashedKeys) remove(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.m, name)
+}
+
+// keyOf returns the key of the files named name, looking it up in the metadata of the entry
+// if not seen since the start. It returns false if the key is unknown, e.g. the entry is being set.
+func (f *Cache) keyOf(name string) (string, bool) {
+	if !f.keyHashing {
+		return name, true
+	}
+	if key, ok := f.hashedKeys.get(name); ok {
+		return key, true
+	}
+	var (
+		m   entryMeta
+		err error
+	)
+	switch s := f.metas().(type) {
+	case xattrMeta:
+		m, err = s.readPath(filepath.Join(f.filedir(), name), filepath.Join(f.metadir(), name))
+	case sidecarMeta:
+		m, err = s.readPath(filepath.Join(f.metadir(), name))
+	}
+	if err != nil || m.Key == "" {
+		return "", false
+	}
+	f.hashedKeys.set(name, m.Key)
+	return m.Key, true
+}
+
+// orphanAge is how long GC leaves the file of a hashed key without the meta holding its key,
+// which is written right after the file, before removing it by its name, e.g. as its Set crashed in between.
+const orphanAge = time.Minute
+
+// dropOrphan removes the file named name of fi of a hashed key without its meta, if older than orphanAge.
+func (f *Cache) dropOrphan(name string, fi os.FileInfo) {
+	fp := filepath.Join(f.filedir(), name)
+	if time.Since(fi.ModTime()) < orphanAge {
+		return
+	}
+	// the file may have just been set again, with its meta being written
+	if fi, err := f.statStored(fp); err != nil || time.Since(fi.ModTime()) < orphanAge {
+		return
+	}
+	if err := f.removeStored(fp); err != nil {
+		if !vanished(err) {
+			f.gcErrorf("gc orphan %s : %s", fp, err)
+		}
+		return
+	}
+	if _, ok := f.metas().(sidecarMeta); ok {
+		if err := os.Remove(filepath.Join(f.metadir(), name)); err != nil && !vanished(err) {
+			f.gcErrorf("gc meta of orphan %s : %s", fp, err)
+		}
+	}
+	f.gcEvicted(1, fi.Size())
+}
+
+// keysOf returns the keys of the files named names, skipping the unknown ones.
+func (f *Cache) keysOf(names []string) []string {
+	if !f.keyHashing {
+		return names
+	}
+	keys := names[:0]
+	for _, name := range names {
+		if key, ok := f.keyOf(name); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Keys returns the keys in the cache, the original ones if key hashing is enabled.
+func (f *Cache) Keys() ([]string, error) { return f.keys() }
+
+// ForEach calls fn with each key in the cache, the original ones if key hashing is enabled,
+// stopping at the first error returned by fn.
+func (f *Cache) ForEach(fn func(key string) error) error {
+	keys, err := f.keys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package fscache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+var (
+	// ErrCorrupted will be returned when getting a key whose value mismatches the checksum in its entry header.
+	ErrCorrupted = errors.New("entry corrupted")
+	// ErrUnknownFormat will be returned when getting a key whose entry header is of a codec unknown to this version.
+	ErrUnknownFormat = errors.New("unknown entry format")
+)
+
+// WithEntryHeader prefixes the values set with a small header holding a checksum verified by Get(),
+// and the expiry of SetWithTTL() instead of a sidecar file. Entries without a header,
+// e.g. set before the option was enabled, are still read as raw values.
+func WithEntryHeader() Option { return func(fc *Cache) { fc.entryHeader = true } }
+
+// entryHeaderLen is the length of the entry header of
+//
+//	magic | flags | codec | dictionary version | expire at in unix nanoseconds | crc32 of the value | crc32 of the header before
+//
+// in big endian.
+const entryHeaderLen = 24
+
+const (
+	entryMagic = "\xf5FSC"
+
+	entryFlagChecksum = 1 << 0
+	entryFlagTTL      = 1 << 1
+
+	// codecRaw means the value is stored as is, other codecs are reserved for compression and encryption.
+	codecRaw = 0
+	// codecDeflateDict means the value is compressed by DEFLATE with the dictionary of the version in the header,
+	// see WithDictCompression().
+	codecDeflateDict = 1
+)
+
+type entryHeader struct {
+	flags    byte
+	codec    byte
+	dict     uint16
+	expireAt int64
+	crc      uint32
+}
+
+func encodeEntry(val []byte, expireAt int64) []byte {
+	buf := make([]byte, entryHeaderLen, entryHeaderLen+len(val))
+	encodeEntryHeader(buf, crc32.ChecksumIEEE(val), expireAt)
+	return append(buf, val...)
+}
+
+// encodeEntryCodec encodes the entry of val stored by codec with the dictionary of version dict.
+func encodeEntryCodec(val []byte, expireAt int64, codec byte, dict uint16) []byte {
+	buf := encodeEntry(val, expireAt)
+	buf[5] = codec
+	binary.BigEndian.PutUint16(buf[6:8], dict)
+	binary.BigEndian.PutUint32(buf[20:24], crc32.ChecksumIEEE(buf[:20]))
+	return buf
+}
+
+// encodeEntryHeader encodes the header of a value of checksum crc into buf.
+func encodeEntryHeader(buf []byte, crc uint32, expireAt int64) {
+	copy(buf, entryMagic)
+	buf[4] = entryFlagChecksum
+	if expireAt > 0 {
+		buf[4] |= entryFlagTTL
+	}
+	buf[5] = codecRaw
+	binary.BigEndian.PutUint64(buf[8:16], uint64(expireAt))
+	binary.BigEndian.PutUint32(buf[16:20], crc)
+	binary.BigEndian.PutUint32(buf[20:24], crc32.ChecksumIEEE(buf[:20]))
+}
+
+// parseEntryHeader parses the header at the beginning of buf, and tells if there is one.
+// A header is recognized by its magic and checksum, so that a raw value is hardly mistaken for one.
+func parseEntryHeader(buf []byte) (entryHeader, bool) {
+	if len(buf) < entryHeaderLen || string(buf[:4]) != entryMagic {
+		return entryHeader{}, false
+	}
+	if crc32.ChecksumIEEE(buf[:20]) != binary.BigEndian.Uint32(buf[20:24]) {
+		return entryHeader{}, false
+	}
+	return entryHeader{
+		flags:    buf[4],
+		codec:    buf[5],
+		dict:     binary.BigEndian.Uint16(buf[6:8]),
+		expireAt: int64(binary.BigEndian.Uint64(buf[8:16])),
+		crc:      binary.BigEndian.Uint32(buf[16:20]),
+	}, true
+}
+
+func (h entryHeader) expired(now time.Time) bool {
+	return h.flags&entryFlagTTL != 0 && now.UnixNano() >= h.expireAt
+}
+
+// decodeEntry returns the value in the entry buf of key, returns ErrNotFound and deletes key if it expired.
+func (f *Cache) decodeEntry(key string, buf []byte) ([]byte, error) {
+	h, ok := parseEntryHeader(buf)
+	if !ok {
+		return f.decodeValue(key, buf)
+	}
+	if h.codec != codecRaw && h.codec != codecDeflateDict {
+		return nil, fmt.Errorf("%w: codec %d", ErrUnknownFormat, h.codec)
+	}
+	if h.expired(time.Now()) {
+		f.deleteExpired(key, f.headerStillExpired(key))
+		return nil, ErrNotFound
+	}
+	if err := verifyEntry(key, buf); err != nil {
+		return nil, err
+	}
+	val := buf[entryHeaderLen:]
+	if h.codec == codecDeflateDict {
+		var err error
+		if val, err = f.dicts.decompress(h.dict, val); err != nil {
+			return nil, fmt.Errorf("%s : %w", key, err)
+		}
+	}
+	return f.decodeValue(key, val)
+}
+
+// headerExpired tells if the entry file of key expired by its header, deleting it if so.
+func (f *Cache) headerExpired(key string) bool {
+	if !f.entryHeader {
+		return false
+	}
+	expired := f.headerStillExpired(key)
+	if !expired() {
+		return false
+	}
+	f.deleteExpired(key, expired)
+	return true
+}
+
+// headerStillExpired returns a recheck for deleteExpired() of the expiry in the stored header of key.
+func (f *Cache) headerStillExpired(key string) func() bool {
+	return func() bool {
+		h, ok := f.storedHeader(key)
+		return ok && h.expired(time.Now())
+	}
+}
+
+// storedHeader returns the parsed header of the stored entry of key, whether packed or in its file.
+func (f *Cache) storedHeader(key string) (entryHeader, bool) {
+	buf, packed, err := f.packs.peek(key)
+	if err != nil {
+		return entryHeader{}, false
+	}
+	if !packed {
+		file, _, err := f.openStored(f.filepath(key))
+		if err != nil {
+			return entryHeader{}, false
+		}
+		buf = make([]byte, entryHeaderLen)
+		_, err = io.ReadFull(file, buf)
+		file.Close()
+		if err != nil {
+			return entryHeader{}, false
+		}
+	}
+	return parseEntryHeader(buf)
+}
+
+// fileValueSize returns the size of the value in the entry file of key, excluding its header.
+func (f *Cache) fileValueSize(key string) (int64, error) {
+	file, fi, err := f.openStored(f.filepath(key))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	buf := make([]byte, entryHeaderLen)
+	if _, err := io.ReadFull(file, buf); err == nil {
+		if _, ok := parseEntryHeader(buf); ok {
+			return fi.Size() - entryHeaderLen, nil
+		}
+	}
+	return fi.Size(), nil
+}
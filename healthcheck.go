@@ -0,0 +1,84 @@
+package fscache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithMinFreeBytes specifies how many bytes at least should be free on the filesystem of the cache,
+// or Healthy() reports an error. By default, Healthy() reports an error only when there is no free space.
+func WithMinFreeBytes(bytes int64) Option { return func(fc *Cache) { fc.minFreeBytes = bytes } }
+
+// Healthy performs a quick self-test suitable for readiness probes:
+// it sets, gets and removes a probe entry, checks the free space, and checks if GC is running.
+// It returns nil if the cache is healthy, or ctx.Err() if ctx is done before the self-test finishes.
+func (f *Cache) Healthy(ctx context.Context) error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- f.selfTest() }()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-errCh:
+		return err
+	}
+}
+
+func (f *Cache) selfTest() error {
+	if f.health.isDegraded() || !f.breaker.allow() {
+		return ErrDegraded
+	}
+
+	key := ".probe-" + strconv.Itoa(os.Getpid()) + "-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	fp := f.filepath(key)
+	val := []byte(key)
+	if err := f.writeStored(key, val); err != nil {
+		return fmt.Errorf("set probe: %w", err)
+	}
+	defer f.removeStored(fp)
+	valFromCache, err := f.readStored(fp)
+	if err != nil {
+		return fmt.Errorf("get probe: %w", err)
+	}
+	if !bytes.Equal(val, valFromCache) {
+		return errors.New("get probe: value mismatched")
+	}
+	if err := f.removeStored(fp); err != nil {
+		return fmt.Errorf("remove probe: %w", err)
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(f.filedir(), &st); err != nil {
+		return fmt.Errorf("statfs %s: %w", f.filedir(), err)
+	}
+	f.tuneMu.RLock()
+	minFree := f.minFreeBytes
+	f.tuneMu.RUnlock()
+	if free := int64(st.Bavail) * int64(st.Bsize); free <= minFree {
+		return fmt.Errorf("free space %d bytes, want more than %d bytes", free, minFree)
+	}
+
+	if err := f.gcFailed(); err != nil {
+		return err
+	}
+	if maxBytes, interval := f.gcSettings(); maxBytes > 0 {
+		if f.adaptiveGC != nil && f.adaptiveGC.maxInterval > interval {
+			interval = f.adaptiveGC.maxInterval
+		}
+		last := atomic.LoadInt64(&f.stats.lastGc)
+		if last == 0 {
+			last = f.stats.startAt
+		}
+		if since := time.Since(time.Unix(0, last)); since > 2*interval+time.Minute {
+			return fmt.Errorf("gc stale, last completed %s ago", since)
+		}
+	}
+	return nil
+}
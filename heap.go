@@ -1,10 +1,6 @@
 package fscache
 
-import (
-	"os"
-	"syscall"
-	"time"
-)
+import "os"
 
 type fileInfoHeap []os.FileInfo
 
@@ -13,11 +9,7 @@ func (f fileInfoHeap) Len() int {
 }
 
 func (f fileInfoHeap) Less(i, j int) bool {
-	fis := f[i].Sys().(*syscall.Stat_t)
-	fjs := f[j].Sys().(*syscall.Stat_t)
-	fia := time.Unix(fis.Atim.Sec, fis.Atim.Nsec)
-	fja := time.Unix(fjs.Atim.Sec, fjs.Atim.Nsec)
-	return fia.Before(fja)
+	return atime(f[i]).Before(atime(f[j]))
 }
 
 func (f fileInfoHeap) Swap(i, j int) {
@@ -0,0 +1,215 @@
+package fscache
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Formats supported by DumpHeatmap().
+const (
+	HeatmapCSV  = "csv"
+	HeatmapJSON = "json"
+)
+
+// maxHeatmapKeys is the most keys a heatmap records, dropping the least recently hit first.
+const maxHeatmapKeys = 100000
+
+// WithHeatmap records per-key hit counts and last access time of the most recently hit 100000 keys,
+// persisting them under the cache dir every interval.
+func WithHeatmap(interval time.Duration) Option {
+	return func(fc *Cache) { fc.heatmap = newHeatmap(interval, maxHeatmapKeys) }
+}
+
+// HeatmapEntry is the access record of a key.
+type HeatmapEntry struct {
+	Key        string    `json:"key"`
+	Hits       uint64    `json:"hits"`
+	LastAccess time.Time `json:"lastAccess"`
+}
+
+type heat struct {
+	key  string
+	hits uint64
+	last int64
+}
+
+// heatmap is the records of keys, in a list of the most recently hit first, bounded by max.
+type heatmap struct {
+	mu       sync.Mutex
+	m        map[string]*list.Element
+	lru      *list.List
+	max      int
+	interval time.Duration
+}
+
+func newHeatmap(interval time.Duration, max int) *heatmap {
+	return &heatmap{m: map[string]*list.Element{}, lru: list.New(), max: max, interval: interval}
+}
+
+func (f *Cache) heatmapPath() string { return filepath.Join(f.cacheDir, "heatmap") }
+
+func (h *heatmap) hit(key string) {
+	now := time.Now().UnixNano()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := h.record(key)
+	e.hits++
+	e.last = now
+}
+
+// record returns the record of key, the most recently hit, added if missing.
+func (h *heatmap) record(key string) *heat {
+	if el, ok := h.m[key]; ok {
+		h.lru.MoveToFront(el)
+		return el.Value.(*heat)
+	}
+	e := &heat{key: key}
+	h.m[key] = h.lru.PushFront(e)
+	if h.lru.Len() > h.max {
+		oldest := h.lru.Back()
+		h.lru.Remove(oldest)
+		delete(h.m, oldest.Value.(*heat).key)
+	}
+	return e
+}
+
+// entries returns the records sorted by hits, the hottest first.
+func (h *heatmap) entries() []HeatmapEntry {
+	h.mu.Lock()
+	rst := make([]HeatmapEntry, 0, len(h.m))
+	for el := h.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*heat)
+		rst = append(rst, HeatmapEntry{Key: e.key, Hits: e.hits, LastAccess: time.Unix(0, e.last)})
+	}
+	h.mu.Unlock()
+	sort.Slice(rst, func(i, j int) bool {
+		if rst[i].Hits != rst[j].Hits {
+			return rst[i].Hits > rst[j].Hits
+		}
+		return rst[i].Key < rst[j].Key
+	})
+	return rst
+}
+
+// load reads the heatmap file, which is a sequence of
+// uvarint key length, key, uvarint hits and varint last access in unix nanoseconds,
+// the least recently hit first.
+func (h *heatmap) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		key := make([]byte, n)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return err
+		}
+		hits, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		last, err := binary.ReadVarint(r)
+		if err != nil {
+			return err
+		}
+		e := h.record(string(key))
+		e.hits, e.last = hits, last
+	}
+}
+
+func (h *heatmap) save(path string) error {
+	var (
+		buf []byte
+		tmp = make([]byte, binary.MaxVarintLen64)
+	)
+	h.mu.Lock()
+	for el := h.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*heat)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(len(e.key)))]...)
+		buf = append(buf, e.key...)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, e.hits)]...)
+		buf = append(buf, tmp[:binary.PutVarint(tmp, e.last)]...)
+	}
+	h.mu.Unlock()
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (f *Cache) heatmapRunner() {
+	ticker := time.NewTicker(f.heatmap.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stopCh:
+			f.saveHeatmap()
+			return
+		case <-ticker.C:
+			f.saveHeatmap()
+		}
+	}
+}
+
+func (f *Cache) saveHeatmap() {
+	if err := f.heatmap.save(f.heatmapPath()); err != nil {
+		f.logger.Errorf("save heatmap %s : %s", f.heatmapPath(), err)
+	}
+}
+
+// DumpHeatmap writes the per-key hit counts and last access time to w in format,
+// which is either HeatmapCSV or HeatmapJSON, the hottest key first.
+// It requires WithHeatmap().
+func (f *Cache) DumpHeatmap(w io.Writer, format string) error {
+	if f.heatmap == nil {
+		return fmt.Errorf("heatmap not enabled")
+	}
+	entries := f.heatmap.entries()
+	switch format {
+	case HeatmapCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"key", "hits", "last_access"}); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			record := []string{e.Key, strconv.FormatUint(e.Hits, 10), e.LastAccess.Format(time.RFC3339Nano)}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case HeatmapJSON:
+		return json.NewEncoder(w).Encode(entries)
+	}
+	return fmt.Errorf("unknown heatmap format %q", format)
+}
@@ -0,0 +1,159 @@
+package fscache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewHandler returns a http.Handler serving the cache c, mapping URL path /key to key.
+// Keys not valid file names, e.g. empty, "..", or with slashes, are rejected with 400 Bad Request.
+// GET gets the value supporting range requests and revalidation by ETag, HEAD tells if the key exists with its size, PUT sets the value to the request body,
+// and DELETE deletes the key. DELETE /?prefix=p deletes all keys starting with p.
+// GET /?key=k1&key=k2 and POST / with a key a line get many keys in one round-trip, responding their values
+// as the parts of a multipart/mixed response, see MultiBackend.
+func NewHandler(c Interface, opts ...HandlerOption) http.Handler {
+	h := &handler{c: c}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+type handler struct {
+	c     Interface
+	limit *limiter
+	auth  AuthFunc
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.limit != nil {
+		release, limited := h.limit.limited(w, r)
+		if limited {
+			return
+		}
+		defer release()
+	}
+	if prefix, ok := r.URL.Query()["prefix"]; ok && r.Method == http.MethodDelete {
+		h.purge(w, r, strings.Join(prefix, ""))
+		return
+	}
+	if keys, ok, err := multiGetKeys(w, r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if ok {
+		h.getMulti(w, r, keys)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if !validKey(key) {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+	action := ActionRead
+	switch r.Method {
+	case http.MethodPut:
+		action = ActionWrite
+	case http.MethodDelete:
+		action = ActionDelete
+	}
+	if !h.authorized(w, r, action, key) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var (
+			val []byte
+			err error
+		)
+		if f, ok := h.c.(*Cache); ok {
+			var version string
+			val, version, err = f.GetIfChanged(key, etagVersion(r.Header.Get("If-None-Match")))
+			if version != "" {
+				w.Header().Set("ETag", strconv.Quote(version))
+			}
+			if err == ErrNotModified {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		} else {
+			val, err = h.c.Get(key, nil)
+		}
+		if err == ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(val))
+	case http.MethodHead:
+		if !h.c.Has(key) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if f, ok := h.c.(*Cache); ok {
+			if size, err := f.fileValueSize(key); err == nil {
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			}
+		}
+	case http.MethodPut:
+		val, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.c.Set(key, val); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		d, ok := h.c.(Deleter)
+		if !ok {
+			http.Error(w, "delete not supported", http.StatusNotImplemented)
+			return
+		}
+		if err := d.Delete(key); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// purge deletes all keys starting with prefix.
+func (h *handler) purge(w http.ResponseWriter, r *http.Request, prefix string) {
+	f, ok := h.c.(*Cache)
+	if !ok {
+		http.Error(w, "purge not supported", http.StatusNotImplemented)
+		return
+	}
+	if !h.authorized(w, r, ActionPurge, prefix) {
+		return
+	}
+	n, err := f.DeletePrefix(prefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(strconv.Itoa(n) + "\n"))
+}
+
+// etagVersion returns the version of the single strong ETag in an If-None-Match header, empty if none.
+func etagVersion(header string) string {
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' || strings.Contains(header, ",") {
+		return ""
+	}
+	return header[1 : len(header)-1]
+}
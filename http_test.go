@@ -0,0 +1,320 @@
+package fscache
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	if err := cache.Set("key", randBytes(10)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	h := NewHandler(cache, WithRateLimit(0.001, 2), WithClientKey(func(r *http.Request) string {
+		return r.Header.Get("X-Client")
+	}))
+
+	get := func(client string) int {
+		r := httptest.NewRequest(http.MethodGet, "/key", nil)
+		r.Header.Set("X-Client", client)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	for i := 0; i < 2; i++ {
+		if code := get("noisy"); code != http.StatusOK {
+			t.Errorf("expected request within burst served, got %d", code)
+		}
+	}
+	if code := get("noisy"); code != http.StatusTooManyRequests {
+		t.Errorf("expected request over the limit rejected, got %d", code)
+	}
+	if code := get("quiet"); code != http.StatusOK {
+		t.Errorf("expected other clients served, got %d", code)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	l := (&handler{}).limiter()
+	l.maxConcurrent = 1
+	r := httptest.NewRequest(http.MethodGet, "/key", nil)
+
+	release, _ := l.acquire(r)
+	if release == nil {
+		t.Fatalf("expected the first request allowed")
+	}
+	if again, _ := l.acquire(r); again != nil {
+		t.Errorf("expected concurrent request over the limit rejected")
+	}
+	release()
+	if again, _ := l.acquire(r); again == nil {
+		t.Errorf("expected request allowed after release")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	acl := ACL{
+		"":        {"*": {ActionRead}},
+		"team-a-": {"alice": {ActionRead, ActionWrite, ActionDelete, ActionPurge}},
+	}
+	h := NewHandler(cache, WithAuth(NewACLAuth(acl, func(r *http.Request) string {
+		return r.Header.Get("X-Client")
+	})))
+
+	do := func(method, target, client string) int {
+		r := httptest.NewRequest(method, target, strings.NewReader("val"))
+		r.Header.Set("X-Client", client)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := do(http.MethodPut, "/team-a-key", "alice"); code != http.StatusNoContent {
+		t.Errorf("expected alice writing to her namespace, got %d", code)
+	}
+	if code := do(http.MethodPut, "/team-a-key", "bob"); code != http.StatusForbidden {
+		t.Errorf("expected bob forbidden writing to team a, got %d", code)
+	}
+	if code := do(http.MethodGet, "/team-a-key", "bob"); code != http.StatusOK {
+		t.Errorf("expected anyone reading, got %d", code)
+	}
+	if code := do(http.MethodPut, "/other", "alice"); code != http.StatusForbidden {
+		t.Errorf("expected alice forbidden writing outside her namespace, got %d", code)
+	}
+	if code := do(http.MethodDelete, "/?prefix=team-a-", "bob"); code != http.StatusForbidden {
+		t.Errorf("expected bob forbidden purging, got %d", code)
+	}
+	if code := do(http.MethodDelete, "/?prefix=team-a-", "alice"); code != http.StatusOK {
+		t.Errorf("expected alice purging her namespace, got %d", code)
+	}
+	if cache.Has("team-a-key") {
+		t.Errorf("expected namespace purged")
+	}
+}
+
+func TestHandlerTraversal(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	acl := ACL{"team-a-": {"*": {ActionRead, ActionWrite}}}
+	h := NewHandler(cache, WithAuth(NewACLAuth(acl, nil)))
+
+	for _, target := range []string{"/../../escaped", "/team-a-/../../escaped", "/team-a-%2F..%2F..%2Fescaped", "/.", "/team-a-%00"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, target, strings.NewReader("val")))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected PUT %s rejected, got %d", target, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?key=team-a-key&key=team-a-/../../escaped", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected multi-get of a key out of the cache rejected, got %d", w.Code)
+	}
+	for _, fp := range []string{filepath.Join(cache.cacheDir, "escaped"), filepath.Join(filepath.Dir(cache.cacheDir), "escaped")} {
+		if _, err := os.Stat(fp); !os.IsNotExist(err) {
+			t.Errorf("expected nothing written to %s, got %v", fp, err)
+		}
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	if err := cache.Set("key", randBytes(4*1024)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	cache.gc()
+
+	w := httptest.NewRecorder()
+	NewAdminHandler(cache).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/gc", nil))
+	var reports []GCReport
+	if err := json.NewDecoder(w.Body).Decode(&reports); err != nil {
+		t.Fatalf("decode gc reports: %s", err)
+	}
+	if len(reports) != 1 || reports[0].EvictedFiles != 1 || reports[0].EvictedBytes != 4*1024 {
+		t.Errorf("unexpected gc reports %+v", reports)
+	}
+}
+
+func TestETag(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	if err := cache.Set("key", randBytes(10)); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	h := NewHandler(cache)
+	get := func(etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/key", nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	w := get("")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected the value with an etag, got %d %q", w.Code, etag)
+	}
+	if w := get(etag); w.Code != http.StatusNotModified || w.Body.Len() > 0 {
+		t.Errorf("expected not modified, got %d", w.Code)
+	}
+	if w := get(`"other"`); w.Code != http.StatusOK || w.Body.Len() != 10 {
+		t.Errorf("expected the value of another etag, got %d", w.Code)
+	}
+}
+
+func TestAdminEntries(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	for _, key := range []string{"key1", "key2", "other"} {
+		if err := cache.Set(key, randBytes(10)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	NewAdminHandler(cache).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/entries?prefix=key&limit=1", nil))
+	var page entriesPage
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("decode entries: %s", err)
+	}
+	if len(page.Entries) != 1 || page.Entries[0].Key != "key1" || page.Next == "" {
+		t.Errorf("unexpected page %+v", page)
+	}
+	w = httptest.NewRecorder()
+	NewAdminHandler(cache).ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+		"/entries?prefix=key&limit=1&cursor="+url.QueryEscape(page.Next), nil))
+	page = entriesPage{}
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("decode entries: %s", err)
+	}
+	if len(page.Entries) != 1 || page.Entries[0].Key != "key2" || page.Next != "" {
+		t.Errorf("unexpected last page %+v", page)
+	}
+
+	w = httptest.NewRecorder()
+	NewAdminHandler(cache).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/entries?minAge=soon", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a bad age, got %d", w.Code)
+	}
+}
+
+func TestExportImportIndex(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	peer, cancelPeer := newCache()
+	defer cancelPeer()
+
+	// key1 set in the cache after the peer, key2 an hour before
+	for _, set := range []struct {
+		c   *Cache
+		key string
+	}{{cache, "key2"}, {peer, "key1"}, {peer, "key2"}, {peer, "key3"}, {cache, "key1"}} {
+		if err := set.c.Set(set.key, randBytes(10)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(cache.filepath("key2"), old, old); err != nil {
+		t.Fatalf("chtimes: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	NewAdminHandler(peer).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/index", nil))
+	p, err := cache.ImportIndex(w.Body)
+	if err != nil {
+		t.Fatalf("import index: %s", err)
+	}
+	if len(p.Entries) != 3 || !p.Has("key3") || p.Has("key4") {
+		t.Errorf("expected the 3 entries of the peer, got %+v", p.Entries)
+	}
+	if e, ok := p.Stat("key1"); !ok || e.Size != 10 {
+		t.Errorf("expected key1 of 10 bytes, got %+v", e)
+	}
+	if want := []string{"key2", "key3"}; !reflect.DeepEqual(p.Missing, want) {
+		t.Errorf("expected missing %v, got %v", want, p.Missing)
+	}
+}
+
+func TestMultiGet(t *testing.T) {
+	cache, cancel := newCache()
+	defer cancel()
+	vals := map[string][]byte{"key1": randBytes(10), "key 2": randBytes(20)}
+	for key, val := range vals {
+		if err := cache.Set(key, val); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+	}
+	srv := httptest.NewServer(NewHandler(cache))
+	defer srv.Close()
+
+	got, err := NewHTTPBackend(srv.URL, nil).(MultiBackend).FetchMulti([]string{"key1", "missing", "key 2"})
+	if err != nil {
+		t.Fatalf("fetch multi: %s", err)
+	}
+	if !reflect.DeepEqual(got, vals) {
+		t.Errorf("expected the values of the keys found, got %d values", len(got))
+	}
+
+	w := httptest.NewRecorder()
+	NewHandler(cache).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?key=key1&key=missing", nil))
+	if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || !strings.HasPrefix(ct, "multipart/mixed") {
+		t.Errorf("expected a multipart response, got %d %s", w.Code, ct)
+	}
+	if n := strings.Count(w.Body.String(), "Content-Location: /key1"); n != 1 {
+		t.Errorf("expected a part of key1, got %d", n)
+	}
+
+	// a failed key is left out alone
+	if err := os.Remove(cache.filepath("key 2")); err != nil {
+		t.Fatalf("remove: %s", err)
+	}
+	if err := os.Mkdir(cache.filepath("key 2"), 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	got, err = NewHTTPBackend(srv.URL, nil).(MultiBackend).FetchMulti([]string{"key1", "key 2"})
+	if err != nil || len(got) != 1 || !bytes.Equal(got["key1"], vals["key1"]) {
+		t.Errorf("expected the value of key1 only, got %d values, err %v", len(got), err)
+	}
+
+	w = httptest.NewRecorder()
+	body := strings.NewReader(strings.Repeat("k", maxMultiGetBodyBytes+1))
+	NewHandler(cache).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", body))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a body too large rejected, got %d", w.Code)
+	}
+
+	// the keys missing are fetched at once from a MultiBackend
+	var posts int32
+	counted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			atomic.AddInt32(&posts, 1)
+		}
+		NewHandler(cache).ServeHTTP(w, r)
+	}))
+	defer counted.Close()
+	reader, cancel2 := newCache(WithBackend(NewHTTPBackend(counted.URL, nil)))
+	defer cancel2()
+	got, err = reader.GetMulti([]string{"key1", "missing"})
+	if err != nil || len(got) != 1 || atomic.LoadInt32(&posts) != 1 {
+		t.Errorf("expected the values fetched in 1 post, got %d values in %d posts, err %v", len(got), posts, err)
+	}
+	if !reader.Has("key1") {
+		t.Errorf("expected the values fetched set")
+	}
+}
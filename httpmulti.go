@@ -0,0 +1,141 @@
+package fscache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+const (
+	// maxMultiGetKeys is the most keys a multi-get gets.
+	maxMultiGetKeys = 10000
+	// maxMultiGetBodyBytes is the largest body of a multi-get by POST, of the most keys of 1KB.
+	maxMultiGetBodyBytes = maxMultiGetKeys * 1024
+)
+
+// multiGetKeys returns the keys of a multi-get, by the key query parameters of GET / or the lines of the body
+// of POST /, false if r is not a multi-get.
+func multiGetKeys(w http.ResponseWriter, r *http.Request) ([]string, bool, error) {
+	if r.URL.Path != "/" {
+		return nil, false, nil
+	}
+	switch r.Method {
+	case http.MethodGet:
+		keys, ok := r.URL.Query()["key"]
+		return keys, ok, nil
+	case http.MethodPost:
+		var keys []string
+		s := bufio.NewScanner(http.MaxBytesReader(w, r.Body, maxMultiGetBodyBytes))
+		for s.Scan() {
+			if s.Text() != "" {
+				keys = append(keys, s.Text())
+			}
+		}
+		return keys, true, s.Err()
+	}
+	return nil, false, nil
+}
+
+// getMulti serves the values of keys found as the parts of a multipart/mixed response, in the order of keys,
+// each with the path of its key in its Content-Location header. Keys not found or failing are left out,
+// so that a key failing does not fail the others.
+func (h *handler) getMulti(w http.ResponseWriter, r *http.Request, keys []string) {
+	if len(keys) > maxMultiGetKeys {
+		http.Error(w, fmt.Sprintf("more than %d keys", maxMultiGetKeys), http.StatusRequestEntityTooLarge)
+		return
+	}
+	for _, key := range keys {
+		if !validKey(key) {
+			http.Error(w, "invalid key", http.StatusBadRequest)
+			return
+		}
+		if !h.authorized(w, r, ActionRead, key) {
+			return
+		}
+	}
+	var vals map[string][]byte
+	if f, ok := h.c.(*Cache); ok {
+		// the values of the keys not failing are returned with the KeyErrors of the others
+		vals, _ = f.GetMulti(keys)
+	} else {
+		vals = make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			if val, err := h.c.Get(key, nil); err == nil {
+				vals[key] = val
+			}
+		}
+	}
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	for _, key := range keys {
+		val, ok := vals[key]
+		if !ok {
+			continue
+		}
+		delete(vals, key)
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":     {"application/octet-stream"},
+			"Content-Location": {"/" + url.PathEscape(key)},
+		})
+		if err != nil {
+			return
+		}
+		if _, err := pw.Write(val); err != nil {
+			return
+		}
+	}
+	mw.Close()
+}
+
+// FetchMulti fetches the values of keys in one round-trip by a multi-get of NewHandler().
+// Keys must not have newlines.
+func (h *httpBackend) FetchMulti(keys []string) (map[string][]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, h.baseURL+"/", strings.NewReader(strings.Join(keys, "\n")))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("POST %s responded %s: %s", req.URL, resp.Status, msg)
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		return nil, fmt.Errorf("POST %s responded %q, not multipart/mixed", req.URL, resp.Header.Get("Content-Type"))
+	}
+	var (
+		vals = make(map[string][]byte, len(keys))
+		mr   = multipart.NewReader(resp.Body, params["boundary"])
+	)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return vals, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		key, err := url.PathUnescape(strings.TrimPrefix(part.Header.Get("Content-Location"), "/"))
+		if err != nil {
+			return nil, fmt.Errorf("part of key %q : %w", part.Header.Get("Content-Location"), err)
+		}
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(part); err != nil {
+			return nil, err
+		}
+		vals[key] = buf.Bytes()
+	}
+}
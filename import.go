@@ -0,0 +1,148 @@
+package fscache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Importer reads the entries of a cache written by another tool, see Cache.Import().
+type Importer interface {
+	// Import calls fn with each entry, stopping at the first error returned by fn.
+	Import(fn func(e ImportedEntry) error) error
+}
+
+// ImportedEntry is an entry read by an Importer, whose value is only readable within the call.
+type ImportedEntry struct {
+	Key     string
+	Value   io.Reader
+	Size    int64
+	ModTime time.Time
+}
+
+// Import sets the entries read by im into the cache, with their modification times as the access
+// and modification times of their files, so that a warm cache of another tool is adopted in LRU order.
+// It returns how many entries imported.
+func (f *Cache) Import(im Importer) (int, error) {
+	n := 0
+	p := f.newProgress("import", 0)
+	defer p.done()
+	err := im.Import(func(e ImportedEntry) error {
+		if err := f.SetReader(e.Key, e.Value, e.Size); err != nil {
+			return err
+		}
+		if err := f.chtimesStored(f.filepath(e.Key), e.ModTime, e.ModTime); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		n++
+		p.add(1, e.Size)
+		return nil
+	})
+	return n, err
+}
+
+// walkImport calls fn with each regular file under dir, opened for reading.
+func walkImport(dir string, fn func(path string, fi os.FileInfo, file *os.File) error) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		defer file.Close()
+		return fn(path, fi, file)
+	})
+}
+
+type djherbisImporter struct{ dir string }
+
+// NewDjherbisImporter returns an Importer of a github.com/djherbis/fscache cache in dir,
+// whose files are named by the URL-safe base64 of their keys. Other files are skipped.
+func NewDjherbisImporter(dir string) Importer { return djherbisImporter{dir: dir} }
+
+func (d djherbisImporter) Import(fn func(e ImportedEntry) error) error {
+	return walkImport(d.dir, func(path string, fi os.FileInfo, file *os.File) error {
+		key, err := base64.URLEncoding.DecodeString(fi.Name())
+		if err != nil || len(key) == 0 {
+			return nil
+		}
+		return fn(ImportedEntry{Key: string(key), Value: file, Size: fi.Size(), ModTime: fi.ModTime()})
+	})
+}
+
+type diskvImporter struct{ dir string }
+
+// NewDiskvImporter returns an Importer of a github.com/peterbourgon/diskv store in dir, the disk store
+// of many Go caches, e.g. github.com/gregjones/httpcache/diskcache, whose files are named by their keys
+// in the dirs given by the transform of the store.
+func NewDiskvImporter(dir string) Importer { return diskvImporter{dir: dir} }
+
+func (d diskvImporter) Import(fn func(e ImportedEntry) error) error {
+	return walkImport(d.dir, func(path string, fi os.FileInfo, file *os.File) error {
+		return fn(ImportedEntry{Key: fi.Name(), Value: file, Size: fi.Size(), ModTime: fi.ModTime()})
+	})
+}
+
+type nginxImporter struct{ dir string }
+
+// NewNginxImporter returns an Importer of an nginx proxy_cache in dir, which imports the bodies of
+// the cached responses under their cache keys, as found in the "KEY:" lines of the files.
+// Files without a key, e.g. temporary ones, are skipped. The keys are usually URLs with slashes,
+// which need WithKeyHashing().
+func NewNginxImporter(dir string) Importer { return nginxImporter{dir: dir} }
+
+// errNoNginxKey is returned by readNginxHeader if the file is not a cache file of nginx.
+var errNoNginxKey = errors.New("no nginx cache key")
+
+func (n nginxImporter) Import(fn func(e ImportedEntry) error) error {
+	return walkImport(n.dir, func(path string, fi os.FileInfo, file *os.File) error {
+		key, bodyStart, err := readNginxHeader(file)
+		if err == errNoNginxKey {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := file.Seek(bodyStart, io.SeekStart); err != nil {
+			return err
+		}
+		return fn(ImportedEntry{Key: key, Value: file, Size: fi.Size() - bodyStart, ModTime: fi.ModTime()})
+	})
+}
+
+// readNginxHeader reads the key and the offset of the body of an nginx cache file,
+// which has a binary header, a "KEY: " line, the response headers and the body.
+func readNginxHeader(r io.Reader) (string, int64, error) {
+	const keyLine = "\nKEY: "
+	br := bufio.NewReaderSize(r, 64*1024)
+	buf, err := br.Peek(64 * 1024)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", 0, err
+	}
+	start := bytes.Index(buf, []byte(keyLine))
+	if start < 0 {
+		return "", 0, errNoNginxKey
+	}
+	start += len(keyLine)
+	end := bytes.IndexByte(buf[start:], '\n')
+	if end < 0 {
+		return "", 0, errNoNginxKey
+	}
+	key := strings.TrimRight(string(buf[start:start+end]), "\r")
+	body := bytes.Index(buf[start+end:], []byte("\r\n\r\n"))
+	if key == "" || body < 0 {
+		return "", 0, errNoNginxKey
+	}
+	return key, int64(start + end + body + 4), nil
+}
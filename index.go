@@ -0,0 +1,108 @@
+package fscache
+
+import "sync"
+
+// index tracks the size of each entry, so that the usage of the cache is known without walking it.
+type index struct {
+	mu    sync.Mutex
+	m     map[string]int64
+	bytes int64
+	// stale is true when the index may miss changes and has to be rebuilt by walking the cache.
+	stale bool
+	// changed records the keys changed while rebuilding, a negative size means removed.
+	changed map[string]int64
+	// bloom filters keys not in the index if bloomKeys > 0.
+	bloom     *bloomFilter
+	bloomKeys int
+}
+
+func newIndex() *index {
+	return &index{m: map[string]int64{}, stale: true}
+}
+
+func (i *index) set(key string, size int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.bytes += size - i.m[key]
+	i.m[key] = size
+	if i.bloom != nil {
+		i.bloom.add(key)
+	}
+	if i.changed != nil {
+		i.changed[key] = size
+	}
+}
+
+func (i *index) remove(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.bytes -= i.m[key]
+	delete(i.m, key)
+	if i.changed != nil {
+		i.changed[key] = -1
+	}
+}
+
+// beginRebuild starts recording changes, which are applied over the rebuilt index by endRebuild().
+func (i *index) beginRebuild() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.changed = map[string]int64{}
+}
+
+// endRebuild replaces the index with entries found by walking the cache.
+func (i *index) endRebuild(m map[string]int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for k, size := range i.changed {
+		if size < 0 {
+			delete(m, k)
+		} else {
+			m[k] = size
+		}
+	}
+	i.m, i.bytes, i.stale, i.changed = m, 0, false, nil
+	for _, size := range m {
+		i.bytes += size
+	}
+	if i.bloomKeys > 0 {
+		keys := i.bloomKeys
+		if 2*len(m) > keys {
+			keys = 2 * len(m)
+		}
+		i.bloom = newBloomFilter(keys)
+		for k := range m {
+			i.bloom.add(k)
+		}
+	}
+}
+
+// mayContain tells if key may be in the cache, which is false only if the Bloom filter is sure it is not.
+func (i *index) mayContain(key string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.bloom == nil || i.stale || i.bloom.mayContain(key)
+}
+
+func (i *index) markStale() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.stale = true
+}
+
+// usage returns the bytes taken up by entries, and whether it could be trusted.
+func (i *index) usage() (int64, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.bytes, !i.stale
+}
+
+func (i *index) keys() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	keys := make([]string, 0, len(i.m))
+	for k := range i.m {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,99 @@
+package fscache
+
+import (
+	"bytes"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithInotify watches the cache dir with inotify, so that entries added or removed by other processes
+// are accounted, and GC walks the cache dir only when it takes up more than max bytes.
+func WithInotify() Option { return func(fc *Cache) { fc.inotify = true } }
+
+const inotifyMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_DELETE
+
+// watchInotify returns the inotify fd watching the cache dir.
+func (f *Cache) watchInotify() (int, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return -1, err
+	}
+	if _, err := unix.InotifyAddWatch(fd, f.filedir(), inotifyMask); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func (f *Cache) inotifyRunner(fd int) {
+	defer unix.Close(fd)
+	var (
+		buf = make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		pfd = []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	)
+	for {
+		select {
+		case <-f.stopCh:
+			return
+		default:
+		}
+		n, err := unix.Poll(pfd, 1000)
+		if err != nil && err != unix.EINTR {
+			f.logger.Errorf("poll inotify of %s : %s", f.filedir(), err)
+			f.index.markStale()
+			return
+		}
+		if n <= 0 {
+			continue
+		}
+		n, err = unix.Read(fd, buf)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			f.logger.Errorf("read inotify of %s : %s", f.filedir(), err)
+			f.index.markStale()
+			return
+		}
+		f.handleInotifyEvents(buf[:n])
+	}
+}
+
+func (f *Cache) handleInotifyEvents(buf []byte) {
+	for off := 0; off+unix.SizeofInotifyEvent <= len(buf); {
+		ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+		nameBytes := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+		name := string(bytes.TrimRight(nameBytes, "\x00"))
+		off += unix.SizeofInotifyEvent + int(ev.Len)
+
+		switch {
+		case ev.Mask&(unix.IN_Q_OVERFLOW|unix.IN_IGNORED) != 0:
+			f.index.markStale()
+		case ev.Mask&(unix.IN_MOVED_FROM|unix.IN_DELETE) != 0:
+			// the hashed keys deleted by the cache are forgotten, and already removed from the index
+			if key, ok := f.keyOf(name); ok {
+				f.index.remove(key)
+			}
+		case ev.Mask&(unix.IN_MOVED_TO|unix.IN_CLOSE_WRITE) != 0:
+			// a hashed key is unknown until its meta is written, after which written() indexes it
+			key, ok := f.keyOf(name)
+			if !ok {
+				continue
+			}
+			fi, err := os.Lstat(f.filepath(key))
+			if err != nil {
+				if os.IsNotExist(err) {
+					f.index.remove(key)
+					continue
+				}
+				f.index.markStale()
+				continue
+			}
+			if fi.Mode().IsRegular() {
+				f.index.set(key, fi.Size())
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package fscache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	journalOpSet    = 'S'
+	journalOpDelete = 'D'
+)
+
+type journalRecord struct {
+	op  byte
+	key string
+	// next is the journal offset right after this record.
+	next int64
+}
+
+// journal is an append-only log of cache writes, one record per line,
+// formatted as an op byte followed by the quoted key.
+type journal struct {
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	// sync syncs the journal after each record, see WithDurable()
+	sync bool
+}
+
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &journal{f: f, size: fi.Size()}, nil
+}
+
+func (j *journal) append(op byte, key string) error {
+	line := string(op) + " " + strconv.Quote(key) + "\n"
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	n, err := j.f.WriteString(line)
+	j.size += int64(n)
+	if err == nil && j.sync {
+		err = j.f.Sync()
+	}
+	return err
+}
+
+// readFrom returns the complete records after offset off,
+// and the offset right after the last returned record.
+func (j *journal) readFrom(off int64) ([]journalRecord, int64, error) {
+	j.mu.Lock()
+	size := j.size
+	j.mu.Unlock()
+	if off >= size {
+		return nil, off, nil
+	}
+
+	var (
+		records []journalRecord
+		r       = bufio.NewReader(io.NewSectionReader(j.f, off, size-off))
+	)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			// a partial line is left for the next read
+			return records, off, nil
+		}
+		if err != nil {
+			return records, off, err
+		}
+		if len(line) < 3 || line[1] != ' ' {
+			return records, off, fmt.Errorf("corrupted journal record at offset %d", off)
+		}
+		key, err := strconv.Unquote(line[2 : len(line)-1])
+		if err != nil {
+			return records, off, fmt.Errorf("corrupted journal record at offset %d: %s", off, err)
+		}
+		off += int64(len(line))
+		records = append(records, journalRecord{op: line[0], key: key, next: off})
+	}
+}
+
+// truncateAt empties the journal if nothing has been appended after off,
+// and reports whether it did.
+func (j *journal) truncateAt(off int64) (bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if off != j.size {
+		return false, nil
+	}
+	if err := j.f.Truncate(0); err != nil {
+		return false, err
+	}
+	j.size = 0
+	return true, nil
+}
+
+func (j *journal) close() error {
+	return j.f.Close()
+}
@@ -0,0 +1,76 @@
+package fscache
+
+import (
+	"os"
+	"sync"
+)
+
+// LockKey takes the lock of key which the cache takes to write key, and returns the func to unlock it,
+// so that applications doing work on the entry of key, e.g. transforming its value in place, are not
+// torn by concurrent sets or deletes of key. The lock is held within this process. Methods writing key,
+// including Get() fetching it from the backend, block until it is unlocked, so they must not be
+// called by the holder of the lock. It returns os.ErrClosed if the cache is closed.
+func (f *Cache) LockKey(key string) (unlock func(), err error) {
+	select {
+	case <-f.stopCh:
+		return nil, os.ErrClosed
+	default:
+	}
+	return f.keyLocks.lock(key), nil
+}
+
+// keyLocks are the locks of keys, each removed once no one holds or waits for it.
+type keyLocks struct {
+	mu sync.Mutex
+	m  map[string]*keyLock
+}
+
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks key, and returns the func to unlock it.
+func (k *keyLocks) lock(key string) func() {
+	k.mu.Lock()
+	if k.m == nil {
+		k.m = map[string]*keyLock{}
+	}
+	l, ok := k.m[key]
+	if !ok {
+		l = &keyLock{}
+		k.m[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.mu.Lock()
+	return k.unlocker(key, l)
+}
+
+// tryLock locks key if no one holds it, and returns the func to unlock it, or false if held.
+func (k *keyLocks) tryLock(key string) (func(), bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.m[key]; ok {
+		return nil, false
+	}
+	if k.m == nil {
+		k.m = map[string]*keyLock{}
+	}
+	l := &keyLock{refs: 1}
+	l.mu.Lock()
+	k.m[key] = l
+	return k.unlocker(key, l), true
+}
+
+func (k *keyLocks) unlocker(key string, l *keyLock) func() {
+	return func() {
+		l.mu.Unlock()
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(k.m, key)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package fscache
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Latency is the percentiles of the latencies of an operation, within 1/8 of the real ones.
+type Latency struct {
+	Count int64
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// latencySubBits is the bits of the buckets per power of 2 of latency histograms, 8 of them.
+const latencySubBits = 3
+
+// latencyHistogram is a log-linear histogram of latencies in nanoseconds, as HDR histograms,
+// recorded without locks.
+type latencyHistogram struct {
+	counts [(64 - latencySubBits + 1) << latencySubBits]int64
+	sum    int64
+	max    int64
+}
+
+// latencyBucket returns the bucket of ns, which is exact below 16.
+func latencyBucket(ns int64) int {
+	if ns < 1<<latencySubBits {
+		return int(ns)
+	}
+	exp := bits.Len64(uint64(ns)) - 1
+	sub := int(ns>>(exp-latencySubBits)) & (1<<latencySubBits - 1)
+	return (exp-latencySubBits+1)<<latencySubBits + sub
+}
+
+// latencyBucketMax returns the largest latency in bucket b.
+func latencyBucketMax(b int) int64 {
+	if b < 1<<latencySubBits {
+		return int64(b)
+	}
+	exp := b>>latencySubBits + latencySubBits - 1
+	sub := int64(b & (1<<latencySubBits - 1))
+	return (1<<latencySubBits+sub+1)<<(exp-latencySubBits) - 1
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	ns := int64(d)
+	if ns < 0 {
+		ns = 0
+	}
+	atomic.AddInt64(&h.counts[latencyBucket(ns)], 1)
+	atomic.AddInt64(&h.sum, ns)
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if ns <= max || atomic.CompareAndSwapInt64(&h.max, max, ns) {
+			return
+		}
+	}
+}
+
+// since records the latency since start.
+func (h *latencyHistogram) since(start time.Time) { h.record(time.Since(start)) }
+
+// get returns the percentiles of the latencies recorded.
+func (h *latencyHistogram) get() Latency {
+	var (
+		counts [len(h.counts)]int64
+		total  int64
+	)
+	for i := range counts {
+		counts[i] = atomic.LoadInt64(&h.counts[i])
+		total += counts[i]
+	}
+	max := atomic.LoadInt64(&h.max)
+	percentile := func(q float64) time.Duration {
+		rank := int64(math.Ceil(q * float64(total)))
+		var n int64
+		for b, c := range counts {
+			if n += c; n >= rank && c > 0 {
+				if v := latencyBucketMax(b); v < max {
+					return time.Duration(v)
+				}
+				break
+			}
+		}
+		return time.Duration(max)
+	}
+	if total == 0 {
+		return Latency{}
+	}
+	return Latency{Count: total, P50: percentile(0.5), P95: percentile(0.95), P99: percentile(0.99), Max: time.Duration(max)}
+}
+
+// writeMetrics writes the metrics of f in the text format of Prometheus.
+func (f *Cache) writeMetrics(w io.Writer) error {
+	s := f.Stats()
+	counters := []struct {
+		name, help string
+		value      int64
+	}{
+		{"fscache_hits_total", "Gets finding the key.", s.Hits},
+		{"fscache_misses_total", "Gets not finding the key.", s.Misses},
+		{"fscache_written_bytes_total", "Bytes set to the cache.", s.BytesWritten},
+		{"fscache_corrupt_entries_total", "Corrupt entries found.", s.CorruptEntries},
+		{"fscache_premature_evictions_total", "Misses of keys evicted recently.", s.PrematureEvictions},
+	}
+	for _, c := range counters {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value); err != nil {
+			return err
+		}
+	}
+
+	const name = "fscache_operation_duration_seconds"
+	if _, err := fmt.Fprintf(w, "# HELP %s Latencies of operations.\n# TYPE %s summary\n", name, name); err != nil {
+		return err
+	}
+	for _, op := range []struct {
+		name string
+		h    *latencyHistogram
+		l    Latency
+	}{
+		{"get", &f.stats.getLatency, s.GetLatency},
+		{"set", &f.stats.setLatency, s.SetLatency},
+		{"delete", &f.stats.deleteLatency, s.DeleteLatency},
+		{"gc", &f.stats.gcLatency, s.GCLatency},
+	} {
+		for _, q := range []struct {
+			quantile string
+			d        time.Duration
+		}{{"0.5", op.l.P50}, {"0.95", op.l.P95}, {"0.99", op.l.P99}} {
+			if _, err := fmt.Fprintf(w, "%s{op=%q,quantile=%q} %g\n", name, op.name, q.quantile, q.d.Seconds()); err != nil {
+				return err
+			}
+		}
+		sum := time.Duration(atomic.LoadInt64(&op.h.sum)).Seconds()
+		if _, err := fmt.Fprintf(w, "%s_sum{op=%q} %g\n%s_count{op=%q} %d\n", name, op.name, sum, name, op.name, op.l.Count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package fscache
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultListLimit is the number of entries of a page listed by default.
+const defaultListLimit = 1000
+
+// ListOptions filters and pages the entries listed by ListEntries(). Zero fields do not filter.
+type ListOptions struct {
+	// Prefix lists only the keys starting with it.
+	Prefix string
+	// Namespace lists only the keys of the tenant of the name, see Tenant().
+	Namespace string
+	// MinSize and MaxSize list only the entries of sizes between them, inclusive.
+	MinSize int64
+	MaxSize int64
+	// MinAge and MaxAge list only the entries set the last time between them ago, inclusive.
+	MinAge time.Duration
+	MaxAge time.Duration
+	// Cursor lists the entries after the page it was returned with, from the first page if empty.
+	Cursor string
+	// Limit is the max number of entries of the page, by default 1000.
+	Limit int
+}
+
+// ErrInvalidCursor will be returned by ListEntries() when the cursor was not returned by it.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+const (
+	// maxListSnapshots is the most key snapshots of listings in progress kept.
+	maxListSnapshots = 16
+	// listSnapshotTTL is how long the key snapshot of a listing is kept after its last page.
+	listSnapshotTTL = 10 * time.Minute
+)
+
+// listSnapshots keeps the sorted keys of the listings in progress by ListEntries(), so that the pages after
+// the first one are listed without listing and sorting the keys of the cache again.
+type listSnapshots struct {
+	mu    sync.Mutex
+	seq   uint64
+	snaps map[uint64]*listSnapshot
+}
+
+type listSnapshot struct {
+	keys   []string
+	usedAt time.Time
+}
+
+// put keeps the sorted keys of a new listing, dropping the snapshots expired, and the least recently
+// used one over the max, and returns its id.
+func (l *listSnapshots) put(keys []string) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.snaps == nil {
+		l.snaps = map[uint64]*listSnapshot{}
+	}
+	now := time.Now()
+	var oldest uint64
+	for id, snap := range l.snaps {
+		if now.Sub(snap.usedAt) > listSnapshotTTL {
+			delete(l.snaps, id)
+		} else if oldest == 0 || snap.usedAt.Before(l.snaps[oldest].usedAt) {
+			oldest = id
+		}
+	}
+	if len(l.snaps) >= maxListSnapshots {
+		delete(l.snaps, oldest)
+	}
+	l.seq++
+	l.snaps[l.seq] = &listSnapshot{keys: keys, usedAt: now}
+	return l.seq
+}
+
+// get returns the keys of the listing id, false if it expired.
+func (l *listSnapshots) get(id uint64) ([]string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	snap, ok := l.snaps[id]
+	if !ok {
+		return nil, false
+	}
+	snap.usedAt = time.Now()
+	return snap.keys, true
+}
+
+func (l *listSnapshots) drop(id uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.snaps, id)
+}
+
+// ListEntries returns a page of the entries matching opts in the order of their keys, and the opaque cursor
+// of the next page, empty after the last page. The keys are listed and sorted once for the first page, and
+// kept for the next pages for 10 minutes after the last one, so that a page takes the time of its entries
+// only: entries deleted between pages are skipped, entries set between pages are not listed, and entries
+// changed between pages are listed by their current infos. An expired cursor lists the keys again,
+// from after the last key of its page.
+func (f *Cache) ListEntries(opts ListOptions) ([]EntryInfo, string, error) {
+	var (
+		keys  []string
+		id    uint64
+		after string
+		ok    bool
+	)
+	if opts.Cursor != "" {
+		i := strings.IndexByte(opts.Cursor, ':')
+		if i < 0 {
+			return nil, "", ErrInvalidCursor
+		}
+		var err error
+		if id, err = strconv.ParseUint(opts.Cursor[:i], 16, 64); err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		after = opts.Cursor[i+1:]
+		keys, ok = f.lists.get(id)
+	}
+	if !ok {
+		var err error
+		if keys, err = f.keys(); err != nil {
+			return nil, "", err
+		}
+		sort.Strings(keys)
+		id = f.lists.put(keys)
+	}
+	prefix := opts.Prefix
+	if opts.Namespace != "" {
+		prefix = opts.Namespace + tenantSep + prefix
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	// the keys of prefix are together, from the first one
+	from := prefix
+	if after >= from {
+		from = after
+	}
+	i := sort.SearchStrings(keys, from)
+	if i < len(keys) && opts.Cursor != "" && keys[i] == after {
+		i++
+	}
+
+	var (
+		infos []EntryInfo
+		now   = time.Now()
+	)
+	for ; i < len(keys) && len(infos) < limit && strings.HasPrefix(keys[i], prefix); i++ {
+		info, err := f.Stat(keys[i])
+		if err == ErrNotFound || err == ErrIllegalEntry {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if opts.matches(info, now) {
+			infos = append(infos, info)
+		}
+	}
+	if i == len(keys) || len(infos) == 0 || !strings.HasPrefix(keys[i], prefix) {
+		f.lists.drop(id)
+		return infos, "", nil
+	}
+	return infos, strconv.FormatUint(id, 16) + ":" + infos[len(infos)-1].Key, nil
+}
+
+func (o ListOptions) matches(info EntryInfo, now time.Time) bool {
+	age := now.Sub(info.Updated)
+	return info.Size >= o.MinSize && (o.MaxSize <= 0 || info.Size <= o.MaxSize) &&
+		age >= o.MinAge && (o.MaxAge <= 0 || age <= o.MaxAge)
+}
+
+// entriesPage is a page of entries served by the admin handler.
+type entriesPage struct {
+	Entries []EntryInfo `json:"entries"`
+	Next    string      `json:"next,omitempty"`
+}
+
+// listOptions parses the list options from the query parameters q.
+func listOptions(q url.Values) (ListOptions, error) {
+	opts := ListOptions{Prefix: q.Get("prefix"), Namespace: q.Get("namespace"), Cursor: q.Get("cursor")}
+	for name, n := range map[string]*int64{"minSize": &opts.MinSize, "maxSize": &opts.MaxSize} {
+		if v := q.Get(name); v != "" {
+			var err error
+			if *n, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return opts, fmt.Errorf("%s : %w", name, err)
+			}
+		}
+	}
+	for name, d := range map[string]*time.Duration{"minAge": &opts.MinAge, "maxAge": &opts.MaxAge} {
+		if v := q.Get(name); v != "" {
+			var err error
+			if *d, err = time.ParseDuration(v); err != nil {
+				return opts, fmt.Errorf("%s : %w", name, err)
+			}
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if opts.Limit, err = strconv.Atoi(v); err != nil {
+			return opts, fmt.Errorf("limit : %w", err)
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,85 @@
+package fscache
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrLoaderPanic will be returned by GetOrSet() and read-through Gets when the loader or the backend panicked.
+var ErrLoaderPanic = errors.New("loader panicked")
+
+// GetOrSet gets the value of key to dst like Get(), and on a miss sets the value of key as loaded by load.
+// Concurrent misses of key call load once, the others waiting for and sharing its value, so that a hot
+// key missing does not load it again and again. A panic of load is recovered and returned to every
+// caller waiting as an error wrapping ErrLoaderPanic, so that it never blocks the callers after them.
+func (f *Cache) GetOrSet(key string, dst []byte, load func(key string) ([]byte, error)) ([]byte, error) {
+	dst, err := f.Get(key, dst)
+	if err != ErrNotFound {
+		return dst, err
+	}
+	val, err := f.load(key, func(key string) ([]byte, error) {
+		val, err := load(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.Set(key, val); err != nil && err != ErrShed {
+			f.logger.Errorf("set %s loaded : %s", key, err)
+		}
+		return val, nil
+	})
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, val...), nil
+}
+
+// flight is a load of a key in progress.
+type flight struct {
+	done chan struct{}
+	val  []byte
+	err  error
+}
+
+// flights is the loads in progress by their keys, whose zero value is ready to use.
+type flights struct {
+	mu sync.Mutex
+	m  map[string]*flight
+}
+
+// load calls fn to load the value of key, unless a load of key is in progress, whose value is shared.
+// The value returned must not be modified.
+func (f *Cache) load(key string, fn func(key string) ([]byte, error)) (val []byte, err error) {
+	fs := &f.flights
+	fs.mu.Lock()
+	if fl, ok := fs.m[key]; ok {
+		fs.mu.Unlock()
+		atomic.AddInt64(&f.stats.dedupedLoads, 1)
+		<-fl.done
+		return fl.val, fl.err
+	}
+	if fs.m == nil {
+		fs.m = map[string]*flight{}
+	}
+	fl := &flight{done: make(chan struct{})}
+	fs.m[key] = fl
+	fs.mu.Unlock()
+
+	atomic.AddInt64(&f.stats.loads, 1)
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&f.stats.loaderPanics, 1)
+			f.logger.Errorf("load %s panic : %v\n%s", key, r, debug.Stack())
+			fl.val, fl.err = nil, fmt.Errorf("load %s : %w: %v", key, ErrLoaderPanic, r)
+			val, err = fl.val, fl.err
+		}
+		fs.mu.Lock()
+		delete(fs.m, key)
+		fs.mu.Unlock()
+		close(fl.done)
+	}()
+	fl.val, fl.err = fn(key)
+	return fl.val, fl.err
+}
@@ -0,0 +1,90 @@
+package fscache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// WithLoadShedding skips cache fills while the host is under pressure, i.e. the share of time some tasks
+// stalled on IO or memory in the last 10 seconds exceeds maxPressure percents, read from the pressure stall
+// information (PSI) of the cgroup the process is in, or of the whole host. The values fetched from a Backend or
+// loaded by GetOrSet() are returned without being set, and Sets fail with ErrShed.
+// It has no effect if PSI is not available, which requires Linux 4.20+.
+func WithLoadShedding(maxPressure float64) Option {
+	return func(fc *Cache) { fc.shedder = &loadShedder{maxPressure: maxPressure, files: pressureFiles()} }
+}
+
+// ErrShed will be returned by Sets skipped under pressure, whose values are not cached, see WithLoadShedding().
+var ErrShed = errors.New("set shed under pressure")
+
+const pressureCheckInterval = time.Second
+
+type loadShedder struct {
+	maxPressure float64
+	files       []string
+	checkedAt   int64
+	shedding    int32
+}
+
+// pressureFiles returns the PSI files of the cgroup v2 the process is in, falling back to the ones of the host.
+func pressureFiles() []string {
+	if buf, err := ioutil.ReadFile("/proc/self/cgroup"); err == nil {
+		for _, line := range strings.Split(string(buf), "\n") {
+			if strings.HasPrefix(line, "0::") {
+				dir := filepath.Join("/sys/fs/cgroup", strings.TrimPrefix(line, "0::"))
+				if _, err := ioutil.ReadFile(filepath.Join(dir, "io.pressure")); err == nil {
+					return []string{filepath.Join(dir, "io.pressure"), filepath.Join(dir, "memory.pressure")}
+				}
+			}
+		}
+	}
+	return []string{"/proc/pressure/io", "/proc/pressure/memory"}
+}
+
+// shed tells if fills should be skipped, rechecking the pressure at most every pressureCheckInterval.
+func (l *loadShedder) shed() bool {
+	if l == nil {
+		return false
+	}
+	now := time.Now().UnixNano()
+	checkedAt := atomic.LoadInt64(&l.checkedAt)
+	if now-checkedAt >= int64(pressureCheckInterval) && atomic.CompareAndSwapInt64(&l.checkedAt, checkedAt, now) {
+		var shedding int32
+		for _, fp := range l.files {
+			if pressure, ok := readPressure(fp); ok && pressure > l.maxPressure {
+				shedding = 1
+				break
+			}
+		}
+		atomic.StoreInt32(&l.shedding, shedding)
+	}
+	return atomic.LoadInt32(&l.shedding) == 1
+}
+
+// readPressure returns the avg10 of the "some" line of a PSI file like
+//
+//	some avg10=1.23 avg60=0.50 avg300=0.10 total=123456
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func readPressure(fp string) (float64, bool) {
+	buf, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return 0, false
+	}
+	s := bufio.NewScanner(bytes.NewReader(buf))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "some" || !strings.HasPrefix(fields[1], "avg10=") {
+			continue
+		}
+		pressure, err := strconv.ParseFloat(strings.TrimPrefix(fields[1], "avg10="), 64)
+		return pressure, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,119 @@
+package fscache
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithSharedMode lets multiple caches, in this process or others, use the same cache dir,
+// where only one of them runs GC at a time. Without it, New() fails with ErrLocked
+// if another cache is using the cache dir.
+func WithSharedMode() Option { return func(fc *Cache) { fc.shared = true } }
+
+func (f *Cache) lockPath() string   { return filepath.Join(f.cacheDir, "lock") }
+func (f *Cache) gcLockPath() string { return filepath.Join(f.cacheDir, "gc.lock") }
+
+// lock locks the cache dir, exclusively unless in shared mode.
+func (f *Cache) lock() error {
+	if f.nfs {
+		return f.lockNFS()
+	}
+	how := unix.LOCK_EX
+	if f.shared {
+		how = unix.LOCK_SH
+	}
+	file, err := lockFile(f.lockPath(), how)
+	if err != nil {
+		return err
+	}
+	f.lockFile = file
+	if f.shared {
+		gcLock, err := os.OpenFile(f.gcLockPath(), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			f.unlock()
+			return err
+		}
+		f.gcLockFile = gcLock
+	}
+	return nil
+}
+
+func (f *Cache) unlock() {
+	if f.nfsDirLock != nil {
+		f.nfsDirLock.unlock()
+		f.nfsDirLock = nil
+	}
+	if f.gcLockFile != nil {
+		f.gcLockFile.Close()
+		f.gcLockFile = nil
+	}
+	if f.lockFile != nil {
+		f.lockFile.Close()
+		f.lockFile = nil
+	}
+}
+
+// lockGc tells if this cache should run GC, which is false if this cache, e.g. its GC runner and a GC
+// triggered otherwise, or another cache sharing the dir is running GC.
+// unlockGc() should be called after GC if it returns true.
+func (f *Cache) lockGc() bool {
+	if !atomic.CompareAndSwapInt32(&f.gcRunning, 0, 1) {
+		return false
+	}
+	if !f.lockGcShared() {
+		atomic.StoreInt32(&f.gcRunning, 0)
+		return false
+	}
+	return true
+}
+
+// lockGcShared tells if no other cache sharing the dir is running GC, locking it for this cache if so.
+func (f *Cache) lockGcShared() bool {
+	if f.nfsGcLock != nil {
+		ok, err := f.nfsGcLock.tryLock()
+		if err != nil {
+			f.logger.Errorf("lock %s : %s", f.nfsGcLock.path, err)
+		}
+		return ok
+	}
+	if f.nfsDirLock != nil {
+		return f.fenced()
+	}
+	if f.gcLockFile == nil {
+		return true
+	}
+	err := unix.Flock(int(f.gcLockFile.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err != nil && err != unix.EWOULDBLOCK {
+		f.logger.Errorf("lock %s : %s", f.gcLockPath(), err)
+	}
+	return err == nil
+}
+
+func (f *Cache) unlockGc() {
+	if f.nfsGcLock != nil {
+		f.nfsGcLock.unlock()
+	}
+	if f.gcLockFile != nil {
+		unix.Flock(int(f.gcLockFile.Fd()), unix.LOCK_UN)
+	}
+	atomic.StoreInt32(&f.gcRunning, 0)
+}
+
+// lockFile opens and flocks the file at path without blocking, returning ErrLocked if it is locked.
+func lockFile(path string, how int) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(file.Fd()), how|unix.LOCK_NB); err != nil {
+		file.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, &os.PathError{Op: "flock", Path: path, Err: err}
+	}
+	return file, nil
+}
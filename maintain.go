@@ -0,0 +1,123 @@
+package fscache
+
+import (
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// WithMaintenance runs a maintenance job every interval at PriorityBackground, which recompresses the entries
+// compressed with older dictionaries, or stored as is, with the current dictionary of WithDictCompression()
+// if they shrink, and compacts the packs, reclaiming space without waiting for GC or blocking Gets and Sets.
+// Each pass examines up to batch entries, continuing from where the last pass stopped. Entries recompressed
+// keep their access and modification times.
+func WithMaintenance(interval time.Duration, batch int) Option {
+	return func(fc *Cache) {
+		fc.maintenanceInterval = interval
+		fc.maintenanceBatch = batch
+	}
+}
+
+func (f *Cache) maintenanceRunner() {
+	ticker := time.NewTicker(f.maintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stopCh:
+			return
+		case <-ticker.C:
+			f.maintain()
+		}
+	}
+}
+
+// maintain recompresses a batch of entries after the key maintained last, and compacts the packs.
+func (f *Cache) maintain() {
+	if f.dicts != nil && f.dicts.version() > 0 {
+		keys, err := f.keys()
+		if err != nil {
+			f.logger.Errorf("maintain cache dir %s : %s", f.filedir(), err)
+		}
+		sort.Strings(keys)
+		i := sort.Search(len(keys), func(i int) bool { return keys[i] > f.maintainedKey })
+		for n := 0; n < f.maintenanceBatch && n < len(keys); n++ {
+			if i == len(keys) {
+				i = 0
+			}
+			select {
+			case <-f.stopCh:
+				return
+			default:
+			}
+			f.sched.idle()
+			if err := f.recompress(keys[i]); err != nil && err != ErrNotFound && !vanished(err) {
+				f.logger.Errorf("recompress %s : %s", keys[i], err)
+			}
+			f.maintainedKey = keys[i]
+			i++
+		}
+	}
+	if f.packs != nil {
+		f.sched.idle()
+		if err := f.packs.compact(); err != nil {
+			f.logger.Errorf("compact packs %s : %s", f.packdir(), err)
+		}
+	}
+}
+
+// recompress rewrites the entry of key with the current dictionary if it was compressed with an older one
+// or stored as is, and shrinks, keeping its times.
+func (f *Cache) recompress(key string) error {
+	defer f.keyLocks.lock(key)()
+	fp := f.filepath(key)
+	buf, packed, err := f.packs.peek(key)
+	if err != nil {
+		return err
+	}
+	var fi os.FileInfo
+	if !packed {
+		var file StorageFile
+		if file, fi, err = f.openStored(fp); err != nil {
+			return err
+		}
+		buf, err = f.readEntryFile(file, fi.Size())
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	h, ok := parseEntryHeader(buf)
+	if !ok || !f.dicts.stale(h) {
+		return nil
+	}
+	if err := verifyEntry(key, buf); err != nil {
+		return err
+	}
+	val := buf[entryHeaderLen:]
+	if h.codec == codecDeflateDict {
+		if val, err = f.dicts.decompress(h.dict, val); err != nil {
+			return err
+		}
+	}
+	var expireAt int64
+	if h.flags&entryFlagTTL != 0 {
+		expireAt = h.expireAt
+	}
+	entry := f.encodeEntry(val, expireAt)
+	if len(entry) >= len(buf) {
+		return nil
+	}
+	if packed {
+		err = f.packs.rewrite(key, entry)
+	} else if err = f.writeStored(key, entry); err == nil {
+		f.index.set(key, int64(len(entry)))
+		err = f.chtimesStored(fp, atime(fi), fi.ModTime())
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&f.stats.recompressed, 1)
+	atomic.AddInt64(&f.stats.recompressedBytes, int64(len(buf)-len(entry)))
+	return nil
+}
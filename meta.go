@@ -0,0 +1,167 @@
+package fscache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// entryMeta is the metadata of an entry, stored by the metaStore of the cache.
+type entryMeta struct {
+	// Cost is the cost to recompute the value, e.g. in seconds.
+	Cost float64 `json:"cost,omitempty"`
+	// Tags are the tags attached to the entry.
+	Tags []string `json:"tags,omitempty"`
+	// ExpireAt is when the entry expires in unix nanoseconds, 0 means never.
+	ExpireAt int64 `json:"expireAt,omitempty"`
+	// Key is the original key of the entry if key hashing is enabled.
+	Key string `json:"key,omitempty"`
+	// CreatedAt is when the key was first set in unix nanoseconds, if it has been set again since,
+	// as the modification time of the entry is when it was set the last time.
+	CreatedAt int64 `json:"createdAt,omitempty"`
+}
+
+func (m entryMeta) isZero() bool {
+	return m.Cost == 0 && len(m.Tags) == 0 && m.ExpireAt == 0 && m.Key == "" && m.CreatedAt == 0
+}
+
+func (m entryMeta) expired(now time.Time) bool { return m.ExpireAt > 0 && now.UnixNano() >= m.ExpireAt }
+
+// metaTmpPrefix prefixes the names of meta files being written.
+const metaTmpPrefix = ".tmp-"
+
+func (f *Cache) metadir() string            { return filepath.Join(f.cacheDir, "meta") }
+func (f *Cache) metapath(key string) string { return filepath.Join(f.metadir(), f.filename(key)) }
+
+// metaStore stores the metadata of entries, read by Get and the sweeper and dropped by Delete and GC.
+type metaStore interface {
+	// read returns the metadata of key, or zero metadata if there is none.
+	read(key string) (entryMeta, error)
+	// write writes the metadata of key, which is not zero.
+	write(key string, m entryMeta) error
+	// remove removes the metadata of key if any.
+	remove(key string) error
+}
+
+// sidecarMeta stores the metadata of an entry in a sidecar file named by the key under the meta dir.
+type sidecarMeta struct{ f *Cache }
+
+// metas returns the metaStore of the cache, sidecar files by default.
+func (f *Cache) metas() metaStore {
+	if f.meta == nil {
+		return sidecarMeta{f: f}
+	}
+	return f.meta
+}
+
+func (f *Cache) readMeta(key string) (entryMeta, error) { return f.metas().read(key) }
+
+// writeMeta writes the metadata of key, removing it if m is zero.
+func (f *Cache) writeMeta(key string, m entryMeta) error {
+	if m.isZero() {
+		return f.removeMeta(key)
+	}
+	return f.metas().write(key, m)
+}
+
+func (f *Cache) removeMeta(key string) error { return f.metas().remove(key) }
+
+func (s sidecarMeta) read(key string) (entryMeta, error) { return s.readPath(s.f.metapath(key)) }
+
+// readPath reads the metadata in the sidecar file at fp.
+func (s sidecarMeta) readPath(fp string) (entryMeta, error) {
+	var m entryMeta
+	if atomic.LoadInt32(&s.f.metaUsed) == 0 {
+		return m, nil
+	}
+	buf, err := ioutil.ReadFile(fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return m, err
+	}
+	err = json.Unmarshal(buf, &m)
+	return m, err
+}
+
+func (s sidecarMeta) write(key string, m entryMeta) error {
+	f := s.f
+	if atomic.LoadInt32(&f.metaUsed) == 0 {
+		if err := os.MkdirAll(f.metadir(), 0775); err != nil {
+			return err
+		}
+		atomic.StoreInt32(&f.metaUsed, 1)
+	}
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(f.metadir(), metaTmpPrefix)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if f.durable {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.metapath(key)); err != nil || !f.durable {
+		return err
+	}
+	return f.syncMetadir()
+}
+
+func (s sidecarMeta) remove(key string) error {
+	f := s.f
+	if atomic.LoadInt32(&f.metaUsed) == 0 {
+		return nil
+	}
+	if err := os.Remove(f.metapath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// replaceMeta writes the metadata of key, and updates the tag index by its previous metadata.
+func (f *Cache) replaceMeta(key string, m entryMeta) error {
+	old, err := f.readMeta(key)
+	if err != nil {
+		return err
+	}
+	if err := f.writeMeta(key, m); err != nil {
+		return err
+	}
+	if len(old.Tags) == 0 && len(m.Tags) == 0 {
+		return nil
+	}
+	return f.updateTags(key, old.Tags, m.Tags)
+}
+
+// dropMeta removes the metadata of key, and drops key from the tag index.
+func (f *Cache) dropMeta(key string) error {
+	return f.replaceMeta(key, entryMeta{})
+}
+
+// entryCost returns the cost of key, 0 if unknown.
+func (f *Cache) entryCost(key string) float64 {
+	m, err := f.readMeta(key)
+	if err != nil {
+		f.logger.Errorf("read meta of %s : %s", key, err)
+	}
+	return m.Cost
+}
@@ -0,0 +1,170 @@
+package fscache
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// ErrUnsupportedLayout will be returned when migrating from or to a layout no cache stores entries in.
+var ErrUnsupportedLayout = errors.New("unsupported layout")
+
+// Layout is how the entries of a cache are laid out in its cache dir.
+type Layout int
+
+const (
+	// LayoutFlat stores every value in a file named by its key, the layout of EngineFile.
+	LayoutFlat Layout = iota
+	// LayoutHashed stores every value in a file named by the hash of its key, the layout of WithKeyHashing().
+	LayoutHashed
+	// LayoutPacked stores values in value logs, the layout of EngineLog.
+	LayoutPacked
+	// LayoutFanOut stores every value in a file under subdirs named by the prefixes of its key hash.
+	// No cache stores entries so yet, so that Migrate returns ErrUnsupportedLayout for it.
+	LayoutFanOut
+)
+
+func (l Layout) String() string {
+	switch l {
+	case LayoutFlat:
+		return "flat"
+	case LayoutHashed:
+		return "hashed"
+	case LayoutPacked:
+		return "packed"
+	case LayoutFanOut:
+		return "fan-out"
+	}
+	return fmt.Sprintf("Layout(%d)", int(l))
+}
+
+// Migrate converts the entries in cacheDir from the from layout to the to layout in place,
+// keeping their values and metadata, so that adopting another layout does not discard a warm cache.
+// The cache dir must not be used by a cache during the migration. Entries are moved one by one,
+// so that an interrupted migration is resumed by calling Migrate again with the same layouts.
+// Options other than the layouts, e.g. WithXattrMeta() and WithProgress(), apply to both sides.
+// Keys which are not valid file names, e.g. with slashes, fail to migrate out of LayoutHashed.
+func Migrate(cacheDir string, from, to Layout, opts ...Option) error {
+	if from > LayoutFanOut || to > LayoutFanOut || from < 0 || to < 0 {
+		return fmt.Errorf("migrate from %s to %s: unknown layout", from, to)
+	}
+	if from == LayoutFanOut || to == LayoutFanOut {
+		return fmt.Errorf("migrate from %s to %s: %w", from, to, ErrUnsupportedLayout)
+	}
+	if from == to {
+		return nil
+	}
+	src, dst := from.configure(cacheDir, opts), to.configure(cacheDir, opts)
+	if err := dst.lock(); err != nil {
+		return err
+	}
+	defer dst.unlock()
+	for _, f := range []*Cache{src, dst} {
+		if err := f.prepareLayout(); err != nil {
+			return err
+		}
+		defer f.packs.close()
+	}
+	keys, err := src.keys()
+	if err != nil {
+		return err
+	}
+	p := dst.newProgress("migrate", int64(len(keys)))
+	defer p.done()
+	for _, key := range keys {
+		if to == LayoutHashed {
+			// skip the entries migrated before an interruption
+			if k, ok := dst.keyOf(key); ok && dst.filename(k) == key {
+				p.add(1, 0)
+				continue
+			}
+		}
+		size, err := migrateEntry(src, dst, key)
+		if err != nil {
+			return fmt.Errorf("migrate %s from %s to %s: %w", key, from, to, err)
+		}
+		p.add(1, size)
+	}
+	return nil
+}
+
+// configure returns a cache in layout l over cacheDir with opts applied, which is not opened.
+func (l Layout) configure(cacheDir string, opts []Option) *Cache {
+	f := configure(opts...)
+	f.cacheDir = cacheDir
+	// values are moved as stored, with their entry headers and transforms if any
+	f.entryHeader, f.transforms = false, nil
+	f.engine, f.keyHashing = EngineFile, false
+	switch l {
+	case LayoutHashed:
+		WithKeyHashing()(f)
+	case LayoutPacked:
+		f.engine = EngineLog
+	}
+	return f
+}
+
+// prepareLayout prepares the dirs and the value logs of a cache configured by Layout.configure.
+func (f *Cache) prepareLayout() error {
+	for _, dir := range []string{f.filedir(), f.tmpdir()} {
+		if err := os.MkdirAll(dir, 0775); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(f.metadir()); err == nil {
+		f.metaUsed = 1
+	}
+	if f.xattrMeta && xattrSupported(f.tmpdir()) {
+		f.meta = xattrMeta{f: f, sidecar: sidecarMeta{f: f}}
+	}
+	f.configureEngine()
+	if f.packs != nil {
+		return f.packs.open(f.packdir())
+	}
+	return nil
+}
+
+// migrateEntry moves the value and metadata of key from src to dst, and returns the size of the value.
+// The value is set into dst before removed from src, so that an interruption loses no entry.
+func migrateEntry(src, dst *Cache, key string) (int64, error) {
+	val, packed, err := src.packs.get(key, nil)
+	if !packed {
+		val, err = ioutil.ReadFile(src.filepath(key))
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	meta, err := src.readMeta(key)
+	if err != nil {
+		return 0, err
+	}
+	meta.Key = ""
+	// dst shares the meta of key with src if their files are named alike
+	sharedMeta := dst.metapath(key) == src.metapath(key)
+	if err := dst.set(key, val, meta); err != nil {
+		return 0, err
+	}
+	if packed {
+		if _, err := src.packs.remove(key); err != nil {
+			return 0, err
+		}
+	} else if fp := src.filepath(key); fp != dst.filepath(key) {
+		if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	if !sharedMeta {
+		// by the meta read before, which might be gone with the file of key
+		if err := src.removeMeta(key); err != nil {
+			return 0, err
+		}
+		if err := src.updateTags(key, meta.Tags, nil); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(val)), nil
+}
@@ -0,0 +1,256 @@
+package fscache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WithNFSMode makes the cache behave correctly on a cache dir mounted over NFS, where flock is unreliable,
+// atime is coarse or not updated, metadata operations are round trips to the server, and file handles go
+// stale when other clients replace or remove files. In NFS mode:
+//
+//   - the cache dir and GC are locked by lockfiles created exclusively, holding fencing tokens, which are
+//     broken once not refreshed for a minute, and GC stops evicting once its lock is found taken over
+//   - tmp files are not flocked, so the ones left by crashes are removed by New() once an hour old
+//   - GC evicts by CLOCK instead of LRU and Gets do not update atime, as WithClock()
+//   - the dir syncs of WithDurable() after writing values and their metadata are batched across
+//     concurrent Sets, while the other metadata operations, e.g. creates and renames, are not
+//   - reads, writes, removes and GC scans failing with ESTALE are retried, as WithRetry()
+//
+// All the caches sharing the cache dir must be in NFS mode.
+func WithNFSMode() Option { return func(fc *Cache) { fc.nfs = true } }
+
+const (
+	// nfsLockLease is how long a lockfile is held without being refreshed before others may break it.
+	nfsLockLease = time.Minute
+	// nfsTmpMaxAge is how old tmp files are removed as left by crashes in NFS mode.
+	nfsTmpMaxAge = time.Hour
+	// nfsStaleRetries is how many times an operation failing with ESTALE is retried in NFS mode.
+	nfsStaleRetries = 3
+)
+
+// configureNFS applies NFS mode over the other options.
+func (f *Cache) configureNFS() {
+	if _, ok := f.policy.(lru); ok {
+		WithClock()(f)
+	}
+	f.skipAtime = true
+	f.dirSyncs = &syncBatch{dir: f.filedir()}
+	f.metaSyncs = &syncBatch{dir: f.metadir()}
+}
+
+// nfsLock is a lockfile created exclusively, holding a fencing token larger than the ones of all the holders
+// before, so that a holder whose lease expired, e.g. stalled, finds out it lost the lock before doing anything
+// conflicting with the new holder.
+type nfsLock struct {
+	path  string
+	token uint64
+}
+
+func (l *nfsLock) fencePath() string { return l.path + ".fence" }
+
+// tryLock creates the lockfile without blocking, breaking it if its holder has not refreshed it for a lease,
+// and tells if it is locked.
+func (l *nfsLock) tryLock() (bool, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		token := readToken(l.fencePath()) + 1
+		file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = file.WriteString(strconv.FormatUint(token, 10))
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				err = writeToken(l.fencePath(), token)
+			}
+			if err != nil {
+				os.Remove(l.path)
+				return false, err
+			}
+			l.token = token
+			return true, nil
+		}
+		if !os.IsExist(err) {
+			return false, err
+		}
+		fi, err := os.Stat(l.path)
+		if err != nil {
+			if vanished(err) {
+				continue
+			}
+			return false, err
+		}
+		if time.Since(fi.ModTime()) < nfsLockLease {
+			return false, nil
+		}
+		// the holder is gone without unlocking, and only one of the breakers renames the lockfile away
+		stale := l.path + ".stale-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		if err := os.Rename(l.path, stale); err == nil {
+			os.Remove(stale)
+		}
+	}
+	return false, nil
+}
+
+// readToken returns the token in the file at path, 0 if none.
+func readToken(path string) uint64 {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	token, _ := strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+	return token
+}
+
+// writeToken replaces the file at path by one holding token.
+func writeToken(path string, token uint64) error {
+	if err := ioutil.WriteFile(path+".tmp", []byte(strconv.FormatUint(token, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// refresh tells if the lock is still held, and renews its lease if so.
+func (l *nfsLock) refresh() bool {
+	if l.token == 0 || readToken(l.path) != l.token {
+		return false
+	}
+	now := time.Now()
+	return os.Chtimes(l.path, now, now) == nil
+}
+
+func (l *nfsLock) unlock() {
+	if l.refresh() {
+		os.Remove(l.path)
+	}
+	l.token = 0
+}
+
+func (f *Cache) nfsLockPath() string   { return f.lockPath() + ".nfs" }
+func (f *Cache) nfsGcLockPath() string { return f.gcLockPath() + ".nfs" }
+
+// lockNFS locks the cache dir by a lockfile unless in shared mode, where the caches lock GC by another.
+func (f *Cache) lockNFS() error {
+	if f.shared {
+		f.nfsGcLock = &nfsLock{path: f.nfsGcLockPath()}
+		return nil
+	}
+	l := &nfsLock{path: f.nfsLockPath()}
+	ok, err := l.tryLock()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrLocked
+	}
+	f.nfsDirLock = l
+	return nil
+}
+
+// nfsLockRunner renews the lease of the lock of the cache dir until the cache is closed.
+func (f *Cache) nfsLockRunner() {
+	ticker := time.NewTicker(nfsLockLease / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !f.nfsDirLock.refresh() {
+				f.logger.Errorf("lost lock %s, taken over by another cache", f.nfsDirLock.path)
+			}
+		case <-f.stopCh:
+			return
+		}
+	}
+}
+
+// fenced tells if the lock GC runs under is still held, so that GC does not evict without it.
+func (f *Cache) fenced() bool {
+	switch {
+	case !f.nfs:
+		return true
+	case f.nfsDirLock != nil:
+		return f.nfsDirLock.refresh()
+	case f.nfsGcLock != nil:
+		return f.nfsGcLock.refresh()
+	}
+	return true
+}
+
+// syncBatch syncs a dir once for all the callers waiting meanwhile, instead of once for each.
+type syncBatch struct {
+	dir string
+
+	mu      sync.Mutex
+	next    *syncRound
+	running bool
+	// rounds counts the syncs run
+	rounds int64
+}
+
+// syncRound is a sync of a dir and the callers waiting for it.
+type syncRound struct {
+	done chan struct{}
+	err  error
+}
+
+// sync returns after a sync of the dir started after it was called.
+func (b *syncBatch) sync() error {
+	b.mu.Lock()
+	if b.next == nil {
+		b.next = &syncRound{done: make(chan struct{})}
+	}
+	r := b.next
+	if b.running {
+		b.mu.Unlock()
+		<-r.done
+		return r.err
+	}
+	// sync for the callers waiting until none is
+	b.running = true
+	for b.next != nil {
+		cur := b.next
+		b.next = nil
+		b.mu.Unlock()
+		cur.err = syncDir(b.dir)
+		close(cur.done)
+		b.mu.Lock()
+		b.rounds++
+	}
+	b.running = false
+	b.mu.Unlock()
+	return r.err
+}
+
+// syncFiledir syncs the dir of the files of entries, batched in NFS mode.
+func (f *Cache) syncFiledir() error {
+	if f.dirSyncs != nil {
+		return f.dirSyncs.sync()
+	}
+	return syncDir(f.filedir())
+}
+
+// syncMetadir syncs the dir of the sidecar metadata of entries, batched in NFS mode.
+func (f *Cache) syncMetadir() error {
+	if f.metaSyncs != nil {
+		return f.metaSyncs.sync()
+	}
+	return syncDir(f.metadir())
+}
+
+// cleanNFSTmpDir removes the files in dir older than nfsTmpMaxAge, which are unlocked in NFS mode.
+func (f *Cache) cleanNFSTmpDir(dir string, fis []os.FileInfo) {
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || time.Since(fi.ModTime()) < nfsTmpMaxAge {
+			continue
+		}
+		fp := filepath.Join(dir, fi.Name())
+		if err := os.Remove(fp); err != nil && !vanished(err) {
+			f.logger.Errorf("remove tmp file %s : %s", fp, err)
+		}
+	}
+}
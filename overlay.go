@@ -0,0 +1,140 @@
+package fscache
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// onOverlay tells if dir is on overlayfs, e.g. the writable layer of a container.
+func onOverlay(dir string) bool {
+	var st unix.Statfs_t
+	return unix.Statfs(dir, &st) == nil && st.Type == unix.OVERLAYFS_SUPER_MAGIC
+}
+
+// checkOverlay adjusts the cache to a cache dir on overlayfs, where the entries baked into the lower layers,
+// e.g. of a container image, are copied up into the upper layer as a whole once their atimes are updated,
+// and take no space of the upper layer otherwise, nor free any once evicted. Gets do not update atime,
+// as WithClock(), and GC counts and evicts only the entries in the upper layer, if it is found.
+func (f *Cache) checkOverlay() {
+	if f.storage != nil || !onOverlay(f.filedir()) {
+		return
+	}
+	if _, ok := f.policy.(lru); ok {
+		WithClock()(f)
+	}
+	f.skipAtime = true
+	upper, err := overlayUpperDir("/proc/self/mountinfo", f.filedir())
+	if err != nil || upper == "" {
+		f.logger.Errorf("cache dir %s on overlayfs without its upper dir found, counting the lower layers : %v", f.filedir(), err)
+		return
+	}
+	f.overlayUpper = upper
+	f.logger.Errorf("cache dir %s on overlayfs, better on a volume, counting only %s", f.filedir(), upper)
+}
+
+// overlayUpperDir returns the dir in the upper layer of the overlayfs dir is on, as mounted in the mountinfo
+// file at path, empty if dir is not on overlayfs or its upper dir is unknown.
+func overlayUpperDir(path, dir string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return parseOverlayUpperDir(file, dir)
+}
+
+// parseOverlayUpperDir is overlayUpperDir() of the mountinfo read from r, in lines of
+//
+//	36 35 98:0 / /mnt/root rw,noatime shared:1 - overlay overlay rw,lowerdir=/l,upperdir=/u,workdir=/w
+func parseOverlayUpperDir(r io.Reader, dir string) (string, error) {
+	dir = filepath.Clean(dir)
+	var mountPoint, upper string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || len(fields) < sep+4 {
+			continue
+		}
+		mp := unescapeMountinfo(fields[4])
+		if !within(dir, mp) || len(mp) < len(mountPoint) {
+			continue
+		}
+		// the mount nearest to dir wins, overlayfs or not
+		mountPoint, upper = mp, ""
+		if fields[sep+1] != "overlay" {
+			continue
+		}
+		for _, opt := range strings.Split(fields[sep+3], ",") {
+			if strings.HasPrefix(opt, "upperdir=") {
+				upper = unescapeMountinfo(strings.TrimPrefix(opt, "upperdir="))
+			}
+		}
+	}
+	if err := sc.Err(); err != nil || upper == "" {
+		return "", err
+	}
+	rel, err := filepath.Rel(mountPoint, dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(upper, rel), nil
+}
+
+// within tells if path is dir or under it.
+func within(path, dir string) bool {
+	return dir == "/" || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// unescapeMountinfo unescapes the octal escapes of spaces and the like in a field of mountinfo.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// upperEntries returns the entries in the upper layer of the overlayfs and their bytes,
+// dropping the ones only in the lower layers, which take none of its space.
+func (f *Cache) upperEntries(entries []os.FileInfo) ([]os.FileInfo, int64) {
+	var (
+		upper = make([]bool, len(entries))
+		n     int
+		bytes int64
+	)
+	f.parallel(len(entries), func(i int) {
+		_, err := os.Lstat(filepath.Join(f.overlayUpper, f.filename(entries[i].Name())))
+		upper[i] = err == nil
+	})
+	for i, fi := range entries {
+		if upper[i] {
+			entries[n] = fi
+			n++
+			bytes += fi.Size()
+		}
+	}
+	return entries[:n], bytes
+}
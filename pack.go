@@ -0,0 +1,826 @@
+package fscache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// WithPackfiles stores values smaller than threshold bytes in append-only pack files instead of a file per key,
+// avoiding an inode per small entry and keeping small entries close on disk.
+// GC evicts packed entries least recently accessed first once their values take more than maxBytes,
+// and compacts packs mostly taken by evicted, deleted or replaced entries.
+// Packed entries can not be undeleted from the trash.
+func WithPackfiles(threshold, maxBytes int64) Option {
+	return func(fc *Cache) {
+		fc.packs = &packStore{threshold: threshold, maxBytes: maxBytes, sealBytes: packSealBytes}
+	}
+}
+
+const (
+	// packSealBytes is the size over which the active pack is sealed and a new one is started.
+	packSealBytes = 64 * 1024 * 1024
+	// packHeaderLen is the length of the record header: crc32, flags, key length and value length.
+	packHeaderLen = 13
+	packSuffix    = ".pack"
+	// hintHeaderLen is the length of the hint header: flags, key length, value length and record offset.
+	hintHeaderLen = 17
+	hintSuffix    = ".hint"
+	// atimeHintName is the file of the last access times of the packed entries, saved at close.
+	atimeHintName = "atime" + hintSuffix
+	// atimeHintHeaderLen is the length of the atime hint header: key length and atime.
+	atimeHintHeaderLen = 12
+
+	packFlagTombstone = 1
+)
+
+var errPackCorrupt = errors.New("corrupt pack record")
+
+func (f *Cache) packdir() string { return filepath.Join(f.cacheDir, "packs") }
+
+type packLoc struct {
+	pack  uint32
+	off   int64
+	size  int64
+	atime int64
+	// mtime is when the record was appended, or its pack was modified last if loaded.
+	mtime int64
+}
+
+type pack struct {
+	file  *os.File
+	size  int64
+	live  int64
+	hints []byte
+}
+
+// packStore keeps small entries in packs, which are sequences of records of
+//
+//	crc32 of the rest | flags | key length | value length | key | value
+//
+// in big endian. A record supersedes the records of the same key before it,
+// and a record flagged tombstone deletes the key.
+// Once a pack is sealed, a hint file of
+//
+//	flags | key length | value length | record offset | key
+//
+// for each record is written next to it, so that the index is loaded without reading the values.
+// The access times of the entries are saved at close in a hint file of
+//
+//	key length | atime | key
+//
+// for each entry, and restored at open, as they are otherwise lost with the index.
+type packStore struct {
+	threshold int64
+	maxBytes  int64
+	sealBytes int64
+	dir       string
+	// durable syncs the dir after creating packs, see WithDurable()
+	durable bool
+
+	mu     sync.RWMutex
+	packs  map[uint32]*pack
+	active uint32
+	index  map[string]*packLoc
+	bytes  int64
+	// loaded tells if the index is fully loaded, so that its atimes are saved at close
+	loaded bool
+}
+
+func packName(id uint32) string { return fmt.Sprintf("%08x%s", id, packSuffix) }
+func hintName(id uint32) string { return fmt.Sprintf("%08x%s", id, hintSuffix) }
+
+func recordLen(key string, size int64) int64 { return packHeaderLen + int64(len(key)) + size }
+
+// fits tells if a value of size bytes should be packed.
+func (p *packStore) fits(size int) bool { return p != nil && int64(size) < p.threshold }
+
+// open loads the packs under dir, truncating a record torn by a crash at the end of the last pack.
+func (p *packStore) open(dir string) error {
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	names, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	var ids []uint32
+	for _, name := range names {
+		if !strings.HasSuffix(name, packSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, packSuffix), 16, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	p.dir, p.packs, p.index, p.bytes = dir, map[uint32]*pack{}, map[string]*packLoc{}, 0
+	for i, id := range ids {
+		if err := p.load(id, i == len(ids)-1); err != nil {
+			p.close()
+			return err
+		}
+	}
+	if len(ids) == 0 || p.packs[p.active].size >= p.sealBytes {
+		if err := p.rotate(); err != nil {
+			p.close()
+			return err
+		}
+	}
+	// atimes are only hints, the entries keeping the mtimes of their packs without them
+	p.loadAtimes()
+	p.loaded = true
+	return nil
+}
+
+func (p *packStore) load(id uint32, last bool) error {
+	fp := filepath.Join(p.dir, packName(id))
+	file, err := os.OpenFile(fp, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	pk := &pack{file: file}
+	p.packs[id], p.active = pk, id
+	atime := fi.ModTime().UnixNano()
+
+	if !last {
+		if err := p.loadHints(id, atime); err == nil {
+			pk.size, pk.hints = fi.Size(), nil
+			return nil
+		}
+		pk.hints = nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(file, 0, fi.Size()))
+	for pk.size < fi.Size() {
+		key, val, flags, err := readRecord(r)
+		if err != nil {
+			if !last {
+				return fmt.Errorf("%s at %d: %w", fp, pk.size, err)
+			}
+			// torn by a crash while appending
+			return file.Truncate(pk.size)
+		}
+		p.apply(id, key, pk.size, int64(len(val)), flags, atime)
+		pk.size += recordLen(key, int64(len(val)))
+	}
+	if !last {
+		// hints are only to speed up loading
+		p.writeHints(id)
+	}
+	return nil
+}
+
+// loadHints applies the hint file of pack id, which is rejected as a whole if malformed.
+func (p *packStore) loadHints(id uint32, atime int64) error {
+	buf, err := ioutil.ReadFile(filepath.Join(p.dir, hintName(id)))
+	if err != nil {
+		return err
+	}
+	for len(buf) > 0 {
+		if len(buf) < hintHeaderLen {
+			return errPackCorrupt
+		}
+		keyLen := int(binary.BigEndian.Uint32(buf[1:5]))
+		if len(buf) < hintHeaderLen+keyLen {
+			return errPackCorrupt
+		}
+		size := int64(binary.BigEndian.Uint32(buf[5:9]))
+		off := int64(binary.BigEndian.Uint64(buf[9:17]))
+		p.apply(id, string(buf[hintHeaderLen:hintHeaderLen+keyLen]), off, size, buf[0], atime)
+		buf = buf[hintHeaderLen+keyLen:]
+	}
+	return nil
+}
+
+// writeHints writes the hint file of pack id, and drops the hints in memory.
+func (p *packStore) writeHints(id uint32) error {
+	pk := p.packs[id]
+	hints := pk.hints
+	pk.hints = nil
+	fp := filepath.Join(p.dir, hintName(id))
+	if err := ioutil.WriteFile(fp+".tmp", hints, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fp+".tmp", fp)
+}
+
+// loadAtimes restores the atimes saved at close to the entries still packed,
+// keeping the later of them and the ones loaded, as the hint file is stale after a crash.
+func (p *packStore) loadAtimes() error {
+	buf, err := ioutil.ReadFile(filepath.Join(p.dir, atimeHintName))
+	if err != nil {
+		return err
+	}
+	for len(buf) > 0 {
+		if len(buf) < atimeHintHeaderLen {
+			return errPackCorrupt
+		}
+		keyLen := int(binary.BigEndian.Uint32(buf[0:4]))
+		if len(buf) < atimeHintHeaderLen+keyLen {
+			return errPackCorrupt
+		}
+		atime := int64(binary.BigEndian.Uint64(buf[4:12]))
+		if loc, ok := p.index[string(buf[atimeHintHeaderLen:atimeHintHeaderLen+keyLen])]; ok && atime > loc.atime {
+			loc.atime = atime
+		}
+		buf = buf[atimeHintHeaderLen+keyLen:]
+	}
+	return nil
+}
+
+// writeAtimes writes the atimes of the packed entries to the atime hint file, with p.mu held.
+func (p *packStore) writeAtimes() error {
+	var buf []byte
+	var hdr [atimeHintHeaderLen]byte
+	for key, loc := range p.index {
+		binary.BigEndian.PutUint32(hdr[0:4], uint32(len(key)))
+		binary.BigEndian.PutUint64(hdr[4:12], uint64(atomic.LoadInt64(&loc.atime)))
+		buf = append(append(buf, hdr[:]...), key...)
+	}
+	fp := filepath.Join(p.dir, atimeHintName)
+	if err := ioutil.WriteFile(fp+".tmp", buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fp+".tmp", fp)
+}
+
+// apply applies a record at off of pack id to the index and the hints, with p.mu held.
+func (p *packStore) apply(id uint32, key string, off, size int64, flags byte, atime int64) {
+	pk := p.packs[id]
+	var hdr [hintHeaderLen]byte
+	hdr[0] = flags
+	binary.BigEndian.PutUint32(hdr[1:5], uint32(len(key)))
+	binary.BigEndian.PutUint32(hdr[5:9], uint32(size))
+	binary.BigEndian.PutUint64(hdr[9:17], uint64(off))
+	pk.hints = append(append(pk.hints, hdr[:]...), key...)
+
+	p.drop(key)
+	if flags&packFlagTombstone == 0 {
+		p.index[key] = &packLoc{pack: id, off: off, size: size, atime: atime, mtime: atime}
+		pk.live += recordLen(key, size)
+		p.bytes += size
+	}
+}
+
+// recordPrealloc is the most bytes allocated for a record before reading it.
+const recordPrealloc = 1 << 20
+
+func readRecord(r io.Reader) (key string, val []byte, flags byte, err error) {
+	var hdr [packHeaderLen]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return "", nil, 0, err
+	}
+	n := int64(binary.BigEndian.Uint32(hdr[5:9])) + int64(binary.BigEndian.Uint32(hdr[9:13]))
+	var buf []byte
+	if n <= recordPrealloc {
+		buf = make([]byte, n)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return "", nil, 0, err
+		}
+	} else {
+		// the lengths of a torn or corrupt header may be anything, so as not to allocate gigabytes for them
+		b := bytes.NewBuffer(make([]byte, 0, recordPrealloc))
+		if _, err = io.CopyN(b, r, n); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", nil, 0, err
+		}
+		buf = b.Bytes()
+	}
+	crc := crc32.Update(crc32.ChecksumIEEE(hdr[4:]), crc32.IEEETable, buf)
+	if crc != binary.BigEndian.Uint32(hdr[:4]) {
+		return "", nil, 0, errPackCorrupt
+	}
+	keyLen := binary.BigEndian.Uint32(hdr[5:9])
+	return string(buf[:keyLen]), buf[keyLen:], hdr[4], nil
+}
+
+func appendRecord(buf []byte, key string, val []byte, flags byte) []byte {
+	var hdr [packHeaderLen]byte
+	hdr[4] = flags
+	binary.BigEndian.PutUint32(hdr[5:9], uint32(len(key)))
+	binary.BigEndian.PutUint32(hdr[9:13], uint32(len(val)))
+	crc := crc32.ChecksumIEEE(hdr[4:])
+	crc = crc32.Update(crc, crc32.IEEETable, []byte(key))
+	crc = crc32.Update(crc, crc32.IEEETable, val)
+	binary.BigEndian.PutUint32(hdr[:4], crc)
+	buf = append(buf, hdr[:]...)
+	buf = append(buf, key...)
+	return append(buf, val...)
+}
+
+// rotate seals the active pack and starts a new one, with p.mu held.
+func (p *packStore) rotate() error {
+	id := p.active
+	if len(p.packs) > 0 {
+		// hints are only to speed up loading
+		p.writeHints(id)
+		id++
+	}
+	file, err := os.OpenFile(filepath.Join(p.dir, packName(id)), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if p.durable {
+		if err := syncDir(p.dir); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	p.packs[id], p.active = &pack{file: file}, id
+	return nil
+}
+
+// append appends a record to the active pack, syncs it and applies it, with p.mu held.
+func (p *packStore) append(key string, val []byte, flags byte) (*packLoc, error) {
+	pk := p.packs[p.active]
+	rec := appendRecord(nil, key, val, flags)
+	if _, err := pk.file.WriteAt(rec, pk.size); err != nil {
+		pk.file.Truncate(pk.size)
+		return nil, err
+	}
+	if err := pk.file.Sync(); err != nil {
+		return nil, err
+	}
+	id, off := p.active, pk.size
+	pk.size += int64(len(rec))
+	p.apply(id, key, off, int64(len(val)), flags, time.Now().UnixNano())
+	loc := p.index[key]
+	if pk.size >= p.sealBytes {
+		// keep appending to the active pack if a new one can not be created
+		p.rotate()
+	}
+	return loc, nil
+}
+
+// drop removes key from the index, with p.mu held.
+func (p *packStore) drop(key string) bool {
+	loc, ok := p.index[key]
+	if !ok {
+		return false
+	}
+	delete(p.index, key)
+	p.packs[loc.pack].live -= recordLen(key, loc.size)
+	p.bytes -= loc.size
+	return true
+}
+
+func (p *packStore) put(key string, val []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.append(key, val, 0)
+	return err
+}
+
+// rewrite rewrites the value of key as val, e.g. recompressed, keeping its times.
+func (p *packStore) rewrite(key string, val []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old, ok := p.index[key]
+	if !ok {
+		return ErrNotFound
+	}
+	atime, mtime := atomic.LoadInt64(&old.atime), old.mtime
+	loc, err := p.append(key, val, 0)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&loc.atime, atime)
+	loc.mtime = mtime
+	return nil
+}
+
+// files returns the number of pack files open.
+func (p *packStore) files() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.packs)
+}
+
+// get appends the value of key to dst, and tells if key is packed.
+func (p *packStore) get(key string, dst []byte) ([]byte, bool, error) {
+	if p == nil {
+		return dst, false, nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	loc, ok := p.index[key]
+	if !ok {
+		return dst, false, nil
+	}
+	val, err := p.read(key, loc)
+	if err != nil {
+		return dst, true, err
+	}
+	atomic.StoreInt64(&loc.atime, time.Now().UnixNano())
+	return append(dst, val...), true, nil
+}
+
+// peek returns the value of key like get(), without updating its access time.
+func (p *packStore) peek(key string) ([]byte, bool, error) {
+	if p == nil {
+		return nil, false, nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	loc, ok := p.index[key]
+	if !ok {
+		return nil, false, nil
+	}
+	val, err := p.read(key, loc)
+	return val, true, err
+}
+
+// read reads the value of key at loc, with p.mu held.
+func (p *packStore) read(key string, loc *packLoc) ([]byte, error) {
+	pk := p.packs[loc.pack]
+	r := io.NewSectionReader(pk.file, loc.off, recordLen(key, loc.size))
+	k, val, _, err := readRecord(r)
+	if err == nil && k != key {
+		err = errPackCorrupt
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s of %s at %d: %w", key, pk.file.Name(), loc.off, err)
+	}
+	return val, nil
+}
+
+func (p *packStore) has(key string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.index[key]
+	return ok
+}
+
+// stat returns the location of key, false if it is not packed.
+func (p *packStore) stat(key string) (packLoc, bool) {
+	if p == nil {
+		return packLoc{}, false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	loc, ok := p.index[key]
+	if !ok {
+		return packLoc{}, false
+	}
+	return packLoc{pack: loc.pack, off: loc.off, size: loc.size, atime: atomic.LoadInt64(&loc.atime), mtime: loc.mtime}, true
+}
+
+// remove deletes key with a tombstone, and tells if key was packed.
+func (p *packStore) remove(key string) (bool, error) {
+	if p == nil {
+		return false, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.index[key]; !ok {
+		return false, nil
+	}
+	if _, err := p.append(key, nil, packFlagTombstone); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// take gets the value of key and deletes it with a tombstone, and tells if key was packed.
+func (p *packStore) take(key string) ([]byte, bool, error) {
+	if p == nil {
+		return nil, false, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	loc, ok := p.index[key]
+	if !ok {
+		return nil, false, nil
+	}
+	val, err := p.read(key, loc)
+	if err != nil {
+		return nil, true, err
+	}
+	if _, err := p.append(key, nil, packFlagTombstone); err != nil {
+		return nil, true, err
+	}
+	return val, true, nil
+}
+
+func (p *packStore) keys() []string {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	keys := make([]string, 0, len(p.index))
+	for k := range p.index {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// evict deletes the least recently accessed entries until their values take no more than maxBytes,
+// and returns the keys evicted and the bytes taken by their values.
+func (p *packStore) evict(withValues bool) ([]string, [][]byte, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bytes <= p.maxBytes {
+		return nil, nil, 0, nil
+	}
+	keys := make([]string, 0, len(p.index))
+	for k := range p.index {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return atomic.LoadInt64(&p.index[keys[i]].atime) < atomic.LoadInt64(&p.index[keys[j]].atime)
+	})
+	bytes := p.bytes
+	for i, k := range keys {
+		if bytes <= p.maxBytes {
+			keys = keys[:i]
+			break
+		}
+		bytes -= p.index[k].size
+	}
+	return p.tombstone(keys, withValues)
+}
+
+// evictKeys deletes the keys packed, and returns the keys evicted, their values if withValues,
+// and the bytes taken by their values.
+func (p *packStore) evictKeys(keys []string, withValues bool) ([]string, [][]byte, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var packed []string
+	for _, k := range keys {
+		if _, ok := p.index[k]; ok {
+			packed = append(packed, k)
+		}
+	}
+	return p.tombstone(packed, withValues)
+}
+
+// tombstone deletes keys, and returns the keys deleted, their values if withValues, and the bytes taken
+// by their values, with p.mu held. Keys whose values can not be read are deleted without their values.
+func (p *packStore) tombstone(keys []string, withValues bool) ([]string, [][]byte, int64, error) {
+	var (
+		bytes int64
+		vals  [][]byte
+	)
+	for i, k := range keys {
+		loc := p.index[k]
+		if withValues {
+			val, _ := p.read(k, loc)
+			vals = append(vals, val)
+		}
+		if _, err := p.append(k, nil, packFlagTombstone); err != nil {
+			if withValues {
+				vals = vals[:i]
+			}
+			return keys[:i], vals, bytes, err
+		}
+		bytes += loc.size
+	}
+	return keys, vals, bytes, nil
+}
+
+// usage returns the number of entries packed and the bytes taken by their values.
+func (p *packStore) usage() (int64, int64) {
+	if p == nil {
+		return 0, 0
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return int64(len(p.index)), p.bytes
+}
+
+// infos returns the os.FileInfo of the entries packed, with their last access time as atime,
+// so that they are chosen from by the eviction policy together with the entries in files.
+func (p *packStore) infos() []os.FileInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	infos := make([]os.FileInfo, 0, len(p.index))
+	for k, loc := range p.index {
+		e := &entryInfo{name: k}
+		e.st.Mode = syscall.S_IFREG | 0644
+		e.st.Size = loc.size
+		e.st.Atim = syscall.NsecToTimespec(atomic.LoadInt64(&loc.atime))
+		e.st.Mtim = syscall.NsecToTimespec(loc.mtime)
+		infos = append(infos, e)
+	}
+	return infos
+}
+
+// compact rewrites the live records of sealed packs into the active pack and removes them,
+// once a sealed pack is mostly dead. The oldest packs are compacted up to the newest mostly dead one,
+// so that tombstones dropped with them have no older record to delete left.
+func (p *packStore) compact() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ids []uint32
+	for id := range p.packs {
+		if id != p.active {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	upto := -1
+	for i, id := range ids {
+		if pk := p.packs[id]; pk.live*2 < pk.size {
+			upto = i
+		}
+	}
+	if upto < 0 {
+		return nil
+	}
+	compacting := map[uint32]bool{}
+	for _, id := range ids[:upto+1] {
+		compacting[id] = true
+	}
+	for key, loc := range p.index {
+		if !compacting[loc.pack] {
+			continue
+		}
+		val := make([]byte, loc.size)
+		if _, err := p.packs[loc.pack].file.ReadAt(val, loc.off+packHeaderLen+int64(len(key))); err != nil {
+			return err
+		}
+		atime := atomic.LoadInt64(&loc.atime)
+		newLoc, err := p.append(key, val, 0)
+		if err != nil {
+			return err
+		}
+		newLoc.atime, newLoc.mtime = atime, loc.mtime
+	}
+	for id := range compacting {
+		pk := p.packs[id]
+		pk.file.Close()
+		delete(p.packs, id)
+		if err := os.Remove(filepath.Join(p.dir, hintName(id))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(pk.file.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot copies the packs into dir, linking sealed packs and copying what has been written to the active one.
+func (p *packStore) snapshot(dir string) error {
+	if p == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, pk := range p.packs {
+		dst := filepath.Join(dir, packName(id))
+		if id != p.active {
+			if err := os.Link(pk.file.Name(), dst); err != nil {
+				return err
+			}
+			continue
+		}
+		buf := make([]byte, pk.size)
+		if _, err := pk.file.ReadAt(buf, 0); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(dst, buf, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *packStore) close() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var err error
+	if p.loaded {
+		// atimes are only hints
+		p.writeAtimes()
+		p.loaded = false
+	}
+	for _, pk := range p.packs {
+		if cerr := pk.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	p.packs = map[uint32]*pack{}
+	return err
+}
+
+// setPacked sets the value of key into the packs, dropping the file of key if the old value was not packed.
+func (f *Cache) setPacked(key string, src []byte, meta entryMeta) error {
+	err := f.packs.put(key, src)
+	f.health.observeWrite(err)
+	if err != nil {
+		return err
+	}
+	if err := f.removeStored(f.filepath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := f.dropChunked(key); err != nil {
+		return err
+	}
+	f.index.remove(key)
+	f.policy.add(key, int64(len(src)), meta.Cost)
+	return f.recorded(key, int64(len(src)), meta)
+}
+
+// gcPacks evicts and compacts the packs. Packed entries of the hybrid engine are evicted
+// together with the entries in files instead, see gcPacked().
+func (f *Cache) gcPacks() {
+	if f.engine != EngineHybrid {
+		if f.engine == EngineLog {
+			f.sizeHist.update(f.packs.infos())
+		}
+		evicted, vals, bytes, err := f.packs.evict(f.wantEvicted())
+		if err != nil {
+			f.gcErrorf("gc packs %s : %s", f.packdir(), err)
+		}
+		f.evicted(evicted, vals, bytes)
+	}
+	if err := f.packs.compact(); err != nil {
+		f.gcErrorf("compact packs %s : %s", f.packdir(), err)
+	}
+}
+
+// gcPacked evicts the keys packed, and returns the other keys.
+func (f *Cache) gcPacked(keys []string) []string {
+	evicted, vals, bytes, err := f.packs.evictKeys(keys, f.wantEvicted())
+	if err != nil {
+		f.gcErrorf("gc packs %s : %s", f.packdir(), err)
+	}
+	f.evicted(evicted, vals, bytes)
+	packed := make(map[string]bool, len(evicted))
+	for _, k := range evicted {
+		packed[k] = true
+	}
+	var rst []string
+	for _, k := range keys {
+		if !packed[k] && !f.packs.has(k) {
+			rst = append(rst, k)
+		}
+	}
+	return rst
+}
+
+// evicted drops the bookkeeping of packed keys evicted, whose values took bytes, and passes them with
+// their values vals if wanted to the evict hook.
+func (f *Cache) evicted(keys []string, vals [][]byte, bytes int64) {
+	f.gcEvicted(int64(len(keys)), bytes)
+	for i, k := range keys {
+		f.callEvictHook(k, func() (io.ReadCloser, error) {
+			if vals[i] == nil {
+				return nil, errPackCorrupt
+			}
+			return f.packedValue(k, vals[i])
+		})
+		f.policy.remove(k)
+		f.changed(EventEvict, k)
+		if err := f.dropMeta(k); err != nil {
+			f.gcErrorf("gc meta of %s : %s", k, err)
+		}
+	}
+}
+
+func readDirNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(-1)
+}
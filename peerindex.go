@@ -0,0 +1,91 @@
+package fscache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ExportIndex writes the infos of the entries in the cache to w as JSON lines in the order of their keys,
+// without their values, so that a peer learns what the cache has by ImportIndex(). It returns how many
+// entries exported.
+func (f *Cache) ExportIndex(w io.Writer) (int, error) {
+	keys, err := f.keys()
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(keys)
+	var (
+		bw  = bufio.NewWriter(w)
+		enc = json.NewEncoder(bw)
+		n   int
+	)
+	for _, key := range keys {
+		info, err := f.Stat(key)
+		if err == ErrNotFound || err == ErrIllegalEntry {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := enc.Encode(info); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, bw.Flush()
+}
+
+// PeerIndex is the index of a peer cache read by ImportIndex().
+type PeerIndex struct {
+	// Entries are the entries of the peer in the order of their keys.
+	Entries []EntryInfo
+	// Missing are the keys of the peer not in the cache, or set in the peer since they were set in the cache,
+	// in the order of the keys, which are the ones worth replicating from the peer.
+	Missing []string
+}
+
+// Has tells if the peer has key.
+func (p *PeerIndex) Has(key string) bool {
+	_, ok := p.Stat(key)
+	return ok
+}
+
+// Stat returns the info of the entry of key in the peer, false if the peer does not have it.
+func (p *PeerIndex) Stat(key string) (EntryInfo, bool) {
+	i := sort.Search(len(p.Entries), func(i int) bool { return p.Entries[i].Key >= key })
+	if i < len(p.Entries) && p.Entries[i].Key == key {
+		return p.Entries[i], true
+	}
+	return EntryInfo{}, false
+}
+
+// ImportIndex reads the index of a peer cache written by ExportIndex() from r, and compares it with the cache.
+func (f *Cache) ImportIndex(r io.Reader) (*PeerIndex, error) {
+	var (
+		p   = &PeerIndex{}
+		dec = json.NewDecoder(bufio.NewReader(r))
+	)
+	for {
+		var e EntryInfo
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("decode index : %w", err)
+		}
+		p.Entries = append(p.Entries, e)
+	}
+	sort.SliceStable(p.Entries, func(i, j int) bool { return p.Entries[i].Key < p.Entries[j].Key })
+	for _, e := range p.Entries {
+		info, err := f.Stat(e.Key)
+		switch {
+		case err == ErrNotFound || err == nil && e.Updated.After(info.Updated):
+			p.Missing = append(p.Missing, e.Key)
+		case err != nil && err != ErrIllegalEntry:
+			return nil, err
+		}
+	}
+	return p, nil
+}
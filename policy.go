@@ -0,0 +1,211 @@
+package fscache
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// policy decides which entries GC evicts.
+type policy interface {
+	// add is called when key is set with a value of size bytes and the cost to recompute it.
+	add(key string, size int64, cost float64)
+	// touch is called when key is got.
+	touch(key string)
+	// remove is called when key is deleted or evicted.
+	remove(key string)
+	// victims returns keys to evict among entries found by GC, which should free at least needBytes.
+	victims(entries []os.FileInfo, needBytes int64) []string
+}
+
+// lru evicts the least recently used entries based on atime.
+type lru struct{}
+
+func (lru) add(key string, size int64, cost float64) {}
+func (lru) touch(key string)                         {}
+func (lru) remove(key string)                        {}
+
+func (lru) victims(entries []os.FileInfo, needBytes int64) []string {
+	var (
+		fih        = fileInfoHeap(entries)
+		bytesSoFar int64
+		keys       []string
+	)
+	heap.Init(&fih)
+	for bytesSoFar < needBytes && fih.Len() > 0 {
+		fi := heap.Pop(&fih).(os.FileInfo)
+		bytesSoFar += fi.Size()
+		keys = append(keys, fi.Name())
+	}
+	return keys
+}
+
+// persistentPolicy is a policy whose state in memory is saved at Close() and after every GC pass,
+// and loaded at startup.
+type persistentPolicy interface {
+	policy
+	save(w io.Writer) error
+	load(r io.Reader) error
+}
+
+func (f *Cache) policyPath() string { return filepath.Join(f.cacheDir, "policy") }
+
+// persistentPolicy returns the policy of f if it is persistent, unwrapping fairPolicy.
+func (f *Cache) persistentPolicy() (persistentPolicy, bool) {
+	p := f.policy
+	if fp, ok := p.(*fairPolicy); ok {
+		p = fp.policy
+	}
+	pp, ok := p.(persistentPolicy)
+	return pp, ok
+}
+
+func (f *Cache) loadPolicy() error {
+	p, ok := f.persistentPolicy()
+	if !ok {
+		return nil
+	}
+	file, err := os.Open(f.policyPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	return p.load(bufio.NewReader(file))
+}
+
+func (f *Cache) savePolicy() {
+	p, ok := f.persistentPolicy()
+	if !ok {
+		return
+	}
+	var buf bytes.Buffer
+	err := p.save(&buf)
+	if err == nil {
+		fp := f.policyPath()
+		if err = ioutil.WriteFile(fp+".tmp", buf.Bytes(), 0644); err == nil {
+			err = os.Rename(fp+".tmp", fp)
+		}
+	}
+	if err != nil {
+		f.logger.Errorf("save policy %s : %s", f.policyPath(), err)
+	}
+}
+
+// keyList is a list of keys with the sizes of their values, from the least to the most recently used.
+type keyList struct {
+	l     *list.List
+	m     map[string]*list.Element
+	bytes int64
+}
+
+type keyItem struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+func newKeyList() *keyList { return &keyList{l: list.New(), m: map[string]*list.Element{}} }
+
+func (k *keyList) len() int { return k.l.Len() }
+
+func (k *keyList) has(key string) bool {
+	_, ok := k.m[key]
+	return ok
+}
+
+// pushBack pushes key as the most recently used, moving it if in the list.
+func (k *keyList) pushBack(key string, size int64) {
+	k.remove(key)
+	k.m[key] = k.l.PushBack(keyItem{Key: key, Size: size})
+	k.bytes += size
+}
+
+// pushFront pushes key as the least recently used, moving it if in the list.
+func (k *keyList) pushFront(key string, size int64) {
+	k.remove(key)
+	k.m[key] = k.l.PushFront(keyItem{Key: key, Size: size})
+	k.bytes += size
+}
+
+// moveToBack moves key to the most recently used, if in the list.
+func (k *keyList) moveToBack(key string) {
+	if e, ok := k.m[key]; ok {
+		k.l.MoveToBack(e)
+	}
+}
+
+func (k *keyList) remove(key string) (keyItem, bool) {
+	e, ok := k.m[key]
+	if !ok {
+		return keyItem{}, false
+	}
+	it := k.l.Remove(e).(keyItem)
+	delete(k.m, key)
+	k.bytes -= it.Size
+	return it, true
+}
+
+// front returns the least recently used key.
+func (k *keyList) front() (keyItem, bool) {
+	e := k.l.Front()
+	if e == nil {
+		return keyItem{}, false
+	}
+	return e.Value.(keyItem), true
+}
+
+// popFront removes and returns the least recently used key.
+func (k *keyList) popFront() (keyItem, bool) {
+	it, ok := k.front()
+	if !ok {
+		return keyItem{}, false
+	}
+	return k.remove(it.Key)
+}
+
+// items returns the keys from the least to the most recently used.
+func (k *keyList) items() []keyItem {
+	items := make([]keyItem, 0, k.l.Len())
+	for e := k.l.Front(); e != nil; e = e.Next() {
+		items = append(items, e.Value.(keyItem))
+	}
+	return items
+}
+
+// retain removes the keys not in found.
+func (k *keyList) retain(found map[string]int64) {
+	for key := range k.m {
+		if _, ok := found[key]; !ok {
+			k.remove(key)
+		}
+	}
+}
+
+// unknownEntries returns the entries in no lists, the most recently accessed first,
+// which are set before the start or by others.
+func unknownEntries(entries []os.FileInfo, lists ...*keyList) []os.FileInfo {
+	var unknown []os.FileInfo
+	for _, fi := range entries {
+		known := false
+		for _, l := range lists {
+			if l.has(fi.Name()) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			unknown = append(unknown, fi)
+		}
+	}
+	h := fileInfoHeap(unknown)
+	sort.Slice(unknown, func(i, j int) bool { return h.Less(j, i) })
+	return unknown
+}
@@ -0,0 +1,32 @@
+package fscache
+
+import "sync/atomic"
+
+// Prefetch fetches the values of keys missing from the cache from the backend in the background
+// at PriorityBackground, for applications predicting their upcoming accesses. A key being fetched by
+// a Get is not fetched again, and a Get of a key being prefetched waits for the prefetch instead of
+// fetching it again. Failed prefetches are only logged. Without WithBackend(), it does nothing.
+func (f *Cache) Prefetch(keys []string) {
+	if f.backend == nil || len(keys) == 0 {
+		return
+	}
+	keys = append([]string(nil), keys...)
+	f.background(func() {
+		for _, key := range keys {
+			select {
+			case <-f.stopCh:
+				return
+			default:
+			}
+			if f.Has(key) {
+				continue
+			}
+			// wait for the foreground before the fetch is joinable, so that a Get joining it does not wait too
+			f.sched.idle()
+			atomic.AddInt64(&f.stats.prefetches, 1)
+			if _, err := f.fetch(key, nil, priorityIdle); err != nil && err != ErrNotFound {
+				f.logger.Errorf("prefetch %s : %s", key, err)
+			}
+		}
+	})
+}
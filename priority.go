@@ -0,0 +1,82 @@
+package fscache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Priority is the IO class of operations.
+type Priority int
+
+const (
+	// PriorityForeground is of operations someone waits for, e.g. Gets serving requests, which is the default.
+	PriorityForeground Priority = iota
+	// PriorityBackground is of operations nobody waits for, e.g. prefetches and refreshes, whose IO is
+	// scheduled only while no foreground Get, Set or Delete is in progress.
+	PriorityBackground
+	// priorityIdle is of background operations which already waited for the foreground ones,
+	// so that foreground operations joining them do not wait.
+	priorityIdle
+)
+
+const (
+	// backgroundMaxWait is the longest a background operation waits for the foreground ones,
+	// so that background operations are not starved by a steady foreground load.
+	backgroundMaxWait = time.Second
+	// backgroundPoll is how often a background operation checks for the foreground ones.
+	backgroundPoll = time.Millisecond
+)
+
+// ioScheduler schedules background operations after the foreground ones.
+type ioScheduler struct {
+	foreground int64
+}
+
+// begin marks an operation of prio started, waiting for the foreground ones in progress if background,
+// and returns the func to mark it done.
+func (s *ioScheduler) begin(prio Priority) func() {
+	if prio == PriorityBackground {
+		s.idle()
+	}
+	if prio != PriorityForeground {
+		return func() {}
+	}
+	atomic.AddInt64(&s.foreground, 1)
+	return func() { atomic.AddInt64(&s.foreground, -1) }
+}
+
+// idle waits until no foreground operation is in progress, up to backgroundMaxWait.
+func (s *ioScheduler) idle() {
+	for start := time.Now(); atomic.LoadInt64(&s.foreground) > 0 && time.Since(start) < backgroundMaxWait; {
+		time.Sleep(backgroundPoll)
+	}
+}
+
+// WithPriority returns the cache doing its Gets, Sets and Deletes at prio. Background IO of the cache
+// itself, e.g. of the scrubber, is always at PriorityBackground.
+func (f *Cache) WithPriority(prio Priority) Interface {
+	if prio == PriorityForeground {
+		return f
+	}
+	return &prioritized{f: f, prio: prio}
+}
+
+// prioritized is a cache doing its operations at a priority.
+type prioritized struct {
+	f    *Cache
+	prio Priority
+}
+
+func (p *prioritized) Set(key string, src []byte) error {
+	return p.f.setPrio(key, src, entryMeta{}, p.prio)
+}
+
+func (p *prioritized) Get(key string, dst []byte) ([]byte, error) {
+	return p.f.getPrio(key, dst, p.prio)
+}
+
+func (p *prioritized) Has(key string) bool { return p.f.Has(key) }
+
+func (p *prioritized) Delete(key string) error { return p.f.deletePrio(key, p.prio) }
+
+func (p *prioritized) Close() error { return p.f.Close() }
@@ -0,0 +1,97 @@
+package fscache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Progress reports how far a long operation over entries goes.
+type Progress struct {
+	// Op is the operation, "scan" for GC scans or "snapshot".
+	Op string
+	// Files and Bytes are how many entries and their bytes processed so far.
+	Files int64
+	Bytes int64
+	// TotalFiles is how many entries to process, 0 if unknown.
+	TotalFiles int64
+	// Elapsed is the time since the operation started.
+	Elapsed time.Duration
+	// ETA estimates the time left, 0 if unknown.
+	ETA time.Duration
+	// Done is true for the last report of the operation.
+	Done bool
+}
+
+// WithProgress calls fn with the progress of long operations over entries every interval,
+// and when they finish, so that operators of large caches can see what is happening.
+func WithProgress(interval time.Duration, fn func(Progress)) Option {
+	return func(fc *Cache) {
+		fc.progressInterval = interval
+		fc.progressFn = fn
+	}
+}
+
+type progress struct {
+	fn       func(Progress)
+	interval int64
+	op       string
+	total    int64
+	start    time.Time
+
+	files      int64
+	bytes      int64
+	lastReport int64
+}
+
+// newProgress starts tracking op over total entries, which returns nil if progress is not reported.
+func (f *Cache) newProgress(op string, total int64) *progress {
+	if f.progressFn == nil {
+		return nil
+	}
+	now := time.Now()
+	return &progress{
+		fn:         f.progressFn,
+		interval:   int64(f.progressInterval),
+		op:         op,
+		total:      total,
+		start:      now,
+		lastReport: now.UnixNano(),
+	}
+}
+
+// add records files processed with bytes, and reports if it has been interval since the last report.
+func (p *progress) add(files, bytes int64) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.files, files)
+	atomic.AddInt64(&p.bytes, bytes)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&p.lastReport)
+	if now-last < p.interval || !atomic.CompareAndSwapInt64(&p.lastReport, last, now) {
+		return
+	}
+	p.report(false)
+}
+
+func (p *progress) done() {
+	if p == nil {
+		return
+	}
+	p.report(true)
+}
+
+func (p *progress) report(done bool) {
+	rp := Progress{
+		Op:         p.op,
+		Files:      atomic.LoadInt64(&p.files),
+		Bytes:      atomic.LoadInt64(&p.bytes),
+		TotalFiles: p.total,
+		Elapsed:    time.Since(p.start),
+		Done:       done,
+	}
+	if !done && rp.TotalFiles > 0 && rp.Files > 0 && rp.Files < rp.TotalFiles {
+		rp.ETA = rp.Elapsed / time.Duration(rp.Files) * time.Duration(rp.TotalFiles-rp.Files)
+	}
+	p.fn(rp)
+}
@@ -0,0 +1,58 @@
+package fscache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// QuarantineReport describes a corrupt entry moved into the quarantine dir with WithQuarantine(),
+// written next to it as <name>.report.json, so that operators can investigate the corruption.
+type QuarantineReport struct {
+	Key           string    `json:"key"`
+	Path          string    `json:"path"`
+	Reason        string    `json:"reason"`
+	Size          int64     `json:"size"`
+	ModTime       time.Time `json:"modTime"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+}
+
+const quarantineReportSuffix = ".report.json"
+
+// corrupted deletes the corrupt entry of key, or moves it into the quarantine dir with a report
+// with WithQuarantine(). Packed entries are always deleted.
+func (f *Cache) corrupted(key string, cause error) {
+	atomic.AddInt64(&f.stats.corruptEntries, 1)
+	if !f.quarantine || f.packs.has(key) {
+		if err := f.delete(key, EventDelete); err != nil {
+			f.logger.Errorf("delete corrupt entry %s : %s", key, err)
+			return
+		}
+		f.logger.Errorf("corrupt entry %s : %s, deleted", key, cause)
+		return
+	}
+	fp := f.filepath(key)
+	rep := QuarantineReport{Key: key, Path: fp, Reason: cause.Error(), QuarantinedAt: time.Now()}
+	if fi, err := f.statStored(fp); err == nil {
+		rep.Size, rep.ModTime = fi.Size(), fi.ModTime()
+	}
+	dst := filepath.Join(f.quarantinedir(), f.filename(key)+"."+strconv.FormatInt(rep.QuarantinedAt.UnixNano(), 10))
+	if err := f.renameStored(fp, dst); err != nil {
+		f.logger.Errorf("quarantine corrupt entry %s : %s", fp, err)
+		return
+	}
+	if err := f.deleted(key, EventDelete); err != nil {
+		f.logger.Errorf("delete corrupt entry %s : %s", key, err)
+	}
+	f.logger.Errorf("corrupt entry %s : %s, quarantined to %s", fp, cause, dst)
+	buf, err := json.MarshalIndent(rep, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(dst+quarantineReportSuffix, append(buf, '\n'), 0644)
+	}
+	if err != nil {
+		f.logger.Errorf("write quarantine report of %s : %s", dst, err)
+	}
+}
@@ -0,0 +1,119 @@
+package fscache
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HandlerOption configures the http.Handler returned by NewHandler().
+type HandlerOption func(h *handler)
+
+// WithRateLimit limits each client to rps requests per second with bursts of burst requests,
+// by a token bucket per client. Requests over the limit are responded 429 Too Many Requests.
+func WithRateLimit(rps float64, burst int) HandlerOption {
+	return func(h *handler) {
+		h.limiter().rps = rps
+		h.limiter().burst = float64(burst)
+	}
+}
+
+// WithMaxConcurrentRequests limits each client to n requests in flight,
+// beyond which requests are responded 429 Too Many Requests.
+func WithMaxConcurrentRequests(n int) HandlerOption {
+	return func(h *handler) { h.limiter().maxConcurrent = n }
+}
+
+// WithClientKey specifies how to tell clients apart for limiting, by the host of the remote address by default.
+func WithClientKey(clientKey func(r *http.Request) string) HandlerOption {
+	return func(h *handler) { h.limiter().clientKey = clientKey }
+}
+
+// clientIdle is how long a client is forgotten after its last request.
+const clientIdle = time.Minute
+
+type clientState struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+type limiter struct {
+	rps           float64
+	burst         float64
+	maxConcurrent int
+	clientKey     func(r *http.Request) string
+
+	mu        sync.Mutex
+	clients   map[string]*clientState
+	lastSweep time.Time
+}
+
+func (h *handler) limiter() *limiter {
+	if h.limit == nil {
+		h.limit = &limiter{rps: math.Inf(1), clientKey: remoteHost, clients: map[string]*clientState{}}
+	}
+	return h.limit
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// acquire takes a token and a concurrency slot of the client of r, returns the release func if allowed,
+// or how long to wait before retrying otherwise.
+func (l *limiter) acquire(r *http.Request) (func(), time.Duration) {
+	key := l.clientKey(r)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > clientIdle {
+		for k, c := range l.clients {
+			if c.active == 0 && now.Sub(c.last) > clientIdle {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	c, ok := l.clients[key]
+	if !ok {
+		c = &clientState{tokens: l.burst, last: now}
+		l.clients[key] = c
+	}
+	if !math.IsInf(l.rps, 1) {
+		c.tokens = math.Min(l.burst, c.tokens+now.Sub(c.last).Seconds()*l.rps)
+		c.last = now
+		if c.tokens < 1 {
+			return nil, time.Duration((1 - c.tokens) / l.rps * float64(time.Second))
+		}
+	}
+	if l.maxConcurrent > 0 && c.active >= l.maxConcurrent {
+		return nil, time.Second
+	}
+	c.tokens--
+	c.active++
+	c.last = now
+	return func() {
+		l.mu.Lock()
+		c.active--
+		l.mu.Unlock()
+	}, 0
+}
+
+// limited tells if r is over the limits of its client and responded 429, otherwise returns the release func.
+func (l *limiter) limited(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	release, wait := l.acquire(r)
+	if release != nil {
+		return release, false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+	return nil, true
+}
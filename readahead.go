@@ -0,0 +1,49 @@
+package fscache
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Predictor returns the keys likely to be got soon after key, e.g. the next chunks of a file.
+type Predictor func(key string) []string
+
+// WithPredictor makes a Get of key prefetch the keys returned by predictor for key, see Prefetch().
+// It has no effect without WithBackend().
+func WithPredictor(predictor Predictor) Option { return func(fc *Cache) { fc.predictor = predictor } }
+
+// NextChunks is a Predictor of the n keys after key with numeric suffixes, e.g. "file.3" and "file.004"
+// after "file.2" and "file.003" for n of 2, keeping the zero padding. Keys without numeric suffixes
+// predict nothing.
+func NextChunks(n int) Predictor {
+	return func(key string) []string {
+		i := len(key)
+		for i > 0 && key[i-1] >= '0' && key[i-1] <= '9' {
+			i--
+		}
+		digits := key[i:]
+		num, err := strconv.ParseUint(digits, 10, 64)
+		if err != nil {
+			return nil
+		}
+		keys := make([]string, 0, n)
+		for j := 1; j <= n; j++ {
+			next := strconv.FormatUint(num+uint64(j), 10)
+			if pad := len(digits) - len(next); pad > 0 && digits[0] == '0' {
+				next = strings.Repeat("0", pad) + next
+			}
+			keys = append(keys, key[:i]+next)
+		}
+		return keys
+	}
+}
+
+// readahead prefetches the keys predicted after key.
+func (f *Cache) readahead(key string) {
+	if f.predictor == nil || f.backend == nil {
+		return
+	}
+	if keys := f.predictor(key); len(keys) > 0 {
+		f.Prefetch(keys)
+	}
+}
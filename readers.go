@@ -0,0 +1,63 @@
+package fscache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// WithDeferBusyEviction makes GC defer evicting the entries being read by GetAt() or GetTo() until
+// their readers are closed, to the next GC pass after. By default, GC evicts them anyway, which does not
+// break the readers, which keep reading the values got, but the space of their files on local filesystems
+// is only freed once they are closed, while already not counted by GC.
+func WithDeferBusyEviction() Option { return func(fc *Cache) { fc.readers.enabled = true } }
+
+// readerRefs counts the readers of the entries in files.
+type readerRefs struct {
+	enabled bool
+	mu      sync.Mutex
+	refs    map[string]int
+}
+
+// addReader takes a reader of key with the key locked, so that GC evicting key either sees the reader,
+// or has removed the file before it is opened.
+func (f *Cache) addReader(key string) {
+	if !f.readers.enabled {
+		return
+	}
+	defer f.keyLocks.lock(key)()
+	r := &f.readers
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refs == nil {
+		r.refs = map[string]int{}
+	}
+	r.refs[key]++
+}
+
+// doneReader releases a reader of key taken by addReader().
+func (f *Cache) doneReader(key string) {
+	if !f.readers.enabled {
+		return
+	}
+	r := &f.readers
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refs[key]--; r.refs[key] <= 0 {
+		delete(r.refs, key)
+	}
+}
+
+// busy tells if key, locked, is being read, counting an eviction deferred if so.
+func (f *Cache) busy(key string) bool {
+	if !f.readers.enabled {
+		return false
+	}
+	r := &f.readers
+	r.mu.Lock()
+	n := r.refs[key]
+	r.mu.Unlock()
+	if n > 0 {
+		atomic.AddInt64(&f.stats.deferredEvictions, 1)
+	}
+	return n > 0
+}
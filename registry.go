@@ -0,0 +1,75 @@
+package fscache
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	registryMu sync.Mutex
+	// registry maps names passed to Open() to caches.
+	registry = map[string]*Cache{}
+	// registryDirs maps absolute cache dirs to caches, so that there is one cache per dir in the process.
+	registryDirs = map[string]*Cache{}
+)
+
+// Open returns the cache registered by name in this process, creating it with opts if there is none,
+// so that libraries can share caches without wiring them through every call site.
+// Without WithCacheDir(), the cache holds in the fscache/name dir under the user cache dir.
+// There is at most one cache per cache dir, so opening another name with the same cache dir
+// returns the same cache, and opts are ignored if the cache exists.
+func Open(name string, opts ...Option) (Interface, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if fc, ok := registry[name]; ok {
+		return fc, nil
+	}
+	fc := configure(opts...)
+	if fc.cacheDir == "" {
+		fc.cacheDir = filepath.Join(userCacheDir(), "fscache", name)
+	}
+	dir, err := filepath.Abs(fc.cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	if existing, ok := registryDirs[dir]; ok {
+		registry[name] = existing
+		return existing, nil
+	}
+	if err := fc.open(); err != nil {
+		return nil, err
+	}
+	registry[name] = fc
+	registryDirs[dir] = fc
+	return fc, nil
+}
+
+// Default returns the cache shared by the process, which is Open("default").
+func Default() (Interface, error) {
+	return Open("default")
+}
+
+func userCacheDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return dir
+	}
+	return os.TempDir()
+}
+
+// unregister removes fc from the registry when it is closed.
+func unregister(fc *Cache) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for name, c := range registry {
+		if c == fc {
+			delete(registry, name)
+		}
+	}
+	for dir, c := range registryDirs {
+		if c == fc {
+			delete(registryDirs, dir)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package fscache
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// AccessRecord is an access of a key in an access log, one JSON object per line, e.g.
+//
+//	{"key": "a1b2", "size": 4096, "time": "2021-01-02T15:04:05Z"}
+type AccessRecord struct {
+	Key  string    `json:"key"`
+	Size int64     `json:"size"`
+	Time time.Time `json:"time"`
+	// Op is AccessGet or AccessSet, AccessGet if empty.
+	Op string `json:"op,omitempty"`
+	// Hit tells if a Get found the key.
+	Hit bool `json:"hit,omitempty"`
+	// Latency is how long the access took in nanoseconds.
+	Latency time.Duration `json:"latency,omitempty"`
+}
+
+// ReplayConfig is the caches simulated by Replay().
+type ReplayConfig struct {
+	// Policies is the eviction policies named as in Config.Policy, all of them by default.
+	Policies []string
+	// MaxBytes is the quotas simulated with each of the policies.
+	MaxBytes []int64
+	// GcInterval is how often GC runs in the time of the log, 5 minutes by default.
+	GcInterval time.Duration
+}
+
+// ReplayResult is how a cache with an eviction policy and a quota did in Replay().
+type ReplayResult struct {
+	Policy       string  `json:"policy"`
+	MaxBytes     int64   `json:"maxBytes"`
+	Gets         int64   `json:"gets"`
+	Hits         int64   `json:"hits"`
+	HitRatio     float64 `json:"hitRatio"`
+	ByteHitRatio float64 `json:"byteHitRatio"`
+	Evictions    int64   `json:"evictions"`
+}
+
+// replayPolicies is the eviction policies simulated by default.
+var replayPolicies = []string{"lru", "gds", "clock", "arc", "tinylfu", "slru"}
+
+// Replay simulates caches with each of the eviction policies and quotas in cfg offline, by replaying
+// the access log read from r, e.g. logged by WithAccessLog(), so that eviction settings are chosen
+// with data instead of guessed. A Set sets a key, and so does a Get of a size missing it or finding it
+// of another size. Hit and Latency of records are ignored. GC evicts by the policies as in a cache,
+// every GC interval in the time of the log, where records without times are a second apart.
+func Replay(r io.Reader, cfg ReplayConfig) ([]ReplayResult, error) {
+	if len(cfg.MaxBytes) == 0 {
+		return nil, errors.New("replay: no max bytes")
+	}
+	if len(cfg.Policies) == 0 {
+		cfg.Policies = replayPolicies
+	}
+	if cfg.GcInterval <= 0 {
+		cfg.GcInterval = 5 * time.Minute
+	}
+	records, err := readAccessLog(r)
+	if err != nil {
+		return nil, err
+	}
+	var results []ReplayResult
+	for _, name := range cfg.Policies {
+		for _, maxBytes := range cfg.MaxBytes {
+			opt, err := policyOption(name)
+			if err != nil {
+				return nil, fmt.Errorf("replay %w", err)
+			}
+			f := configure()
+			if opt != nil {
+				opt(f)
+			}
+			res := replay(records, f.policy, maxBytes, cfg.GcInterval)
+			res.Policy = name
+			if name == "" {
+				res.Policy = "lru"
+			}
+			results = append(results, res)
+		}
+	}
+	return results, nil
+}
+
+func readAccessLog(r io.Reader) ([]AccessRecord, error) {
+	var records []AccessRecord
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var rec AccessRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("access log line %d : %w", line, err)
+		}
+		if rec.Time.IsZero() {
+			rec.Time = time.Unix(int64(len(records)), 0)
+		}
+		records = append(records, rec)
+	}
+	return records, sc.Err()
+}
+
+// replay simulates a cache with policy p limited to maxBytes over records.
+func replay(records []AccessRecord, p policy, maxBytes int64, gcInterval time.Duration) ReplayResult {
+	var (
+		res      = ReplayResult{MaxBytes: maxBytes}
+		entries  = map[string]*simEntry{}
+		curBytes int64
+		getBytes int64
+		hitBytes int64
+		nextGc   time.Time
+	)
+	for _, rec := range records {
+		if nextGc.IsZero() {
+			nextGc = rec.Time.Add(gcInterval)
+		} else if !rec.Time.Before(nextGc) {
+			nextGc = rec.Time.Add(gcInterval)
+			if curBytes > maxBytes {
+				infos := make([]os.FileInfo, 0, len(entries))
+				for _, e := range entries {
+					infos = append(infos, e)
+				}
+				for _, k := range p.victims(infos, curBytes-maxBytes) {
+					if e, ok := entries[k]; ok {
+						curBytes -= e.size
+						delete(entries, k)
+						p.remove(k)
+						res.Evictions++
+					}
+				}
+			}
+		}
+
+		e, ok := entries[rec.Key]
+		if rec.Op != AccessSet {
+			res.Gets++
+			getBytes += rec.Size
+			if ok && (e.size == rec.Size || rec.Size == 0) {
+				res.Hits++
+				hitBytes += e.size
+				e.atime = rec.Time
+				p.touch(rec.Key)
+				continue
+			}
+			if rec.Size == 0 {
+				// missed of an unknown size, which the Set after it sets
+				continue
+			}
+		}
+		if ok {
+			curBytes -= e.size
+		}
+		entries[rec.Key] = &simEntry{key: rec.Key, size: rec.Size, atime: rec.Time}
+		curBytes += rec.Size
+		p.add(rec.Key, rec.Size, 0)
+	}
+	if res.Gets > 0 {
+		res.HitRatio = float64(res.Hits) / float64(res.Gets)
+	}
+	if getBytes > 0 {
+		res.ByteHitRatio = float64(hitBytes) / float64(getBytes)
+	}
+	return res
+}
+
+// simEntry is an entry of a simulated cache, as GC finds the file of an entry.
+type simEntry struct {
+	key   string
+	size  int64
+	atime time.Time
+}
+
+func (e *simEntry) Name() string       { return e.key }
+func (e *simEntry) Size() int64        { return e.size }
+func (e *simEntry) Mode() os.FileMode  { return 0644 }
+func (e *simEntry) ModTime() time.Time { return e.atime }
+func (e *simEntry) IsDir() bool        { return false }
+func (e *simEntry) Sys() interface{}   { return nil }
@@ -0,0 +1,140 @@
+package fscache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithReplication ships every entry set to or deleted from the cache to a peer cache served by NewHandler() at peerURL.
+// Entries are shipped asynchronously in the order of a write journal, and shipping resumes from where
+// it stopped after a restart, so a standby host starts warm after failover.
+func WithReplication(peerURL string) Option {
+	return func(fc *Cache) { fc.replicaURL = strings.TrimSuffix(peerURL, "/") }
+}
+
+// WithReplicationInterval specifies how often the replicator checks the write journal for new entries.
+func WithReplicationInterval(interval time.Duration) Option {
+	return func(fc *Cache) { fc.replicaInterval = interval }
+}
+
+func (f *Cache) journalPath() string { return filepath.Join(f.cacheDir, "journal") }
+func (f *Cache) replicationOffsetPath() string {
+	return filepath.Join(f.cacheDir, "replication.offset")
+}
+
+func (f *Cache) replicateRunner(off int64) {
+	ticker := time.NewTicker(f.replicaInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stopCh:
+			return
+		case <-ticker.C:
+			off = f.replicate(off)
+		}
+	}
+}
+
+// replicate ships the entries recorded in the journal after off, and returns the offset to resume from.
+func (f *Cache) replicate(off int64) int64 {
+	records, _, err := f.journal.readFrom(off)
+	if err != nil {
+		f.logger.Errorf("replicate read journal %s : %s", f.journalPath(), err)
+	}
+	shipped := off
+	for _, r := range records {
+		if err := f.ship(r); err != nil {
+			f.logger.Errorf("replicate %q to %s : %s", r.key, f.replicaURL, err)
+			break
+		}
+		shipped = r.next
+	}
+	if truncated, err := f.journal.truncateAt(shipped); err != nil {
+		f.logger.Errorf("truncate journal %s : %s", f.journalPath(), err)
+	} else if truncated {
+		shipped = 0
+	}
+	if shipped != off {
+		if err := f.saveReplicationOffset(shipped); err != nil {
+			f.logger.Errorf("save replication offset %s : %s", f.replicationOffsetPath(), err)
+		}
+	}
+	return shipped
+}
+
+func (f *Cache) ship(r journalRecord) error {
+	switch r.op {
+	case journalOpSet:
+		var (
+			val []byte
+			err error
+		)
+		if m, _, ok := f.statChunked(r.key); ok {
+			// chunked values are stored raw
+			val, err = f.getChunked(r.key, m, nil)
+		} else {
+			if val, ok, err = f.packs.get(r.key, nil); !ok {
+				val, err = f.readStored(f.filepath(r.key))
+			}
+			if err == nil {
+				val, err = f.decodeEntry(r.key, val)
+			}
+		}
+		if err != nil {
+			if os.IsNotExist(err) || err == ErrNotFound {
+				// evicted or expired before being shipped
+				return nil
+			}
+			return err
+		}
+		return f.replicaDo(http.MethodPut, r.key, val)
+	case journalOpDelete:
+		return f.replicaDo(http.MethodDelete, r.key, nil)
+	}
+	return nil
+}
+
+func (f *Cache) replicaDo(method, key string, body []byte) error {
+	req, err := http.NewRequest(method, f.replicaURL+"/"+url.PathEscape(key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := f.replicaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("peer responded %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (f *Cache) loadReplicationOffset() (int64, error) {
+	buf, err := ioutil.ReadFile(f.replicationOffsetPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseInt(string(buf), 10, 64)
+}
+
+func (f *Cache) saveReplicationOffset(off int64) error {
+	fp := f.replicationOffsetPath()
+	tmp := fp + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(off, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fp)
+}
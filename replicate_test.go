@@ -0,0 +1,75 @@
+package fscache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReplication(t *testing.T) {
+	peer, cancelPeer := newCache()
+	defer cancelPeer()
+	server := httptest.NewServer(NewHandler(peer))
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "fscache")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	cache, err := New(
+		WithCacheDir(cacheDir),
+		WithMaxBytes(0),
+		WithGcStopCh(stopCh),
+		WithReplication(server.URL),
+		WithReplicationInterval(100*time.Millisecond),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	val := randBytes(1024)
+	if err := cache.Set("key", val); err != nil {
+		panic(err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	valFromPeer, err := peer.Get("key", nil)
+	if err != nil {
+		t.Fatalf("get from peer: %s", err)
+	}
+	if !bytes.Equal(val, valFromPeer) {
+		t.Errorf("valFromPeer not equals to val")
+	}
+}
+
+func TestReplicateChunked(t *testing.T) {
+	peer, cancelPeer := newCache()
+	defer cancelPeer()
+	server := httptest.NewServer(NewHandler(peer))
+	defer server.Close()
+	cache, cancel := newCache(WithChunkedStorage(1000, 1000, 0),
+		WithReplication(server.URL), WithReplicationInterval(time.Hour))
+	defer cancel()
+
+	val := randBytes(3500)
+	if err := cache.Set("big", val); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if _, _, ok := cache.statChunked("big"); !ok {
+		t.Fatalf("expected the value chunked")
+	}
+	if err := cache.ship(journalRecord{op: journalOpSet, key: "big"}); err != nil {
+		t.Fatalf("ship: %s", err)
+	}
+	if got, err := peer.Get("big", nil); err != nil || !bytes.Equal(got, val) {
+		t.Errorf("expected the chunked value replicated, err %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package fscache
+
+import (
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// SizeBucket is the entries of sizes above the bucket before and up to UpTo bytes in a size histogram.
+type SizeBucket struct {
+	UpTo    int64 `json:"upTo"`
+	Entries int64 `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// sizeBucketBounds is the UpTo of the buckets of size histograms, by powers of 4 from 1KB.
+var sizeBucketBounds = []int64{
+	1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10,
+	1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20,
+	1 << 30, 4 << 30, math.MaxInt64,
+}
+
+// sizeHistogram is the size histogram of the entries as of the last GC scan.
+type sizeHistogram struct {
+	mu      sync.Mutex
+	buckets []SizeBucket
+}
+
+// update replaces the histogram by the one of entries.
+func (h *sizeHistogram) update(entries []os.FileInfo) {
+	buckets := make([]SizeBucket, len(sizeBucketBounds))
+	for i, upTo := range sizeBucketBounds {
+		buckets[i].UpTo = upTo
+	}
+	for _, fi := range entries {
+		i := sort.Search(len(sizeBucketBounds), func(i int) bool { return sizeBucketBounds[i] >= fi.Size() })
+		buckets[i].Entries++
+		buckets[i].Bytes += fi.Size()
+	}
+	h.mu.Lock()
+	h.buckets = buckets
+	h.mu.Unlock()
+}
+
+// get returns the histogram, nil before the first GC scan.
+func (h *sizeHistogram) get() []SizeBucket {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]SizeBucket(nil), h.buckets...)
+}
+
+// Report is a capacity planning report of the cache, see Cache.Report().
+type Report struct {
+	// SizeHistogram is the sizes of the entries as of the last GC scan, nil before it.
+	SizeHistogram []SizeBucket `json:"sizeHistogram"`
+	// HitRates is the hit rates estimated at capacities, the smallest first, nil without WithHeatmap().
+	HitRates []CapacityHitRate `json:"hitRates,omitempty"`
+}
+
+// CapacityHitRate is the hit rate of Gets estimated with the cache limited to MaxBytes.
+type CapacityHitRate struct {
+	MaxBytes int64   `json:"maxBytes"`
+	HitRate  float64 `json:"hitRate"`
+}
+
+// reportCapacities is the capacities hit rates are estimated at, as fractions of the bytes of the keys hit.
+var reportCapacities = []float64{0.125, 0.25, 0.5, 0.75, 1}
+
+// Report returns a capacity planning report of the cache to guide the choice of WithMaxBytes().
+// With WithHeatmap(), it estimates the hit rates at capacities up to the bytes of the keys hit,
+// by replaying the hits recorded into a cache keeping the keys of the most hits per byte.
+// Keys hit but evicted are taken as of the average size. Capacities above are not estimated,
+// as the misses of keys never stored would not hit with any capacity.
+func (f *Cache) Report() Report {
+	rep := Report{SizeHistogram: f.sizeHist.get()}
+	if f.heatmap == nil {
+		return rep
+	}
+	gets := atomic.LoadInt64(&f.stats.hits) + atomic.LoadInt64(&f.stats.misses)
+	heats := f.heatmap.entries()
+	if gets == 0 || len(heats) == 0 {
+		return rep
+	}
+
+	sizes := make(map[string]int64, len(heats))
+	if f.packs != nil {
+		for _, fi := range f.packs.infos() {
+			sizes[fi.Name()] = fi.Size()
+		}
+	}
+	var known, knownBytes int64
+	for _, e := range heats {
+		size, ok := sizes[e.Key]
+		if !ok {
+			fi, err := f.statStored(f.filepath(e.Key))
+			if err != nil {
+				sizes[e.Key] = -1
+				continue
+			}
+			size, sizes[e.Key] = fi.Size(), fi.Size()
+		}
+		known, knownBytes = known+1, knownBytes+size
+	}
+	avg := int64(1)
+	if known > 0 && knownBytes/known > 0 {
+		avg = knownBytes / known
+	}
+	var total int64
+	for _, e := range heats {
+		if sizes[e.Key] <= 0 {
+			sizes[e.Key] = avg
+		}
+		total += sizes[e.Key]
+	}
+	sort.Slice(heats, func(i, j int) bool {
+		return float64(heats[i].Hits)/float64(sizes[heats[i].Key]) > float64(heats[j].Hits)/float64(sizes[heats[j].Key])
+	})
+
+	var bytes int64
+	var hits uint64
+	i := 0
+	for _, frac := range reportCapacities {
+		capacity := int64(float64(total) * frac)
+		for ; i < len(heats) && bytes+sizes[heats[i].Key] <= capacity; i++ {
+			bytes += sizes[heats[i].Key]
+			hits += heats[i].Hits
+		}
+		rep.HitRates = append(rep.HitRates, CapacityHitRate{MaxBytes: capacity, HitRate: float64(hits) / float64(gets)})
+	}
+	return rep
+}
@@ -0,0 +1,58 @@
+package fscache
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// RetentionRule limits how long entries whose keys start with Prefix are kept since set.
+type RetentionRule struct {
+	Prefix string
+	MaxAge time.Duration
+}
+
+// WithRetention makes GC evict entries older than the MaxAge of the rule with the longest Prefix of their keys,
+// whether or not the cache is over WithMaxBytes(), e.g. entries under "logs-" for 7 days and
+// the others, with the rule of Prefix "", for 30 days. Entries matching no rules are kept as long as they fit,
+// and entries excluded by WithGcExclude() are never evicted by the rules.
+func WithRetention(rules ...RetentionRule) Option {
+	return func(fc *Cache) { fc.retention = append(fc.retention, rules...) }
+}
+
+// maxAge returns the MaxAge of the rule with the longest prefix of key, and tells if any rule matches.
+func (f *Cache) maxAge(key string) (time.Duration, bool) {
+	var (
+		rule  RetentionRule
+		found bool
+	)
+	for _, r := range f.retention {
+		if strings.HasPrefix(key, r.Prefix) && (!found || len(r.Prefix) > len(rule.Prefix)) {
+			rule, found = r, true
+		}
+	}
+	return rule.MaxAge, found
+}
+
+// retentionVictims splits entries into the ones kept by the retention rules, and the keys
+// of the others to evict, and returns the bytes taken up by the latter.
+func (f *Cache) retentionVictims(entries []os.FileInfo) ([]os.FileInfo, []string, int64) {
+	if len(f.retention) == 0 {
+		return entries, nil, 0
+	}
+	var (
+		now   = time.Now()
+		kept  = make([]os.FileInfo, 0, len(entries))
+		keys  []string
+		bytes int64
+	)
+	for _, fi := range entries {
+		if maxAge, ok := f.maxAge(fi.Name()); ok && now.Sub(fi.ModTime()) > maxAge {
+			keys = append(keys, fi.Name())
+			bytes += fi.Size()
+			continue
+		}
+		kept = append(kept, fi)
+	}
+	return kept, keys, bytes
+}
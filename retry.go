@@ -0,0 +1,54 @@
+package fscache
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// WithRetry retries the reads, writes and removes of Gets, Sets and Deletes failing transiently, with EINTR,
+// EAGAIN, ESTALE or short writes, up to attempts times, waiting backoff before the first retry and twice as
+// long before each next one, instead of failing the call on the first hiccup. Retries are counted in
+// Stats.Retries. By default, only ESTALE is retried in NFS mode, 3 times without waiting.
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(fc *Cache) {
+		fc.retryAttempts = attempts
+		fc.retryBackoff = backoff
+	}
+}
+
+// transient tells if err may not happen again if the operation failing with it is retried.
+func transient(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.ESTALE) || errors.Is(err, io.ErrShortWrite)
+}
+
+// retries returns how many times an operation failing with err is retried.
+func (f *Cache) retries(err error) int {
+	n := 0
+	if transient(err) {
+		n = f.retryAttempts
+	}
+	if f.nfs && errors.Is(err, syscall.ESTALE) && n < nfsStaleRetries {
+		// reopening the files by their paths gets fresh handles
+		n = nfsStaleRetries
+	}
+	return n
+}
+
+// retry calls fn, again as long as it fails transiently and retries are left.
+func (f *Cache) retry(fn func() error) error {
+	err := fn()
+	backoff := f.retryBackoff
+	for i := 0; err != nil && i < f.retries(err); i++ {
+		atomic.AddInt64(&f.stats.retries, 1)
+		if backoff > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		err = fn()
+	}
+	return err
+}
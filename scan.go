@@ -0,0 +1,172 @@
+package fscache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// WithGcWorkers specifies how many goroutines GC uses to stat and remove entries in parallel,
+// which speeds up GC of caches with millions of entries on fast disks. By default, it is 1.
+func WithGcWorkers(n int) Option { return func(fc *Cache) { fc.gcWorkers = n } }
+
+// scan returns the file infos of regular entries in the cache dir, reporting illegal entries.
+// Only entries which might be regular files by their dirent types are stated.
+// Entries removed during the scan are skipped.
+func (f *Cache) scan() ([]os.FileInfo, error) {
+	if f.storage != nil {
+		return f.scanStored()
+	}
+	dir, err := os.Open(f.filedir())
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	dirfd := int(dir.Fd())
+
+	f.scanBuf = f.scanBuf[:cap(f.scanBuf)]
+	if len(f.scanBuf) == 0 {
+		f.scanBuf = make([]byte, 64*1024)
+	}
+	f.scanNames, f.scanTypes, err = readDirents(dirfd, f.scanBuf, f.scanNames[:0], f.scanTypes[:0])
+	if err != nil {
+		return nil, &os.PathError{Op: "getdents", Path: f.filedir(), Err: err}
+	}
+
+	var (
+		infos = make([]os.FileInfo, len(f.scanNames))
+		p     = f.newProgress("scan", int64(len(f.scanNames)))
+	)
+	defer p.done()
+	f.parallel(len(f.scanNames), func(i int) {
+		var (
+			name = f.scanNames[i]
+			ok   bool
+		)
+		if fi := direntInfo(name, f.scanTypes[i]); fi != nil {
+			p.add(1, 0)
+			f.illegalEntry(filepath.Join(f.filedir(), name), fi)
+			return
+		}
+		fi, err := statEntry(dirfd, name)
+		if err != nil {
+			p.add(1, 0)
+			if !vanished(err) {
+				f.gcErrorf("gc stat %s : %s", filepath.Join(f.filedir(), name), err)
+			}
+			return
+		}
+		p.add(1, fi.Size())
+		if !fi.Mode().IsRegular() {
+			f.illegalEntry(filepath.Join(f.filedir(), name), fi)
+			return
+		}
+		// an entry of a hashed key is skipped until its meta holding the key is written
+		if fi.name, ok = f.keyOf(name); ok {
+			infos[i] = fi
+		} else {
+			f.dropOrphan(name, fi)
+		}
+	})
+
+	n := 0
+	for _, fi := range infos {
+		if fi != nil {
+			infos[n] = fi
+			n++
+		}
+	}
+	return infos[:n], nil
+}
+
+// vanished tells if err is caused by a file removed by others, e.g. evicted by another process
+// sharing the cache dir, or on NFS, removed by another client, which GC skips as normal churn.
+func vanished(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, syscall.ESTALE)
+}
+
+// remove removes entries of keys in parallel from the files and the index, and returns the keys removed.
+// Each key is locked, so that a value set meanwhile is either removed with its bytes or kept.
+func (f *Cache) remove(keys []string) []string {
+	if !f.fenced() {
+		f.gcErrorf("gc lock lost, not evicting %d entries", len(keys))
+		return nil
+	}
+	removed := make([]bool, len(keys))
+	f.parallel(len(keys), func(i int) {
+		defer f.keyLocks.lock(keys[i])()
+		if f.busy(keys[i]) {
+			return
+		}
+		f.callEvictHook(keys[i], func() (io.ReadCloser, error) { return f.evictedValue(keys[i]) })
+		fp := f.filepath(keys[i])
+		if err := f.removeStored(fp); err != nil && !vanished(err) {
+			f.gcErrorf("gc %s : %s", fp, err)
+			return
+		}
+		f.index.remove(keys[i])
+		removed[i] = true
+	})
+	var rst []string
+	for i, k := range keys {
+		if removed[i] {
+			rst = append(rst, k)
+		}
+	}
+	return rst
+}
+
+// parallel calls fn with 0 to n-1 with GC workers. A panic of fn in a worker stops the calls left,
+// and is raised again by parallel, so that it is recovered by the GC pass, see recoverGc().
+func (f *Cache) parallel(n int, fn func(i int)) {
+	workers := f.gcWorkers
+	if workers <= 1 || n <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	if workers > n {
+		workers = n
+	}
+	var (
+		wg       sync.WaitGroup
+		ch       = make(chan int, workers)
+		panicked int32
+		once     sync.Once
+		cause    interface{}
+	)
+	call := func(i int) {
+		defer func() {
+			if r := recover(); r != nil {
+				once.Do(func() { cause = workerPanic{value: r, stack: debug.Stack()} })
+				atomic.StoreInt32(&panicked, 1)
+			}
+		}()
+		fn(i)
+	}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				if atomic.LoadInt32(&panicked) == 0 {
+					call(i)
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+	if cause != nil {
+		panic(cause)
+	}
+}
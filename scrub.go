@@ -0,0 +1,95 @@
+package fscache
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// WithScrub makes the cache re-verify the checksums of all entries in the background, slowly enough to
+// verify each once per period, e.g. a week, so that silent corruption is found before being read.
+// Corrupt entries are deleted, or moved into the quarantine dir with WithQuarantine().
+// Only entries with headers, see WithEntryHeader(), and packed entries have checksums.
+func WithScrub(period time.Duration) Option { return func(fc *Cache) { fc.scrubPeriod = period } }
+
+func (f *Cache) scrubRunner() {
+	for {
+		keys, err := f.keys()
+		if err != nil {
+			f.logger.Errorf("scrub cache dir %s : %s", f.filedir(), err)
+		}
+		interval := f.scrubPeriod / time.Duration(len(keys)+1)
+		if interval <= 0 {
+			interval = 1
+		}
+		ticker := time.NewTicker(interval)
+		for i := 0; i <= len(keys); i++ {
+			select {
+			case <-f.stopCh:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+			}
+			if i < len(keys) {
+				f.sched.idle()
+				f.scrub(keys[i])
+			}
+		}
+		ticker.Stop()
+		atomic.StoreInt64(&f.stats.lastScrub, time.Now().UnixNano())
+	}
+}
+
+// scrub verifies the checksum of the entry of key, handling it if corrupt.
+func (f *Cache) scrub(key string) {
+	val, packed, err := f.packs.get(key, nil)
+	if !packed {
+		val, err = f.readNoAtime(f.filepath(key))
+		if os.IsNotExist(err) {
+			return
+		}
+	}
+	if err == nil {
+		err = verifyEntry(key, val)
+	}
+	atomic.AddInt64(&f.stats.scrubbedEntries, 1)
+	atomic.AddInt64(&f.stats.scrubbedBytes, int64(len(val)))
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrCorrupted), err == errPackCorrupt:
+		f.corrupted(key, err)
+	default:
+		f.logger.Errorf("scrub %s : %s", key, err)
+	}
+}
+
+// readNoAtime reads the file at fp without updating its atime, so that scrubbing does not disturb LRU.
+func (f *Cache) readNoAtime(fp string) ([]byte, error) {
+	file, err := os.OpenFile(fp, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NOATIME, 0)
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EPERM {
+		// O_NOATIME is only permitted to the owner
+		file, err = os.OpenFile(fp, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// verifyEntry returns ErrCorrupted if the entry buf has a header whose checksum mismatches the value.
+func verifyEntry(key string, buf []byte) error {
+	h, ok := parseEntryHeader(buf)
+	if !ok || h.flags&entryFlagChecksum == 0 {
+		return nil
+	}
+	if crc := crc32.ChecksumIEEE(buf[entryHeaderLen:]); crc != h.crc {
+		return fmt.Errorf("%w: %s checksum %08x, expected %08x", ErrCorrupted, key, crc, h.crc)
+	}
+	return nil
+}
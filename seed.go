@@ -0,0 +1,31 @@
+package fscache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// WithSeedDir specifies a read-only directory checked on misses, e.g. an NFS share of prebuilt artifacts.
+// The file named by the key in it is copied into the cache, and counted as a hit.
+func WithSeedDir(seedDir string) Option { return func(fc *Cache) { fc.seedDir = seedDir } }
+
+// getSeed gets the value of key from the seed directory to dst, and copies it into the cache.
+func (f *Cache) getSeed(key string, dst []byte) ([]byte, error) {
+	if f.seedDir == "" {
+		return dst, ErrNotFound
+	}
+	src, err := ioutil.ReadFile(filepath.Join(f.seedDir, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dst, ErrNotFound
+		}
+		return dst, err
+	}
+	if err := f.Set(key, src); err != nil {
+		f.logger.Errorf("copy seed %s into cache : %s", key, err)
+	}
+	atomic.AddInt64(&f.stats.seedHits, 1)
+	return append(dst, src...), nil
+}
@@ -0,0 +1,136 @@
+package fscache
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrDiskFull will be returned when setting a value of known size which does not fit in the filesystem,
+// before writing it.
+var ErrDiskFull = errors.New("disk full")
+
+// SetReader sets the value of key as size bytes read from r, without holding the value in memory.
+// The space is reserved up front, so that a value which does not fit fails fast with ErrDiskFull
+// instead of after writing most of it. It returns io.ErrUnexpectedEOF if r has less than size bytes.
+func (f *Cache) SetReader(key string, r io.Reader, size int64) error {
+	if err := f.checkKey(key); err != nil {
+		return err
+	}
+	if !f.writable() {
+		return ErrDegraded
+	}
+	if f.shedder.shed() {
+		atomic.AddInt64(&f.stats.shed, 1)
+		return ErrShed
+	}
+	total := size
+	if f.entryHeader {
+		total += entryHeaderLen
+	}
+	// storages are written whole by writeStored()
+	if f.packs.fits(int(total)) || len(f.transforms) > 0 || f.dicts.fits(size) || f.storage != nil {
+		val := make([]byte, size)
+		if _, err := io.ReadFull(r, val); err != nil {
+			return err
+		}
+		return f.set(key, val, entryMeta{})
+	}
+	release, err := f.acquireWrite()
+	if err != nil {
+		return err
+	}
+	defer release()
+	defer f.keyLocks.lock(key)()
+	created := f.createdAt(key)
+	if f.chunked(size) {
+		return f.setChunked(key, r, size, entryMeta{CreatedAt: created})
+	}
+
+	dst, err := newAtomicFileWriter(f.filepath(key), f.tmppath(key), f.fileOpts(), 0644)
+	if err != nil {
+		f.health.observeWrite(err)
+		return err
+	}
+	w := dst.(*atomicFileWriter)
+	if err := f.setFrom(key, w, r, size, total); err != nil {
+		w.writeErr = err
+		w.Close()
+		return err
+	}
+	err = w.Close()
+	f.health.observeWrite(err)
+	if err != nil {
+		return err
+	}
+	f.adviseSet(key, total)
+	return f.written(key, total, entryMeta{CreatedAt: created})
+}
+
+// setFrom writes the entry of total bytes with the value of size bytes read from r to w.
+func (f *Cache) setFrom(key string, w *atomicFileWriter, r io.Reader, size, total int64) error {
+	if err := fallocate(w.f, total); err != nil {
+		return fmt.Errorf("reserve %d bytes for %s : %w", total, key, err)
+	}
+	var hdr []byte
+	if f.entryHeader {
+		hdr = make([]byte, entryHeaderLen)
+		if _, err := w.Write(hdr); err != nil {
+			return err
+		}
+	}
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(w, io.TeeReader(io.LimitReader(r, size), crc))
+	if err != nil {
+		return err
+	}
+	if n < size {
+		return io.ErrUnexpectedEOF
+	}
+	if hdr != nil {
+		encodeEntryHeader(hdr, crc.Sum32(), 0)
+		if _, err := w.f.WriteAt(hdr, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetFromFile sets the value of key as the content of the file at path like SetReader().
+func (f *Cache) SetFromFile(key, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return f.SetReader(key, file, fi.Size())
+}
+
+// fallocate reserves size bytes for file, returning ErrDiskFull if they do not fit.
+// Filesystems not supporting it are not reserved.
+func fallocate(file *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	for {
+		err := unix.Fallocate(int(file.Fd()), 0, 0, size)
+		switch err {
+		case nil, unix.EOPNOTSUPP, unix.ENOSYS:
+			return nil
+		case unix.EINTR:
+			continue
+		case unix.ENOSPC, unix.EFBIG:
+			return ErrDiskFull
+		}
+		return err
+	}
+}
@@ -0,0 +1,37 @@
+package fscache
+
+import (
+	"errors"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithSlowOpThreshold logs a warning for each Get, Set and Delete taking longer than d, in the fields
+//
+//	slow op=get key=9e2c5ed6f3a1b4c7 size=4096 duration=1.2s errno=EIO
+//
+// where key is hashed as in the access log, and errno is the errno the operation failed with, if any,
+// so that flaky disks are diagnosed in production. By default, slow operations are not logged.
+func WithSlowOpThreshold(d time.Duration) Option {
+	return func(fc *Cache) { fc.slowOpThreshold = d }
+}
+
+// opDone records the latency of an op of key on size bytes since start to h, and logs it if slow.
+func (f *Cache) opDone(h *latencyHistogram, op, key string, size int64, start time.Time, err error) {
+	d := time.Since(start)
+	h.record(d)
+	if f.slowOpThreshold <= 0 || d <= f.slowOpThreshold {
+		return
+	}
+	errno := "-"
+	var e syscall.Errno
+	if errors.As(err, &e) {
+		if errno = unix.ErrnoName(e); errno == "" {
+			errno = strconv.Itoa(int(e))
+		}
+	}
+	f.logger.Errorf("slow op=%s key=%x size=%d duration=%s errno=%s", op, keyHash(key), size, d, errno)
+}
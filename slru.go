@@ -0,0 +1,144 @@
+package fscache
+
+import (
+	"os"
+	"sync"
+)
+
+// WithSLRU makes GC evict entries by segmented LRU instead of LRU. New entries enter a probation segment,
+// and move to a protected segment only when got again, so that values never reused are evicted first.
+func WithSLRU() Option { return func(fc *Cache) { fc.policy = &slru{segments: newSegments()} } }
+
+// protectedShare is the share of bytes of the protected segment.
+const protectedShare = 0.8
+
+// segments keeps the entries got once in probation and the ones got more than once in protected,
+// both from the least to the most recently used.
+type segments struct {
+	probation, protected *keyList
+	// max is the bytes of both segments, 0 if unknown yet
+	max int64
+}
+
+func newSegments() *segments {
+	return &segments{probation: newKeyList(), protected: newKeyList()}
+}
+
+func (s *segments) has(key string) bool { return s.probation.has(key) || s.protected.has(key) }
+
+func (s *segments) bytes() int64 { return s.probation.bytes + s.protected.bytes }
+
+func (s *segments) len() int { return s.probation.len() + s.protected.len() }
+
+// hit moves key to the most recently used of protected, and tells if it is in the segments.
+func (s *segments) hit(key string) bool {
+	if it, ok := s.probation.remove(key); ok {
+		s.protect(key, it.Size)
+		return true
+	}
+	if s.protected.has(key) {
+		s.protected.moveToBack(key)
+		return true
+	}
+	return false
+}
+
+// protect pushes key to protected, demoting the least recently used ones to probation if it overflows.
+func (s *segments) protect(key string, size int64) {
+	s.probation.remove(key)
+	s.protected.pushBack(key, size)
+	s.demote()
+}
+
+func (s *segments) demote() {
+	if s.max <= 0 {
+		return
+	}
+	max := int64(float64(s.max) * protectedShare)
+	for s.protected.bytes > max && s.protected.len() > 1 {
+		it, _ := s.protected.popFront()
+		s.probation.pushBack(it.Key, it.Size)
+	}
+}
+
+func (s *segments) remove(key string) {
+	s.probation.remove(key)
+	s.protected.remove(key)
+}
+
+func (s *segments) retain(found map[string]int64) {
+	s.probation.retain(found)
+	s.protected.retain(found)
+}
+
+// front returns the segment to evict from and its least recently used key.
+func (s *segments) front() (*keyList, keyItem, bool) {
+	for _, l := range []*keyList{s.probation, s.protected} {
+		if it, ok := l.front(); ok {
+			return l, it, true
+		}
+	}
+	return nil, keyItem{}, false
+}
+
+// slru is the segmented LRU.
+type slru struct {
+	mu sync.Mutex
+	*segments
+}
+
+func (s *slru) add(key string, size int64, cost float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.has(key) {
+		s.protect(key, size)
+		return
+	}
+	s.probation.pushBack(key, size)
+}
+
+func (s *slru) touch(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hit(key)
+}
+
+func (s *slru) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.segments.remove(key)
+}
+
+func (s *slru) victims(entries []os.FileInfo, needBytes int64) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var (
+		sizes    = make(map[string]int64, len(entries))
+		curBytes int64
+	)
+	for _, fi := range entries {
+		sizes[fi.Name()] = fi.Size()
+		curBytes += fi.Size()
+	}
+	s.retain(sizes)
+	for _, fi := range unknownEntries(entries, s.probation, s.protected) {
+		s.probation.pushFront(fi.Name(), fi.Size())
+	}
+	s.max = curBytes - needBytes
+	s.demote()
+
+	var (
+		keys       []string
+		bytesSoFar int64
+	)
+	for bytesSoFar < needBytes {
+		l, it, ok := s.front()
+		if !ok {
+			break
+		}
+		l.remove(it.Key)
+		keys = append(keys, it.Key)
+		bytesSoFar += it.Size
+	}
+	return keys
+}
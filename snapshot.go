@@ -0,0 +1,102 @@
+package fscache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrSnapshotDirNotEmpty will be returned when snapshotting into a dir which is not empty.
+var ErrSnapshotDirNotEmpty = errors.New("snapshot dir not empty")
+
+// Snapshot produces a point-in-time copy of the cache under dir by hard linking
+// every entry, so it neither copies values nor blocks concurrent Sets.
+// Since Set replaces entries by rename, a linked entry keeps the value it had
+// when it was linked. The metadata, tags and chunks of entries are linked as well, so that
+// the restored entries keep their TTLs, hashed keys and chunked values. dir must be on the
+// same filesystem as the cache, and either missing or empty, otherwise ErrSnapshotDirNotEmpty
+// is returned. The snapshot can be restored by passing it to WithCacheDir().
+func (f *Cache) Snapshot(dir string) error {
+	if f.storage != nil {
+		return fmt.Errorf("snapshot: %w", ErrLocalOnly)
+	}
+	if names, err := readDirNames(dir); err == nil && len(names) > 0 {
+		return ErrSnapshotDirNotEmpty
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	snap := &Cache{cacheDir: dir}
+	if err := os.MkdirAll(snap.filedir(), 0775); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(snap.tmpdir(), 0775); err != nil {
+		return err
+	}
+	if err := f.packs.snapshot(snap.packdir()); err != nil {
+		return err
+	}
+	p := f.newProgress("snapshot", 0)
+	defer p.done()
+	// the metadata, tags and chunks of entries
+	for _, dir := range [][2]string{{f.metadir(), snap.metadir()}, {f.tagsdir(), snap.tagsdir()}, {f.chunkdir(), snap.chunkdir()}} {
+		if err := linkTree(dir[0], dir[1]); err != nil {
+			return err
+		}
+	}
+	return filepath.Walk(f.filedir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if path == f.filedir() {
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		p.add(1, info.Size())
+		dst := snap.filepath(info.Name())
+		if err := os.Link(path, dst); err != nil {
+			if os.IsNotExist(err) {
+				// evicted by gc after walking to it
+				return nil
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// linkTree hard links the files under src into dst, creating the dirs, and skipping the files being written.
+func linkTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0775)
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), metaTmpPrefix) || strings.HasPrefix(info.Name(), chunkTmpPrefix) {
+			return nil
+		}
+		if err := os.Link(path, target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,274 @@
+package fscache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SoakConfig is the load Soak() puts on a cache.
+type SoakConfig struct {
+	// Duration is how long the load lasts, 1 minute by default.
+	Duration time.Duration
+	// Writers, Readers and Deleters are the goroutines setting, getting and deleting keys, 4, 4 and 1 by default.
+	Writers, Readers, Deleters int
+	// Keys is the number of keys loaded, 1000 by default.
+	Keys int
+	// MaxValueBytes is the most bytes of a value set, 64KB by default.
+	MaxValueBytes int
+	// CheckInterval is how often the load pauses for the invariants to be checked, 10 seconds by default.
+	CheckInterval time.Duration
+}
+
+// SoakResult is what Soak() did and found.
+type SoakResult struct {
+	Sets    int64 `json:"sets"`
+	Gets    int64 `json:"gets"`
+	Hits    int64 `json:"hits"`
+	Deletes int64 `json:"deletes"`
+	Checks  int64 `json:"checks"`
+	// Violations is the invariants found broken, none if the cache held up.
+	Violations []string `json:"violations,omitempty"`
+}
+
+// maxSoakViolations is the most violations a soak reports, as a broken invariant is usually broken again and again.
+const maxSoakViolations = 100
+
+// Soak opens a cache with opts, and sets, gets and deletes keys concurrently with GC for cfg.Duration or until
+// ctx is done, as a stress test of the cache and the filesystem under it, e.g. nightly or before deploying on
+// a new filesystem. Every value got is verified by a checksum set with it. Every CheckInterval, the load pauses
+// to check that the bytes accounted match the files, that no temporary file is left behind, that GC brings
+// the cache under its max bytes and that every value is intact. The cache is reopened at the end to check the
+// values survive it. Broken invariants are reported in the result, and an error is returned only if the cache
+// could not be opened. Soak needs a local cache dir, which should not be in use.
+func Soak(ctx context.Context, cfg SoakConfig, opts ...Option) (SoakResult, error) {
+	if cfg.Duration <= 0 {
+		cfg.Duration = time.Minute
+	}
+	if cfg.Writers <= 0 {
+		cfg.Writers = 4
+	}
+	if cfg.Readers <= 0 {
+		cfg.Readers = 4
+	}
+	if cfg.Deleters <= 0 {
+		cfg.Deleters = 1
+	}
+	if cfg.Keys <= 0 {
+		cfg.Keys = 1000
+	}
+	if cfg.MaxValueBytes <= 0 {
+		cfg.MaxValueBytes = 64 * 1024
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = 10 * time.Second
+	}
+	fi, err := New(opts...)
+	if err != nil {
+		return SoakResult{}, err
+	}
+	f := fi.(*Cache)
+	if f.storage != nil {
+		f.Close()
+		return SoakResult{}, errors.New("soak needs a local cache dir")
+	}
+
+	s := &soak{cfg: cfg}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	spawn := func(n int, op func(f *Cache, r *rand.Rand)) {
+		for i := 0; i < n; i++ {
+			r := rand.New(rand.NewSource(time.Now().UnixNano() + int64(i)))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ctx.Err() == nil {
+					s.mu.RLock()
+					op(f, r)
+					s.mu.RUnlock()
+				}
+			}()
+		}
+	}
+	spawn(cfg.Writers, s.set)
+	spawn(cfg.Readers, s.get)
+	spawn(cfg.Deleters, s.delete)
+
+	ticker := time.NewTicker(cfg.CheckInterval)
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			done = true
+		}
+		s.mu.Lock()
+		s.check(f)
+		s.mu.Unlock()
+	}
+	ticker.Stop()
+	wg.Wait()
+
+	if err := f.Close(); err != nil {
+		s.violatef("close : %s", err)
+	}
+	if fi, err = New(opts...); err != nil {
+		s.violatef("reopen : %s", err)
+	} else {
+		s.verifyAll(fi.(*Cache))
+		if err := fi.(*Cache).Close(); err != nil {
+			s.violatef("close : %s", err)
+		}
+	}
+	return s.res, nil
+}
+
+// soak is a soak in progress.
+type soak struct {
+	cfg SoakConfig
+	// mu is held for reading by the load, and for writing by the checks pausing it.
+	mu  sync.RWMutex
+	res SoakResult
+
+	violationsMu sync.Mutex
+}
+
+func (s *soak) violatef(format string, args ...interface{}) {
+	s.violationsMu.Lock()
+	defer s.violationsMu.Unlock()
+	if len(s.res.Violations) < maxSoakViolations {
+		s.res.Violations = append(s.res.Violations, fmt.Sprintf(format, args...))
+	}
+}
+
+func (s *soak) key(r *rand.Rand) string {
+	return fmt.Sprintf("soak-%d", r.Intn(s.cfg.Keys))
+}
+
+// soakValue returns a value of key of size random bytes followed by their checksum with key.
+func soakValue(r *rand.Rand, key string, size int) []byte {
+	val := make([]byte, size+4)
+	r.Read(val[:size])
+	crc := crc32.Update(crc32.ChecksumIEEE([]byte(key)), crc32.IEEETable, val[:size])
+	binary.BigEndian.PutUint32(val[size:], crc)
+	return val
+}
+
+// verifySoakValue tells if val is a value of key by soakValue().
+func verifySoakValue(key string, val []byte) bool {
+	if len(val) < 4 {
+		return false
+	}
+	size := len(val) - 4
+	crc := crc32.Update(crc32.ChecksumIEEE([]byte(key)), crc32.IEEETable, val[:size])
+	return crc == binary.BigEndian.Uint32(val[size:])
+}
+
+func (s *soak) set(f *Cache, r *rand.Rand) {
+	key := s.key(r)
+	if err := f.Set(key, soakValue(r, key, r.Intn(s.cfg.MaxValueBytes+1))); err != nil {
+		s.violatef("set %s : %s", key, err)
+	}
+	atomic.AddInt64(&s.res.Sets, 1)
+}
+
+func (s *soak) get(f *Cache, r *rand.Rand) {
+	key := s.key(r)
+	val, err := f.Get(key, nil)
+	atomic.AddInt64(&s.res.Gets, 1)
+	if err == ErrNotFound {
+		return
+	}
+	if err != nil {
+		s.violatef("get %s : %s", key, err)
+		return
+	}
+	atomic.AddInt64(&s.res.Hits, 1)
+	if !verifySoakValue(key, val) {
+		s.violatef("corrupt value of %s of %d bytes", key, len(val))
+	}
+}
+
+func (s *soak) delete(f *Cache, r *rand.Rand) {
+	key := s.key(r)
+	if err := f.Delete(key); err != nil {
+		s.violatef("delete %s : %s", key, err)
+	}
+	atomic.AddInt64(&s.res.Deletes, 1)
+}
+
+// check checks the invariants of f with the load paused.
+func (s *soak) check(f *Cache) {
+	s.res.Checks++
+	// keep GC in the background from changing the files while walking them
+	for !f.lockGc() {
+		time.Sleep(time.Millisecond)
+	}
+	du, err := duDir(f.filedir())
+	if err != nil {
+		s.violatef("walk %s : %s", f.filedir(), err)
+	} else if usage, ok := f.index.usage(); ok && usage != du {
+		s.violatef("%d bytes accounted, but %d bytes in %s", usage, du, f.filedir())
+	}
+	tmps, err := duDir(f.tmpdir())
+	if err != nil {
+		s.violatef("walk %s : %s", f.tmpdir(), err)
+	} else if tmps > 0 {
+		s.violatef("%d bytes of tmp files left in %s", tmps, f.tmpdir())
+	}
+	f.unlockGc()
+
+	f.gc()
+	maxBytes, _ := f.gcSettings()
+	if du, err := duDir(f.filedir()); err == nil && du > maxBytes && len(f.gcExclude) == 0 {
+		s.violatef("%d bytes in %s after gc over %d", du, f.filedir(), maxBytes)
+	}
+	s.verifyAll(f)
+}
+
+// verifyAll verifies the values of all keys in f.
+func (s *soak) verifyAll(f *Cache) {
+	keys, err := f.Keys()
+	if err != nil {
+		s.violatef("keys : %s", err)
+		return
+	}
+	for _, key := range keys {
+		val, err := f.Get(key, nil)
+		if err == ErrNotFound {
+			// evicted since listed
+			continue
+		}
+		if err != nil {
+			s.violatef("get %s listed : %s", key, err)
+		} else if !verifySoakValue(key, val) {
+			s.violatef("corrupt value of %s of %d bytes", key, len(val))
+		}
+	}
+}
+
+// duDir returns the bytes of the regular files under dir.
+func duDir(dir string) (int64, error) {
+	var bytes int64
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			bytes += fi.Size()
+		}
+		return nil
+	})
+	return bytes, err
+}
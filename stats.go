@@ -0,0 +1,160 @@
+package fscache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the cache metrics, counted since the cache was created.
+type Stats struct {
+	// Hits is the number of Gets finding the key, including SeedHits.
+	Hits int64
+	// Misses is the number of Gets not finding the key.
+	Misses int64
+	// SeedHits is the number of Gets finding the key in the seed directory.
+	SeedHits int64
+	// Fetches is the number of values fetched from the backend on misses.
+	Fetches int64
+	// Loads is the number of values loaded by GetOrSet() or fetched by read-through Gets.
+	Loads int64
+	// DedupedLoads is the number of misses sharing the value of a load in progress instead of loading it again.
+	DedupedLoads int64
+	// LoaderPanics is the number of loads recovered from panics, see ErrLoaderPanic.
+	LoaderPanics int64
+	// Shed is the number of Sets and fills skipped under pressure, see WithLoadShedding().
+	Shed int64
+	// UnchangedSets is the number of Sets skipped as their values were unchanged, see WithSkipUnchanged().
+	UnchangedSets int64
+	// DeferredEvictions is the number of evictions deferred as the entries were being read,
+	// see WithDeferBusyEviction().
+	DeferredEvictions int64
+	// RejectedWrites is the number of writes failed over WithMaxConcurrentWrites().
+	RejectedWrites int64
+	// Prefetches is the number of values missing from the cache fetched by Prefetch().
+	Prefetches int64
+	// PrematureEvictions is the number of misses of keys evicted recently, see WithEvictionGhosts().
+	PrematureEvictions int64
+	// Recompressed is the number of entries recompressed by WithMaintenance(), which took
+	// RecompressedBytes less.
+	Recompressed      int64
+	RecompressedBytes int64
+	// PackedEntries is the number of entries in packs or value logs.
+	PackedEntries int64
+	// PackedBytes is the bytes taken by the values of PackedEntries.
+	PackedBytes int64
+	// GCHistory is the reports of the last GC passes, the oldest first, see WithGcHistory().
+	GCHistory []GCReport
+	// BytesWritten is the number of bytes set to the cache.
+	BytesWritten int64
+	// GCPanics is the number of GC passes recovered from panics.
+	GCPanics int64
+	// LastGC is when GC completed the last time, zero if it never did.
+	LastGC time.Time
+	// ScrubbedEntries is the number of entries verified by WithScrub().
+	ScrubbedEntries int64
+	// ScrubbedBytes is the bytes of ScrubbedEntries.
+	ScrubbedBytes int64
+	// CorruptEntries is the number of corrupt entries found.
+	CorruptEntries int64
+	// LastScrub is when the scrubber completed a pass over all entries the last time, zero if it never did.
+	LastScrub time.Time
+	// OpenFiles is the number of files kept open, see WithMaxOpenFiles().
+	OpenFiles int64
+	// RejectedOpens is the number of files not opened over WithMaxOpenFiles().
+	RejectedOpens int64
+	// SizeHistogram is the sizes of the entries as of the last GC scan, see Report().
+	SizeHistogram []SizeBucket
+	// Tenants is the metrics of the tenants by their names, see Tenant().
+	Tenants map[string]TenantStats
+	// Retries is the number of operations retried after failing transiently, see WithRetry().
+	Retries int64
+	// Degraded tells if the cache is degraded to read-only.
+	Degraded bool
+	// CircuitOpen tells if the circuit of the disk is open, see WithCircuitBreaker().
+	CircuitOpen bool
+	// GetLatency, SetLatency, DeleteLatency and GCLatency are the latencies of Gets, Sets, Deletes and GC passes.
+	GetLatency    Latency
+	SetLatency    Latency
+	DeleteLatency Latency
+	GCLatency     Latency
+}
+
+type stats struct {
+	hits         int64
+	misses       int64
+	seedHits     int64
+	fetches      int64
+	shed         int64
+	loads        int64
+	dedupedLoads int64
+	loaderPanics int64
+	bytesWritten int64
+	lastGc       int64
+	gcPanics     int64
+	retries      int64
+	startAt      int64
+
+	scrubbedEntries int64
+	scrubbedBytes   int64
+	corruptEntries  int64
+	lastScrub       int64
+	unchangedSets   int64
+
+	getLatency    latencyHistogram
+	setLatency    latencyHistogram
+	deleteLatency latencyHistogram
+	gcLatency     latencyHistogram
+
+	deferredEvictions int64
+	rejectedWrites    int64
+	prefetches        int64
+	recompressed      int64
+	recompressedBytes int64
+
+	prematureEvictions int64
+}
+
+// Stats returns the current metrics of the cache.
+func (f *Cache) Stats() Stats {
+	s := Stats{
+		Hits:         atomic.LoadInt64(&f.stats.hits),
+		Misses:       atomic.LoadInt64(&f.stats.misses),
+		SeedHits:     atomic.LoadInt64(&f.stats.seedHits),
+		Fetches:      atomic.LoadInt64(&f.stats.fetches),
+		Shed:         atomic.LoadInt64(&f.stats.shed),
+		Loads:        atomic.LoadInt64(&f.stats.loads),
+		DedupedLoads: atomic.LoadInt64(&f.stats.dedupedLoads),
+		LoaderPanics: atomic.LoadInt64(&f.stats.loaderPanics),
+		BytesWritten: atomic.LoadInt64(&f.stats.bytesWritten),
+		GCPanics:     atomic.LoadInt64(&f.stats.gcPanics),
+		Retries:      atomic.LoadInt64(&f.stats.retries),
+		Degraded:     f.health.isDegraded(),
+		CircuitOpen:  !f.breaker.allow(),
+
+		ScrubbedEntries: atomic.LoadInt64(&f.stats.scrubbedEntries),
+		ScrubbedBytes:   atomic.LoadInt64(&f.stats.scrubbedBytes),
+		CorruptEntries:  atomic.LoadInt64(&f.stats.corruptEntries),
+		UnchangedSets:   atomic.LoadInt64(&f.stats.unchangedSets),
+	}
+	s.PackedEntries, s.PackedBytes = f.packs.usage()
+	s.OpenFiles = atomic.LoadInt64(&f.fds.open) + int64(f.packs.files())
+	s.RejectedOpens = atomic.LoadInt64(&f.fds.rejected)
+	s.DeferredEvictions = atomic.LoadInt64(&f.stats.deferredEvictions)
+	s.RejectedWrites = atomic.LoadInt64(&f.stats.rejectedWrites)
+	s.Prefetches = atomic.LoadInt64(&f.stats.prefetches)
+	s.PrematureEvictions = atomic.LoadInt64(&f.stats.prematureEvictions)
+	s.Recompressed = atomic.LoadInt64(&f.stats.recompressed)
+	s.RecompressedBytes = atomic.LoadInt64(&f.stats.recompressedBytes)
+	s.GCHistory = f.gcHistory.reports()
+	s.SizeHistogram = f.sizeHist.get()
+	s.Tenants = f.tenantStats()
+	s.GetLatency, s.SetLatency = f.stats.getLatency.get(), f.stats.setLatency.get()
+	s.DeleteLatency, s.GCLatency = f.stats.deleteLatency.get(), f.stats.gcLatency.get()
+	if lastGc := atomic.LoadInt64(&f.stats.lastGc); lastGc > 0 {
+		s.LastGC = time.Unix(0, lastGc)
+	}
+	if lastScrub := atomic.LoadInt64(&f.stats.lastScrub); lastScrub > 0 {
+		s.LastScrub = time.Unix(0, lastScrub)
+	}
+	return s
+}
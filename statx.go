@@ -0,0 +1,133 @@
+package fscache
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// entryInfo is the os.FileInfo of an entry, built from statx or fstatat relative to the cache dir.
+type entryInfo struct {
+	name string
+	st   syscall.Stat_t
+}
+
+func (e *entryInfo) Name() string       { return e.name }
+func (e *entryInfo) Size() int64        { return e.st.Size }
+func (e *entryInfo) ModTime() time.Time { return time.Unix(e.st.Mtim.Unix()) }
+func (e *entryInfo) IsDir() bool        { return e.Mode().IsDir() }
+func (e *entryInfo) Sys() interface{}   { return &e.st }
+
+func (e *entryInfo) Mode() os.FileMode {
+	mode := os.FileMode(e.st.Mode & 0777)
+	switch e.st.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+	return mode
+}
+
+const statxMask = unix.STATX_TYPE | unix.STATX_MODE | unix.STATX_SIZE | unix.STATX_ATIME | unix.STATX_MTIME
+
+// noStatx is set when the kernel does not support statx.
+var noStatx int32
+
+// statEntry stats name under dirfd without following symlinks,
+// asking only for the fields GC needs by statx if the kernel supports it.
+func statEntry(dirfd int, name string) (*entryInfo, error) {
+	e := &entryInfo{name: name}
+	if atomic.LoadInt32(&noStatx) == 0 {
+		var stx unix.Statx_t
+		err := unix.Statx(dirfd, name, unix.AT_SYMLINK_NOFOLLOW, statxMask, &stx)
+		if err == nil {
+			e.st.Mode = uint32(stx.Mode)
+			e.st.Size = int64(stx.Size)
+			e.st.Atim = syscall.NsecToTimespec(stx.Atime.Sec*1e9 + int64(stx.Atime.Nsec))
+			e.st.Mtim = syscall.NsecToTimespec(stx.Mtime.Sec*1e9 + int64(stx.Mtime.Nsec))
+			return e, nil
+		}
+		if err != unix.ENOSYS {
+			return nil, &os.PathError{Op: "statx", Path: name, Err: err}
+		}
+		atomic.StoreInt32(&noStatx, 1)
+	}
+	// unix.Stat_t and syscall.Stat_t are the same struct
+	if err := unix.Fstatat(dirfd, name, (*unix.Stat_t)(unsafe.Pointer(&e.st)), unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, &os.PathError{Op: "fstatat", Path: name, Err: err}
+	}
+	return e, nil
+}
+
+// direntInfo returns the entryInfo of a non-regular entry from its dirent type without stating it,
+// or nil if it might be a regular file.
+func direntInfo(name string, typ uint8) *entryInfo {
+	var mode uint32
+	switch typ {
+	case unix.DT_BLK:
+		mode = syscall.S_IFBLK
+	case unix.DT_CHR:
+		mode = syscall.S_IFCHR
+	case unix.DT_DIR:
+		mode = syscall.S_IFDIR
+	case unix.DT_FIFO:
+		mode = syscall.S_IFIFO
+	case unix.DT_LNK:
+		mode = syscall.S_IFLNK
+	case unix.DT_SOCK:
+		mode = syscall.S_IFSOCK
+	default:
+		return nil
+	}
+	e := &entryInfo{name: name}
+	e.st.Mode = mode
+	return e
+}
+
+// readDirents reads the names and types of entries in the dir of fd by getdents,
+// reusing buf for reading, and appending to names and types.
+func readDirents(fd int, buf []byte, names []string, types []uint8) ([]string, []uint8, error) {
+	for {
+		n, err := unix.ReadDirent(fd, buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return names, types, err
+		}
+		if n <= 0 {
+			return names, types, nil
+		}
+		for off := 0; off < n; {
+			de := (*unix.Dirent)(unsafe.Pointer(&buf[off]))
+			nameBuf := buf[off+int(unsafe.Offsetof(de.Name)) : off+int(de.Reclen)]
+			off += int(de.Reclen)
+			if de.Ino == 0 {
+				continue
+			}
+			nameLen := 0
+			for nameLen < len(nameBuf) && nameBuf[nameLen] != 0 {
+				nameLen++
+			}
+			name := string(nameBuf[:nameLen])
+			if name == "." || name == ".." {
+				continue
+			}
+			names = append(names, name)
+			types = append(types, de.Type)
+		}
+	}
+}
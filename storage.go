@@ -0,0 +1,243 @@
+package fscache
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ErrLocalOnly will be returned by the features relying on local files when a Storage is set, see WithStorage().
+var ErrLocalOnly = errors.New("not supported with a storage")
+
+// Storage is where the files of entries are stored, so that filesystems other than the local one,
+// e.g. NFS or SMB with their own tuning, or an object store emulating files, can hold the values
+// while the eviction, the index and the API of the cache are reused. Paths are the paths of the files
+// under the cache dir, which still holds the lock, the meta and the other state of the cache locally.
+type Storage interface {
+	// Open opens the file at path for reading, without following symlinks.
+	Open(path string) (StorageFile, error)
+	// CreateTemp creates the temporary file at path for writing, failing if it exists.
+	// Closing it makes what was written durable.
+	CreateTemp(path string) (io.WriteCloser, error)
+	// Rename renames the file at oldpath to newpath atomically, replacing the file at newpath if any.
+	Rename(oldpath, newpath string) error
+	// Walk calls fn with each entry in dir, stopping at the first error returned by fn.
+	Walk(dir string, fn func(fi os.FileInfo) error) error
+	// Remove removes the file at path.
+	Remove(path string) error
+	// Stat returns the info of the file at path, without following symlinks.
+	Stat(path string) (os.FileInfo, error)
+	// Chtimes changes the access and modification times of the file at path.
+	Chtimes(path string, atime, mtime time.Time) error
+}
+
+// StorageFile is a file opened by Storage.Open().
+type StorageFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// WithStorage stores the files of entries in storage instead of the local filesystem.
+// Errors satisfying os.IsNotExist() tell missing files. GC evicts by the access times of files
+// in the *syscall.Stat_t of their infos if any, or by their modification times.
+// Features relying on local files, e.g. GetTo(), GetAt(), GetDir(), WithDirectIO() and WithInotify(),
+// keep using the local filesystem. Snapshot() and BeginSet() fail with ErrLocalOnly, as they rely on
+// linking and renaming local files into the cache. In shared mode, tmp files left by crashes in storage are removed
+// at startup once older than an hour, as they can not be locked by their writers.
+func WithStorage(storage Storage) Option { return func(fc *Cache) { fc.storage = storage } }
+
+// LocalStorage returns the Storage of the local filesystem, e.g. to be wrapped by other storages.
+func LocalStorage() Storage { return localStorage{} }
+
+type localStorage struct{}
+
+func (localStorage) Open(path string) (StorageFile, error) {
+	return os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+}
+
+func (localStorage) CreateTemp(path string) (io.WriteCloser, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return syncCloser{file}, nil
+}
+
+// syncCloser syncs the file before closing it.
+type syncCloser struct{ *os.File }
+
+func (s syncCloser) Close() error {
+	if err := s.File.Sync(); err != nil {
+		s.File.Close()
+		return err
+	}
+	return s.File.Close()
+}
+
+func (localStorage) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+func (localStorage) Walk(dir string, fn func(fi os.FileInfo) error) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if err := fn(fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (localStorage) Remove(path string) error              { return os.Remove(path) }
+func (localStorage) Stat(path string) (os.FileInfo, error) { return os.Lstat(path) }
+func (localStorage) Chtimes(path string, atime, mtime time.Time) error {
+	return os.Chtimes(path, atime, mtime)
+}
+
+// atime returns the access time of the file of fi, or its modification time if unknown.
+func atime(fi os.FileInfo) time.Time {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Sec, st.Atim.Nsec)
+	}
+	return fi.ModTime()
+}
+
+// openStored opens the regular file at fp in the storage.
+func (f *Cache) openStored(fp string) (StorageFile, os.FileInfo, error) {
+	if f.storage == nil {
+		file, fi, err := f.openEntry(fp)
+		if err != nil {
+			return nil, nil, err
+		}
+		return file, fi, nil
+	}
+	file, err := f.storage.Open(fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		file.Close()
+		f.logger.Errorf("illegal entry %s with mode %s, ignored", fp, fi.Mode())
+		return nil, nil, ErrIllegalEntry
+	}
+	return file, fi, nil
+}
+
+// writeStored atomically writes src as the file of key in the storage, retried if failing transiently.
+func (f *Cache) writeStored(key string, src []byte) error {
+	return f.retry(func() error { return f.writeStoredOnce(key, src) })
+}
+
+func (f *Cache) writeStoredOnce(key string, src []byte) error {
+	if f.storage == nil {
+		if f.directIO(int64(len(src))) {
+			return atomicWriteFileDirect(f.filepath(key), f.tmppath(key), f.fileOpts(), src, 0644)
+		}
+		return atomicWriteFile(f.filepath(key), f.tmppath(key), f.fileOpts(), src, 0644)
+	}
+	tmp := f.tmppath(key)
+	w, err := f.storage.CreateTemp(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(src); err != nil {
+		w.Close()
+	} else if err = w.Close(); err == nil {
+		err = f.storage.Rename(tmp, f.filepath(key))
+	}
+	if err != nil {
+		f.storage.Remove(tmp)
+	}
+	return err
+}
+
+// readStored reads the regular file at fp in the storage.
+func (f *Cache) readStored(fp string) ([]byte, error) {
+	file, fi, err := f.openStored(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return f.readEntryFile(file, fi.Size())
+}
+
+func (f *Cache) removeStored(fp string) error {
+	if f.storage == nil {
+		return os.Remove(fp)
+	}
+	return f.storage.Remove(fp)
+}
+
+func (f *Cache) renameStored(oldpath, newpath string) error {
+	if f.storage == nil {
+		return os.Rename(oldpath, newpath)
+	}
+	return f.storage.Rename(oldpath, newpath)
+}
+
+func (f *Cache) statStored(fp string) (os.FileInfo, error) {
+	if f.storage == nil {
+		return os.Lstat(fp)
+	}
+	return f.storage.Stat(fp)
+}
+
+func (f *Cache) chtimesStored(fp string, atime, mtime time.Time) error {
+	if f.storage == nil {
+		return os.Chtimes(fp, atime, mtime)
+	}
+	return f.storage.Chtimes(fp, atime, mtime)
+}
+
+// readDirStored returns the infos of the files in dir in the storage.
+func (f *Cache) readDirStored(dir string) ([]os.FileInfo, error) {
+	if f.storage == nil {
+		return ioutil.ReadDir(dir)
+	}
+	var infos []os.FileInfo
+	err := f.storage.Walk(dir, func(fi os.FileInfo) error {
+		infos = append(infos, fi)
+		return nil
+	})
+	return infos, err
+}
+
+// scanStored returns the infos of the regular files of entries in the storage, named by their keys.
+func (f *Cache) scanStored() ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	err := f.storage.Walk(f.filedir(), func(fi os.FileInfo) error {
+		if !fi.Mode().IsRegular() {
+			f.logger.Errorf("illegal entry %s with mode %s, ignored", fi.Name(), fi.Mode())
+			return nil
+		}
+		if key, ok := f.keyOf(fi.Name()); ok {
+			infos = append(infos, keyedInfo{FileInfo: fi, key: key})
+		} else {
+			f.dropOrphan(fi.Name(), fi)
+		}
+		return nil
+	})
+	return infos, err
+}
+
+// keyedInfo is the info of the file of an entry named by its key.
+type keyedInfo struct {
+	os.FileInfo
+	key string
+}
+
+func (k keyedInfo) Name() string { return k.key }
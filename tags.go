@@ -0,0 +1,100 @@
+package fscache
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// SetWithTags sets the value of key as src like Set(), attaching tags to it,
+// so that it can be deleted by InvalidateTag() with any of the tags.
+func (f *Cache) SetWithTags(key string, src []byte, tags ...string) error {
+	return f.set(key, src, entryMeta{Tags: tags})
+}
+
+// InvalidateTag deletes all keys set with tag, and returns how many keys deleted.
+func (f *Cache) InvalidateTag(tag string) (int, error) {
+	td := f.tagdir(tag)
+	fis, err := ioutil.ReadDir(td)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	n := 0
+	for _, fi := range fis {
+		key, ok := f.keyOf(fi.Name())
+		if !ok {
+			// the entry of the hashed key was deleted with its meta
+			os.Remove(filepath.Join(td, fi.Name()))
+			continue
+		}
+		if m, err := f.readMeta(key); err == nil && !hasTag(m.Tags, tag) {
+			// the tag was dropped by setting key again, e.g. replacing the file holding its meta
+			os.Remove(filepath.Join(td, fi.Name()))
+			continue
+		}
+		if err := f.Delete(key); err != nil {
+			return n, err
+		}
+		// in case the key was deleted without its meta
+		os.Remove(filepath.Join(td, fi.Name()))
+		n++
+	}
+	if err := os.Remove(td); err != nil && !os.IsNotExist(err) && !isNotEmpty(err) {
+		return n, err
+	}
+	return n, nil
+}
+
+// tags dir keeps an index from tag to keys, where a key set with a tag
+// has an empty file named by the name of its files under the dir named by the escaped tag.
+func (f *Cache) tagsdir() string          { return filepath.Join(f.cacheDir, "tags") }
+func (f *Cache) tagdir(tag string) string { return filepath.Join(f.tagsdir(), url.PathEscape(tag)) }
+
+// updateTags updates the tag index for key whose tags changed from oldTags to newTags.
+func (f *Cache) updateTags(key string, oldTags, newTags []string) error {
+	keep := make(map[string]bool, len(newTags))
+	for _, t := range newTags {
+		keep[t] = true
+	}
+	for _, t := range oldTags {
+		if keep[t] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(f.tagdir(t), f.filename(key))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, t := range newTags {
+		td := f.tagdir(t)
+		if err := os.MkdirAll(td, 0775); err != nil {
+			return err
+		}
+		marker, err := os.OpenFile(filepath.Join(td, f.filename(key)), os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		if err := marker.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotEmpty(err error) bool {
+	pe, ok := err.(*os.PathError)
+	return ok && (pe.Err == syscall.ENOTEMPTY || pe.Err == syscall.EEXIST)
+}
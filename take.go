@@ -0,0 +1,82 @@
+package fscache
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Take gets the value of key and deletes it atomically, so that among concurrent Takes of key
+// only one gets the value and others get ErrNotFound, e.g. to consume an artifact exactly once.
+func (f *Cache) Take(key string) ([]byte, error) {
+	if err := f.checkKey(key); err != nil {
+		return nil, err
+	}
+	unlock := f.keyLocks.lock(key)
+	val, err := f.take(key)
+	unlock()
+	switch err {
+	case nil:
+		atomic.AddInt64(&f.stats.hits, 1)
+	case ErrNotFound:
+		atomic.AddInt64(&f.stats.misses, 1)
+		f.missed(key)
+	}
+	return val, err
+}
+
+func (f *Cache) take(key string) ([]byte, error) {
+	src, packed, err := f.packs.take(key)
+	if err != nil {
+		return nil, err
+	}
+	m, _, chunked := f.statChunked(key)
+	if chunked {
+		// concurrent Takes are serialized by the key lock
+		if src, err = f.getChunked(key, m, nil); err != nil {
+			return nil, err
+		}
+		if _, err := f.dropChunked(key); err != nil {
+			return nil, err
+		}
+	} else if !packed {
+		// the rename succeeds for only one of concurrent Takes
+		tp := filepath.Join(f.movedir(), f.filename(key)) + ".take-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		if err := f.renameStored(f.filepath(key), tp); err != nil {
+			if os.IsNotExist(err) {
+				return nil, ErrNotFound
+			}
+			return nil, err
+		}
+		src, err = f.readStored(tp)
+		f.removeStored(tp)
+		if err != nil {
+			return nil, err
+		}
+		f.index.remove(key)
+	}
+	f.policy.remove(key)
+	f.changed(EventDelete, key)
+	meta, err := f.readMeta(key)
+	if err != nil {
+		f.logger.Errorf("read meta of %s : %s", key, err)
+	}
+	if err := f.dropMeta(key); err != nil {
+		return nil, err
+	}
+	if f.journal != nil {
+		if err := f.journal.append(journalOpDelete, key); err != nil {
+			return nil, err
+		}
+	}
+	if meta.expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	if chunked {
+		// chunked values are stored raw
+		return src, nil
+	}
+	return f.decodeEntry(key, src)
+}
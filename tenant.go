@@ -0,0 +1,267 @@
+package fscache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrInvalidKey will be returned when a key is not a valid file name, e.g. empty or with a slash,
+	// by a Cache without key hashing, and by a Tenant when a key is also too long.
+	ErrInvalidKey = errors.New("invalid key")
+	// ErrQuotaExceeded will be returned by a Tenant when setting a value would take it over its quota.
+	ErrQuotaExceeded = errors.New("tenant quota exceeded")
+)
+
+// tenantSep separates the name of a tenant from the keys in its namespace.
+const tenantSep = ":"
+
+// TenantConfig is the limits of a Tenant.
+type TenantConfig struct {
+	// MaxBytes is the bytes the values of the tenant may take, 0 means unlimited.
+	MaxBytes int64
+	// MaxKeyLen is the length keys of the tenant may have, 200 by default.
+	MaxKeyLen int
+}
+
+// Tenant is a view of the cache for an untrusted workload, whose keys are validated and kept in
+// a namespace of its own, whose values are limited by a quota, and whose metrics are reported
+// under its name in Stats().Tenants, so that a cache daemon can serve many workloads on a host.
+// Values set other than through the view are not counted in its quota.
+type Tenant struct {
+	f      *Cache
+	name   string
+	prefix string
+
+	mu    sync.Mutex
+	cfg   TenantConfig
+	sizes map[string]int64
+	bytes int64
+
+	hits     int64
+	misses   int64
+	sets     int64
+	rejected int64
+}
+
+// TenantStats is a snapshot of the metrics of a Tenant.
+type TenantStats struct {
+	Hits     int64
+	Misses   int64
+	Sets     int64
+	Rejected int64
+	Keys     int64
+	Bytes    int64
+}
+
+// Tenant returns the view of the tenant name, which has only letters, digits, '-' and '_'.
+// Getting the view of a tenant again returns the same view with its config replaced by cfg.
+// The keys of the tenant in the cache are counted in its quota.
+func (f *Cache) Tenant(name string, cfg TenantConfig) (*Tenant, error) {
+	if name == "" || strings.TrimFunc(name, isTenantRune) != "" {
+		return nil, fmt.Errorf("tenant %q: %w", name, ErrInvalidKey)
+	}
+	if cfg.MaxKeyLen <= 0 {
+		cfg.MaxKeyLen = 200
+	}
+	f.tenantsMu.Lock()
+	defer f.tenantsMu.Unlock()
+	if t, ok := f.tenants[name]; ok {
+		t.mu.Lock()
+		t.cfg = cfg
+		t.mu.Unlock()
+		return t, nil
+	}
+	t := &Tenant{f: f, name: name, prefix: name + tenantSep, cfg: cfg, sizes: map[string]int64{}}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	if f.tenants == nil {
+		f.tenants = map[string]*Tenant{}
+	}
+	f.tenants[name] = t
+	return t, nil
+}
+
+func isTenantRune(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_'
+}
+
+// load counts the entries of the tenant in the cache by their stored sizes.
+func (t *Tenant) load() error {
+	keys, err := t.f.keys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if _, ok := t.sizes[k]; ok || !strings.HasPrefix(k, t.prefix) {
+			continue
+		}
+		if size, ok := t.f.storedSize(k); ok {
+			t.sizes[k] = size
+			t.bytes += size
+		}
+	}
+	return nil
+}
+
+// key validates key of the tenant, and returns the key in the cache.
+func (t *Tenant) key(key string) (string, error) {
+	t.mu.Lock()
+	maxLen := t.cfg.MaxKeyLen
+	t.mu.Unlock()
+	if len(key) > maxLen || !validKey(key) {
+		return "", fmt.Errorf("tenant %s key %.64q: %w", t.name, key, ErrInvalidKey)
+	}
+	return t.prefix + key, nil
+}
+
+// Set implements Interface.Set(), failing with ErrQuotaExceeded if src would take the tenant over its quota.
+// The size of src is reserved in the quota while setting, and the stored size of the value is charged
+// once set, like the entries counted by Tenant().
+func (t *Tenant) Set(key string, src []byte) error {
+	k, err := t.key(key)
+	if err != nil {
+		return err
+	}
+	size := int64(len(src))
+	t.mu.Lock()
+	old, had := t.sizes[k]
+	if t.cfg.MaxBytes > 0 && t.bytes-old+size > t.cfg.MaxBytes {
+		t.mu.Unlock()
+		atomic.AddInt64(&t.rejected, 1)
+		return ErrQuotaExceeded
+	}
+	// reserved before set, so that concurrent sets do not take the tenant over its quota together
+	t.sizes[k], t.bytes = size, t.bytes-old+size
+	t.mu.Unlock()
+
+	err = t.f.Set(k, src)
+	stored, ok := t.f.storedSize(k)
+	t.mu.Lock()
+	if t.sizes[k] == size {
+		switch {
+		case err == nil && ok:
+			t.sizes[k], t.bytes = stored, t.bytes-size+stored
+		case had:
+			t.sizes[k], t.bytes = old, t.bytes-size+old
+		default:
+			delete(t.sizes, k)
+			t.bytes -= size
+		}
+	}
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&t.sets, 1)
+	return nil
+}
+
+// Get implements Interface.Get().
+func (t *Tenant) Get(key string, dst []byte) ([]byte, error) {
+	k, err := t.key(key)
+	if err != nil {
+		return dst, err
+	}
+	dst, err = t.f.Get(k, dst)
+	switch err {
+	case nil:
+		atomic.AddInt64(&t.hits, 1)
+	case ErrNotFound:
+		atomic.AddInt64(&t.misses, 1)
+	}
+	return dst, err
+}
+
+// Has implements Interface.Has().
+func (t *Tenant) Has(key string) bool {
+	k, err := t.key(key)
+	return err == nil && t.f.Has(k)
+}
+
+// Delete implements Deleter.Delete().
+func (t *Tenant) Delete(key string) error {
+	k, err := t.key(key)
+	if err != nil {
+		return err
+	}
+	return t.f.Delete(k)
+}
+
+// Keys returns the keys of the tenant, without its namespace.
+func (t *Tenant) Keys() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := make([]string, 0, len(t.sizes))
+	for k := range t.sizes {
+		keys = append(keys, strings.TrimPrefix(k, t.prefix))
+	}
+	return keys
+}
+
+// Close implements io.Closer, dropping the view, keeping the entries of the tenant.
+func (t *Tenant) Close() error {
+	t.f.tenantsMu.Lock()
+	defer t.f.tenantsMu.Unlock()
+	if t.f.tenants[t.name] == t {
+		delete(t.f.tenants, t.name)
+	}
+	return nil
+}
+
+// Stats returns the current metrics of the tenant.
+func (t *Tenant) Stats() TenantStats {
+	t.mu.Lock()
+	keys, bytes := int64(len(t.sizes)), t.bytes
+	t.mu.Unlock()
+	return TenantStats{
+		Hits:     atomic.LoadInt64(&t.hits),
+		Misses:   atomic.LoadInt64(&t.misses),
+		Sets:     atomic.LoadInt64(&t.sets),
+		Rejected: atomic.LoadInt64(&t.rejected),
+		Keys:     keys,
+		Bytes:    bytes,
+	}
+}
+
+// forget uncounts key of the tenant, which was deleted, evicted or expired.
+func (t *Tenant) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if size, ok := t.sizes[key]; ok {
+		t.bytes -= size
+		delete(t.sizes, key)
+	}
+}
+
+// tenantRemoved uncounts key from its tenant if any, which was deleted, evicted or expired.
+func (f *Cache) tenantRemoved(key string) {
+	i := strings.Index(key, tenantSep)
+	if i < 0 {
+		return
+	}
+	f.tenantsMu.Lock()
+	t := f.tenants[key[:i]]
+	f.tenantsMu.Unlock()
+	if t != nil {
+		t.forget(key)
+	}
+}
+
+// tenantStats returns the metrics of the tenants by their names, nil if there is none.
+func (f *Cache) tenantStats() map[string]TenantStats {
+	f.tenantsMu.Lock()
+	defer f.tenantsMu.Unlock()
+	if len(f.tenants) == 0 {
+		return nil
+	}
+	stats := make(map[string]TenantStats, len(f.tenants))
+	for name, t := range f.tenants {
+		stats[name] = t.Stats()
+	}
+	return stats
+}
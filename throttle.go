@@ -0,0 +1,42 @@
+package fscache
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrTooManyWrites will be returned when setting a key over WithMaxConcurrentWrites() without blocking.
+var ErrTooManyWrites = errors.New("too many concurrent writes")
+
+// WithMaxConcurrentWrites caps the number of values written into files at once by Set(), SetReader()
+// and SetDir(), so that thousands of simultaneous Sets do not open thousands of tmp files and saturate
+// the disk. Writers over it wait for a slot if block, or fail with ErrTooManyWrites otherwise. Packed values,
+// which are appended, and uploads begun by BeginSet(), which are capped by WithMaxOpenFiles(), are not
+// counted. By default, it is unlimited.
+func WithMaxConcurrentWrites(n int, block bool) Option {
+	return func(fc *Cache) {
+		if n > 0 {
+			fc.writeSlots = make(chan struct{}, n)
+		}
+		fc.blockWrites = block
+	}
+}
+
+// acquireWrite takes a slot of writes, and returns the func to release it.
+func (f *Cache) acquireWrite() (func(), error) {
+	if f.writeSlots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-f.writeSlots }
+	if f.blockWrites {
+		f.writeSlots <- struct{}{}
+		return release, nil
+	}
+	select {
+	case f.writeSlots <- struct{}{}:
+		return release, nil
+	default:
+		atomic.AddInt64(&f.stats.rejectedWrites, 1)
+		return nil, ErrTooManyWrites
+	}
+}
@@ -0,0 +1,233 @@
+package fscache
+
+import (
+	"hash/fnv"
+	"os"
+	"sync"
+)
+
+// WithTinyLFU makes GC evict entries by W-TinyLFU instead of LRU, so that a one-off scan reading
+// every key, e.g. a backup job, does not evict the hot working set. New entries enter a small LRU window,
+// and leave it for the segmented main area only if estimated more frequently used than the entry
+// they would evict, by a sketch of the recent sets and gets.
+func WithTinyLFU() Option { return func(fc *Cache) { fc.policy = newTinyLFU() } }
+
+// WithAdaptiveTinyLFU is WithTinyLFU() with a window whose share of the bytes self-tunes, like the target of ARC,
+// by ghost lists of the keys recently evicted: a set of a key evicted from the window, which the admission
+// rejected or recency alone would have kept, grows the window, and one of a key evicted from the main area,
+// which frequency would have kept, shrinks it.
+func WithAdaptiveTinyLFU() Option {
+	return func(fc *Cache) {
+		t := newTinyLFU()
+		t.windowGhosts, t.mainGhosts = newKeyList(), newKeyList()
+		fc.policy = t
+	}
+}
+
+const (
+	// tinyLFUWindow is the share of bytes of the window.
+	tinyLFUWindow = 0.01
+	// tinyLFUMaxWindow is the max share of bytes of the adaptive window.
+	tinyLFUMaxWindow = 0.8
+	// tinyLFUWindowStep is the share the adaptive window grows or shrinks by a ghost hit.
+	tinyLFUWindowStep = 0.05
+)
+
+// tinyLFU keeps the new entries in window, and the others in the segmented main.
+type tinyLFU struct {
+	mu     sync.Mutex
+	sketch *countMinSketch
+	window *keyList
+	main   *segments
+	// share is the share of bytes of window.
+	share float64
+	// windowGhosts and mainGhosts are the keys recently evicted from window and main if adaptive,
+	// up to the bytes GC keeps the entries under.
+	windowGhosts, mainGhosts *keyList
+}
+
+func newTinyLFU() *tinyLFU {
+	return &tinyLFU{
+		sketch: newCountMinSketch(1 << 14),
+		window: newKeyList(),
+		main:   newSegments(),
+		share:  tinyLFUWindow,
+	}
+}
+
+// adapt grows or shrinks the share of the window if key was recently evicted, with the lock held.
+func (t *tinyLFU) adapt(key string) {
+	if t.windowGhosts == nil {
+		return
+	}
+	if _, ok := t.windowGhosts.remove(key); ok {
+		t.share += tinyLFUWindowStep
+		if t.share > tinyLFUMaxWindow {
+			t.share = tinyLFUMaxWindow
+		}
+	} else if _, ok := t.mainGhosts.remove(key); ok {
+		t.share -= tinyLFUWindowStep
+		if t.share < tinyLFUWindow {
+			t.share = tinyLFUWindow
+		}
+	}
+}
+
+func (t *tinyLFU) add(key string, size int64, cost float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sketch.increment(key)
+	switch {
+	case t.window.has(key):
+		t.window.pushBack(key, size)
+	case t.main.has(key):
+		t.main.protect(key, size)
+	default:
+		t.adapt(key)
+		t.window.pushBack(key, size)
+	}
+}
+
+func (t *tinyLFU) touch(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sketch.increment(key)
+	if !t.main.hit(key) {
+		t.window.moveToBack(key)
+	}
+}
+
+func (t *tinyLFU) remove(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.window.remove(key)
+	t.main.remove(key)
+}
+
+func (t *tinyLFU) victims(entries []os.FileInfo, needBytes int64) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var (
+		sizes    = make(map[string]int64, len(entries))
+		curBytes int64
+	)
+	for _, fi := range entries {
+		sizes[fi.Name()] = fi.Size()
+		curBytes += fi.Size()
+	}
+	t.window.retain(sizes)
+	t.main.retain(sizes)
+	for _, fi := range unknownEntries(entries, t.window, t.main.probation, t.main.protected) {
+		t.main.probation.pushFront(fi.Name(), fi.Size())
+	}
+	var (
+		keys       []string
+		bytesSoFar int64
+		windowMax  = int64(float64(curBytes-needBytes) * t.share)
+	)
+	t.main.max = curBytes - needBytes - windowMax
+	t.main.demote()
+	evict := func(it keyItem, ghosts *keyList) {
+		keys = append(keys, it.Key)
+		bytesSoFar += it.Size
+		if ghosts != nil {
+			ghosts.pushBack(it.Key, it.Size)
+		}
+	}
+	for bytesSoFar < needBytes {
+		if t.window.len() > 0 && t.window.bytes > windowMax {
+			candidate, _ := t.window.popFront()
+			if t.main.bytes()+candidate.Size <= t.main.max {
+				t.main.probation.pushBack(candidate.Key, candidate.Size)
+				continue
+			}
+			l, victim, ok := t.main.front()
+			// the candidate is admitted only if more frequent, so that a scan does not flush main
+			if ok && t.sketch.estimate(candidate.Key) > t.sketch.estimate(victim.Key) {
+				l.remove(victim.Key)
+				evict(victim, t.mainGhosts)
+				t.main.probation.pushBack(candidate.Key, candidate.Size)
+			} else {
+				evict(candidate, t.windowGhosts)
+			}
+			continue
+		}
+		l, it, ok := t.main.front()
+		ghosts := t.mainGhosts
+		if !ok {
+			if it, ok = t.window.front(); !ok {
+				break
+			}
+			l, ghosts = t.window, t.windowGhosts
+		}
+		l.remove(it.Key)
+		evict(it, ghosts)
+	}
+	for _, ghosts := range []*keyList{t.windowGhosts, t.mainGhosts} {
+		for ghosts != nil && ghosts.bytes > curBytes-needBytes && ghosts.len() > 0 {
+			ghosts.popFront()
+		}
+	}
+	return keys
+}
+
+// countMinSketch estimates the frequencies of keys with 4 rows of saturating counters,
+// halved after every 10 times the width increments, so that the frequencies decay.
+type countMinSketch struct {
+	rows      [4][]uint8
+	mask      uint64
+	additions int
+}
+
+const sketchMaxCount = 15
+
+func newCountMinSketch(width int) *countMinSketch {
+	s := &countMinSketch{mask: uint64(width - 1)}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) indexes(key string) [4]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	lo, hi := sum, sum>>32|sum<<32
+	var idx [4]uint64
+	for i := range idx {
+		idx[i] = (lo + uint64(i)*hi) & s.mask
+	}
+	return idx
+}
+
+func (s *countMinSketch) increment(key string) {
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < sketchMaxCount {
+			s.rows[i][j]++
+		}
+	}
+	s.additions++
+	if s.additions >= 10*len(s.rows[0]) {
+		s.reset()
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	min := uint8(sketchMaxCount)
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < min {
+			min = s.rows[i][j]
+		}
+	}
+	return min
+}
+
+func (s *countMinSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] /= 2
+		}
+	}
+	s.additions /= 2
+}
@@ -0,0 +1,54 @@
+package fscache
+
+import "fmt"
+
+// Transform transforms the values stored in the cache, e.g. compressing, encrypting or framing them.
+type Transform interface {
+	// Encode returns what to store for the value val of key.
+	Encode(key string, val []byte) ([]byte, error)
+	// Decode returns the value of key stored as val, reversing Encode.
+	Decode(key string, val []byte) ([]byte, error)
+}
+
+// NewTransform returns a Transform of the functions encode and decode.
+func NewTransform(encode, decode func(key string, val []byte) ([]byte, error)) Transform {
+	return funcTransform{encode: encode, decode: decode}
+}
+
+type funcTransform struct {
+	encode, decode func(key string, val []byte) ([]byte, error)
+}
+
+func (t funcTransform) Encode(key string, val []byte) ([]byte, error) { return t.encode(key, val) }
+func (t funcTransform) Decode(key string, val []byte) ([]byte, error) { return t.decode(key, val) }
+
+// WithTransforms encodes the values set by transforms in order, and decodes the values got
+// in the reverse order, e.g. compressing before encrypting, so that transformations are composed
+// by users instead of built into the cache. The entry header, if any, is over the encoded value.
+// Values streamed by SetReader(), GetTo() and GetAt(), and uploaded by BeginSet(), are transformed
+// in memory, and the trees of SetDir() are stored as is. Entries set without the same transforms are not decodable.
+func WithTransforms(transforms ...Transform) Option {
+	return func(fc *Cache) { fc.transforms = transforms }
+}
+
+// encodeValue encodes the value val of key by the transforms.
+func (f *Cache) encodeValue(key string, val []byte) ([]byte, error) {
+	for _, t := range f.transforms {
+		var err error
+		if val, err = t.Encode(key, val); err != nil {
+			return nil, fmt.Errorf("encode %s : %w", key, err)
+		}
+	}
+	return val, nil
+}
+
+// decodeValue decodes the value val of key stored by the transforms.
+func (f *Cache) decodeValue(key string, val []byte) ([]byte, error) {
+	for i := len(f.transforms) - 1; i >= 0; i-- {
+		var err error
+		if val, err = f.transforms[i].Decode(key, val); err != nil {
+			return nil, fmt.Errorf("decode %s : %w", key, err)
+		}
+	}
+	return val, nil
+}
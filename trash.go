@@ -0,0 +1,148 @@
+package fscache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WithTrash makes Delete move entries into the trash dir under the cache dir instead of removing them,
+// where they can be restored by Undelete within the retention, and are removed by GC afterwards.
+// Trashed entries do not count towards max bytes.
+func WithTrash(retention time.Duration) Option {
+	return func(fc *Cache) { fc.trashRetention = retention }
+}
+
+func (f *Cache) trashdir() string            { return filepath.Join(f.cacheDir, "trash") }
+func (f *Cache) trashpath(key string) string { return filepath.Join(f.trashdir(), f.filename(key)) }
+func (f *Cache) trashEnabled() bool          { return f.trashRetention > 0 }
+
+// trashMetadir is where the metadata of trashed entries is kept, as it is dropped with their keys.
+func (f *Cache) trashMetadir() string { return filepath.Join(f.cacheDir, "trash-meta") }
+func (f *Cache) trashMetapath(key string) string {
+	return filepath.Join(f.trashMetadir(), f.filename(key))
+}
+
+// trash moves the entry of key into the trash with its metadata, and sets its mtime to now as the deletion time.
+func (f *Cache) trash(key string) error {
+	m, err := f.readMeta(key)
+	if err != nil {
+		f.logger.Errorf("read meta of %s : %s", key, err)
+	}
+	tp := f.trashpath(key)
+	if err := f.renameStored(f.filepath(key), tp); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := f.chtimesStored(tp, now, now); err != nil {
+		return err
+	}
+	mp := f.trashMetapath(key)
+	if m.isZero() {
+		// dropping the metadata of the entry of key trashed before
+		if err := os.Remove(mp); err != nil && !os.IsNotExist(err) {
+			f.logger.Errorf("remove meta of trashed %s : %s", key, err)
+		}
+		return nil
+	}
+	// the entry is restored without its metadata if failed
+	buf, err := json.Marshal(m)
+	if err == nil {
+		err = ioutil.WriteFile(mp, buf, 0644)
+	}
+	if err != nil {
+		f.logger.Errorf("keep meta of trashed %s : %s", key, err)
+	}
+	return nil
+}
+
+// takeTrashedMeta returns the metadata of the trashed entry of key and removes it, zero metadata if none.
+func (f *Cache) takeTrashedMeta(key string) entryMeta {
+	var m entryMeta
+	mp := f.trashMetapath(key)
+	buf, err := ioutil.ReadFile(mp)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			f.logger.Errorf("read meta of trashed %s : %s", key, err)
+		}
+		return m
+	}
+	os.Remove(mp)
+	if err := json.Unmarshal(buf, &m); err != nil {
+		f.logger.Errorf("read meta of trashed %s : %s", key, err)
+	}
+	return m
+}
+
+// Undelete restores a key deleted within the trash retention, with its metadata, e.g. its TTL and tags.
+// It returns ErrNotFound if the key is not in the trash, or os.ErrExist if the key has been set again.
+func (f *Cache) Undelete(key string) error {
+	if err := f.checkKey(key); err != nil {
+		return err
+	}
+	defer f.keyLocks.lock(key)()
+	tp := f.trashpath(key)
+	if err := f.restore(tp, f.filepath(key)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	fi, err := f.statStored(f.filepath(key))
+	if err != nil {
+		return err
+	}
+	m := f.takeTrashedMeta(key)
+	f.index.set(key, fi.Size())
+	f.policy.add(key, fi.Size(), m.Cost)
+	return f.recordSet(key, m)
+}
+
+// restore moves the trashed file tp back to fp, failing with os.ErrExist if fp exists.
+// Storages are only checked for fp with the key locked, as they cannot link files.
+func (f *Cache) restore(tp, fp string) error {
+	if f.storage == nil {
+		if err := os.Link(tp, fp); err != nil {
+			return err
+		}
+		return os.Remove(tp)
+	}
+	if _, err := f.storage.Stat(tp); err != nil {
+		return err
+	}
+	if _, err := f.storage.Stat(fp); err == nil {
+		return os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return f.storage.Rename(tp, fp)
+}
+
+// emptyTrash removes entries deleted longer ago than the trash retention.
+func (f *Cache) emptyTrash() {
+	fis, err := f.readDirStored(f.trashdir())
+	if err != nil {
+		f.gcErrorf("read trash dir %s : %s", f.trashdir(), err)
+		return
+	}
+	deadline := time.Now().Add(-f.trashRetention)
+	for _, fi := range fis {
+		if fi.ModTime().After(deadline) {
+			continue
+		}
+		tp := filepath.Join(f.trashdir(), fi.Name())
+		remove := os.RemoveAll
+		if f.storage != nil {
+			remove = f.storage.Remove
+		}
+		if err := remove(tp); err != nil && !vanished(err) {
+			f.gcErrorf("empty trash %s : %s", tp, err)
+			continue
+		}
+		if err := os.Remove(filepath.Join(f.trashMetadir(), fi.Name())); err != nil && !vanished(err) {
+			f.gcErrorf("empty trash %s : %s", tp, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package fscache
+
+import (
+	"math/rand"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// WithTTLJitter randomizes TTLs passed to SetWithTTL() by up to ±fraction of them,
+// so that entries set with the same TTL at the same time do not expire together.
+func WithTTLJitter(fraction float64) Option { return func(fc *Cache) { fc.ttlJitter = fraction } }
+
+// SetWithTTL sets the value of key as src like Set(), which expires after ttl.
+// Getting an expired key returns ErrNotFound.
+func (f *Cache) SetWithTTL(key string, src []byte, ttl time.Duration) error {
+	if f.ttlJitter > 0 {
+		ttl = time.Duration(float64(ttl) * (1 + f.ttlJitter*(2*rand.Float64()-1)))
+	}
+	return f.set(key, src, entryMeta{ExpireAt: time.Now().Add(ttl).UnixNano()})
+}
+
+// expired tells if key has expired, deleting it if so.
+func (f *Cache) expired(key string) bool {
+	m, err := f.readMeta(key)
+	if err != nil {
+		f.logger.Errorf("read meta of %s : %s", key, err)
+		return false
+	}
+	if !m.expired(time.Now()) {
+		return false
+	}
+	f.deleteExpired(key, func() bool {
+		m, err := f.readMeta(key)
+		return err == nil && m.expired(time.Now())
+	})
+	return true
+}
+
+// deleteExpired deletes the entry of key found expired, if still expired by expired with the key locked,
+// so that a value set meanwhile, whose meta is written after its file, is not deleted.
+// It is skipped if the key is held, e.g. by a Set or by the caller itself, rather than waiting for it.
+func (f *Cache) deleteExpired(key string, expired func() bool) {
+	unlock, ok := f.keyLocks.tryLock(key)
+	if !ok {
+		return
+	}
+	defer unlock()
+	if !expired() {
+		return
+	}
+	if err := f.delete(key, EventExpire); err != nil {
+		f.logger.Errorf("delete expired %s : %s", key, err)
+	}
+}
+
+// WithSweepInterval specifies how often expired entries are swept, which is independent of GC,
+// so that they are removed promptly even if the cache is far from max bytes. By default, it is 1 minute.
+// A non-positive interval disables the sweeps, leaving expired entries to be deleted when got or evicted.
+func WithSweepInterval(interval time.Duration) Option {
+	return func(fc *Cache) { fc.sweepInterval = interval }
+}
+
+func (f *Cache) sweepRunner() {
+	ticker := time.NewTicker(f.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stopCh:
+			return
+		case <-ticker.C:
+			f.sweep()
+		}
+	}
+}
+
+// sweep deletes expired entries, by reading only the meta of entries,
+// and the headers of entries with WithEntryHeader(), which keep their TTLs instead of the meta.
+func (f *Cache) sweep() {
+	if f.entryHeader {
+		keys, err := f.keys()
+		if err != nil {
+			f.logger.Errorf("sweep cache dir %s : %s", f.filedir(), err)
+		}
+		for _, k := range keys {
+			if expired := f.headerStillExpired(k); expired() {
+				f.deleteExpired(k, expired)
+			}
+		}
+	}
+	if _, ok := f.meta.(xattrMeta); ok {
+		keys, err := f.keys()
+		if err != nil {
+			f.logger.Errorf("sweep cache dir %s : %s", f.filedir(), err)
+		}
+		for _, k := range keys {
+			f.expired(k)
+		}
+	}
+	if atomic.LoadInt32(&f.metaUsed) == 0 {
+		return
+	}
+	dir, err := os.Open(f.metadir())
+	if err != nil {
+		f.logger.Errorf("sweep meta dir %s : %s", f.metadir(), err)
+		return
+	}
+	keys, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		f.logger.Errorf("sweep meta dir %s : %s", f.metadir(), err)
+		return
+	}
+	for _, name := range keys {
+		if strings.HasPrefix(name, metaTmpPrefix) {
+			continue
+		}
+		if k, ok := f.keyOf(name); ok {
+			f.expired(k)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package fscache
+
+import (
+	"errors"
+	"math"
+	"os"
+	"time"
+)
+
+// UpdateConfig updates the settings of the cache tunable at runtime from cfg without recreating the cache,
+// e.g. on SIGHUP in a daemon, which are MaxBytes, GcInterval, MinFreeBytes, GcExcludeMaxBytes and
+// NamespaceWeights. Other fields take effect only in new caches, and are ignored. Zero fields are
+// the defaults as in New(). A GC pass in progress completes with the settings before the update,
+// and the next one runs within the new GC interval. Caches created with GC disabled by WithMaxBytes(0)
+// are not updated, returning an error. The quotas of tenants are updated by getting their views again,
+// see Cache.Tenant().
+func (f *Cache) UpdateConfig(cfg *Config) error {
+	if cfg.MaxBytes < 0 || cfg.GcInterval < 0 || cfg.MinFreeBytes < 0 || cfg.GcExcludeMaxBytes < 0 {
+		return errors.New("update config: negative setting")
+	}
+	fair, ok := f.policy.(*fairPolicy)
+	if cfg.NamespaceWeights != nil && !ok {
+		return errors.New("update config: namespace weights not configured when the cache was created")
+	}
+	maxBytes, interval := cfg.MaxBytes, time.Duration(cfg.GcInterval)
+	if maxBytes == 0 {
+		maxBytes = math.MaxInt64
+	}
+	if interval == 0 {
+		interval = 5 * time.Minute
+	}
+
+	f.tuneMu.Lock()
+	if f.maxBytes <= 0 && f.packs == nil {
+		// GC is not running to take the new settings
+		f.tuneMu.Unlock()
+		return errors.New("update config: GC disabled when the cache was created")
+	}
+	f.maxBytes, f.gcInterval = maxBytes, interval
+	f.minFreeBytes, f.gcExcludeMaxBytes = cfg.MinFreeBytes, cfg.GcExcludeMaxBytes
+	if ok {
+		// no weights weigh every key alike, as if the cache evicted by its policy alone
+		fair.weights = cfg.NamespaceWeights
+	}
+	f.tuneMu.Unlock()
+	if f.engine == EngineLog {
+		f.packs.mu.Lock()
+		f.packs.maxBytes = maxBytes
+		f.packs.mu.Unlock()
+	}
+	select {
+	case f.tunedCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// gcTuning is the settings of a GC pass, copied when it begins.
+type gcTuning struct {
+	maxBytes, excludeMaxBytes int64
+	victims                   func(entries []os.FileInfo, needBytes int64) []string
+}
+
+// gcTuning copies the settings of a GC pass, so that UpdateConfig(), and the readers waiting behind it,
+// do not wait for the pass.
+func (f *Cache) gcTuning() gcTuning {
+	f.tuneMu.RLock()
+	defer f.tuneMu.RUnlock()
+	t := gcTuning{maxBytes: f.maxBytes, excludeMaxBytes: f.gcExcludeMaxBytes, victims: f.policy.victims}
+	if fair, ok := f.policy.(*fairPolicy); ok {
+		t.victims = (&fairPolicy{policy: fair.policy, weights: fair.weights}).victims
+	}
+	return t
+}
+
+// gcSettings returns the bytes GC keeps the entries under and the GC interval.
+func (f *Cache) gcSettings() (int64, time.Duration) {
+	f.tuneMu.RLock()
+	defer f.tuneMu.RUnlock()
+	return f.maxBytes, f.gcInterval
+}
@@ -0,0 +1,74 @@
+package fscache
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"time"
+)
+
+// WithSkipUnchanged makes Set skip writing a value identical to the one stored with the same metadata,
+// e.g. of idempotent producers setting unchanged artifacts again, saving the writes and syncs of the files.
+// The stored value of the same size is compared by the checksum in its entry header first if
+// WithEntryHeader(), and then by its bytes, so that the value is read instead of written only if likely
+// unchanged. A Set skipped updates the access time of the entry, but neither its modification time,
+// nor the watchers. Packed values are always written.
+func WithSkipUnchanged() Option { return func(fc *Cache) { fc.skipUnchanged = true } }
+
+// unchangedChunk is how many bytes of a stored value are compared at once.
+const unchangedChunk = 64 * 1024
+
+// unchanged tells if the entry of key is src, stored with meta, updating its access time if so,
+// with the key locked.
+func (f *Cache) unchanged(key string, src []byte, meta entryMeta) bool {
+	if !f.index.mayContain(key) {
+		return false
+	}
+	fp := f.filepath(key)
+	file, fi, err := f.openStored(fp)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	if fi.Size() != int64(len(src)) {
+		return false
+	}
+	old, err := f.readMeta(key)
+	if err != nil {
+		return false
+	}
+	meta.CreatedAt = old.CreatedAt
+	if f.keyHashing {
+		meta.Key = key
+	}
+	if !reflect.DeepEqual(old, meta) {
+		return false
+	}
+	// the header holds the checksum, and the expiry of the value
+	var off int
+	if f.entryHeader && len(src) >= entryHeaderLen {
+		off = entryHeaderLen
+	}
+	buf := make([]byte, unchangedChunk)
+	for _, r := range [][2]int{{0, off}, {off, len(src)}} {
+		for start := r[0]; start < r[1]; start += len(buf) {
+			end := start + len(buf)
+			if end > r[1] {
+				end = r[1]
+			}
+			if _, err := file.ReadAt(buf[:end-start], int64(start)); err != nil && err != io.EOF {
+				return false
+			}
+			if !bytes.Equal(buf[:end-start], src[start:end]) {
+				return false
+			}
+		}
+	}
+	if !f.skipAtime {
+		if err := f.chtimesStored(fp, time.Now(), fi.ModTime()); err != nil {
+			return false
+		}
+	}
+	f.policy.touch(key)
+	return true
+}
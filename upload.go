@@ -0,0 +1,132 @@
+package fscache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrUploadOffset will be returned when writing a chunk not at the end of the upload.
+var ErrUploadOffset = errors.New("chunk offset not at the end of upload")
+
+func (f *Cache) uploaddir() string            { return filepath.Join(f.cacheDir, "uploads") }
+func (f *Cache) uploadpath(key string) string { return filepath.Join(f.uploaddir(), f.filename(key)) }
+
+// Upload is a resumable Set of a huge value, written chunk by chunk. Chunks written are persisted,
+// so that an upload interrupted, even by a process restart, resumes by calling BeginSet() again
+// and writing from Offset().
+type Upload struct {
+	f    *Cache
+	key  string
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// BeginSet begins or resumes an upload of key.
+func (f *Cache) BeginSet(key string) (*Upload, error) {
+	if err := f.checkKey(key); err != nil {
+		return nil, err
+	}
+	if f.storage != nil {
+		return nil, fmt.Errorf("begin set: %w", ErrLocalOnly)
+	}
+	if err := os.MkdirAll(f.uploaddir(), 0775); err != nil {
+		return nil, err
+	}
+	if err := f.reserveFd(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(f.uploadpath(key), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		f.fds.release()
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		f.fds.release()
+		return nil, err
+	}
+	return &Upload{f: f, key: key, file: file, size: fi.Size()}, nil
+}
+
+// Offset returns how many bytes have been written, where the next chunk should be written at.
+func (u *Upload) Offset() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.size
+}
+
+// WriteChunk writes chunk at offset, which must be Offset() so that no byte is missing or written twice.
+func (u *Upload) WriteChunk(offset int64, chunk []byte) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.file == nil {
+		return os.ErrClosed
+	}
+	if offset != u.size {
+		return fmt.Errorf("%w: offset %d, upload size %d", ErrUploadOffset, offset, u.size)
+	}
+	n, err := u.file.WriteAt(chunk, offset)
+	u.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return u.file.Sync()
+}
+
+// Commit sets the value of key as the bytes uploaded. They are renamed into the cache as the file of key,
+// unless they are to be encoded, packed, chunked or prefixed with a header, when they are set like SetFromFile().
+func (u *Upload) Commit() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.file == nil {
+		return os.ErrClosed
+	}
+	if !u.f.writable() {
+		return ErrDegraded
+	}
+	if !u.f.rawFile(u.size) || u.f.packs.fits(int(u.size)) {
+		err := u.file.Close()
+		u.file = nil
+		u.f.fds.release()
+		if err == nil {
+			err = u.f.SetFromFile(u.key, u.f.uploadpath(u.key))
+		}
+		if err != nil {
+			return err
+		}
+		return os.Remove(u.f.uploadpath(u.key))
+	}
+	defer u.f.keyLocks.lock(u.key)()
+	created := u.f.createdAt(u.key)
+	err := u.file.Close()
+	u.file = nil
+	u.f.fds.release()
+	if err == nil {
+		err = os.Rename(u.f.uploadpath(u.key), u.f.filepath(u.key))
+	}
+	u.f.health.observeWrite(err)
+	if err != nil {
+		return err
+	}
+	return u.f.written(u.key, u.size, entryMeta{CreatedAt: created})
+}
+
+// Abort discards the bytes uploaded.
+func (u *Upload) Abort() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.file != nil {
+		u.file.Close()
+		u.file = nil
+		u.f.fds.release()
+	}
+	if err := os.Remove(u.f.uploadpath(u.key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package fscache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// WithCacheVersion specifies the version of the values, e.g. of their serialization format.
+// When the cache was last opened with another version, or without any, all existing entries are
+// invalidated at startup, or moved into the quarantine dir with WithQuarantine(), along with
+// their chunks, heatmap, journal, trash and pending uploads.
+func WithCacheVersion(version string) Option { return func(fc *Cache) { fc.version = version } }
+
+func (f *Cache) versionPath() string { return filepath.Join(f.cacheDir, "version") }
+
+// checkVersion invalidates the entries if they are of another version than the configured one.
+func (f *Cache) checkVersion() error {
+	if f.version == "" {
+		return nil
+	}
+	stored, err := ioutil.ReadFile(f.versionPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && bytes.Equal(stored, []byte(f.version)) {
+		return nil
+	}
+	if err := f.invalidate(string(stored)); err != nil {
+		return err
+	}
+	fp := f.versionPath()
+	if err := ioutil.WriteFile(fp+".tmp", []byte(f.version), 0644); err != nil {
+		return err
+	}
+	return os.Rename(fp+".tmp", fp)
+}
+
+// invalidate moves away the dirs and files holding entries of the stored version or about them,
+// and removes them, or keeps them in the quarantine dir.
+func (f *Cache) invalidate(stored string) error {
+	keys, err := f.keys()
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(f.movedir(), "invalidated-"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	if f.quarantine {
+		dst = filepath.Join(f.quarantinedir(), "version-"+stored+"-"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	}
+	if err := os.MkdirAll(dst, 0775); err != nil {
+		return err
+	}
+	for _, fp := range []string{
+		f.filedir(), f.metadir(), f.tagsdir(), f.packdir(), f.chunkdir(), f.trashdir(), f.trashMetadir(), f.uploaddir(),
+		f.heatmapPath(), f.journalPath(), f.replicationOffsetPath(), f.policyPath(),
+	} {
+		if err := os.Rename(fp, filepath.Join(dst, filepath.Base(fp))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, key := range keys {
+		f.changed(EventDelete, key)
+	}
+	if f.quarantine {
+		return nil
+	}
+	return os.RemoveAll(dst)
+}
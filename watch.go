@@ -0,0 +1,98 @@
+package fscache
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventOp is what happened to a key.
+type EventOp string
+
+// Ops of events sent by Watch().
+const (
+	EventSet    EventOp = "set"
+	EventDelete EventOp = "delete"
+	EventEvict  EventOp = "evict"
+	EventExpire EventOp = "expire"
+)
+
+// Event tells what happened to a key when.
+type Event struct {
+	Op   EventOp
+	Key  string
+	Time time.Time
+}
+
+// watchBuffer is the number of events buffered for a watcher, beyond which events are dropped.
+const watchBuffer = 128
+
+type watcher struct {
+	prefix string
+	ch     chan Event
+}
+
+type watchers struct {
+	n  int32
+	mu sync.RWMutex
+	m  map[*watcher]struct{}
+}
+
+// Watch returns a channel receiving events of keys starting with prefix, which are set,
+// deleted, evicted by GC or expired, so that dependent components can react without polling.
+// Events are dropped if the receiver falls behind by more than 128 events.
+// The channel is closed by cancel or by closing the cache.
+func (f *Cache) Watch(prefix string) (<-chan Event, func()) {
+	w := &watcher{prefix: prefix, ch: make(chan Event, watchBuffer)}
+	f.watchers.mu.Lock()
+	if f.watchers.m == nil {
+		f.watchers.m = map[*watcher]struct{}{}
+	}
+	f.watchers.m[w] = struct{}{}
+	atomic.AddInt32(&f.watchers.n, 1)
+	f.watchers.mu.Unlock()
+
+	var once sync.Once
+	return w.ch, func() { once.Do(func() { f.watchers.remove(w) }) }
+}
+
+func (ws *watchers) remove(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if _, ok := ws.m[w]; ok {
+		delete(ws.m, w)
+		atomic.AddInt32(&ws.n, -1)
+		close(w.ch)
+	}
+}
+
+// emit sends an event of key to the watchers of it.
+func (ws *watchers) emit(op EventOp, key string) {
+	if atomic.LoadInt32(&ws.n) == 0 {
+		return
+	}
+	e := Event{Op: op, Key: key, Time: time.Now()}
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	for w := range ws.m {
+		if !strings.HasPrefix(key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- e:
+		default:
+		}
+	}
+}
+
+// closeAll closes the channels of all watchers.
+func (ws *watchers) closeAll() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for w := range ws.m {
+		close(w.ch)
+	}
+	ws.m = nil
+	atomic.StoreInt32(&ws.n, 0)
+}
@@ -0,0 +1,87 @@
+package fscache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithXattrMeta stores the metadata of entries, e.g. TTLs, costs and tags, in an extended attribute
+// of their files instead of sidecar files, if the filesystem supports user extended attributes.
+// The metadata of packed entries and of entries set before stays in sidecar files.
+func WithXattrMeta() Option { return func(fc *Cache) { fc.xattrMeta = true } }
+
+const metaXattr = "user.fscache.meta"
+
+// xattrMeta stores the metadata of an entry in an extended attribute of its file,
+// falling back to sidecar files for entries without files.
+type xattrMeta struct {
+	f       *Cache
+	sidecar sidecarMeta
+}
+
+// xattrSupported tells if the filesystem of dir supports user extended attributes.
+func xattrSupported(dir string) bool {
+	fp := filepath.Join(dir, ".xattr-probe")
+	file, err := os.Create(fp)
+	if err != nil {
+		return false
+	}
+	file.Close()
+	defer os.Remove(fp)
+	return unix.Setxattr(fp, metaXattr, []byte("{}"), 0) == nil
+}
+
+func (x xattrMeta) read(key string) (entryMeta, error) {
+	return x.readPath(x.f.filepath(key), x.f.metapath(key))
+}
+
+// readPath reads the metadata in the extended attribute of the file at fp,
+// or in the sidecar file at sidecarPath if there is none.
+func (x xattrMeta) readPath(fp, sidecarPath string) (entryMeta, error) {
+	var m entryMeta
+	buf := make([]byte, 512)
+	for {
+		n, err := unix.Lgetxattr(fp, metaXattr, buf)
+		if err == unix.ERANGE {
+			buf = make([]byte, len(buf)*4)
+			continue
+		}
+		if err == unix.ENODATA || err == unix.ENOENT {
+			return x.sidecar.readPath(sidecarPath)
+		}
+		if err != nil {
+			return m, &os.PathError{Op: "getxattr", Path: fp, Err: err}
+		}
+		return m, json.Unmarshal(buf[:n], &m)
+	}
+}
+
+func (x xattrMeta) write(key string, m entryMeta) error {
+	if x.f.packs.has(key) {
+		return x.sidecar.write(key, m)
+	}
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	err = unix.Lsetxattr(x.f.filepath(key), metaXattr, buf, 0)
+	if err == unix.ENOENT {
+		return x.sidecar.write(key, m)
+	}
+	if err != nil {
+		return &os.PathError{Op: "setxattr", Path: x.f.filepath(key), Err: err}
+	}
+	// drop the sidecar written before
+	return x.sidecar.remove(key)
+}
+
+func (x xattrMeta) remove(key string) error {
+	err := unix.Lremovexattr(x.f.filepath(key), metaXattr)
+	if err != nil && err != unix.ENODATA && err != unix.ENOENT {
+		return &os.PathError{Op: "removexattr", Path: x.f.filepath(key), Err: err}
+	}
+	return x.sidecar.remove(key)
+}